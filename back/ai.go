@@ -3,6 +3,11 @@ package main
 import (
 	"context"
 	"fmt"
+	"log/slog"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -11,12 +16,123 @@ import (
 // ============================================================================
 
 const (
-	INFINITY          = 999999
-	WIN_SCORE         = 100000
-	DEFAULT_DEPTH     = 4
-	MAX_THINKING_TIME = 30 * time.Second
+	INFINITY               = 999999
+	PIN_PENALTY            = 25
+	CHECK_TIE_BREAK        = 50
+	WIN_SCORE              = 100000
+	MAX_EVAL               = 10000 // Static evaluations are clamped to ±MAX_EVAL, everything beyond is a mate score
+	DEFAULT_DEPTH          = 4
+	MAX_DEPTH              = 10
+	MAX_THINKING_TIME      = 30 * time.Second
+	AI_REPLY_TIMEOUT       = 30 * time.Second // Request deadline for the AI's reply when its think time is uncapped
+	AI_REPLY_MARGIN        = 5 * time.Second  // How much longer than the think time a request gives the AI
+	ANALYSIS_THINKING_TIME = 15 * time.Second
+	AI_ALTERNATIVES        = 3 // Ranked moves a forced AI move reports with ?analyze=true
+	MAX_AI_ALTERNATIVES    = 10
+	QUIESCENCE_DEPTH       = 4
+	MIDGAME_PHASE          = 24
+	ABORT_CHECK_INTERVAL   = 1024
+	MAX_CHECK_EXTENSION    = 2 // Most plies a single check may add
+	MAX_SEARCH_EXTENSION   = 4 // Most plies extensions may add along one line
+	MAX_MIN_RESPONSE_TIME  = 10 * time.Second
+
+	// Analysis requests may ask for more think time with max_think_ms, up to
+	// this unless configured otherwise
+	MAX_ANALYSIS_THINKING_TIME = 2 * time.Minute
+
+	// Extensions are tallied in quarter plies, so a recapture can add part of one
+	EXTENSION_UNITS         = 4
+	MAX_RECAPTURE_EXTENSION = EXTENSION_UNITS // Most a single recapture may add: one ply
+
+	// Mop-up: against a bare king, drive it to the edge and bring the king in
+	MOP_UP_EDGE_WEIGHT   = 10
+	MOP_UP_KING_DISTANCE = 4
+
+	// Contempt: a side at least WINNING_MARGIN ahead at the root scores any
+	// draw (stalemate, repetition, fifty moves) as DRAW_CONTEMPT behind, so
+	// it won't give the win away at shallow depth
+	WINNING_MARGIN = 300
+	DRAW_CONTEMPT  = 200
+
+	// King safety: files next to the king with no friendly pawn, and enemy
+	// pawns within PAWN_STORM_RANGE ranks in front of it, per file
+	OPEN_FILE_PENALTY      = 25
+	HALF_OPEN_FILE_PENALTY = 15
+	PAWN_STORM_PENALTY     = 10
+	PAWN_STORM_RANGE       = 3
+
+	// Pawn races: a passed pawn the enemy king can't catch, with no enemy
+	// pieces left to stop it, is nearly a queen; fewer steps to go is better
+	UNSTOPPABLE_PAWN_BONUS = 400
+	UNSTOPPABLE_PAWN_STEP  = 20
+
+	// Late-move reductions: past the first LMR_FULL_DEPTH_MOVES in the
+	// ordering, quiet moves are searched LMR_REDUCTION plies shallower at
+	// nodes with at least LMR_MIN_DEPTH left, and again at full depth only
+	// if they turn out to improve on the best move so far
+	LMR_FULL_DEPTH_MOVES = 3
+	LMR_MIN_DEPTH        = 3
+	LMR_REDUCTION        = 1
+
+	// Resignation: when enabled, the AI gives up after RESIGN_MOVES searches
+	// in a row find it at least RESIGN_THRESHOLD behind
+	RESIGN_THRESHOLD = 900
+	RESIGN_MOVES     = 3
+	MAX_RESIGN_MOVES = 20
+
+	// Draw offers: the AI takes one when a DRAW_OFFER_DEPTH search finds it
+	// at least DRAW_ACCEPT_THRESHOLD behind
+	DRAW_ACCEPT_THRESHOLD = 100
+	DRAW_OFFER_DEPTH      = 2
 )
 
+// AISettings bundles everything a difficulty level controls
+type AISettings struct {
+	Depth              int  `json:"depth"`
+	Randomness         int  `json:"randomness"` // Max centipawn noise added to each root move
+	UseQuiescence      bool `json:"useQuiescence"`
+	UseOpeningBook     bool `json:"useOpeningBook"`
+	CheckExtension     int  `json:"checkExtension"`     // Plies added to the search when the side to move is in check
+	RecaptureExtension int  `json:"recaptureExtension"` // Quarter plies added to a move taking back on the square just captured on
+}
+
+var difficultyPresets = map[string]AISettings{
+	"easy":   {Depth: 2, Randomness: 150, UseQuiescence: false, UseOpeningBook: false, CheckExtension: 0, RecaptureExtension: 0},
+	"medium": {Depth: 4, Randomness: 30, UseQuiescence: false, UseOpeningBook: true, CheckExtension: 1, RecaptureExtension: 0},
+	"hard":   {Depth: 6, Randomness: 0, UseQuiescence: true, UseOpeningBook: true, CheckExtension: 1, RecaptureExtension: 0},
+	"expert": {Depth: 8, Randomness: 0, UseQuiescence: true, UseOpeningBook: true, CheckExtension: 1, RecaptureExtension: 0},
+}
+
+// ResignPolicy decides when the AI resigns instead of playing on. It is off
+// unless enabled.
+type ResignPolicy struct {
+	Enabled   bool `json:"enabled"`
+	Threshold int  `json:"threshold"` // Centipawns behind, from the AI's side
+	Moves     int  `json:"moves"`     // Consecutive hopeless searches needed
+}
+
+func DefaultResignPolicy() ResignPolicy {
+	return ResignPolicy{Threshold: RESIGN_THRESHOLD, Moves: RESIGN_MOVES}
+}
+
+// EvalWeights scale evaluation terms for a playing style, in percent of
+// their normal value. King safety applies to the AI's own king and king
+// attack to the opponent's.
+type EvalWeights struct {
+	Mobility      int `json:"mobility"`
+	CenterControl int `json:"centerControl"`
+	KingAttack    int `json:"kingAttack"`
+	KingSafety    int `json:"kingSafety"`
+}
+
+const DEFAULT_STYLE = "balanced"
+
+var stylePresets = map[string]EvalWeights{
+	"aggressive": {Mobility: 130, CenterControl: 125, KingAttack: 150, KingSafety: 70},
+	"balanced":   {Mobility: 100, CenterControl: 100, KingAttack: 100, KingSafety: 100},
+	"defensive":  {Mobility: 80, CenterControl: 90, KingAttack: 70, KingSafety: 150},
+}
+
 // Piece values for material evaluation
 var pieceValues = map[PieceType]int{
 	Pawn:   100,
@@ -27,91 +143,231 @@ var pieceValues = map[PieceType]int{
 	King:   20000,
 }
 
+// Points per square a piece can reach; long-range pieces reach more squares
+// anyway, so each one is worth less to them
+var mobilityWeights = map[PieceType]int{
+	Knight: 4,
+	Bishop: 3,
+	Rook:   2,
+	Queen:  1,
+}
+
 // ============================================================================
 // PIECE-SQUARE TABLES FOR POSITIONAL EVALUATION
 // ============================================================================
 
-// Pawn position values (Black perspective, White will be flipped)
-var pawnTable = [8][8]int{
-	{0, 0, 0, 0, 0, 0, 0, 0},
-	{50, 50, 50, 50, 50, 50, 50, 50},
-	{10, 10, 20, 30, 30, 20, 10, 10},
-	{5, 5, 10, 25, 25, 10, 5, 5},
-	{0, 0, 0, 20, 20, 0, 0, 0},
-	{5, -5, -10, 0, 0, -10, -5, 5},
-	{5, 10, 10, -20, -20, 10, 10, 5},
-	{0, 0, 0, 0, 0, 0, 0, 0},
-}
-
-var knightTable = [8][8]int{
-	{-50, -40, -30, -30, -30, -30, -40, -50},
-	{-40, -20, 0, 0, 0, 0, -20, -40},
-	{-30, 0, 10, 15, 15, 10, 0, -30},
-	{-30, 5, 15, 20, 20, 15, 5, -30},
-	{-30, 0, 15, 20, 20, 15, 0, -30},
-	{-30, 5, 10, 15, 15, 10, 5, -30},
-	{-40, -20, 0, 5, 5, 0, -20, -40},
-	{-50, -40, -30, -30, -30, -30, -40, -50},
-}
-
-var bishopTable = [8][8]int{
-	{-20, -10, -10, -10, -10, -10, -10, -20},
-	{-10, 0, 0, 0, 0, 0, 0, -10},
-	{-10, 0, 5, 10, 10, 5, 0, -10},
-	{-10, 5, 5, 10, 10, 5, 5, -10},
-	{-10, 0, 10, 10, 10, 10, 0, -10},
-	{-10, 10, 10, 10, 10, 10, 10, -10},
-	{-10, 5, 0, 0, 0, 0, 5, -10},
-	{-20, -10, -10, -10, -10, -10, -10, -20},
-}
-
-var rookTable = [8][8]int{
-	{0, 0, 0, 0, 0, 0, 0, 0},
-	{5, 10, 10, 10, 10, 10, 10, 5},
-	{-5, 0, 0, 0, 0, 0, 0, -5},
-	{-5, 0, 0, 0, 0, 0, 0, -5},
-	{-5, 0, 0, 0, 0, 0, 0, -5},
-	{-5, 0, 0, 0, 0, 0, 0, -5},
-	{-5, 0, 0, 0, 0, 0, 0, -5},
-	{0, 0, 0, 5, 5, 0, 0, 0},
-}
-
-var queenTable = [8][8]int{
-	{-20, -10, -10, -5, -5, -10, -10, -20},
-	{-10, 0, 0, 0, 0, 0, 0, -10},
-	{-10, 0, 5, 5, 5, 5, 0, -10},
-	{-5, 0, 5, 5, 5, 5, 0, -5},
-	{0, 0, 5, 5, 5, 5, 0, -5},
-	{-10, 5, 5, 5, 5, 5, 0, -10},
-	{-10, 0, 5, 0, 0, 0, 0, -10},
-	{-20, -10, -10, -5, -5, -10, -10, -20},
-}
-
-var kingTable = [8][8]int{
-	{-30, -40, -40, -50, -50, -40, -40, -30},
-	{-30, -40, -40, -50, -50, -40, -40, -30},
-	{-30, -40, -40, -50, -50, -40, -40, -30},
-	{-30, -40, -40, -50, -50, -40, -40, -30},
-	{-20, -30, -30, -40, -40, -30, -30, -20},
-	{-10, -20, -20, -20, -20, -20, -20, -10},
-	{20, 20, 0, 0, 0, 0, 20, 20},
-	{20, 30, 10, 0, 0, 10, 30, 20},
+// The tables are loaded from pst.json at startup, see pst.go
+
+// Game phase is measured by the non-pawn material left on the board: the full
+// starting set is MIDGAME_PHASE, bare kings and pawns are 0
+var phaseWeights = map[PieceType]int{
+	Knight: 1,
+	Bishop: 1,
+	Rook:   2,
+	Queen:  4,
+}
+
+// EvalMode selects which evaluation components are used, mainly for teaching
+type EvalMode string
+
+const (
+	EvalFull       EvalMode = "full"
+	EvalMaterial   EvalMode = "material"   // piece values only
+	EvalPositional EvalMode = "positional" // piece-square tables and positional factors only
+)
+
+// Evaluator scores a position from Black's point of view, in centipawns, the
+// way every search score is. Game-over positions never reach it, and the
+// search clamps what it returns to +-MAX_EVAL so it can't pass for a mate.
+// Analysis runs several searches at once, so it must be safe to call from
+// several goroutines.
+type Evaluator interface {
+	Evaluate(game *ChessGame) int
+}
+
+// classicalEvaluator is the built-in hand-crafted evaluation. It reads the
+// evaluation mode and style weights off its service, since each search sets
+// them on the snapshot it runs on.
+type classicalEvaluator struct {
+	ai *AIService
+}
+
+func (e classicalEvaluator) Evaluate(game *ChessGame) int {
+	return e.ai.classicalEvaluation(game)
+}
+
+// SearchProgress is reported after each completed iterative-deepening iteration
+type SearchProgress struct {
+	Depth         int   `json:"depth"`
+	BestMove      *Move `json:"bestMove"`
+	Evaluation    int   `json:"evaluation"`
+	NodesSearched int64 `json:"nodesSearched"`
+}
+
+type ProgressFunc func(SearchProgress)
+
+// CandidateMove is a root move with the score the search gave it,
+// Black-positive like every evaluation
+type CandidateMove struct {
+	Move       Move   `json:"move"`
+	UCI        string `json:"uci"`
+	SAN        string `json:"san"`
+	Evaluation int    `json:"evaluation"`
 }
 
 // ============================================================================
 // AI SERVICE
 // ============================================================================
 
+// AILimits bound how much work a single search may do
+type AILimits struct {
+	MaxThinkingTime time.Duration `json:"maxThinkingTime"` // 0 means no cap
+	MaxDepth        int           `json:"maxDepth"`
+	MaxNodes        int64         `json:"maxNodes"` // 0 means unlimited
+}
+
+func DefaultAILimits() AILimits {
+	return AILimits{
+		MaxThinkingTime: MAX_THINKING_TIME,
+		MaxDepth:        MAX_DEPTH,
+	}
+}
+
 type AIService struct {
-	depth           int
-	nodesSearched   int64
-	lastThinkingTime time.Duration
+	// Configuration. The setters may change it while searches run, so a
+	// search never reads it here but on a snapshot taken as it starts.
+	configLock      sync.RWMutex
+	settings        AISettings
+	limits          AILimits
+	evalMode        EvalMode
+	style           string
+	resign          ResignPolicy
+	minResponseTime time.Duration // Replies to the player are padded to at least this
+	clock           Clock
+	evaluator       Evaluator
+	evalCache       *evalCache // Analysis results for positions asked about again
+
+	// Drives book choices and weaker levels' evaluation noise; seed it for
+	// reproducible games. Snapshots share it.
+	rng *lockedRand
+
+	// How the AI found its last move in the live game, for the stats
+	statsLock sync.Mutex
+	lastMove  SearchStats
+
+	// Evaluation weights. Only a snapshot's ever change: a search for the
+	// AI's own move takes its style's, everything else stays neutral.
+	weights     EvalWeights
+	weightsSide Color // The side the style weights play for
 }
 
 func NewAIService() *AIService {
-	return &AIService{
-		depth: DEFAULT_DEPTH,
+	ai := &AIService{
+		settings:  AISettings{Depth: DEFAULT_DEPTH, CheckExtension: 1},
+		limits:    DefaultAILimits(),
+		evalMode:  EvalFull,
+		style:     DEFAULT_STYLE,
+		resign:    DefaultResignPolicy(),
+		weights:   stylePresets[DEFAULT_STYLE],
+		rng:       newLockedRand(time.Now().UnixNano()),
+		evalCache: newEvalCache(EVAL_CACHE_SIZE),
+		clock:     realClock{},
+	}
+	ai.evaluator = classicalEvaluator{ai}
+	return ai
+}
+
+// snapshot copies the configuration into a service of its own for a search
+// to run on, so settings changed meanwhile can't reach the search and what
+// the search changes can't reach anyone else. The evaluation cache and the
+// random source are shared.
+func (ai *AIService) snapshot() *AIService {
+	ai.configLock.RLock()
+	defer ai.configLock.RUnlock()
+
+	snapshot := &AIService{
+		settings:        ai.settings,
+		limits:          ai.limits,
+		evalMode:        ai.evalMode,
+		style:           ai.style,
+		resign:          ai.resign,
+		minResponseTime: ai.minResponseTime,
+		clock:           ai.clock,
+		evalCache:       ai.evalCache,
+		rng:             ai.rng,
+		weights:         stylePresets[DEFAULT_STYLE],
 	}
+	snapshot.evaluator = classicalEvaluator{snapshot}
+	ai.shareEvaluator(snapshot)
+	return snapshot
+}
+
+// lockedRand is a random source any number of searches can draw from at once
+type lockedRand struct {
+	sync.Mutex
+	rand *rand.Rand
+}
+
+func newLockedRand(seed int64) *lockedRand {
+	return &lockedRand{rand: rand.New(rand.NewSource(seed))}
+}
+
+func (r *lockedRand) intn(n int) int {
+	r.Lock()
+	defer r.Unlock()
+	return r.rand.Intn(n)
+}
+
+func (r *lockedRand) seed(seed int64) {
+	r.Lock()
+	defer r.Unlock()
+	r.rand.Seed(seed)
+}
+
+// search is the state of one search. Every search gets its own, so a game
+// move and any number of analysis searches can run side by side without
+// mixing up node counts, deadlines or draw scores.
+type search struct {
+	ai             *AIService // The configuration snapshot it runs on
+	ctx            context.Context
+	aborted        bool
+	nextAbortCheck int64
+	nodes          int64
+	drawScore      int // What a draw is worth to this search, Black-positive
+}
+
+func (ai *AIService) newSearch(ctx context.Context, drawScore int) *search {
+	return &search{ai: ai, ctx: ctx, nextAbortCheck: ABORT_CHECK_INTERVAL, drawScore: drawScore}
+}
+
+// SearchOptions adjust a single search without touching the service's
+// configuration
+type SearchOptions struct {
+	Depth       int           // Replaces the configured depth when above 0, up to the depth limit
+	ThinkTime   time.Duration // Replaces the think-time cap when above 0
+	NoTimeLimit bool          // Search without a think-time cap, until the depth is done or ctx ends
+	Progress    ProgressFunc  // Called after every finished iteration
+}
+
+// SearchStats describe how a search went
+type SearchStats struct {
+	Depth      int           // Deepest finished iteration; 0 for a book or forced move
+	Nodes      int64
+	ThinkTime  time.Duration
+	ThinkLimit time.Duration // The think-time cap it ran under, 0 for none
+	Forced     bool          // The only legal move, so it wasn't searched
+	Book       bool
+}
+
+// SearchResult is what a search found: the move, its score and the scores
+// of the moves it was weighed against
+type SearchResult struct {
+	SearchStats
+	Move       *Move
+	Evaluation int // The move's score in the deepest finished iteration, without noise; 0 if none finished
+
+	candidates []CandidateMove // Every root move's score in that iteration, without noise
+	position   *ChessGame      // The position candidates are for
 }
 
 // ============================================================================
@@ -120,57 +376,201 @@ func NewAIService() *AIService {
 
 // GetBestMove finds the best move using minimax with alpha-beta pruning
 func (ai *AIService) GetBestMove(ctx context.Context, game *ChessGame) (*Move, error) {
+	return ai.GetBestMoveWithProgress(ctx, game, nil)
+}
+
+// GetBestMoveWithProgress is GetBestMove that also calls progress (if not nil)
+// every time an iterative-deepening iteration completes
+func (ai *AIService) GetBestMoveWithProgress(ctx context.Context, game *ChessGame, progress ProgressFunc) (*Move, error) {
+	result, err := ai.Search(ctx, game, SearchOptions{Progress: progress})
+	if err != nil {
+		return nil, err
+	}
+	return result.Move, nil
+}
+
+// Search finds the best move in game with the configuration as it is when
+// the search starts, adjusted by opts. The game itself is never touched.
+func (ai *AIService) Search(ctx context.Context, game *ChessGame, opts SearchOptions) (*SearchResult, error) {
 	if game.GameOver {
 		return nil, fmt.Errorf("game is over")
 	}
 
-	moves := game.GetValidMoves(game.CurrentTurn)
+	moves := game.LegalMoves()
 	if len(moves) == 0 {
 		return nil, fmt.Errorf("no valid moves available")
 	}
 
-	// Use context with timeout
-	ctx, cancel := context.WithTimeout(ctx, MAX_THINKING_TIME)
+	ai = ai.snapshot()
+	if opts.Depth > 0 {
+		ai.settings.Depth = min(opts.Depth, ai.limits.MaxDepth)
+	}
+	switch {
+	case opts.NoTimeLimit:
+		ai.limits.MaxThinkingTime = 0
+	case opts.ThinkTime > 0:
+		ai.limits.MaxThinkingTime = opts.ThinkTime
+	}
+	result := &SearchResult{SearchStats: SearchStats{ThinkLimit: ai.limits.MaxThinkingTime}}
+
+	// With a single legal move there is nothing to weigh, so the think time
+	// (and under a time control, the clock) is saved for later moves. A book
+	// or forced move isn't searched, so it leaves no scores behind.
+	if len(moves) == 1 {
+		result.Move = &moves[0]
+		result.Forced = true
+		return result, nil
+	}
+
+	if ai.settings.UseOpeningBook {
+		ai.rng.Lock()
+		move := bookMove(game, ai.rng.rand)
+		ai.rng.Unlock()
+		if move != nil {
+			result.Move = move
+			result.Book = true
+			return result, nil
+		}
+	}
+
+	// The think-time cap is layered on top of the caller's context, so the
+	// earlier of the two deadlines wins; without a cap only the caller's applies.
+	// It runs on the AI's clock rather than as a context deadline.
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
+	if ai.limits.MaxThinkingTime > 0 {
+		timer := ai.clock.NewTimer(ai.limits.MaxThinkingTime)
+		defer timer.Stop()
+		go func() {
+			select {
+			case <-timer.C():
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
 
-	// Channel to receive the result
-	resultChan := make(chan struct {
-		move *Move
-		err  error
-	}, 1)
-
-	// Run AI calculation in goroutine
-	go func() {
-		start := time.Now()
-		ai.nodesSearched = 0
-		
-		bestMove := ai.getBestMoveSync(game)
-		ai.lastThinkingTime = time.Since(start)
-		
-		resultChan <- struct {
-			move *Move
-			err  error
-		}{bestMove, nil}
-	}()
-
-	// Wait for result or timeout
-	select {
-	case result := <-resultChan:
-		return result.move, result.err
-	case <-ctx.Done():
-		// Return first valid move if timeout
-		return &moves[0], fmt.Errorf("AI thinking timeout, returning first valid move")
+	// The search unwinds soon after ctx ends and still reports the best move
+	// of its deepest finished iteration, so a timeout or stop costs strength,
+	// not the move. It works on a copy so the caller's game is never touched.
+	start := ai.clock.Now()
+	ai.deepen(ctx, game.CopyState(), result, opts.Progress)
+	result.ThinkTime = ai.clock.Since(start)
+
+	if result.Move == nil {
+		result.Move = &moves[0]
 	}
+	return result, nil
 }
 
-func (ai *AIService) getBestMoveSync(game *ChessGame) *Move {
-	moves := game.GetValidMoves(game.CurrentTurn)
-	if len(moves) == 0 {
-		return nil
+// SearchEvaluation scores the position with a plain fixed-depth search: no
+// noise, no book and no contempt, so the same position always gets the same
+// score. It fails if ctx ends or the node budget runs out first.
+func (ai *AIService) SearchEvaluation(ctx context.Context, game *ChessGame, depth int) (int, error) {
+	ai = ai.snapshot()
+	if game.GameOver {
+		return ai.evaluatePosition(game), nil
+	}
+
+	key := evalCacheKey(game, depth, ai.evalMode, ai.settings)
+	if score, ok := ai.evalCache.get(key); ok {
+		return score, nil
+	}
+
+	score, err := ai.newSearch(ctx, 0).fixedDepth(game, depth)
+	if err != nil {
+		return 0, err
+	}
+	ai.evalCache.put(key, score)
+	return score, nil
+}
+
+// Evaluate is the static evaluation through the evaluation cache, for the
+// analysis endpoints that keep asking about the same positions
+func (ai *AIService) Evaluate(game *ChessGame) int {
+	ai = ai.snapshot()
+	if game.GameOver {
+		return ai.evaluatePosition(game)
+	}
+
+	key := evalCacheKey(game, 0, ai.evalMode, ai.settings)
+	if score, ok := ai.evalCache.get(key); ok {
+		return score
+	}
+	score := ai.evaluatePosition(game)
+	ai.evalCache.put(key, score)
+	return score
+}
+
+// deepen searches one ply deeper at a time up to the configured depth, so
+// there is always a finished iteration to report or fall back on. It runs
+// on a snapshot and fills in result as iterations finish.
+func (ai *AIService) deepen(ctx context.Context, game *ChessGame, result *SearchResult, progress ProgressFunc) {
+	moves := game.LegalMoves()
+	s := ai.newSearch(ctx, ai.contemptDrawScore(game))
+
+	// The style colours the AI's own choices; analysis scores stay neutral
+	ai.weights = stylePresets[ai.style]
+	ai.weightsSide = game.CurrentTurn
+
+	for depth := 1; depth <= ai.settings.Depth; depth++ {
+		if ctx.Err() != nil {
+			break
+		}
+
+		move, value, scores, complete := s.searchRoot(game, moves, depth)
+		if !complete {
+			// A partial iteration is only better than having nothing at all
+			if result.Move == nil {
+				result.Move = move
+			}
+			break
+		}
+		result.Move = move
+		result.Evaluation = value
+		result.Depth = depth
+		result.candidates = scores
+		result.position = game
+
+		if progress != nil {
+			progress(SearchProgress{
+				Depth:         depth,
+				BestMove:      move,
+				Evaluation:    value,
+				NodesSearched: s.nodes,
+			})
+		}
+	}
+	result.Nodes = s.nodes
+}
+
+// fixedDepth scores the position with a plain search to depth. It fails if
+// the search is cut short.
+func (s *search) fixedDepth(game *ChessGame, depth int) (int, error) {
+	score := s.minimax(game, depth, 0, -INFINITY, INFINITY, game.CurrentTurn == Black)
+	if s.aborted {
+		return 0, fmt.Errorf("search stopped before reaching depth %d", depth)
+	}
+	return score, nil
+}
+
+// searchRoot scores every root move at the given depth, returning the best
+// one, its score and every move's score. Scores are without the evaluation
+// noise weaker levels choose with. It reports false if the node budget ran
+// out before all moves were searched.
+func (s *search) searchRoot(game *ChessGame, moves []Move, depth int) (*Move, int, []CandidateMove, bool) {
+	// Scores are from Black's point of view, so White looks for the lowest one
+	maximizing := game.CurrentTurn == Black
+	perspective := 1
+	if !maximizing {
+		perspective = -1
 	}
 
 	bestMove := moves[0]
-	bestValue := -INFINITY
+	bestValue := -INFINITY // With noise, what the move is chosen by
+	bestScore := -INFINITY // The chosen move's real score
+	bestTieBreak := -INFINITY
+	scores := make([]CandidateMove, 0, len(moves))
 
 	// Try each possible move
 	for _, move := range moves {
@@ -179,49 +579,181 @@ func (ai *AIService) getBestMoveSync(game *ChessGame) *Move {
 		gameCopy.MakeMove(move)
 
 		// Evaluate this position using minimax
-		value := ai.minimax(gameCopy, ai.depth-1, -INFINITY, INFINITY, false)
+		childDepth, extensions := s.ai.recaptureExtension(game, move, depth-1, 0)
+		score := perspective * s.minimax(gameCopy, childDepth, extensions, -INFINITY, INFINITY, !maximizing)
+		scores = append(scores, CandidateMove{Move: move, Evaluation: perspective * score})
+		value := score
+
+		// Weaker levels blur the evaluation so they occasionally misjudge moves
+		if s.ai.settings.Randomness > 0 {
+			value += s.ai.randomNoise(s.ai.settings.Randomness)
+		}
 
-		if value > bestValue {
+		// Mate scores already favour the slowest loss; among otherwise equal
+		// moves prefer the most forcing one rather than whichever came first
+		tieBreak := rootTieBreak(game, gameCopy, move)
+		if value > bestValue || (value == bestValue && tieBreak > bestTieBreak) {
 			bestValue = value
+			bestScore = score
 			bestMove = move
+			bestTieBreak = tieBreak
 		}
+
+		if s.shouldAbort() {
+			return &bestMove, perspective * bestScore, scores, false
+		}
+	}
+
+	return &bestMove, perspective * bestScore, scores, true
+}
+
+// Alternatives ranks the root moves of the search's deepest finished
+// iteration, best first for the side that was to move. It returns at most
+// limit moves, and none if the move came from the book or was forced.
+func (r *SearchResult) Alternatives(limit int) []CandidateMove {
+	if len(r.candidates) == 0 {
+		return nil
+	}
+	game := r.position
+	ranked := make([]CandidateMove, len(r.candidates))
+	copy(ranked, r.candidates)
+
+	sign := 1
+	if game.CurrentTurn == White {
+		sign = -1
 	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return sign*ranked[i].Evaluation > sign*ranked[j].Evaluation
+	})
+
+	if len(ranked) > limit {
+		ranked = ranked[:limit]
+	}
+	for i := range ranked {
+		ranked[i].UCI = uciMove(ranked[i].Move)
+		ranked[i].SAN = game.MoveToSAN(ranked[i].Move)
+	}
+	return ranked
+}
 
-	return &bestMove
+// randomNoise returns a uniform value in [-amount, amount]
+func (ai *AIService) randomNoise(amount int) int {
+	return ai.rng.intn(2*amount+1) - amount
+}
+
+// shouldAbort reports whether the search must unwind because the node budget
+// is spent or its context ended (a timeout or a stop). The context is only
+// polled every ABORT_CHECK_INTERVAL nodes.
+func (s *search) shouldAbort() bool {
+	if s.aborted {
+		return true
+	}
+
+	if s.ai.limits.MaxNodes > 0 && s.nodes >= s.ai.limits.MaxNodes {
+		s.aborted = true
+	} else if s.nodes >= s.nextAbortCheck {
+		s.nextAbortCheck = s.nodes + ABORT_CHECK_INTERVAL
+		s.aborted = s.ctx.Err() != nil
+	}
+	return s.aborted
+}
+
+// contemptDrawScore is what a draw is worth from the root position: nothing,
+// unless one side is clearly winning, in which case that side counts it as a
+// setback and plays around stalemates and repetitions
+func (ai *AIService) contemptDrawScore(game *ChessGame) int {
+	eval := ai.evaluatePosition(game)
+	switch {
+	case eval >= WINNING_MARGIN:
+		return -DRAW_CONTEMPT
+	case eval <= -WINNING_MARGIN:
+		return DRAW_CONTEMPT
+	}
+	return 0
+}
+
+// terminalScore scores a finished game; depth is what was left to search so
+// faster wins score higher
+func (s *search) terminalScore(game *ChessGame, depth int) int {
+	switch game.Winner {
+	case string(Black):
+		return WIN_SCORE + depth
+	case string(White):
+		return -WIN_SCORE - depth
+	}
+	return s.drawScore
+}
+
+// rootTieBreak ranks equally scored root moves: captures by the value taken,
+// plus a bonus for giving check
+func rootTieBreak(before, after *ChessGame, move Move) int {
+	score := 0
+	if captured := before.capturedBy(move); captured != nil {
+		score += pieceValues[captured.Type]
+	}
+	if after.IsInCheck(after.CurrentTurn) {
+		score += CHECK_TIE_BREAK
+	}
+	return score
 }
 
 // ============================================================================
 // MINIMAX ALGORITHM WITH ALPHA-BETA PRUNING
 // ============================================================================
 
-func (ai *AIService) minimax(game *ChessGame, depth int, alpha, beta int, isMaximizing bool) int {
-	ai.nodesSearched++
+// minimax searches depth more plies; extensions is how much extensions have
+// already added on the way here, in EXTENSION_UNITS per ply
+func (s *search) minimax(game *ChessGame, depth, extensions int, alpha, beta int, isMaximizing bool) int {
+	s.nodes++
 
-	// Terminal cases
-	if depth == 0 {
-		return ai.evaluatePosition(game)
+	// Out of budget or stopped: unwind quickly, the root throws this iteration away
+	if s.shouldAbort() {
+		return s.ai.evaluatePosition(game)
 	}
 
+	// Terminal cases. Extended plies don't count as remaining depth, so a
+	// mate found through checks still scores by how far away it is.
 	if game.GameOver {
-		if game.Winner == string(Black) {
-			return WIN_SCORE + depth // Prefer faster wins
-		} else if game.Winner == string(White) {
-			return -WIN_SCORE - depth
-		} else {
-			return 0 // Draw
+		return s.terminalScore(game, depth-extensions/EXTENSION_UNITS)
+	}
+
+	// Inside the tree one repetition or reaching the fifty-move mark already
+	// counts as a draw: whichever side wants one can steer into the real thing
+	if game.repetitionCount() >= 2 || game.halfMoveClock() >= CLAIMABLE_HALF_MOVES {
+		return s.drawScore
+	}
+
+	// Don't judge a position in check at the horizon, forced tactics are often
+	// only a few checks away. The cap stops long checking sequences from
+	// blowing up the tree.
+	inCheck := game.IsInCheck(game.CurrentTurn)
+	if extension := s.ai.settings.CheckExtension; extension > 0 && extensions+extension*EXTENSION_UNITS <= MAX_SEARCH_EXTENSION*EXTENSION_UNITS && inCheck {
+		depth += extension
+		extensions += extension * EXTENSION_UNITS
+	}
+
+	if depth == 0 {
+		if s.ai.settings.UseQuiescence {
+			return s.quiescence(game, QUIESCENCE_DEPTH, alpha, beta, isMaximizing)
 		}
+		return s.ai.evaluatePosition(game)
 	}
 
 	if isMaximizing {
-		// Black is maximizing (AI player)
+		// Black is maximizing
 		maxEval := -INFINITY
-		moves := game.GetValidMoves(Black)
+		moves := orderMoves(game, game.LegalMoves())
 
-		for _, move := range moves {
+		for i, move := range moves {
 			gameCopy := game.CopyState()
 			gameCopy.MakeMove(move)
 
-			eval := ai.minimax(gameCopy, depth-1, alpha, beta, false)
+			childDepth, childExtensions := s.ai.recaptureExtension(game, move, depth-1, extensions)
+			reduction := lateMoveReduction(game, gameCopy, move, i, depth, inCheck)
+			eval := s.minimax(gameCopy, childDepth-reduction, childExtensions, alpha, beta, false)
+			if reduction > 0 && eval > alpha {
+				eval = s.minimax(gameCopy, childDepth, childExtensions, alpha, beta, false)
+			}
 			maxEval = max(maxEval, eval)
 			alpha = max(alpha, eval)
 
@@ -233,15 +765,20 @@ func (ai *AIService) minimax(game *ChessGame, depth int, alpha, beta int, isMaxi
 		return maxEval
 
 	} else {
-		// White is minimizing (human player)
+		// White is minimizing
 		minEval := INFINITY
-		moves := game.GetValidMoves(White)
+		moves := orderMoves(game, game.LegalMoves())
 
-		for _, move := range moves {
+		for i, move := range moves {
 			gameCopy := game.CopyState()
 			gameCopy.MakeMove(move)
 
-			eval := ai.minimax(gameCopy, depth-1, alpha, beta, true)
+			childDepth, childExtensions := s.ai.recaptureExtension(game, move, depth-1, extensions)
+			reduction := lateMoveReduction(game, gameCopy, move, i, depth, inCheck)
+			eval := s.minimax(gameCopy, childDepth-reduction, childExtensions, alpha, beta, true)
+			if reduction > 0 && eval < beta {
+				eval = s.minimax(gameCopy, childDepth, childExtensions, alpha, beta, true)
+			}
 			minEval = min(minEval, eval)
 			beta = min(beta, eval)
 
@@ -254,6 +791,124 @@ func (ai *AIService) minimax(game *ChessGame, depth int, alpha, beta int, isMaxi
 	}
 }
 
+// recaptureExtension returns the depth and extension tally to search move
+// with. Taking back on the square the opponent just captured on earns the
+// recapture extension, so exchanges at the horizon are played out; the
+// fraction of a ply it adds carries along the line until it makes a whole ply.
+func (ai *AIService) recaptureExtension(game *ChessGame, move Move, depth, extensions int) (int, int) {
+	extension := ai.settings.RecaptureExtension
+	if extension == 0 || extensions+extension > MAX_SEARCH_EXTENSION*EXTENSION_UNITS {
+		return depth, extensions
+	}
+	last := game.GetLastMove()
+	if last == nil || last.CapturedPiece == nil || move.To != last.To {
+		return depth, extensions
+	}
+	plies := (extensions+extension)/EXTENSION_UNITS - extensions/EXTENSION_UNITS
+	return depth + plies, extensions + extension
+}
+
+// lateMoveReduction is how many plies to take off the search of the move at
+// index in the ordering. Captures, promotions and checks are always searched
+// in full, as is everything when the side to move is in check, since that is
+// where the tactics are.
+func lateMoveReduction(before, after *ChessGame, move Move, index, depth int, inCheck bool) int {
+	if depth < LMR_MIN_DEPTH || index < LMR_FULL_DEPTH_MOVES || inCheck {
+		return 0
+	}
+	if before.isCapture(move) || move.Promotion != "" || after.IsInCheck(after.CurrentTurn) {
+		return 0
+	}
+	return LMR_REDUCTION
+}
+
+// orderMoves searches winning and even captures first, best exchange first,
+// then quiet moves, then captures that lose material, so cutoffs come sooner
+func orderMoves(game *ChessGame, moves []Move) []Move {
+	var captures, losingCaptures, quiet []Move
+	exchange := map[Move]int{}
+
+	for _, move := range moves {
+		if !game.isCapture(move) {
+			quiet = append(quiet, move)
+			continue
+		}
+		exchange[move] = game.StaticExchangeEval(move)
+		if exchange[move] < 0 {
+			losingCaptures = append(losingCaptures, move)
+		} else {
+			captures = append(captures, move)
+		}
+	}
+
+	sort.SliceStable(captures, func(i, j int) bool { return exchange[captures[i]] > exchange[captures[j]] })
+	sort.SliceStable(losingCaptures, func(i, j int) bool { return exchange[losingCaptures[i]] > exchange[losingCaptures[j]] })
+
+	ordered := append(captures, quiet...)
+	return append(ordered, losingCaptures...)
+}
+
+// quiescence keeps searching captures past the horizon so the evaluation isn't
+// taken in the middle of an exchange
+func (s *search) quiescence(game *ChessGame, depth int, alpha, beta int, isMaximizing bool) int {
+	s.nodes++
+
+	if game.GameOver {
+		return s.terminalScore(game, 0)
+	}
+
+	standPat := s.ai.evaluatePosition(game)
+	if depth == 0 {
+		return standPat
+	}
+
+	if isMaximizing {
+		if standPat >= beta {
+			return standPat
+		}
+		best := standPat
+		alpha = max(alpha, standPat)
+
+		for _, move := range orderMoves(game, game.LegalMoves()) {
+			if !game.isCapture(move) || game.StaticExchangeEval(move) < 0 {
+				continue
+			}
+			gameCopy := game.CopyState()
+			gameCopy.MakeMove(move)
+
+			eval := s.quiescence(gameCopy, depth-1, alpha, beta, false)
+			best = max(best, eval)
+			alpha = max(alpha, eval)
+			if beta <= alpha {
+				break
+			}
+		}
+		return best
+	}
+
+	if standPat <= alpha {
+		return standPat
+	}
+	best := standPat
+	beta = min(beta, standPat)
+
+	for _, move := range orderMoves(game, game.LegalMoves()) {
+		if !game.isCapture(move) || game.StaticExchangeEval(move) < 0 {
+			continue
+		}
+		gameCopy := game.CopyState()
+		gameCopy.MakeMove(move)
+
+		eval := s.quiescence(gameCopy, depth-1, alpha, beta, true)
+		best = min(best, eval)
+		beta = min(beta, eval)
+		if beta <= alpha {
+			break
+		}
+	}
+	return best
+}
+
 // ============================================================================
 // POSITION EVALUATION
 // ============================================================================
@@ -269,7 +924,29 @@ func (ai *AIService) evaluatePosition(game *ChessGame) int {
 		}
 	}
 
+	// Only a broken setup can be missing a king. The side without one has
+	// lost, whatever the rest of the board says, so the search never plays
+	// for such a position.
+	hasBlackKing, hasWhiteKing := game.findKing(Black) != nil, game.findKing(White) != nil
+	switch {
+	case !hasBlackKing && !hasWhiteKing:
+		return 0
+	case !hasBlackKing:
+		return -WIN_SCORE
+	case !hasWhiteKing:
+		return WIN_SCORE
+	}
+
+	// However the terms stack up, they must not read as a mate
+	score := ai.evaluator.Evaluate(game)
+	return max(-MAX_EVAL, min(score, MAX_EVAL))
+}
+
+// classicalEvaluation is the hand-crafted evaluation: material, piece-square
+// tables and positional factors, as far as the evaluation mode includes them
+func (ai *AIService) classicalEvaluation(game *ChessGame) int {
 	score := 0
+	phase := gamePhase(game)
 
 	// Material and positional evaluation
 	for i := 0; i < 8; i++ {
@@ -279,7 +956,15 @@ func (ai *AIService) evaluatePosition(game *ChessGame) int {
 				continue
 			}
 
-			pieceScore := ai.evaluatePiece(piece, i, j)
+			var pieceScore int
+			switch ai.evalMode {
+			case EvalMaterial:
+				pieceScore = pieceValues[piece.Type]
+			case EvalPositional:
+				pieceScore = ai.pieceSquareValue(piece, i, j, phase)
+			default:
+				pieceScore = ai.evaluatePiece(piece, i, j, phase)
+			}
 
 			if piece.Color == Black {
 				score += pieceScore
@@ -290,41 +975,54 @@ func (ai *AIService) evaluatePosition(game *ChessGame) int {
 	}
 
 	// Additional positional factors
-	score += ai.evaluatePositionalFactors(game)
-
+	if ai.evalMode != EvalMaterial {
+		score += ai.evaluatePositionalFactors(game, phase)
+	}
 	return score
 }
 
-func (ai *AIService) evaluatePiece(piece *Piece, row, col int) int {
-	baseValue := pieceValues[piece.Type]
+// isMateScore tells a won or lost game, or a forced mate found by the search,
+// from an ordinary evaluation
+func isMateScore(score int) bool {
+	return abs(score) > MAX_EVAL
+}
+
+func (ai *AIService) evaluatePiece(piece *Piece, row, col, phase int) int {
+	return pieceValues[piece.Type] + ai.pieceSquareValue(piece, row, col, phase)
+}
 
-	// Get positional bonus using piece-square tables
-	// Flip the row for white pieces (they start at bottom)
+// pieceSquareValue blends the midgame and endgame tables by phase, from all
+// midgame at MIDGAME_PHASE down to all endgame with no pieces left
+func (ai *AIService) pieceSquareValue(piece *Piece, row, col, phase int) int {
+	// The tables are laid out from White's side of the board, which is also
+	// how the board rows run, so only Black's pieces need the row flipped
 	evalRow := row
-	if piece.Color == White {
+	if piece.Color == Black {
 		evalRow = 7 - row
 	}
 
-	var positionValue int
-	switch piece.Type {
-	case Pawn:
-		positionValue = pawnTable[evalRow][col]
-	case Knight:
-		positionValue = knightTable[evalRow][col]
-	case Bishop:
-		positionValue = bishopTable[evalRow][col]
-	case Rook:
-		positionValue = rookTable[evalRow][col]
-	case Queen:
-		positionValue = queenTable[evalRow][col]
-	case King:
-		positionValue = kingTable[evalRow][col]
+	return pieceSquareTables.value(piece.Type, evalRow, col, phase)
+}
+
+// gamePhase sums the phase weights of the pieces on the board, capped at
+// MIDGAME_PHASE so early promotions can't push it past a full midgame
+func gamePhase(game *ChessGame) int {
+	phase := 0
+	for i := 0; i < 8; i++ {
+		for j := 0; j < 8; j++ {
+			if piece := game.Board[i][j]; piece != nil {
+				phase += phaseWeights[piece.Type]
+			}
+		}
 	}
+	return min(phase, MIDGAME_PHASE)
+}
 
-	return baseValue + positionValue
+func taper(midgame, endgame, phase int) int {
+	return (midgame*phase + endgame*(MIDGAME_PHASE-phase)) / MIDGAME_PHASE
 }
 
-func (ai *AIService) evaluatePositionalFactors(game *ChessGame) int {
+func (ai *AIService) evaluatePositionalFactors(game *ChessGame, phase int) int {
 	score := 0
 
 	// Center control bonus
@@ -332,60 +1030,235 @@ func (ai *AIService) evaluatePositionalFactors(game *ChessGame) int {
 	extendedCenter := []Position{{2, 2}, {2, 3}, {2, 4}, {2, 5}, 
 		{3, 2}, {3, 5}, {4, 2}, {4, 5}, {5, 2}, {5, 3}, {5, 4}, {5, 5}}
 
+	// One pass over each side's attacks instead of a board scan per square
+	blackControl := game.AttackMap(Black)
+	whiteControl := game.AttackMap(White)
+
+	center := 0
 	for _, pos := range centerSquares {
-		if ai.isSquareControlledBy(game, pos, Black) {
-			score += 15
+		if blackControl[pos.Row][pos.Col] > 0 {
+			center += 15
 		}
-		if ai.isSquareControlledBy(game, pos, White) {
-			score -= 15
+		if whiteControl[pos.Row][pos.Col] > 0 {
+			center -= 15
 		}
 	}
 
 	for _, pos := range extendedCenter {
-		if ai.isSquareControlledBy(game, pos, Black) {
-			score += 5
+		if blackControl[pos.Row][pos.Col] > 0 {
+			center += 5
 		}
-		if ai.isSquareControlledBy(game, pos, White) {
-			score -= 5
+		if whiteControl[pos.Row][pos.Col] > 0 {
+			center -= 5
 		}
 	}
+	score += center * ai.weights.CenterControl / 100
 
-	// King safety evaluation
+	// King safety evaluation, weighted by how much the style cares about its
+	// own king versus the opponent's
 	blackKing := game.findKing(Black)
 	whiteKing := game.findKing(White)
 
 	if blackKing != nil {
-		score += ai.evaluateKingSafety(*blackKing, Black, game)
+		score += ai.evaluateKingSafety(*blackKing, Black, game, phase) * ai.kingWeight(Black) / 100
 	}
 	if whiteKing != nil {
-		score -= ai.evaluateKingSafety(*whiteKing, White, game)
+		score -= ai.evaluateKingSafety(*whiteKing, White, game, phase) * ai.kingWeight(White) / 100
 	}
 
-	// Mobility (number of legal moves)
-	blackMoves := len(game.GetValidMoves(Black))
-	whiteMoves := len(game.GetValidMoves(White))
-	score += (blackMoves - whiteMoves) * 2
+	score += evaluatePins(game)
+
+	// Mobility of the pieces that rely on it
+	score += (ai.evaluateMobility(game, Black) - ai.evaluateMobility(game, White)) * ai.weights.Mobility / 100
+
+	// Basic mates need the losing king pushed to the edge, which the
+	// piece-square tables alone never aim for
+	score += ai.evaluateMopUp(game, Black) - ai.evaluateMopUp(game, White)
+
+	// Linear pawn advancement misses that one pawn may simply outrun the king
+	score += ai.evaluatePawnRace(game, Black) - ai.evaluatePawnRace(game, White)
 
 	return score
 }
 
-func (ai *AIService) isSquareControlledBy(game *ChessGame, pos Position, color Color) bool {
+// evaluatePins penalizes each absolutely pinned piece, which is effectively
+// immobile
+func evaluatePins(game *ChessGame) int {
+	return (len(game.PinnedPieces(White)) - len(game.PinnedPieces(Black))) * PIN_PENALTY
+}
+
+// evaluatePawnRace rewards color's fastest unstoppable passed pawn while the
+// opponent has nothing but king and pawns, so only the king could catch it
+func (ai *AIService) evaluatePawnRace(game *ChessGame, color Color) int {
+	opponent := opponentColor(color)
+	enemyKing := game.findKing(opponent)
+	if enemyKing == nil {
+		return 0
+	}
+
+	var pawns []Position
 	for i := 0; i < 8; i++ {
 		for j := 0; j < 8; j++ {
 			piece := game.Board[i][j]
-			if piece == nil || piece.Color != color {
+			if piece == nil {
 				continue
 			}
+			if piece.Color == opponent && piece.Type != King && piece.Type != Pawn {
+				return 0
+			}
+			if piece.Color == color && piece.Type == Pawn {
+				pawns = append(pawns, Position{i, j})
+			}
+		}
+	}
 
-			if game.isValidPieceMove(Position{i, j}, pos, piece) {
-				return true
+	best := 0
+	for _, pawn := range pawns {
+		if game.isPassedPawn(pawn, color) && game.pawnOutrunsKing(pawn, color, *enemyKing) {
+			best = max(best, UNSTOPPABLE_PAWN_BONUS-UNSTOPPABLE_PAWN_STEP*pawnStepsToPromote(pawn, color))
+		}
+	}
+	return best
+}
+
+// isPassedPawn reports whether no enemy pawn stands in front of color's pawn
+// on its own or a neighbouring file
+func (g *ChessGame) isPassedPawn(pawn Position, color Color) bool {
+	direction := -1
+	if color == Black {
+		direction = 1
+	}
+	for row := pawn.Row + direction; row >= 0 && row < 8; row += direction {
+		for col := max(0, pawn.Col-1); col <= min(7, pawn.Col+1); col++ {
+			if piece := g.Board[row][col]; piece != nil && piece.Type == Pawn && piece.Color != color {
+				return false
 			}
 		}
 	}
-	return false
+	return true
+}
+
+// pawnOutrunsKing is the rule of the square: with its path clear, the pawn
+// promotes before the enemy king can reach the promotion square, counting
+// whose move it is
+func (g *ChessGame) pawnOutrunsKing(pawn Position, color Color, enemyKing Position) bool {
+	opponent := opponentColor(color)
+	promotion := Position{Row: homeRow(opponent), Col: pawn.Col}
+	direction := sign(promotion.Row - pawn.Row)
+	for row := pawn.Row + direction; row != promotion.Row+direction; row += direction {
+		if g.Board[row][pawn.Col] != nil {
+			return false
+		}
+	}
+
+	tempo := 0
+	if g.CurrentTurn == opponent {
+		tempo = 1
+	}
+	return kingDistance(enemyKing, promotion) > pawnStepsToPromote(pawn, color)+tempo
+}
+
+// pawnStepsToPromote counts the pawn's moves to the last rank, taking the
+// double step from its starting square into account
+func pawnStepsToPromote(pawn Position, color Color) int {
+	steps := abs(homeRow(opponentColor(color)) - pawn.Row)
+	if abs(homeRow(color)-pawn.Row) == 1 {
+		steps--
+	}
+	return steps
 }
 
-func (ai *AIService) evaluateKingSafety(kingPos Position, color Color, game *ChessGame) int {
+func (ai *AIService) kingWeight(color Color) int {
+	if color == ai.weightsSide {
+		return ai.weights.KingSafety
+	}
+	return ai.weights.KingAttack
+}
+
+// evaluateMopUp rewards color, when it can force mate against a bare king, for
+// having the enemy king near the edge and its own king close to it
+func (ai *AIService) evaluateMopUp(game *ChessGame, color Color) int {
+	opponent := opponentColor(color)
+	ownKing, enemyKing := game.findKing(color), game.findKing(opponent)
+	if ownKing == nil || enemyKing == nil {
+		return 0
+	}
+
+	var attackers []PieceType
+	for i := 0; i < 8; i++ {
+		for j := 0; j < 8; j++ {
+			piece := game.Board[i][j]
+			if piece == nil || piece.Type == King {
+				continue
+			}
+			if piece.Color == opponent {
+				return 0
+			}
+			attackers = append(attackers, piece.Type)
+		}
+	}
+	if !hasMatingMaterial(attackers) {
+		return 0
+	}
+
+	kingDistance := abs(ownKing.Row-enemyKing.Row) + abs(ownKing.Col-enemyKing.Col)
+	return MOP_UP_EDGE_WEIGHT*centerDistance(*enemyKing) + MOP_UP_KING_DISTANCE*(14-kingDistance)
+}
+
+// hasMatingMaterial reports whether these pieces (besides the king) can force
+// mate against a bare king
+func hasMatingMaterial(pieces []PieceType) bool {
+	bishops, knights := 0, 0
+	for _, pieceType := range pieces {
+		switch pieceType {
+		case Queen, Rook, Pawn:
+			return true
+		case Bishop:
+			bishops++
+		case Knight:
+			knights++
+		}
+	}
+	return bishops >= 2 || (bishops >= 1 && knights >= 1)
+}
+
+// centerDistance is how many king steps along rows plus columns separate pos
+// from the central four squares, 0 in the centre up to 6 in a corner
+func centerDistance(pos Position) int {
+	return max(3-pos.Row, pos.Row-4) + max(3-pos.Col, pos.Col-4)
+}
+
+// evaluateMobility weighs how many squares each knight, bishop, rook and queen
+// could move to. Pins and checks are ignored, which keeps it far cheaper than
+// generating legal moves at every leaf.
+func (ai *AIService) evaluateMobility(game *ChessGame, color Color) int {
+	mobility := 0
+	for i := 0; i < 8; i++ {
+		for j := 0; j < 8; j++ {
+			piece := game.Board[i][j]
+			if piece == nil || piece.Color != color {
+				continue
+			}
+			if weight, ok := mobilityWeights[piece.Type]; ok {
+				mobility += weight * pieceMobility(game, Position{i, j}, piece)
+			}
+		}
+	}
+	return mobility
+}
+
+// pieceMobility counts the empty or enemy-occupied squares a piece attacks
+func pieceMobility(game *ChessGame, from Position, piece *Piece) int {
+	count := 0
+	game.forEachAttackedSquare(from, piece, func(pos Position) {
+		if target := game.Board[pos.Row][pos.Col]; target == nil || target.Color != piece.Color {
+			count++
+		}
+	})
+	return count
+}
+
+func (ai *AIService) evaluateKingSafety(kingPos Position, color Color, game *ChessGame, phase int) int {
 	safety := 0
 
 	// Penalty for king in center during middlegame
@@ -415,13 +1288,56 @@ func (ai *AIService) evaluateKingSafety(kingPos Position, color Color, game *Che
 
 		if inBounds(Position{checkRow, checkCol}) {
 			piece := game.Board[checkRow][checkCol]
+			if piece != nil && piece.Type == Pawn && piece.Color == color {
+				pawnShield += 2
+				continue
+			}
+		}
+		// A shield pawn pushed one square further still shelters a little
+		if inBounds(Position{checkRow + direction, checkCol}) {
+			piece := game.Board[checkRow+direction][checkCol]
 			if piece != nil && piece.Type == Pawn && piece.Color == color {
 				pawnShield++
 			}
 		}
 	}
 
-	safety += pawnShield * 10
+	safety += pawnShield * 5
+
+	// Files around the king without a friendly pawn give enemy pieces a line
+	// to it, and enemy pawns coming down them pry the shelter open. Both only
+	// matter while there are pieces left to attack with.
+	danger := 0
+	for col := max(0, kingPos.Col-1); col <= min(7, kingPos.Col+1); col++ {
+		ownPawn, enemyPawn := false, false
+		stormDistance := 8
+		for row := 0; row < 8; row++ {
+			piece := game.Board[row][col]
+			if piece == nil || piece.Type != Pawn {
+				continue
+			}
+			if piece.Color == color {
+				ownPawn = true
+				continue
+			}
+			enemyPawn = true
+			// Only pawns still in front of the king can storm it
+			if distance := (row - kingPos.Row) * direction; distance > 0 {
+				stormDistance = min(stormDistance, distance)
+			}
+		}
+
+		switch {
+		case !ownPawn && !enemyPawn:
+			danger += OPEN_FILE_PENALTY
+		case !ownPawn:
+			danger += HALF_OPEN_FILE_PENALTY
+		}
+		if stormDistance <= PAWN_STORM_RANGE {
+			danger += (PAWN_STORM_RANGE + 1 - stormDistance) * PAWN_STORM_PENALTY
+		}
+	}
+	safety -= taper(danger, 0, phase)
 
 	return safety
 }
@@ -430,47 +1346,141 @@ func (ai *AIService) evaluateKingSafety(kingPos Position, color Color, game *Che
 // AI SERVICE METHODS
 // ============================================================================
 
+// AIMoveOptions adjust one move the AI makes in the live game
+type AIMoveOptions struct {
+	ThinkTime    time.Duration // Replaces the think-time cap for this move when above 0
+	Alternatives int           // How many of the AI's ranked candidates to return with the move
+	Progress     ProgressFunc
+}
+
 func (ai *AIService) MakeAIMove(ctx context.Context, chessService *ChessService) (*GameResponse, error) {
-	if chessService.game.GameOver {
+	return ai.MakeAIMoveWithOptions(ctx, chessService, AIMoveOptions{})
+}
+
+// MakeAIMoveWithOptions searches for the AI's move in the live game and plays
+// it. The search can be stopped through the game's service, and how it went
+// is kept for the stats.
+func (ai *AIService) MakeAIMoveWithOptions(ctx context.Context, chessService *ChessService, opts AIMoveOptions) (*GameResponse, error) {
+	// The search works on a snapshot so requests for the game aren't held up
+	// while it thinks; the move is only played if the game is still the same
+	game, version := chessService.aiSnapshot()
+	if game.GameOver {
 		return nil, fmt.Errorf("game is over")
 	}
 
-	move, err := ai.GetBestMove(ctx, chessService.game)
+	// A time control can only make the AI move faster than its cap, the
+	// configured one or the move's own. The budget applies to this search alone.
+	thinkTime := opts.ThinkTime
+	if budget := game.TimeControl.moveBudget(); budget > 0 {
+		limit := thinkTime
+		if limit == 0 {
+			limit = ai.GetMaxThinkingTime()
+		}
+		if limit == 0 || budget < limit {
+			thinkTime = budget
+		}
+	}
+
+	ctx, live := chessService.startAISearch(ctx)
+	defer live.finish()
+
+	result, err := ai.Search(ctx, game, SearchOptions{ThinkTime: thinkTime, Progress: func(p SearchProgress) {
+		live.progress(p.BestMove)
+		if opts.Progress != nil {
+			opts.Progress(p)
+		}
+	}})
 	if err != nil {
 		return nil, fmt.Errorf("failed to get AI move: %w", err)
 	}
 
-	if move == nil {
-		return nil, fmt.Errorf("no valid AI moves available")
+	ai.statsLock.Lock()
+	ai.lastMove = result.SearchStats
+	ai.statsLock.Unlock()
+
+	response, err := chessService.applyAIMove(version, func() error {
+		// Book and forced moves come without a search score and leave the count alone
+		if result.Depth > 0 && ai.shouldResign(chessService, result.Evaluation) {
+			chessService.game.Resign(chessService.aiColor)
+			slog.Info("AI resigned", "hopeless_moves", chessService.hopelessMoves)
+			return nil
+		}
+
+		if err := chessService.game.MakeMove(*result.Move); err != nil {
+			return fmt.Errorf("failed to execute AI move: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	response.AIThinkMs = result.ThinkTime.Milliseconds()
+	if opts.Alternatives > 0 {
+		response.Alternatives = result.Alternatives(opts.Alternatives)
 	}
+	return response, nil
+}
 
-	// Make the move
-	err = chessService.game.MakeMove(*move)
+// AcceptsDraw decides a draw offer to the AI playing aiColor: it agrees
+// when a short search finds it clearly worse, and declines otherwise or if
+// the search can't finish
+func (ai *AIService) AcceptsDraw(ctx context.Context, game *ChessGame, aiColor Color) bool {
+	evaluation, err := ai.analysisWorker(0).SearchEvaluation(ctx, game.CopyState(), DRAW_OFFER_DEPTH)
 	if err != nil {
-		return nil, fmt.Errorf("failed to execute AI move: %w", err)
+		return false
+	}
+	if aiColor == White {
+		evaluation = -evaluation
 	}
+	return evaluation <= -DRAW_ACCEPT_THRESHOLD
+}
 
-	// Return updated game state
-	response := chessService.GetGameState()
-	response.LastMove = move
-	return response, nil
+// shouldResign counts the AI's searches in a row that found it hopelessly
+// behind and reports whether the resignation policy's limit is reached.
+// evaluation is Black-positive, like every search score. The caller holds
+// the service's lock.
+func (ai *AIService) shouldResign(chessService *ChessService, evaluation int) bool {
+	if chessService.aiColor == White {
+		evaluation = -evaluation
+	}
+	policy := ai.GetResignPolicy()
+	if !policy.Enabled || evaluation > -policy.Threshold {
+		chessService.hopelessMoves = 0
+		return false
+	}
+	chessService.hopelessMoves++
+	return chessService.hopelessMoves >= policy.Moves
 }
 
-func (ai *AIService) GetStats() map[string]interface{} {
+func (ai *AIService) GetStats() *StatsResponse {
 	difficulty := ai.getDifficultyString()
-	
-	return map[string]interface{}{
-		"engine":           "Minimax with Alpha-Beta Pruning",
-		"depth":            ai.depth,
-		"difficulty":       difficulty,
-		"timeout":          MAX_THINKING_TIME.String(),
-		"nodes_searched":   ai.nodesSearched,
-		"last_think_time":  ai.lastThinkingTime.String(),
+	ai.statsLock.Lock()
+	last := ai.lastMove
+	ai.statsLock.Unlock()
+
+	ai.configLock.RLock()
+	defer ai.configLock.RUnlock()
+	return &StatsResponse{
+		Engine:        "Minimax with Alpha-Beta Pruning",
+		Depth:         ai.settings.Depth,
+		Difficulty:    difficulty,
+		Timeout:       ai.limits.MaxThinkingTime.String(),
+		MinResponse:   ai.minResponseTime.String(),
+		MaxDepth:      ai.limits.MaxDepth,
+		MaxNodes:      ai.limits.MaxNodes,
+		NodesSearched: last.Nodes,
+		LastThinkTime: last.ThinkTime.String(),
+		LastForced:    last.Forced,
+		Settings:      ai.settings,
+		EvalMode:      ai.evalMode,
+		Style:         ai.style,
+		Resign:        ai.resign,
+		EvalCache:     ai.evalCache.stats(),
 	}
 }
 
 func (ai *AIService) getDifficultyString() string {
-	switch ai.depth {
+	switch ai.GetDepth() {
 	case 1, 2:
 		return "Easy"
 	case 3, 4:
@@ -484,32 +1494,257 @@ func (ai *AIService) getDifficultyString() string {
 	}
 }
 
+// SetDifficulty swaps in the whole preset for a level, so depth, randomness,
+// quiescence and book usage always change together
 func (ai *AIService) SetDifficulty(level string) error {
-	switch level {
-	case "easy", "Easy":
-		ai.depth = 2
-	case "medium", "Medium":
-		ai.depth = 4
-	case "hard", "Hard":
-		ai.depth = 6
-	case "expert", "Expert":
-		ai.depth = 8
-	default:
-		return fmt.Errorf("invalid difficulty level: %s (use easy/medium/hard/expert)", level)
+	settings, err := ai.difficultySettings(level, nil)
+	if err != nil {
+		return err
 	}
+	ai.setSettings(settings)
 	return nil
 }
 
 func (ai *AIService) SetDepth(depth int) error {
-	if depth < 1 || depth > 10 {
-		return fmt.Errorf("depth must be between 1 and 10, got %d", depth)
+	settings, err := ai.difficultySettings("", &depth)
+	if err != nil {
+		return err
 	}
-	ai.depth = depth
+	ai.setSettings(settings)
+	return nil
+}
+
+// difficultySettings works out the settings a difficulty preset (if given)
+// followed by a depth (if given) would leave, without applying them, so a
+// caller can check them alongside other options first
+func (ai *AIService) difficultySettings(level string, depth *int) (AISettings, error) {
+	ai.configLock.RLock()
+	defer ai.configLock.RUnlock()
+
+	settings := ai.settings
+	if level != "" {
+		preset, ok := difficultyPresets[strings.ToLower(level)]
+		if !ok {
+			return settings, fmt.Errorf("invalid difficulty level: %s (use easy/medium/hard/expert)", level)
+		}
+		preset.Depth = min(preset.Depth, ai.limits.MaxDepth)
+		settings = preset
+	}
+	if depth != nil {
+		if *depth < 1 || *depth > ai.limits.MaxDepth {
+			return settings, fmt.Errorf("depth must be between 1 and %d, got %d", ai.limits.MaxDepth, *depth)
+		}
+		settings.Depth = *depth
+	}
+	return settings, nil
+}
+
+func (ai *AIService) setSettings(settings AISettings) {
+	ai.configLock.Lock()
+	defer ai.configLock.Unlock()
+	ai.settings = settings
+}
+
+// SetEvaluator replaces the built-in evaluation; nil restores it. Scores
+// cached under the previous evaluator are dropped.
+func (ai *AIService) SetEvaluator(evaluator Evaluator) {
+	if evaluator == nil {
+		evaluator = classicalEvaluator{ai}
+	}
+	ai.configLock.Lock()
+	defer ai.configLock.Unlock()
+	ai.evaluator = evaluator
+	ai.evalCache = newEvalCache(EVAL_CACHE_SIZE)
+}
+
+// shareEvaluator hands a custom evaluator on to a worker service. The built-in
+// one stays bound to its own service's mode and weights. The caller holds the
+// configuration lock or works on a snapshot.
+func (ai *AIService) shareEvaluator(worker *AIService) {
+	if _, builtIn := ai.evaluator.(classicalEvaluator); !builtIn {
+		worker.evaluator = ai.evaluator
+	}
+}
+
+func (ai *AIService) SetEvalMode(mode string) error {
+	switch EvalMode(mode) {
+	case EvalFull, EvalMaterial, EvalPositional:
+		ai.configLock.Lock()
+		defer ai.configLock.Unlock()
+		ai.evalMode = EvalMode(mode)
+	default:
+		return fmt.Errorf("invalid eval mode: %s (use full/material/positional)", mode)
+	}
+	return nil
+}
+
+func (ai *AIService) SetStyle(style string) error {
+	style = strings.ToLower(style)
+	if _, ok := stylePresets[style]; !ok {
+		return fmt.Errorf("invalid style: %s (use aggressive/balanced/defensive)", style)
+	}
+	ai.configLock.Lock()
+	defer ai.configLock.Unlock()
+	ai.style = style
+	return nil
+}
+
+func (ai *AIService) GetStyle() string {
+	ai.configLock.RLock()
+	defer ai.configLock.RUnlock()
+	return ai.style
+}
+
+// SetResignPolicy replaces the resignation policy. A zero Threshold or Moves
+// takes the default.
+func (ai *AIService) SetResignPolicy(policy ResignPolicy) error {
+	if policy.Threshold == 0 {
+		policy.Threshold = RESIGN_THRESHOLD
+	}
+	if policy.Moves == 0 {
+		policy.Moves = RESIGN_MOVES
+	}
+	if policy.Threshold < 0 || policy.Threshold > MAX_EVAL {
+		return fmt.Errorf("resign threshold must be between 1 and %d, got %d", MAX_EVAL, policy.Threshold)
+	}
+	if policy.Moves < 0 || policy.Moves > MAX_RESIGN_MOVES {
+		return fmt.Errorf("resign moves must be between 1 and %d, got %d", MAX_RESIGN_MOVES, policy.Moves)
+	}
+	ai.configLock.Lock()
+	defer ai.configLock.Unlock()
+	ai.resign = policy
+	return nil
+}
+
+func (ai *AIService) GetResignPolicy() ResignPolicy {
+	ai.configLock.RLock()
+	defer ai.configLock.RUnlock()
+	return ai.resign
+}
+
+func (ai *AIService) SetCheckExtension(plies int) error {
+	if plies < 0 || plies > MAX_CHECK_EXTENSION {
+		return fmt.Errorf("check extension must be between 0 and %d, got %d", MAX_CHECK_EXTENSION, plies)
+	}
+	ai.configLock.Lock()
+	defer ai.configLock.Unlock()
+	ai.settings.CheckExtension = plies
+	return nil
+}
+
+// SetRecaptureExtension sets the quarter plies a recapture adds to the search
+func (ai *AIService) SetRecaptureExtension(quarters int) error {
+	if quarters < 0 || quarters > MAX_RECAPTURE_EXTENSION {
+		return fmt.Errorf("recapture extension must be between 0 and %d quarter plies, got %d", MAX_RECAPTURE_EXTENSION, quarters)
+	}
+	ai.configLock.Lock()
+	defer ai.configLock.Unlock()
+	ai.settings.RecaptureExtension = quarters
 	return nil
 }
 
 func (ai *AIService) GetDepth() int {
-	return ai.depth
+	ai.configLock.RLock()
+	defer ai.configLock.RUnlock()
+	return ai.settings.Depth
+}
+
+// SetLimits applies operator-configured search limits, pulling the current
+// depth down if it is now over the cap
+func (ai *AIService) SetLimits(limits AILimits) {
+	ai.configLock.Lock()
+	defer ai.configLock.Unlock()
+	ai.limits = limits
+	ai.settings.Depth = min(ai.settings.Depth, limits.MaxDepth)
+}
+
+// SetMaxThinkingTime changes the per-search time cap; 0 removes it so deep
+// analysis runs until its depth is done or the caller's context ends
+func (ai *AIService) SetMaxThinkingTime(d time.Duration) error {
+	if d < 0 {
+		return fmt.Errorf("max thinking time must not be negative, got %v", d)
+	}
+	ai.configLock.Lock()
+	defer ai.configLock.Unlock()
+	ai.limits.MaxThinkingTime = d
+	return nil
+}
+
+func (ai *AIService) GetMaxThinkingTime() time.Duration {
+	ai.configLock.RLock()
+	defer ai.configLock.RUnlock()
+	return ai.limits.MaxThinkingTime
+}
+
+// LastMove reports how the AI found its last move in the live game
+func (ai *AIService) LastMove() SearchStats {
+	ai.statsLock.Lock()
+	defer ai.statsLock.Unlock()
+	return ai.lastMove
+}
+
+// SetMinResponseTime sets how long a reply to the player takes at least, so
+// quick moves don't feel instant; 0 turns the padding off
+func (ai *AIService) SetMinResponseTime(d time.Duration) error {
+	if d < 0 || d > MAX_MIN_RESPONSE_TIME {
+		return fmt.Errorf("min response time must be between 0 and %v, got %v", MAX_MIN_RESPONSE_TIME, d)
+	}
+	ai.configLock.Lock()
+	defer ai.configLock.Unlock()
+	ai.minResponseTime = d
+	return nil
+}
+
+func (ai *AIService) GetMinResponseTime() time.Duration {
+	ai.configLock.RLock()
+	defer ai.configLock.RUnlock()
+	return ai.minResponseTime
+}
+
+// PadResponse waits until the min response time has passed since start, but
+// never past ctx's deadline and not at all once ctx is done. start should come
+// from Now so both are read off the same clock.
+func (ai *AIService) PadResponse(ctx context.Context, start time.Time) {
+	ai = ai.snapshot()
+	remaining := ai.minResponseTime - ai.clock.Since(start)
+	if deadline, ok := ctx.Deadline(); ok && deadline.Sub(ai.clock.Now()) < remaining {
+		remaining = deadline.Sub(ai.clock.Now())
+	}
+	if remaining <= 0 {
+		return
+	}
+
+	timer := ai.clock.NewTimer(remaining)
+	defer timer.Stop()
+	select {
+	case <-timer.C():
+	case <-ctx.Done():
+	}
+}
+
+// Now is the time on the AI's clock
+func (ai *AIService) Now() time.Time {
+	ai.configLock.RLock()
+	defer ai.configLock.RUnlock()
+	return ai.clock.Now()
+}
+
+// SetClock replaces the clock the AI times itself with
+func (ai *AIService) SetClock(clock Clock) {
+	ai.configLock.Lock()
+	defer ai.configLock.Unlock()
+	ai.clock = clock
+}
+
+// SetSeed makes book choices and evaluation noise reproducible
+func (ai *AIService) SetSeed(seed int64) {
+	ai.rng.seed(seed)
+}
+
+func (ai *AIService) GetSettings() AISettings {
+	ai.configLock.RLock()
+	defer ai.configLock.RUnlock()
+	return ai.settings
 }
 
 // ============================================================================
@@ -0,0 +1,1048 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// searchMove finds ai's move in fen at depth
+func searchMove(t *testing.T, ai *AIService, fen string, depth int) Move {
+	t.Helper()
+	game, err := LoadFEN(fen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ai.SetDepth(depth); err != nil {
+		t.Fatal(err)
+	}
+	move, err := ai.GetBestMove(context.Background(), game)
+	if err != nil || move == nil {
+		t.Fatalf("no move for %s: %v", fen, err)
+	}
+	return *move
+}
+
+func TestRecaptureExtensionResolvesExchange(t *testing.T) {
+	// Rxd5 wins a pawn: after Rxd5 Rxd5 the second rook takes back. At depth
+	// 2 without quiescence a plain search stops after Black's recapture and
+	// thinks the rook is lost. Check extensions are off so rook checks on
+	// the g-file don't get searched deeper than the exchange.
+	const fen = "3r2k1/8/8/3p4/8/8/3R4/3R2K1 w - - 0 1"
+	capture := Move{From: Position{6, 3}, To: Position{3, 3}}
+
+	plain := NewAIService()
+	plain.SetCheckExtension(0)
+	if move := searchMove(t, plain, fen, 2); move.From == capture.From && move.To == capture.To {
+		t.Fatal("without the extension the search shouldn't see through the exchange")
+	}
+
+	extended := NewAIService()
+	extended.SetCheckExtension(0)
+	if err := extended.SetRecaptureExtension(MAX_RECAPTURE_EXTENSION); err != nil {
+		t.Fatal(err)
+	}
+	if move := searchMove(t, extended, fen, 2); move.From != capture.From || move.To != capture.To {
+		t.Errorf("got %s, want Rxd5", moveCoordinates(move))
+	}
+}
+
+func TestRecaptureExtensionOffByDefault(t *testing.T) {
+	if got := NewAIService().GetSettings().RecaptureExtension; got != 0 {
+		t.Errorf("default recapture extension is %d quarter plies, want 0", got)
+	}
+	for name, preset := range difficultyPresets {
+		if preset.RecaptureExtension != 0 {
+			t.Errorf("%s preset turns the recapture extension on", name)
+		}
+	}
+}
+
+func TestSetRecaptureExtensionBounds(t *testing.T) {
+	ai := NewAIService()
+	if err := ai.SetRecaptureExtension(-1); err == nil {
+		t.Error("negative extension accepted")
+	}
+	if err := ai.SetRecaptureExtension(MAX_RECAPTURE_EXTENSION + 1); err == nil {
+		t.Error("extension above the maximum accepted")
+	}
+}
+
+// TestCheckExtensionFindsSmotheredMate plays Philidor's legacy: Nf7+ Kg8
+// Nh6+ Kh8 Qg8+ Rxg8 Nf7#. Seven plies is past a plain depth 4, but every
+// Black move in it is a reply to check.
+func TestCheckExtensionFindsSmotheredMate(t *testing.T) {
+	const fen = "4rb1k/6pp/8/6N1/2Q5/8/8/6K1 w - - 0 1"
+	for extension := 0; extension <= 1; extension++ {
+		ai := NewAIService()
+		if err := ai.SetCheckExtension(extension); err != nil {
+			t.Fatal(err)
+		}
+		score, err := ai.snapshot().newSearch(context.Background(), 0).fixedDepth(mustLoadFEN(t, fen), 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found := isMateScore(score) && score < 0; found != (extension > 0) {
+			t.Errorf("depth 4 with a %d ply check extension scores %d", extension, score)
+		}
+	}
+
+	ai := NewAIService()
+	if err := ai.SetCheckExtension(1); err != nil {
+		t.Fatal(err)
+	}
+	if san := mustLoadFEN(t, fen).MoveToSAN(searchMove(t, ai, fen, 4)); san != "Nf7+" {
+		t.Errorf("got %s, want Nf7+", san)
+	}
+}
+
+func TestSetCheckExtensionBounds(t *testing.T) {
+	ai := NewAIService()
+	if err := ai.SetCheckExtension(-1); err == nil {
+		t.Error("negative extension accepted")
+	}
+	if err := ai.SetCheckExtension(MAX_CHECK_EXTENSION + 1); err == nil {
+		t.Error("extension above the maximum accepted")
+	}
+}
+
+func TestLateMoveReduction(t *testing.T) {
+	const fen = "4k3/1P6/8/8/p7/8/8/R5K1 w - - 0 1"
+	tests := []struct {
+		name    string
+		san     string
+		index   int
+		depth   int
+		inCheck bool
+		want    int
+	}{
+		{"late quiet move", "Kg2", LMR_FULL_DEPTH_MOVES, LMR_MIN_DEPTH, false, LMR_REDUCTION},
+		{"early in the ordering", "Kg2", LMR_FULL_DEPTH_MOVES - 1, LMR_MIN_DEPTH, false, 0},
+		{"close to the horizon", "Kg2", LMR_FULL_DEPTH_MOVES, LMR_MIN_DEPTH - 1, false, 0},
+		{"side to move in check", "Kg2", LMR_FULL_DEPTH_MOVES, LMR_MIN_DEPTH, true, 0},
+		{"capture", "Rxa4", LMR_FULL_DEPTH_MOVES, LMR_MIN_DEPTH, false, 0},
+		{"promotion", "b8=N", LMR_FULL_DEPTH_MOVES, LMR_MIN_DEPTH, false, 0},
+		{"check", "Re1+", LMR_FULL_DEPTH_MOVES, LMR_MIN_DEPTH, false, 0},
+	}
+	for _, tt := range tests {
+		before := mustLoadFEN(t, fen)
+		move, err := before.parseSAN(tt.san)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		after := before.CopyState()
+		if err := after.MakeMove(move); err != nil {
+			t.Fatal(err)
+		}
+		if got := lateMoveReduction(before, after, move, tt.index, tt.depth, tt.inCheck); got != tt.want {
+			t.Errorf("%s: reduced by %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestReductionsKeepTactics checks reduced searches still find the mates a
+// full-width depth 4 does
+func TestReductionsKeepTactics(t *testing.T) {
+	tests := []struct {
+		name string
+		fen  string
+		want string
+	}{
+		{"scholar's mate", "r1bqkb1r/pppp1ppp/2n2n2/4p2Q/2B1P3/8/PPPP1PPP/RNB1K1NR w KQkq - 4 4", "Qxf7#"},
+		{"back rank", "6k1/5ppp/8/8/8/8/8/3R2K1 w - - 0 1", "Rd8#"},
+		{"smothered mate", "4rb1k/6pp/8/6N1/2Q5/8/8/6K1 w - - 0 1", "Nf7+"},
+	}
+	ai := NewAIService()
+	if err := ai.SetCheckExtension(1); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		if san := mustLoadFEN(t, tt.fen).MoveToSAN(searchMove(t, ai, tt.fen, 4)); san != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, san, tt.want)
+		}
+	}
+}
+
+func TestConcurrentSearchesKeepTheirOwnState(t *testing.T) {
+	fens := []string{
+		"rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1",
+		"r3k2r/p1ppqpb1/bn2pnp1/3PN3/1p2P3/2N2Q1p/PPPBBPPP/R3K2R w KQkq - 0 1",
+		"8/2p5/3p4/KP5r/1R3p1k/8/4P1P1/8 w - - 0 1",
+		"r1bq1rk1/pp2bppp/2n1pn2/3p4/2PP4/2N1PN2/PP3PPP/R2QKB1R b KQ - 0 8",
+	}
+	ai := NewAIService()
+	search := func(fen string, depth int) *SearchResult {
+		result, err := ai.Search(context.Background(), mustLoadFEN(t, fen), SearchOptions{Depth: depth, NoTimeLimit: true})
+		if err != nil {
+			t.Error(err)
+			return nil
+		}
+		return result
+	}
+
+	alone := make([]*SearchResult, len(fens))
+	for i, fen := range fens {
+		alone[i] = search(fen, i%3+2)
+	}
+
+	together := make([]*SearchResult, len(fens))
+	var wg sync.WaitGroup
+	for i, fen := range fens {
+		wg.Add(1)
+		go func(i int, fen string) {
+			defer wg.Done()
+			together[i] = search(fen, i%3+2)
+		}(i, fen)
+	}
+	wg.Wait()
+
+	for i, fen := range fens {
+		a, b := alone[i], together[i]
+		if a == nil || b == nil {
+			continue
+		}
+		if b.Depth != i%3+2 || b.Nodes != a.Nodes || b.Evaluation != a.Evaluation || *b.Move != *a.Move {
+			t.Errorf("%s: searched alongside others got %+v, alone %+v", fen, b.SearchStats, a.SearchStats)
+		}
+		game := mustLoadFEN(t, fen)
+		for _, alternative := range b.Alternatives(MAX_AI_ALTERNATIVES) {
+			if !game.IsValidMove(alternative.Move) {
+				t.Errorf("%s: alternative %s belongs to another search", fen, alternative.UCI)
+			}
+		}
+	}
+}
+
+func TestSearchOptionsLeaveConfigurationAlone(t *testing.T) {
+	ai := NewAIService()
+	if err := ai.SetDepth(2); err != nil {
+		t.Fatal(err)
+	}
+	result, err := ai.Search(context.Background(), NewChessGame(), SearchOptions{Depth: 3, NoTimeLimit: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Depth != 3 || result.ThinkLimit != 0 {
+		t.Errorf("options not applied: %+v", result.SearchStats)
+	}
+	if ai.GetDepth() != 2 || ai.GetMaxThinkingTime() != MAX_THINKING_TIME {
+		t.Errorf("search changed the service: depth %d, think time %v", ai.GetDepth(), ai.GetMaxThinkingTime())
+	}
+}
+
+func TestTimeControlBudgetIsPerMove(t *testing.T) {
+	cs := NewChessService()
+	tc := &TimeControl{InitialMs: 60000, IncrementMs: 2000}
+	if _, err := cs.NewGame(NewGameRequest{HumanColor: Black, TimeControl: tc}); err != nil {
+		t.Fatal(err)
+	}
+	ai := NewAIService()
+	if err := ai.SetDepth(1); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ai.MakeAIMove(context.Background(), cs); err != nil {
+		t.Fatal(err)
+	}
+	if got := ai.LastMove().ThinkLimit; got != tc.moveBudget() {
+		t.Errorf("move searched under a %v cap, want the %v budget", got, tc.moveBudget())
+	}
+	if got := ai.GetMaxThinkingTime(); got != MAX_THINKING_TIME {
+		t.Errorf("budget leaked into the AI's think time: %v", got)
+	}
+}
+
+func TestStyleWeightsStayWithTheirSearch(t *testing.T) {
+	const fen = "r1bq1rk1/pp2bppp/2n1pn2/3p4/2PP4/2N1PN2/PP3PPP/R2QKB1R b KQ - 0 8"
+	neutral := NewAIService().Evaluate(mustLoadFEN(t, fen))
+
+	ai := NewAIService()
+	if err := ai.SetStyle("aggressive"); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ai.Search(context.Background(), NewChessGame(), SearchOptions{Depth: 3, NoTimeLimit: true})
+	}()
+
+	// Only the search plays with the style; evaluations beside it stay neutral
+	for i := 0; i < 20; i++ {
+		if got := ai.snapshot().evaluatePosition(mustLoadFEN(t, fen)); got != neutral {
+			t.Fatalf("evaluation %d beside a styled search, want %d", got, neutral)
+		}
+	}
+	<-done
+	if got := ai.Evaluate(mustLoadFEN(t, fen)); got != neutral {
+		t.Errorf("evaluation %d after a styled search, want %d", got, neutral)
+	}
+}
+
+func TestResignStopsOnlyTheGameSearch(t *testing.T) {
+	cs := NewChessService()
+	if _, err := cs.NewGame(NewGameRequest{HumanColor: Black}); err != nil {
+		t.Fatal(err)
+	}
+	ai := NewAIService()
+	ai.SetMaxThinkingTime(0)
+	if err := ai.SetDepth(MAX_DEPTH); err != nil {
+		t.Fatal(err)
+	}
+
+	analysisCtx, stopAnalysis := context.WithCancel(context.Background())
+	defer stopAnalysis()
+	analysisDone := make(chan struct{})
+	go func() {
+		defer close(analysisDone)
+		ai.Search(analysisCtx, NewChessGame(), SearchOptions{NoTimeLimit: true})
+	}()
+
+	moveErr := make(chan error)
+	go func() {
+		_, err := ai.MakeAIMove(context.Background(), cs)
+		moveErr <- err
+	}()
+	for searching := false; !searching; {
+		cs.mu.Lock()
+		searching = cs.aiSearch != nil
+		cs.mu.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err := cs.Resign(Black); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-moveErr:
+		if !errors.Is(err, errGameChanged) {
+			t.Errorf("got %v, want the move dropped", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("resigning didn't stop the game's search")
+	}
+	select {
+	case <-analysisDone:
+		t.Error("resigning stopped an analysis search")
+	default:
+	}
+}
+
+func TestSearchEvaluationIsWithoutNoise(t *testing.T) {
+	ai := NewAIService()
+	ai.SetSeed(7)
+	settings := ai.GetSettings()
+	settings.Randomness = 300
+	ai.setSettings(settings)
+
+	const fen = "r1bq1rk1/pp2bppp/2n1pn2/3p4/2PP4/2N1PN2/PP3PPP/R2QKB1R b KQ - 0 8"
+	for i := 0; i < 5; i++ {
+		result, err := ai.Search(context.Background(), mustLoadFEN(t, fen), SearchOptions{Depth: 2, NoTimeLimit: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, candidate := range result.Alternatives(MAX_AI_ALTERNATIVES * 10) {
+			if candidate.Move == *result.Move && candidate.Evaluation != result.Evaluation {
+				t.Errorf("%s scored %d, search reported %d", candidate.UCI, candidate.Evaluation, result.Evaluation)
+			}
+		}
+	}
+}
+
+func TestResignationIgnoresNoise(t *testing.T) {
+	cs := NewChessService()
+	if _, err := cs.NewGame(NewGameRequest{HumanColor: Black, StartingFEN: "k7/8/8/8/8/8/8/qr5K w - - 0 1"}); err != nil {
+		t.Fatal(err)
+	}
+	ai := NewAIService()
+	ai.SetSeed(1)
+	settings := ai.GetSettings()
+	settings.Depth = 2
+	settings.Randomness = 100000 // Enough noise to make any move look winning
+	ai.setSettings(settings)
+	if err := ai.SetResignPolicy(ResignPolicy{Enabled: true, Threshold: 500, Moves: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	response, err := ai.MakeAIMove(context.Background(), cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.EndReason != "resignation" {
+		t.Errorf("a rook and queen down the AI played on: %+v", response.EndReason)
+	}
+}
+
+// TestSearchesDuringConfigChanges runs searches while every setter changes the
+// configuration under them. Run with -race.
+func TestSearchesDuringConfigChanges(t *testing.T) {
+	ai := NewAIService()
+	game := mustLoadFEN(t, "r1bq1rk1/pp2bppp/2n1pn2/3p4/2PP4/2N1PN2/PP3PPP/R2QKB1R b KQ - 0 8")
+
+	done := make(chan struct{})
+	var setters sync.WaitGroup
+	setters.Add(1)
+	go func() {
+		defer setters.Done()
+		styles := []string{"aggressive", "balanced", "defensive"}
+		modes := []EvalMode{EvalFull, EvalMaterial, EvalPositional}
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			ai.SetStyle(styles[i%len(styles)])
+			ai.SetEvalMode(string(modes[i%len(modes)]))
+			ai.SetDepth(1 + i%3)
+			ai.SetDifficulty([]string{"easy", "medium", "hard"}[i%3])
+			ai.SetCheckExtension(i % 2)
+			ai.SetRecaptureExtension(i % 3)
+			ai.SetMaxThinkingTime(time.Duration(20+i%20) * time.Millisecond)
+			ai.SetMinResponseTime(0)
+			ai.SetResignPolicy(ResignPolicy{})
+			ai.SetSeed(int64(i))
+			ai.SetEvaluator(nil)
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	var searches sync.WaitGroup
+	for worker := 0; worker < 4; worker++ {
+		searches.Add(1)
+		go func(game *ChessGame) {
+			defer searches.Done()
+			for i := 0; i < 2; i++ {
+				move, err := ai.GetBestMove(context.Background(), game)
+				if err != nil || move == nil || !game.IsValidMove(*move) {
+					t.Errorf("search during config changes: %v, %v", move, err)
+				}
+				if _, err := ai.SearchEvaluation(context.Background(), game, 1); err != nil {
+					t.Error(err)
+				}
+				ai.LastMove()
+				ai.GetStats()
+			}
+		}(game.CopyState())
+	}
+	searches.Wait()
+	close(done)
+	setters.Wait()
+}
+
+func TestBishopPinsKnightToKing(t *testing.T) {
+	game := mustLoadFEN(t, "4k3/8/2n5/1B6/8/8/8/4K3 b - - 0 1")
+	if pinned := game.PinnedPieces(Black); len(pinned) != 1 || pinned[0] != (Position{2, 2}) {
+		t.Fatalf("pinned %v, want the knight on c6", pinned)
+	}
+	for _, move := range game.LegalMoves() {
+		if move.From == (Position{2, 2}) {
+			t.Errorf("pinned knight can play %v", move)
+		}
+	}
+	if got := evaluatePins(game); got != -PIN_PENALTY {
+		t.Errorf("pin scored %d, want %d against Black", got, -PIN_PENALTY)
+	}
+
+	// Two pieces in the way, or a pin each, and nothing is owed
+	for _, fen := range []string{
+		"4k3/3p4/2n5/1B6/8/8/8/4K3 b - - 0 1",
+		"4k3/8/2n5/1B6/1b6/2N5/8/4K3 b - - 0 1",
+	} {
+		if got := evaluatePins(mustLoadFEN(t, fen)); got != 0 {
+			t.Errorf("%s: pins scored %d, want 0", fen, got)
+		}
+	}
+}
+
+// evalInMode scores game with a fresh service set to mode
+func evalInMode(t *testing.T, mode EvalMode, game *ChessGame) int {
+	t.Helper()
+	ai := NewAIService()
+	if err := ai.SetEvalMode(string(mode)); err != nil {
+		t.Fatal(err)
+	}
+	return ai.snapshot().evaluatePosition(game)
+}
+
+func TestMaterialModeIgnoresPlacement(t *testing.T) {
+	// Black is a knight up in both; only where everything stands differs
+	fens := []string{
+		"r1bqkbnr/pppppppp/2n5/8/8/8/PPPPPPPP/R1BQKBNR w KQkq - 0 1",
+		"r1bqkb1r/ppp2ppp/2n2n2/3pp3/8/3P1N2/PPP1PPPP/R1BQKB1R w KQkq - 0 1",
+		"r1bq1rk1/ppp2ppp/2n2n2/2bpp3/8/3P1N2/PPP1PPPP/R1BQKB1R w KQ - 0 1",
+	}
+	for _, fen := range fens {
+		game := mustLoadFEN(t, fen)
+		if got := evalInMode(t, EvalMaterial, game); got != pieceValues[Knight] {
+			t.Errorf("%s: material evaluation %d, want a knight (%d)", fen, got, pieceValues[Knight])
+		}
+	}
+	if evalInMode(t, EvalFull, mustLoadFEN(t, fens[0])) == evalInMode(t, EvalFull, mustLoadFEN(t, fens[1])) {
+		t.Error("full evaluation ignores placement too")
+	}
+}
+
+func TestEvalModesAddUpToFull(t *testing.T) {
+	for _, fen := range symmetryCheckFENs {
+		game := mustLoadFEN(t, fen)
+		material, positional, full := evalInMode(t, EvalMaterial, game), evalInMode(t, EvalPositional, game), evalInMode(t, EvalFull, game)
+		if material+positional != full {
+			t.Errorf("%s: material %d and positional %d don't add up to full %d", fen, material, positional, full)
+		}
+	}
+	if err := NewAIService().SetEvalMode("naked"); err == nil {
+		t.Error("unknown evaluation mode accepted")
+	}
+}
+
+// mateInOne reports whether the side to move can mate at once
+func mateInOne(game *ChessGame) bool {
+	for _, move := range game.LegalMoves() {
+		next := game.CopyState()
+		next.MakeMove(move)
+		if next.EndReason == "checkmate" {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLostPositionResistsLongest(t *testing.T) {
+	// Every king move loses, but Kc8 allows mate straight away
+	fen := "1K6/8/2k2q2/8/8/8/8/8 w - - 0 1"
+	move := searchMove(t, NewAIService(), fen, 4)
+	game := mustLoadFEN(t, fen)
+	if err := game.MakeMove(move); err != nil {
+		t.Fatal(err)
+	}
+	if mateInOne(game) {
+		t.Errorf("played %v, which allows mate in one", move)
+	}
+}
+
+func TestRootTieBreakPrefersForcingMoves(t *testing.T) {
+	game := mustLoadFEN(t, "3qk3/8/8/8/8/8/n2R4/4K3 w - - 0 1")
+	tieBreak := func(san string) int {
+		move, err := game.parseSAN(san)
+		if err != nil {
+			t.Fatal(err)
+		}
+		after := game.CopyState()
+		if err := after.MakeMove(move); err != nil {
+			t.Fatal(err)
+		}
+		return rootTieBreak(game, after, move)
+	}
+	quiet, check, capture, queenCapture := tieBreak("Rb2"), tieBreak("Re2+"), tieBreak("Rxa2"), tieBreak("Rxd8+")
+	if !(quiet < check && check < capture && capture < queenCapture) {
+		t.Errorf("tie-breaks quiet %d, check %d, knight capture %d, queen capture with check %d", quiet, check, capture, queenCapture)
+	}
+}
+
+func TestMobilityScore(t *testing.T) {
+	tests := []struct {
+		name string
+		fen  string
+		want int // White's mobility
+	}{
+		{"start: two squares per knight", "rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1", 2 * 2 * mobilityWeights[Knight]},
+		{"centralised knight", "4k3/8/8/8/3N4/8/8/4K3 w - - 0 1", 8 * mobilityWeights[Knight]},
+		{"rook stopped by its own king", "4k3/8/8/8/8/8/8/R3K3 w - - 0 1", 10 * mobilityWeights[Rook]},
+		{"rook counts the capture, not beyond", "4k3/8/8/8/n7/8/8/R3K3 w - - 0 1", 6 * mobilityWeights[Rook]},
+		{"queen in the corner", "4k3/8/8/8/8/8/8/Q3K3 w - - 0 1", 17 * mobilityWeights[Queen]},
+		{"pinned knight still counts", "4k3/8/8/8/1b6/2N5/8/4K3 w - - 0 1", 8 * mobilityWeights[Knight]},
+		{"kings and pawns have none", "4k3/8/8/8/8/8/4P3/4K3 w - - 0 1", 0},
+	}
+	ai := NewAIService().snapshot()
+	for _, tt := range tests {
+		if got := ai.evaluateMobility(mustLoadFEN(t, tt.fen), White); got != tt.want {
+			t.Errorf("%s: mobility %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMopUpDrivesBareKingToMate(t *testing.T) {
+	for _, fen := range []string{
+		"8/8/8/4k3/8/8/8/R3K3 w - - 0 1",
+		"8/8/8/3k4/8/8/8/4K1Q1 w - - 0 1",
+	} {
+		game := mustLoadFEN(t, fen)
+		attacker, defender := NewAIService(), NewAIService()
+		if err := attacker.SetDepth(3); err != nil {
+			t.Fatal(err)
+		}
+		if err := defender.SetDepth(2); err != nil {
+			t.Fatal(err)
+		}
+		for ply := 0; ply < 60 && !game.GameOver; ply++ {
+			ai := attacker
+			if game.CurrentTurn == Black {
+				ai = defender
+			}
+			move, err := ai.GetBestMove(context.Background(), game)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := game.MakeMove(*move); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if game.EndReason != "checkmate" || game.Winner != string(White) {
+			t.Errorf("%s: ended %q after %d half-moves at %s, want white to mate", fen, game.EndReason, len(game.MoveHistory), game.ToFEN())
+		}
+	}
+}
+
+func TestMopUpPrefersEdgeAndCloseKings(t *testing.T) {
+	ai := NewAIService().snapshot()
+	mopUp := func(fen string) int {
+		return ai.evaluateMopUp(mustLoadFEN(t, fen), White)
+	}
+	centre, edge, corner := mopUp("8/8/8/4k3/8/8/8/R3K3 w - - 0 1"), mopUp("4k3/8/8/8/8/8/8/R3K3 w - - 0 1"), mopUp("7k/8/8/8/8/8/8/R3K3 w - - 0 1")
+	if !(centre < edge && edge < corner) {
+		t.Errorf("bare king in the centre %d, on the edge %d, in the corner %d", centre, edge, corner)
+	}
+	if far, near := mopUp("4k3/8/8/8/8/8/8/R3K3 w - - 0 1"), mopUp("4k3/8/4K3/8/8/8/8/R7 w - - 0 1"); far >= near {
+		t.Errorf("kings far apart %d, close %d", far, near)
+	}
+	for _, fen := range []string{
+		"4k3/8/8/8/8/8/8/N3K3 w - - 0 1",  // a knight can't mate
+		"4k3/p7/8/8/8/8/8/R3K3 w - - 0 1", // not a bare king
+	} {
+		if got := mopUp(fen); got != 0 {
+			t.Errorf("%s: mop-up %d, want 0", fen, got)
+		}
+	}
+}
+
+// seededGame has an AI with book and noise play both sides from the start,
+// returning the moves played
+func seededGame(t *testing.T, seed int64) string {
+	t.Helper()
+	ai := NewAIService()
+	if err := ai.SetDifficulty("medium"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ai.SetDepth(2); err != nil {
+		t.Fatal(err)
+	}
+	ai.SetSeed(seed)
+
+	game := NewChessGame()
+	for ply := 0; ply < 16 && !game.GameOver; ply++ {
+		move, err := ai.GetBestMove(context.Background(), game)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := game.MakeMove(*move); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var moves []string
+	for _, move := range game.MoveHistory {
+		moves = append(moves, fmt.Sprint(move.From, move.To, move.Promotion))
+	}
+	return strings.Join(moves, " ")
+}
+
+func TestSameSeedSameGame(t *testing.T) {
+	first := seededGame(t, 1)
+	if again := seededGame(t, 1); again != first {
+		t.Errorf("same seed played\n%v\nthen\n%v", first, again)
+	}
+
+	differs := false
+	for seed := int64(2); seed < 6 && !differs; seed++ {
+		differs = seededGame(t, seed) != first
+	}
+	if !differs {
+		t.Error("every seed played the same game")
+	}
+}
+
+func TestSameSeedSameChess960Start(t *testing.T) {
+	start := func(seed int64) string {
+		service := NewChessService()
+		service.SetSeed(seed)
+		response, err := service.NewGame(NewGameRequest{Mode: ModePvP, Chess960: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response.FEN
+	}
+	if first, again := start(3), start(3); first != again {
+		t.Errorf("same seed started %s then %s", first, again)
+	}
+}
+
+// TestWinningSideAvoidsStalemate has a queen up play KQ vs K positions where
+// one queen move stalemates the bare king
+func TestWinningSideAvoidsStalemate(t *testing.T) {
+	tests := []struct {
+		fen       string
+		stalemate string
+	}{
+		{"k7/8/2K5/8/8/8/8/1Q6 w - - 0 1", "Qb6"},
+		{"7k/8/5K2/8/8/8/8/6Q1 w - - 0 1", "Qg6"},
+		// No mate in one here, so the stalemate is the only quick finish
+		{"k7/8/8/1K6/8/8/8/2Q5 w - - 0 1", "Qc7"},
+		{"1q6/8/8/8/8/2k5/8/K7 b - - 0 1", "Qb3"},
+	}
+	ai := NewAIService()
+	for _, tt := range tests {
+		for depth := 1; depth <= 4; depth++ {
+			move := searchMove(t, ai, tt.fen, depth)
+			if san := mustLoadFEN(t, tt.fen).MoveToSAN(move); san == tt.stalemate {
+				t.Errorf("%s: depth %d stalemates with %s", tt.fen, depth, san)
+			}
+		}
+	}
+}
+
+func TestDrawsCostTheWinningSide(t *testing.T) {
+	ai := NewAIService().snapshot()
+	tests := []struct {
+		fen  string
+		want int
+	}{
+		{"rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1", 0},
+		{"k7/8/2K5/8/8/8/8/1Q6 w - - 0 1", DRAW_CONTEMPT},
+		{"1q6/8/8/8/8/2k5/8/K7 b - - 0 1", -DRAW_CONTEMPT},
+	}
+	for _, tt := range tests {
+		if got := ai.contemptDrawScore(mustLoadFEN(t, tt.fen)); got != tt.want {
+			t.Errorf("%s: draws score %d, want %d", tt.fen, got, tt.want)
+		}
+	}
+
+	// Once stalemated, the search scores the position at the root's contempt
+	root := mustLoadFEN(t, "k7/8/2K5/8/8/8/8/1Q6 w - - 0 1")
+	stalemated := root.CopyState()
+	playSAN(t, stalemated, "Qb6")
+	score, err := ai.newSearch(context.Background(), ai.contemptDrawScore(root)).fixedDepth(stalemated, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if score != DRAW_CONTEMPT {
+		t.Errorf("stalemate scores %d for Black, want %d", score, DRAW_CONTEMPT)
+	}
+}
+
+// kingSafety scores the White king's safety at the given phase, checking
+// Black's mirror image scores the same
+func kingSafety(t *testing.T, fen string, phase int) int {
+	t.Helper()
+	ai := NewAIService().snapshot()
+	game := mustLoadFEN(t, fen)
+	score := ai.evaluateKingSafety(*game.findKing(White), White, game, phase)
+
+	mirrored := game.ColorMirrored()
+	if got := ai.evaluateKingSafety(*mirrored.findKing(Black), Black, mirrored, phase); got != score {
+		t.Errorf("%s: white king safety %d, black's mirror image %d", fen, score, got)
+	}
+	return score
+}
+
+func TestKingSafetyPenalisesOpenFilesAndStorms(t *testing.T) {
+	sheltered := kingSafety(t, "k7/8/8/8/8/8/5PPP/6K1 w - - 0 1", MIDGAME_PHASE)
+	tests := []struct {
+		name string
+		fen  string
+	}{
+		{"advanced shelter pawn", "k7/8/8/8/6P1/8/5P1P/6K1 w - - 0 1"},
+		{"half-open file", "k7/6p1/8/8/8/8/5P1P/6K1 w - - 0 1"},
+		{"open file", "k7/8/8/8/8/8/5P1P/6K1 w - - 0 1"},
+		{"pawn storm", "k7/8/8/8/6p1/8/5PPP/6K1 w - - 0 1"},
+	}
+	for _, tt := range tests {
+		if got := kingSafety(t, tt.fen, MIDGAME_PHASE); got >= sheltered {
+			t.Errorf("%s scores %d, no worse than the intact shelter's %d", tt.name, got, sheltered)
+		}
+	}
+
+	halfOpen := kingSafety(t, "k7/6p1/8/8/8/8/5P1P/6K1 w - - 0 1", MIDGAME_PHASE)
+	if open := kingSafety(t, "k7/8/8/8/8/8/5P1P/6K1 w - - 0 1", MIDGAME_PHASE); open >= halfOpen {
+		t.Errorf("open file scores %d, no worse than half-open's %d", open, halfOpen)
+	}
+	far := kingSafety(t, "k7/8/8/6p1/8/8/5PPP/6K1 w - - 0 1", MIDGAME_PHASE)
+	if near := kingSafety(t, "k7/8/8/8/8/6p1/5PPP/6K1 w - - 0 1", MIDGAME_PHASE); near >= far {
+		t.Errorf("storm pawn on g3 scores %d, no worse than on g5's %d", near, far)
+	}
+
+	// With nothing left to attack with, open files and storms stop counting
+	if open, halfOpen := kingSafety(t, "k7/8/8/8/8/8/5P1P/6K1 w - - 0 1", 0), kingSafety(t, "k7/6p1/8/8/8/8/5P1P/6K1 w - - 0 1", 0); open != halfOpen {
+		t.Errorf("in the endgame the open file scores %d, the half-open one %d", open, halfOpen)
+	}
+}
+
+// TestWinningSideAvoidsRepetition replays shuffles a search that ignored
+// repetitions inside the tree walked into. repeat is the move it went on to
+// play, bringing a position back a second time and handing Black a threefold
+// claim to aim for.
+func TestWinningSideAvoidsRepetition(t *testing.T) {
+	tests := []struct {
+		fen    string
+		moves  string
+		repeat string
+	}{
+		{"7k/8/8/8/8/8/8/K2Q4 w - - 0 1", "Qd4+ Kg8 Qd5+ Kf8 Qe6 Kg7 Kb1 Kf8 Kc2 Kg7 Kd3 Kf8 Ke4 Kg7 Qe7+ Kg6 Qe6+ Kg5 Qf5+ Kh6 Qf6+ Kh5 Qf5+ Kh6", "Qf6+"},
+		{"7k/8/8/8/8/8/8/K2R4 w - - 0 1", "Rd8+ Kg7 Rd7+ Kf6 Rd5 Ke6 Rc5 Kd6 Rf5 Ke6", "Rc5"},
+	}
+	ai := NewAIService()
+	for _, tt := range tests {
+		game := mustLoadFEN(t, tt.fen)
+		playSAN(t, game, tt.moves)
+		for depth := 1; depth <= 4; depth++ {
+			if err := ai.SetDepth(depth); err != nil {
+				t.Fatal(err)
+			}
+			move, err := ai.GetBestMove(context.Background(), game)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if san := game.MoveToSAN(*move); san == tt.repeat {
+				t.Errorf("%s: depth %d repeats with %s", tt.moves, depth, san)
+			}
+		}
+	}
+}
+
+// TestWinningSideResetsTheFiftyMoveCount has White one quiet move from the
+// fifty-move mark, with a pawn to push instead
+func TestWinningSideResetsTheFiftyMoveCount(t *testing.T) {
+	const fen = "7k/8/8/8/8/8/P7/K2Q4 w - - 99 80"
+	ai := NewAIService()
+	for depth := 1; depth <= 4; depth++ {
+		game := mustLoadFEN(t, fen)
+		move := searchMove(t, ai, fen, depth)
+		if err := game.MakeMove(move); err != nil {
+			t.Fatal(err)
+		}
+		if game.halfMoveClock() != 0 && game.Winner != string(White) {
+			t.Errorf("depth %d plays %v, letting the count reach %d", depth, move, game.halfMoveClock())
+		}
+	}
+}
+
+func TestPawnRace(t *testing.T) {
+	ai := NewAIService().snapshot()
+	tests := []struct {
+		name string
+		fen  string
+		want int
+	}{
+		{"king too far", "8/8/8/8/P7/7k/8/4K3 w - - 0 1", UNSTOPPABLE_PAWN_BONUS - 4*UNSTOPPABLE_PAWN_STEP},
+		{"double step counted", "8/8/8/8/8/7k/P7/4K3 w - - 0 1", UNSTOPPABLE_PAWN_BONUS - 5*UNSTOPPABLE_PAWN_STEP},
+		{"king inside the square", "8/8/8/3k4/P7/8/8/4K3 w - - 0 1", 0},
+		{"one step short with White to move", "8/8/5k2/8/P7/8/8/4K3 w - - 0 1", UNSTOPPABLE_PAWN_BONUS - 4*UNSTOPPABLE_PAWN_STEP},
+		{"one step short with Black to move", "8/8/5k2/8/P7/8/8/4K3 b - - 0 1", 0},
+		{"a knight could stop it", "8/8/8/8/P7/7k/7n/4K3 w - - 0 1", 0},
+		{"path blocked", "8/8/K7/8/P7/7k/8/8 w - - 0 1", 0},
+		{"not passed", "8/1p6/8/8/P7/7k/8/4K3 w - - 0 1", 0},
+	}
+	for _, tt := range tests {
+		if got := ai.evaluatePawnRace(mustLoadFEN(t, tt.fen), White); got != tt.want {
+			t.Errorf("%s: %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestPushesUnstoppablePawn has White choose between racing the a-pawn home
+// and walking the king over to look after the g-pawn
+func TestPushesUnstoppablePawn(t *testing.T) {
+	ai := NewAIService()
+	for _, fen := range []string{
+		"8/8/8/8/P7/6k1/6P1/4K3 w - - 0 1",
+		"8/8/8/8/P6k/8/6P1/4K3 w - - 0 1",
+	} {
+		for depth := 2; depth <= 4; depth++ {
+			if san := mustLoadFEN(t, fen).MoveToSAN(searchMove(t, ai, fen, depth)); san != "a5" {
+				t.Errorf("%s: depth %d plays %s, want a5", fen, depth, san)
+			}
+		}
+	}
+}
+
+// TestEvaluationStaysBelowMateBand piles on material no real game reaches,
+// then walks random games, checking only finished games score as mates
+func TestEvaluationStaysBelowMateBand(t *testing.T) {
+	ai := NewAIService().snapshot()
+	for fen, want := range map[string]int{
+		"qqqqkqqq/qqqqqqqq/8/8/8/8/PPPPPPPP/4K3 w - - 0 1": MAX_EVAL,
+		"4k3/pppppppp/8/8/8/8/QQQQQQQQ/QQQQKQQQ b - - 0 1": -MAX_EVAL,
+	} {
+		if got := ai.evaluatePosition(mustLoadFEN(t, fen)); got != want {
+			t.Errorf("%s evaluates to %d, want %d", fen, got, want)
+		}
+	}
+
+	rng := rand.New(rand.NewSource(9))
+	for i := 0; i < 40; i++ {
+		game := NewChessGame()
+		for ply := 0; ply < 200 && !game.GameOver; ply++ {
+			if eval := ai.evaluatePosition(game); isMateScore(eval) {
+				t.Fatalf("%s evaluates to %d, in the mate band", game.ToFEN(), eval)
+			}
+			moves := game.LegalMoves()
+			if err := game.MakeMove(moves[rng.Intn(len(moves))]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if won := game.Winner == string(White) || game.Winner == string(Black); won && !isMateScore(ai.evaluatePosition(game)) {
+			t.Errorf("%s is won but evaluates to %d", game.ToFEN(), ai.evaluatePosition(game))
+		}
+	}
+
+	if got := uciScore(MAX_EVAL, 4); got != "cp 10000" {
+		t.Errorf("clamped score reports %q", got)
+	}
+	if got := uciScore(WIN_SCORE+3, 4); got != "mate 1" {
+		t.Errorf("mate found with 3 plies left of 4 reports %q", got)
+	}
+	if got := pgnEvalComment(-MAX_EVAL, 4); got != "{[%eval 100.00]}" {
+		t.Errorf("clamped score comments %q", got)
+	}
+}
+
+func TestMissingKingIsLost(t *testing.T) {
+	ai := NewAIService().snapshot()
+	tests := []struct {
+		name    string
+		removed []Position
+		want    int
+	}{
+		{"black king gone", []Position{{0, 4}}, -WIN_SCORE},
+		{"white king gone", []Position{{7, 4}}, WIN_SCORE},
+		{"both gone", []Position{{0, 4}, {7, 4}}, 0},
+	}
+	for _, tt := range tests {
+		// Black is a queen up, which a missing king must outweigh
+		game := mustLoadFEN(t, "3qk3/8/8/8/8/8/8/4K3 w - - 0 1")
+		for _, square := range tt.removed {
+			game.Board[square.Row][square.Col] = nil
+		}
+		if got := ai.evaluatePosition(game); got != tt.want {
+			t.Errorf("%s: %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+// materialEvaluator counts material only, and how often it was asked
+type materialEvaluator struct {
+	calls *atomic.Int64
+}
+
+func (e materialEvaluator) Evaluate(game *ChessGame) int {
+	e.calls.Add(1)
+	score := 0
+	for i := 0; i < 8; i++ {
+		for j := 0; j < 8; j++ {
+			if piece := game.Board[i][j]; piece != nil && piece.Type != King {
+				if piece.Color == Black {
+					score += pieceValues[piece.Type]
+				} else {
+					score -= pieceValues[piece.Type]
+				}
+			}
+		}
+	}
+	return score
+}
+
+// constantEvaluator scores every position the same
+type constantEvaluator int
+
+func (e constantEvaluator) Evaluate(*ChessGame) int { return int(e) }
+
+func TestCustomEvaluator(t *testing.T) {
+	ai := NewAIService()
+	game := NewChessGame()
+	playSAN(t, game, "e4")
+	classical := ai.Evaluate(game)
+	if classical == 0 {
+		t.Fatal("1.e4 should score for White with the built-in evaluation")
+	}
+
+	// The cached score from the built-in evaluation mustn't come back
+	evaluator := materialEvaluator{calls: &atomic.Int64{}}
+	ai.SetEvaluator(evaluator)
+	if got := ai.Evaluate(game); got != 0 {
+		t.Errorf("1.e4 scores %d on material alone, want 0", got)
+	}
+	if got := ai.Evaluate(mustLoadFEN(t, "4k3/8/8/8/8/8/8/3QK3 w - - 0 1")); got != -pieceValues[Queen] {
+		t.Errorf("White's extra queen scores %d, want %d", got, -pieceValues[Queen])
+	}
+	if got := ai.analysisWorker(0).Evaluate(mustLoadFEN(t, "3qk3/8/8/8/8/8/8/4K3 w - - 0 1")); got != pieceValues[Queen] {
+		t.Errorf("analysis worker scores Black's extra queen %d, want %d", got, pieceValues[Queen])
+	}
+
+	// The search calls through it, and on material alone takes the queen
+	const hangingQueen = "4k3/8/8/3q4/8/8/3R4/4K3 w - - 0 1"
+	before := evaluator.calls.Load()
+	if san := mustLoadFEN(t, hangingQueen).MoveToSAN(searchMove(t, ai, hangingQueen, 2)); san != "Rxd5" {
+		t.Errorf("material-only search plays %s, want Rxd5", san)
+	}
+	if evaluator.calls.Load() == before {
+		t.Error("search never called the evaluator")
+	}
+
+	ai.SetEvaluator(constantEvaluator(10 * MAX_EVAL))
+	if got := ai.Evaluate(game); got != MAX_EVAL {
+		t.Errorf("runaway evaluator scores %d, want it clamped to %d", got, MAX_EVAL)
+	}
+
+	ai.SetEvaluator(nil)
+	if got := ai.Evaluate(game); got != classical {
+		t.Errorf("restored built-in evaluation scores %d, want %d", got, classical)
+	}
+}
+
+func TestForcedMoveIsNotSearched(t *testing.T) {
+	// The rook pins White to the first rank: Kf2 is the only move
+	game := mustLoadFEN(t, "7k/8/8/8/8/8/6PP/r5K1 w - - 0 1")
+	ai := NewAIService()
+	if err := ai.SetDepth(8); err != nil {
+		t.Fatal(err)
+	}
+
+	progress := 0
+	result, err := ai.Search(context.Background(), game, SearchOptions{Progress: func(SearchProgress) { progress++ }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if san := game.MoveToSAN(*result.Move); san != "Kf2" {
+		t.Fatalf("played %s, want Kf2", san)
+	}
+	if !result.Forced || result.Nodes != 0 || result.Depth != 0 || progress != 0 {
+		t.Errorf("forced move searched: forced %v, %d nodes, depth %d, %d progress reports", result.Forced, result.Nodes, result.Depth, progress)
+	}
+
+	// Stats follow the AI's moves in the live game
+	if err := ai.SetDepth(2); err != nil {
+		t.Fatal(err)
+	}
+	service := NewChessService()
+	for _, tt := range []struct {
+		fen    string
+		forced bool
+	}{
+		{game.ToFEN(), true},
+		{NewChessGame().ToFEN(), false},
+	} {
+		if _, err := service.NewGame(NewGameRequest{StartingFEN: tt.fen, HumanColor: Black}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ai.MakeAIMove(context.Background(), service); err != nil {
+			t.Fatal(err)
+		}
+		if got := ai.GetStats().LastForced; got != tt.forced {
+			t.Errorf("%s: stats report forced %v, want %v", tt.fen, got, tt.forced)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// ============================================================================
+// GAME REVIEW
+// ============================================================================
+
+const (
+	ANNOTATE_DEPTH     = 2
+	ANNOTATE_MAX_DEPTH = 3
+
+	// The coach reviews each player move during play, so it searches shallow
+	// and gives up rather than hold up the AI's reply
+	COACH_DEPTH   = 2
+	COACH_TIMEOUT = 500 * time.Millisecond
+)
+
+// AnnotationThresholds are how many centipawns a move may give away, from
+// the mover's point of view, before it counts as each kind of error
+type AnnotationThresholds struct {
+	Inaccuracy int `json:"inaccuracy"`
+	Mistake    int `json:"mistake"`
+	Blunder    int `json:"blunder"`
+}
+
+func DefaultAnnotationThresholds() AnnotationThresholds {
+	return AnnotationThresholds{Inaccuracy: 50, Mistake: 100, Blunder: 300}
+}
+
+func (t AnnotationThresholds) validate() error {
+	if t.Inaccuracy <= 0 || t.Mistake < t.Inaccuracy || t.Blunder < t.Mistake {
+		return fmt.Errorf("thresholds must satisfy 0 < inaccuracy <= mistake <= blunder, got %d/%d/%d", t.Inaccuracy, t.Mistake, t.Blunder)
+	}
+	return nil
+}
+
+// classify returns the classification and PGN symbol for a move that lost
+// this many centipawns, or empty strings for a good move
+func (t AnnotationThresholds) classify(loss int) (string, string) {
+	switch {
+	case loss >= t.Blunder:
+		return "blunder", "??"
+	case loss >= t.Mistake:
+		return "mistake", "?"
+	case loss >= t.Inaccuracy:
+		return "inaccuracy", "?!"
+	}
+	return "", ""
+}
+
+// MoveAnnotation is the review of one half-move
+type MoveAnnotation struct {
+	Ply            int    `json:"ply"`
+	Move           string `json:"move"`       // SAN
+	Evaluation     int    `json:"evaluation"` // After the move, Black-positive like every other score
+	Loss           int    `json:"loss"`       // Centipawns the mover gave away, 0 if the move held or improved
+	Classification string `json:"classification,omitempty"`
+	Symbol         string `json:"symbol,omitempty"`
+}
+
+type AnnotateResponse struct {
+	Depth      int                  `json:"depth"`
+	Thresholds AnnotationThresholds `json:"thresholds"`
+	Moves      []MoveAnnotation     `json:"moves"`
+	PGN        string               `json:"pgn"` // With symbols and [%eval] comments
+}
+
+// AnnotateGame replays game, searches the position before the first move and
+// after every move, and marks the moves that let the evaluation slip
+func (ai *AIService) AnnotateGame(ctx context.Context, game *ChessGame, aiColor Color, depth int, thresholds AnnotationThresholds) (*AnnotateResponse, error) {
+	replay, err := game.startingPosition()
+	if err != nil {
+		return nil, fmt.Errorf("failed to rebuild starting position: %w", err)
+	}
+
+	previous, err := ai.SearchEvaluation(ctx, replay.CopyState(), depth)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &AnnotateResponse{Depth: depth, Thresholds: thresholds, Moves: []MoveAnnotation{}}
+	annotations := make([]string, 0, len(game.MoveHistory))
+	for ply, played := range game.MoveHistory {
+		move := Move{From: played.From, To: played.To, Promotion: played.Promotion}
+		mover := replay.CurrentTurn
+		san := replay.MoveToSAN(move)
+		replay.MakeMove(move)
+
+		evaluation, err := ai.SearchEvaluation(ctx, replay.CopyState(), depth)
+		if err != nil {
+			return nil, err
+		}
+
+		loss := moveLoss(previous, evaluation, mover)
+		classification, symbol := thresholds.classify(loss)
+
+		response.Moves = append(response.Moves, MoveAnnotation{
+			Ply:            ply + 1,
+			Move:           san,
+			Evaluation:     evaluation,
+			Loss:           loss,
+			Classification: classification,
+			Symbol:         symbol,
+		})
+		// A finished game needs no evaluation, the SAN or result already says it
+		annotation := symbol
+		if !replay.GameOver {
+			annotation += " " + pgnEvalComment(evaluation, depth)
+		}
+		annotations = append(annotations, annotation)
+		previous = evaluation
+	}
+
+	pgn, err := game.toPGN(aiColor, annotations)
+	if err != nil {
+		return nil, err
+	}
+	response.PGN = pgn
+	return response, nil
+}
+
+// moveLoss is how many centipawns a move by mover gave away, going from the
+// evaluation before it to the one after; 0 if it held or improved
+func moveLoss(before, after int, mover Color) int {
+	// Scores are Black-positive, so White loses what the score gains
+	loss := before - after
+	if mover == White {
+		loss = -loss
+	}
+	return max(loss, 0)
+}
+
+// CoachReport is the live review of a player's move, for games that asked
+// for a coach
+type CoachReport struct {
+	Move       string `json:"move"` // SAN
+	Loss       int    `json:"loss"` // Centipawns given away, see MoveAnnotation
+	Blunder    bool   `json:"blunder"`
+	BetterMove string `json:"betterMove,omitempty"` // SAN of the engine's choice, only for a blunder
+	BetterUCI  string `json:"betterUci,omitempty"`
+}
+
+// ReviewMove searches before and after move is played from before, to
+// COACH_DEPTH, and flags the move as a blunder if it gave away at least
+// threshold centipawns. A blunder also gets the move the engine would have
+// played. It fails if the review doesn't finish within COACH_TIMEOUT.
+func (ai *AIService) ReviewMove(ctx context.Context, before *ChessGame, move Move, threshold int) (*CoachReport, error) {
+	ctx, cancel := context.WithTimeout(ctx, COACH_TIMEOUT)
+	defer cancel()
+
+	worker := ai.analysisWorker(0)
+	worker.settings.Depth = COACH_DEPTH
+
+	previous, err := worker.SearchEvaluation(ctx, before.CopyState(), COACH_DEPTH)
+	if err != nil {
+		return nil, err
+	}
+	// Read the move back as played, with a bare promotion made a queen
+	after := before.CopyState()
+	if err := after.MakeMove(move); err != nil {
+		return nil, err
+	}
+	played := after.MoveHistory[len(after.MoveHistory)-1]
+	move = Move{From: played.From, To: played.To, Promotion: played.Promotion}
+	report := &CoachReport{Move: before.MoveToSAN(move)}
+	evaluation, err := worker.SearchEvaluation(ctx, after, COACH_DEPTH)
+	if err != nil {
+		return nil, err
+	}
+
+	report.Loss = moveLoss(previous, evaluation, before.CurrentTurn)
+	report.Blunder = report.Loss >= threshold
+	if !report.Blunder {
+		return report, nil
+	}
+
+	// A cut-short search still returns a move, but not one worth suggesting
+	better, err := worker.GetBestMove(ctx, before.CopyState())
+	if err != nil {
+		return nil, err
+	}
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("review stopped before finding a better move: %w", ctx.Err())
+	}
+	if *better != move {
+		report.BetterMove = before.MoveToSAN(*better)
+		report.BetterUCI = uciMove(*better)
+	}
+	return report, nil
+}
+
+// pgnEvalComment writes a score the way PGN viewers expect it: in pawns from
+// White's point of view, or #N for a forced mate in N moves, signed by who
+// mates. depth is the search depth the score came from.
+func pgnEvalComment(evaluation, depth int) string {
+	white := -evaluation
+	if !isMateScore(white) {
+		return fmt.Sprintf("{[%%eval %.2f]}", float64(white)/100)
+	}
+
+	// Mate scores are WIN_SCORE plus the depth left when the mate was found
+	plies := max(depth-(abs(white)-WIN_SCORE), 1)
+	mateIn := (plies + 1) / 2
+	if white < 0 {
+		mateIn = -mateIn
+	}
+	return fmt.Sprintf("{[%%eval #%d]}", mateIn)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// BATCH ANALYSIS
+// ============================================================================
+
+const (
+	MAX_BATCH_POSITIONS = 200
+	BATCH_ITEM_TIME     = 2 * time.Second
+)
+
+// BatchResult is the analysis of one position of a batch. A position that
+// couldn't be searched carries an error instead of a move.
+type BatchResult struct {
+	Index      int    `json:"index"`
+	FEN        string `json:"fen"`
+	BestMove   *Move  `json:"best_move,omitempty"`
+	UCI        string `json:"uci,omitempty"`
+	SAN        string `json:"san,omitempty"`
+	Evaluation int    `json:"evaluation"`
+	Depth      int    `json:"depth"` // Deepest completed iteration; 0 if only the static evaluation was used
+	Error      string `json:"error,omitempty"`
+}
+
+type BatchResponse struct {
+	Results    []BatchResult `json:"results"`
+	ItemTimeMs int64         `json:"item_time_ms"`
+}
+
+// batchPositions is every position of a game's main line, from the start
+// through the position after the last move
+func batchPositions(game *ChessGame) ([]*ChessGame, error) {
+	replay, err := game.startingPosition()
+	if err != nil {
+		return nil, fmt.Errorf("failed to rebuild starting position: %w", err)
+	}
+	positions := []*ChessGame{replay.CopyState()}
+	for _, played := range game.MoveHistory {
+		if err := replay.MakeMove(Move{From: played.From, To: played.To, Promotion: played.Promotion}); err != nil {
+			return nil, err
+		}
+		positions = append(positions, replay.CopyState())
+	}
+	return positions, nil
+}
+
+// AnalyzeBatch searches every position with the given number of workers,
+// each position getting at most itemTime. Results come back in input order.
+func (ai *AIService) AnalyzeBatch(ctx context.Context, games []*ChessGame, itemTime time.Duration, workers int) []BatchResult {
+	results := make([]BatchResult, len(games))
+	jobs := make(chan int)
+
+	worker := ai.analysisWorker(itemTime)
+	var wg sync.WaitGroup
+	for w := 0; w < max(min(workers, len(games)), 1); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = worker.analyzeBatchItem(ctx, games[i])
+				results[i].Index = i
+			}
+		}()
+	}
+
+	for i := range games {
+		if ctx.Err() != nil {
+			results[i] = BatchResult{Index: i, FEN: games[i].ToFEN(), Error: ctx.Err().Error()}
+			continue
+		}
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	return results
+}
+
+// analysisWorker copies the search and evaluation settings into a separate
+// service searching for at most itemTime. Book moves, noise and the playing
+// style are left out since analysis should return the engine's own
+// judgement. The evaluation cache is shared.
+func (ai *AIService) analysisWorker(itemTime time.Duration) *AIService {
+	worker := ai.snapshot()
+	worker.settings.UseOpeningBook = false
+	worker.settings.Randomness = 0
+	worker.limits.MaxThinkingTime = itemTime
+	worker.style = DEFAULT_STYLE
+	return worker
+}
+
+func (ai *AIService) analyzeBatchItem(ctx context.Context, game *ChessGame) BatchResult {
+	result := BatchResult{FEN: game.ToFEN()}
+	if game.GameOver {
+		result.Evaluation = ai.evaluatePosition(game)
+		return result
+	}
+
+	var last SearchProgress
+	move, err := ai.GetBestMoveWithProgress(ctx, game, func(p SearchProgress) {
+		last = p
+	})
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	result.BestMove = move
+	result.UCI = uciMove(*move)
+	result.SAN = game.MoveToSAN(*move)
+	result.Depth = last.Depth
+	result.Evaluation = last.Evaluation
+	if last.Depth == 0 {
+		// Not even the first iteration finished in time
+		result.Evaluation = ai.Evaluate(game)
+	}
+	return result
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"math/rand"
+	"strings"
+)
+
+// openingBook maps the moves played so far (in coordinate notation, space
+// separated) to reasonable replies. It only covers the first few moves of
+// common openings, just enough to give the AI some variety early on.
+var openingBook = map[string][]string{
+	"":                    {"e2e4", "d2d4", "c2c4", "g1f3"},
+	"e2e4":                {"e7e5", "c7c5", "e7e6", "c7c6"},
+	"d2d4":                {"d7d5", "g8f6"},
+	"c2c4":                {"e7e5", "g8f6", "c7c5"},
+	"g1f3":                {"d7d5", "g8f6"},
+	"e2e4 e7e5":           {"g1f3", "f1c4", "b1c3"},
+	"e2e4 c7c5":           {"g1f3", "b1c3"},
+	"e2e4 e7e6":           {"d2d4"},
+	"e2e4 c7c6":           {"d2d4"},
+	"d2d4 d7d5":           {"c2c4", "g1f3"},
+	"d2d4 g8f6":           {"c2c4", "g1f3"},
+	"e2e4 e7e5 g1f3":      {"b8c6", "g8f6"},
+	"e2e4 e7e5 f1c4":      {"g8f6", "f8c5"},
+	"e2e4 c7c5 g1f3":      {"d7d6", "b8c6", "e7e6"},
+	"e2e4 e7e6 d2d4":      {"d7d5"},
+	"e2e4 c7c6 d2d4":      {"d7d5"},
+	"d2d4 d7d5 c2c4":      {"e7e6", "c7c6", "d5c4"},
+	"d2d4 g8f6 c2c4":      {"e7e6", "g7g6"},
+	"e2e4 e7e5 g1f3 b8c6": {"f1b5", "f1c4", "d2d4"},
+}
+
+// bookMove returns a random book reply for the current position, or nil once
+// the game has left the book
+func bookMove(game *ChessGame, rng *rand.Rand) *Move {
+	if game.Chess960 || game.StartFEN != "" {
+		return nil
+	}
+
+	played := make([]string, len(game.MoveHistory))
+	for i, move := range game.MoveHistory {
+		played[i] = moveCoordinates(move)
+	}
+
+	candidates := openingBook[strings.Join(played, " ")]
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	for _, i := range rng.Perm(len(candidates)) {
+		for _, move := range game.GetValidMoves(game.CurrentTurn) {
+			if moveCoordinates(move) == candidates[i] {
+				return &move
+			}
+		}
+	}
+	return nil
+}
+
+func moveCoordinates(move Move) string {
+	return move.From.ToAlgebraic() + move.To.ToAlgebraic()
+}
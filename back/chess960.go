@@ -0,0 +1,37 @@
+package main
+
+import "math/rand"
+
+// generateChess960BackRank returns a random Fischer Random back rank: bishops
+// on opposite-colored squares and the king somewhere between the two rooks
+func generateChess960BackRank(rng *rand.Rand) []PieceType {
+	rank := make([]PieceType, 8)
+
+	rank[rng.Intn(4)*2] = Bishop
+	rank[rng.Intn(4)*2+1] = Bishop
+
+	placeOnFreeSquare := func(pieceType PieceType) {
+		free := freeBackRankSquares(rank)
+		rank[free[rng.Intn(len(free))]] = pieceType
+	}
+	placeOnFreeSquare(Queen)
+	placeOnFreeSquare(Knight)
+	placeOnFreeSquare(Knight)
+
+	// The three squares left are filled rook, king, rook from left to right
+	for i, col := range freeBackRankSquares(rank) {
+		rank[col] = []PieceType{Rook, King, Rook}[i]
+	}
+
+	return rank
+}
+
+func freeBackRankSquares(rank []PieceType) []int {
+	var free []int
+	for col, pieceType := range rank {
+		if pieceType == "" {
+			free = append(free, col)
+		}
+	}
+	return free
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestChess960BackRank(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		game := NewChess960Game(rng)
+
+		var bishops, rooks []int
+		king := -1
+		for col := 0; col < 8; col++ {
+			white, black := game.Board[7][col], game.Board[0][col]
+			if white == nil || black == nil || white.Type != black.Type {
+				t.Fatalf("%s: back ranks are not mirrored on file %d", game.StartFEN, col)
+			}
+			switch white.Type {
+			case Bishop:
+				bishops = append(bishops, col)
+			case Rook:
+				rooks = append(rooks, col)
+			case King:
+				king = col
+			}
+		}
+
+		if len(bishops) != 2 || bishops[0]%2 == bishops[1]%2 {
+			t.Fatalf("%s: bishops must be on opposite colors", game.StartFEN)
+		}
+		if len(rooks) != 2 || king < rooks[0] || king > rooks[1] {
+			t.Fatalf("%s: king must stand between the rooks", game.StartFEN)
+		}
+		if _, err := LoadFEN(game.StartFEN); err != nil {
+			t.Fatalf("start FEN %s doesn't load: %v", game.StartFEN, err)
+		}
+	}
+}
+
+func TestChess960CastleOntoOwnSquare(t *testing.T) {
+	game, err := LoadFEN("4k3/8/8/8/8/8/8/6KR w H - 0 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	castle := Move{From: Position{7, 6}, To: Position{7, 7}}
+	if !game.IsValidMove(castle) {
+		t.Fatal("king on g1 should castle with the h1 rook")
+	}
+
+	game.MakeMove(castle)
+	if king := game.Board[7][6]; king == nil || king.Type != King {
+		t.Error("king should stay on g1")
+	}
+	if rook := game.Board[7][5]; rook == nil || rook.Type != Rook {
+		t.Error("rook should end up on f1")
+	}
+}
+
+func TestChess960NoCastlingOutOfCheck(t *testing.T) {
+	// The king already stands on g1, its castling destination, and is in
+	// check from the a1 rook
+	game, err := LoadFEN("4k3/8/8/8/8/8/8/r5KR w H - 0 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	castle := Move{From: Position{7, 6}, To: Position{7, 7}}
+	for _, move := range game.GetValidMoves(White) {
+		if move.From == castle.From && move.To == castle.To {
+			t.Fatal("g1-h1 castling is generated while in check")
+		}
+	}
+	if game.IsValidMove(castle) {
+		t.Error("g1-h1 castles out of check")
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import "time"
+
+// Clock is where the AI reads the time: its think-time cap, the thinking time
+// it reports and the minimum response delay all go through it, so they can
+// be driven by a fake clock instead of waiting on the real one
+type Clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer fires once on C after its duration. Stop releases it early; a
+// time.After timer would otherwise be kept alive until it fired.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                  { return time.Now() }
+func (realClock) Since(t time.Time) time.Duration { return time.Since(t) }
+func (realClock) NewTimer(d time.Duration) Timer  { return realTimer{time.NewTimer(d)} }
+
+type realTimer struct{ *time.Timer }
+
+func (t realTimer) C() <-chan time.Time { return t.Timer.C }
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock only moves when Advance is called, firing the timers it passes
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock *fakeClock
+	at    time.Time
+	c     chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Since(t time.Time) time.Duration { return c.Now().Sub(t) }
+
+func (c *fakeClock) NewTimer(d time.Duration) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	timer := &fakeTimer{clock: c, at: c.now.Add(d), c: make(chan time.Time, 1)}
+	c.timers = append(c.timers, timer)
+	return timer
+}
+
+// Advance moves the clock on by d and fires every timer that came due
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	for _, timer := range c.timers {
+		if timer.at.After(c.now) {
+			pending = append(pending, timer)
+			continue
+		}
+		timer.c <- c.now
+	}
+	c.timers = pending
+}
+
+// pending is how many timers are neither fired nor stopped
+func (c *fakeClock) pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+// waitForTimers waits in real time until n timers are pending, so an
+// Advance can't run before the code under test has set its timer
+func (c *fakeClock) waitForTimers(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for c.pending() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d timers pending, waited for %d", c.pending(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.c }
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	for i, timer := range t.clock.timers {
+		if timer == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func TestThinkTimeCapRunsOnTheAIClock(t *testing.T) {
+	clock := newFakeClock()
+	ai := NewAIService()
+	ai.SetClock(clock)
+	if err := ai.SetMaxThinkingTime(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	game := mustLoadFEN(t, "r3k2r/p1ppqpb1/bn2pnp1/3PN3/1p2P3/2N2Q1p/PPPBBPPP/R3K2R w KQkq - 0 1")
+	done := make(chan *SearchResult)
+	go func() {
+		result, err := ai.Search(context.Background(), game, SearchOptions{Depth: MAX_DEPTH})
+		if err != nil {
+			t.Error(err)
+		}
+		done <- result
+	}()
+
+	clock.waitForTimers(t, 1)
+	clock.Advance(time.Hour)
+	select {
+	case result := <-done:
+		if result == nil {
+			return
+		}
+		if result.Move == nil || result.Depth >= MAX_DEPTH {
+			t.Errorf("got %v at depth %d, want the cut-off search's move", result.Move, result.Depth)
+		}
+		if result.ThinkTime != time.Hour {
+			t.Errorf("reported %v of thinking, want the hour on the AI's clock", result.ThinkTime)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("search kept going after its think time ran out")
+	}
+}
+
+func TestFinishedSearchStopsItsTimer(t *testing.T) {
+	clock := newFakeClock()
+	ai := NewAIService()
+	ai.SetClock(clock)
+	game := mustLoadFEN(t, "r3k2r/p1ppqpb1/bn2pnp1/3PN3/1p2P3/2N2Q1p/PPPBBPPP/R3K2R w KQkq - 0 1")
+	if _, err := ai.Search(context.Background(), game, SearchOptions{Depth: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if n := clock.pending(); n != 0 {
+		t.Errorf("%d think-time timers left running after the search", n)
+	}
+}
+
+func TestPadResponseWaitsOnTheAIClock(t *testing.T) {
+	clock := newFakeClock()
+	ai := NewAIService()
+	ai.SetClock(clock)
+	if err := ai.SetMinResponseTime(2 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	start := ai.Now()
+	done := make(chan struct{})
+	go func() {
+		ai.PadResponse(context.Background(), start)
+		close(done)
+	}()
+
+	clock.waitForTimers(t, 1)
+	clock.Advance(time.Second)
+	select {
+	case <-done:
+		t.Fatal("response returned after 1s of a 2s minimum")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	clock.Advance(time.Second)
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("response still held after the minimum passed")
+	}
+}
+
+func TestPadResponseStopsItsTimerWhenCancelled(t *testing.T) {
+	clock := newFakeClock()
+	ai := NewAIService()
+	ai.SetClock(clock)
+	if err := ai.SetMinResponseTime(2 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		ai.PadResponse(ctx, ai.Now())
+		close(done)
+	}()
+
+	clock.waitForTimers(t, 1)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("response still held after its request was cancelled")
+	}
+	if n := clock.pending(); n != 0 {
+		t.Errorf("%d response timers left running after the cancel", n)
+	}
+}
+
+func TestPadResponseSkipsTimeAlreadySpent(t *testing.T) {
+	clock := newFakeClock()
+	ai := NewAIService()
+	ai.SetClock(clock)
+	if err := ai.SetMinResponseTime(2 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	start := ai.Now()
+	clock.Advance(3 * time.Second)
+	ai.PadResponse(context.Background(), start)
+	if n := clock.pending(); n != 0 {
+		t.Errorf("set %d timers for a response that was already late", n)
+	}
+}
+
+func TestPadResponseStopsAtTheDeadlineOnTheAIClock(t *testing.T) {
+	// The fake clock runs an hour ahead, so the deadline is only close on it
+	clock := &fakeClock{now: time.Now().Add(time.Hour)}
+	ai := NewAIService()
+	ai.SetClock(clock)
+	if err := ai.SetMinResponseTime(2 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), clock.Now().Add(time.Second))
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		ai.PadResponse(ctx, ai.Now())
+		close(done)
+	}()
+
+	clock.waitForTimers(t, 1)
+	clock.Advance(time.Second)
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("response held past its deadline on the AI's clock")
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/url"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ============================================================================
+// CONFIGURATION
+// ============================================================================
+
+const (
+	DEFAULT_PORT            = "8080"
+	DEFAULT_ALLOWED_ORIGINS = "http://localhost:3000"
+)
+
+// Config is the server's startup configuration, read from the environment.
+// Every setting has a default, so an empty environment gives a working server.
+type Config struct {
+	Port           string     // PORT
+	AllowedOrigins []string   // ALLOWED_ORIGINS, comma separated; "*" allows any origin, without credentials
+	AIDefaultDepth int        // AI_DEFAULT_DEPTH, at most AI_MAX_DEPTH
+	AILimits       AILimits   // AI_MAX_THINK_MS, AI_MAX_DEPTH, AI_MAX_NODES
+	LogLevel       slog.Level // LOG_LEVEL: debug, info (default), warn or error
+	MaxHalfMoves   int        // MAX_HALF_MOVES, after which a game is drawn
+
+	AnalysisMaxThinkTime time.Duration // ANALYSIS_MAX_THINK_MS, ceiling on an analysis request's max_think_ms
+	AnalysisMaxSearches  int           // ANALYSIS_MAX_SEARCHES, analysis searches running at once
+	AnalysisQueueTimeout time.Duration // ANALYSIS_QUEUE_MS, how long an analysis request waits for a slot
+	AIReplyTimeout       time.Duration // AI_REPLY_TIMEOUT_MS, at least AI_MAX_THINK_MS
+	Seed                 *int64        // CHESS_SEED, makes AI choices and Chess960 setups reproducible; nil for a random seed
+	DebugEndpoints       bool          // DEBUG_ENDPOINTS=1 turns on /api/debug/profile
+}
+
+// logLevels are the LOG_LEVEL names. Per-move chatter is debug, game and
+// setting changes info, recoverable failures warn and server faults error.
+var logLevels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// loadConfig reads the configuration from the environment and checks it. All
+// invalid settings are reported together, so one restart can fix them all.
+func loadConfig() (Config, error) {
+	var problems []error
+	intSetting := func(key string, defaultValue, min, max int64) int64 {
+		value, err := parseEnvInt(key, defaultValue, min, max)
+		if err != nil {
+			problems = append(problems, err)
+			return defaultValue
+		}
+		return value
+	}
+
+	config := Config{
+		Port:           getEnv("PORT", DEFAULT_PORT),
+		AllowedOrigins: splitOrigins(getEnv("ALLOWED_ORIGINS", DEFAULT_ALLOWED_ORIGINS)),
+		AILimits:       DefaultAILimits(),
+	}
+
+	limits := &config.AILimits
+	limits.MaxThinkingTime = time.Duration(intSetting("AI_MAX_THINK_MS", limits.MaxThinkingTime.Milliseconds(), 0, 600000)) * time.Millisecond
+	limits.MaxDepth = int(intSetting("AI_MAX_DEPTH", int64(limits.MaxDepth), 1, MAX_DEPTH))
+	limits.MaxNodes = intSetting("AI_MAX_NODES", limits.MaxNodes, 0, math.MaxInt64)
+	config.AIDefaultDepth = int(intSetting("AI_DEFAULT_DEPTH", int64(min(DEFAULT_DEPTH, limits.MaxDepth)), 1, int64(limits.MaxDepth)))
+	config.MaxHalfMoves = int(intSetting("MAX_HALF_MOVES", DEFAULT_MAX_HALF_MOVES, AUTOMATIC_HALF_MOVES, MAX_HALF_MOVES_LIMIT))
+	config.AnalysisMaxThinkTime = time.Duration(intSetting("ANALYSIS_MAX_THINK_MS", MAX_ANALYSIS_THINKING_TIME.Milliseconds(), 1, 600000)) * time.Millisecond
+	config.AnalysisMaxSearches = int(intSetting("ANALYSIS_MAX_SEARCHES", int64(runtime.NumCPU()), 1, 256))
+	config.AnalysisQueueTimeout = time.Duration(intSetting("ANALYSIS_QUEUE_MS", ANALYSIS_QUEUE_TIMEOUT.Milliseconds(), 0, 60000)) * time.Millisecond
+	replyTimeout := defaultAIReplyTimeout(limits.MaxThinkingTime)
+	config.AIReplyTimeout = time.Duration(intSetting("AI_REPLY_TIMEOUT_MS", replyTimeout.Milliseconds(), 1, 600000)) * time.Millisecond
+	config.DebugEndpoints = intSetting("DEBUG_ENDPOINTS", 0, 0, 1) == 1
+	if os.Getenv("CHESS_SEED") != "" {
+		seed := intSetting("CHESS_SEED", 0, math.MinInt64, math.MaxInt64)
+		config.Seed = &seed
+	}
+
+	logLevel := strings.ToLower(getEnv("LOG_LEVEL", "info"))
+	if level, ok := logLevels[logLevel]; ok {
+		config.LogLevel = level
+	} else {
+		problems = append(problems, fmt.Errorf("LOG_LEVEL=%q: must be debug, info, warn or error", logLevel))
+	}
+
+	if err := config.validate(); err != nil {
+		problems = append(problems, err)
+	}
+	return config, errors.Join(problems...)
+}
+
+func (c Config) validate() error {
+	var problems []error
+	if port, err := strconv.Atoi(c.Port); err != nil || port < 1 || port > 65535 {
+		problems = append(problems, fmt.Errorf("PORT=%q: must be a port number between 1 and 65535", c.Port))
+	}
+	if c.AILimits.MaxThinkingTime > 0 && c.AIReplyTimeout < c.AILimits.MaxThinkingTime {
+		problems = append(problems, fmt.Errorf("AI_REPLY_TIMEOUT_MS=%d: must not be shorter than the AI think time of %dms", c.AIReplyTimeout.Milliseconds(), c.AILimits.MaxThinkingTime.Milliseconds()))
+	}
+	if len(c.AllowedOrigins) == 0 {
+		problems = append(problems, fmt.Errorf("ALLOWED_ORIGINS: must list at least one origin"))
+	}
+	for _, origin := range c.AllowedOrigins {
+		if origin == "*" {
+			continue
+		}
+		parsed, err := url.Parse(origin)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" || (parsed.Path != "" && parsed.Path != "/") {
+			problems = append(problems, fmt.Errorf("ALLOWED_ORIGINS: %q is not an origin like http://localhost:3000", origin))
+		}
+	}
+	return errors.Join(problems...)
+}
+
+// allowedOrigin returns the Access-Control-Allow-Origin value for a browser
+// at origin, or "" if it may not call the API, and whether it may send
+// credentials. Only listed origins are echoed back with credentials; "*"
+// answers with a literal wildcard, which browsers never pair with cookies.
+func (c Config) allowedOrigin(origin string) (string, bool) {
+	if origin == "" {
+		return "", false
+	}
+	wildcard := false
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" {
+			wildcard = true
+		} else if strings.EqualFold(allowed, origin) {
+			return origin, true
+		}
+	}
+	if wildcard {
+		return "*", false
+	}
+	return "", false
+}
+
+func splitOrigins(raw string) []string {
+	var origins []string
+	for _, origin := range strings.Split(raw, ",") {
+		if origin = strings.TrimSuffix(strings.TrimSpace(origin), "/"); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
+
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+// parseEnvInt reads an integer setting, rejecting values that don't parse or
+// fall outside [min, max]
+func parseEnvInt(key string, defaultValue, min, max int64) (int64, error) {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return defaultValue, nil
+	}
+	value, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || value < min || value > max {
+		return 0, fmt.Errorf("%s=%q: must be an integer between %d and %d", key, raw, min, max)
+	}
+	return value, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// configKeys are cleared before each test so the host environment can't leak in
+var configKeys = []string{
+	"PORT", "ALLOWED_ORIGINS", "AI_DEFAULT_DEPTH", "AI_MAX_THINK_MS", "AI_MAX_DEPTH", "AI_MAX_NODES",
+	"LOG_LEVEL", "MAX_HALF_MOVES", "ANALYSIS_MAX_THINK_MS", "ANALYSIS_MAX_SEARCHES", "ANALYSIS_QUEUE_MS",
+	"AI_REPLY_TIMEOUT_MS", "CHESS_SEED", "DEBUG_ENDPOINTS",
+}
+
+func setConfigEnv(t *testing.T, env map[string]string) {
+	t.Helper()
+	for _, key := range configKeys {
+		t.Setenv(key, env[key])
+	}
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	setConfigEnv(t, nil)
+	config, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Port != DEFAULT_PORT || config.AIDefaultDepth != DEFAULT_DEPTH || config.Seed != nil || config.DebugEndpoints {
+		t.Errorf("unexpected defaults: %+v", config)
+	}
+	if config.AIReplyTimeout != defaultAIReplyTimeout(config.AILimits.MaxThinkingTime) {
+		t.Errorf("reply timeout %v doesn't follow the think time", config.AIReplyTimeout)
+	}
+}
+
+func TestLoadConfigSettings(t *testing.T) {
+	setConfigEnv(t, map[string]string{
+		"ANALYSIS_MAX_SEARCHES": "3",
+		"ANALYSIS_QUEUE_MS":     "250",
+		"AI_REPLY_TIMEOUT_MS":   "40000",
+		"CHESS_SEED":            "-7",
+		"DEBUG_ENDPOINTS":       "1",
+	})
+	config, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.AnalysisMaxSearches != 3 || config.AnalysisQueueTimeout != 250*time.Millisecond || config.AIReplyTimeout != 40*time.Second {
+		t.Errorf("analysis settings not read: %+v", config)
+	}
+	if config.Seed == nil || *config.Seed != -7 || !config.DebugEndpoints {
+		t.Errorf("seed or debug endpoints not read: %+v", config)
+	}
+}
+
+func TestLoadConfigReportsAllProblems(t *testing.T) {
+	setConfigEnv(t, map[string]string{
+		"PORT":                  "http",
+		"AI_DEFAULT_DEPTH":      "99",
+		"LOG_LEVEL":             "loud",
+		"ANALYSIS_MAX_SEARCHES": "0",
+		"ANALYSIS_QUEUE_MS":     "-1",
+		"CHESS_SEED":            "random",
+		"DEBUG_ENDPOINTS":       "yes",
+		"ALLOWED_ORIGINS":       "localhost:3000",
+	})
+	_, err := loadConfig()
+	if err == nil {
+		t.Fatal("invalid configuration accepted")
+	}
+	for _, key := range []string{"PORT", "AI_DEFAULT_DEPTH", "LOG_LEVEL", "ANALYSIS_MAX_SEARCHES", "ANALYSIS_QUEUE_MS", "CHESS_SEED", "DEBUG_ENDPOINTS", "ALLOWED_ORIGINS"} {
+		if !strings.Contains(err.Error(), key) {
+			t.Errorf("%s missing from %v", key, err)
+		}
+	}
+}
+
+func TestLoadConfigReplyTimeoutBelowThinkTime(t *testing.T) {
+	setConfigEnv(t, map[string]string{"AI_MAX_THINK_MS": "10000", "AI_REPLY_TIMEOUT_MS": "5000"})
+	if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), "AI_REPLY_TIMEOUT_MS") {
+		t.Errorf("got %v, want the reply timeout rejected", err)
+	}
+}
+
+func TestAllowedOrigin(t *testing.T) {
+	config := Config{AllowedOrigins: []string{"http://localhost:3000", "*"}}
+	tests := []struct {
+		origin      string
+		allowed     string
+		credentials bool
+	}{
+		{"http://localhost:3000", "http://localhost:3000", true},
+		{"HTTP://LOCALHOST:3000", "HTTP://LOCALHOST:3000", true},
+		{"https://elsewhere.example", "*", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		allowed, credentials := config.allowedOrigin(tt.origin)
+		if allowed != tt.allowed || credentials != tt.credentials {
+			t.Errorf("%q: got %q, %v, want %q, %v", tt.origin, allowed, credentials, tt.allowed, tt.credentials)
+		}
+	}
+
+	listed := Config{AllowedOrigins: []string{"http://localhost:3000"}}
+	if allowed, _ := listed.allowedOrigin("https://elsewhere.example"); allowed != "" {
+		t.Errorf("unlisted origin allowed as %q", allowed)
+	}
+}
+
+func TestCORSWildcardSendsNoCredentials(t *testing.T) {
+	handler := corsMiddleware(Config{AllowedOrigins: []string{"*"}})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, method := range []string{"GET", "OPTIONS"} {
+		req := httptest.NewRequest(method, "/api/game", nil)
+		req.Header.Set("Origin", "https://elsewhere.example")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+			t.Errorf("%s: Access-Control-Allow-Origin is %q, want *", method, got)
+		}
+		if got := rec.Header().Get("Access-Control-Allow-Credentials"); got != "" {
+			t.Errorf("%s: credentials allowed for a wildcard origin", method)
+		}
+	}
+}
+
+func TestCORSVariesOnOriginOnce(t *testing.T) {
+	cors := corsMiddleware(Config{AllowedOrigins: []string{"http://localhost:3000"}})
+	// Wrapped twice, as a router and its subrouter would
+	handler := cors(cors(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	req := httptest.NewRequest("GET", "/api/game", nil)
+	req.Header.Set("Origin", "http://localhost:3000")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if got := rec.Header().Values("Vary"); len(got) != 1 || got[0] != "Origin" {
+		t.Errorf("Vary is %q, want Origin once", got)
+	}
+}
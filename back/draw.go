@@ -0,0 +1,387 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"slices"
+	"strings"
+	"time"
+)
+
+// FIDE draw thresholds: the lower ones only let a player claim the draw, the
+// higher ones end the game automatically
+const (
+	CLAIMABLE_REPETITIONS = 3
+	AUTOMATIC_REPETITIONS = 5
+	CLAIMABLE_HALF_MOVES  = 100 // fifty-move rule
+	AUTOMATIC_HALF_MOVES  = 150 // seventy-five-move rule
+
+	// Not a chess rule: a cap on any game's length, see
+	// ChessService.SetMoveLimit. It keeps runaway self-play or a misbehaving
+	// client from growing a game without end, and sits well above the
+	// longest games played over the board (under 600 half-moves).
+	DEFAULT_MAX_HALF_MOVES = 1000
+	MAX_HALF_MOVES_LIMIT   = 100000
+)
+
+// positionKey identifies a position by piece placement, side to move,
+// castling rights and en passant square, the parts of a FEN the evaluation
+// cache keys on
+func (g *ChessGame) positionKey() string {
+	return strings.Join(strings.Fields(g.ToFEN())[:4], " ")
+}
+
+// zobristKeys hash what positionKey names: one key per piece on each square,
+// plus the side to move, each castling rook and each en passant file. XORing
+// together the keys of what a position has gives its hash, so a move only
+// has to XOR out and in what it changes.
+type zobristKeys struct {
+	pieces    [2][6][64]uint64
+	blackMove uint64
+	castling  [2][8]uint64
+	enPassant [8]uint64
+}
+
+// zobrist is seeded so hashes don't change from one run to the next
+var zobrist = newZobristKeys(rand.New(rand.NewSource(1)))
+
+func newZobristKeys(rng *rand.Rand) *zobristKeys {
+	keys := &zobristKeys{blackMove: rng.Uint64()}
+	for color := range keys.pieces {
+		for pieceType := range keys.pieces[color] {
+			for square := range keys.pieces[color][pieceType] {
+				keys.pieces[color][pieceType][square] = rng.Uint64()
+			}
+		}
+	}
+	for color := range keys.castling {
+		for col := range keys.castling[color] {
+			keys.castling[color][col] = rng.Uint64()
+		}
+	}
+	for col := range keys.enPassant {
+		keys.enPassant[col] = rng.Uint64()
+	}
+	return keys
+}
+
+func (z *zobristKeys) piece(piece *Piece, pos Position) uint64 {
+	color := 0
+	if piece.Color == Black {
+		color = 1
+	}
+	var pieceType int
+	switch piece.Type {
+	case Knight:
+		pieceType = 1
+	case Bishop:
+		pieceType = 2
+	case Rook:
+		pieceType = 3
+	case Queen:
+		pieceType = 4
+	case King:
+		pieceType = 5
+	}
+	return z.pieces[color][pieceType][pos.Row*8+pos.Col]
+}
+
+// positionHash hashes the position from scratch. MakeMove keeps g.hash up to
+// date without it.
+func (g *ChessGame) positionHash() uint64 {
+	hash := g.stateHash()
+	for i := 0; i < 8; i++ {
+		for j := 0; j < 8; j++ {
+			if piece := g.Board[i][j]; piece != nil {
+				hash ^= zobrist.piece(piece, Position{Row: i, Col: j})
+			}
+		}
+	}
+	return hash
+}
+
+// stateHash is the part of the hash that isn't piece placement: side to
+// move, castling rights and an en passant capture, counted the way a FEN
+// writes them
+func (g *ChessGame) stateHash() uint64 {
+	var hash uint64
+	if g.CurrentTurn == Black {
+		hash ^= zobrist.blackMove
+	}
+	for color, side := range []Color{White, Black} {
+		for _, rookCol := range g.castlingRookCols(side) {
+			if g.Chess960 || rookCol == 0 || rookCol == 7 {
+				hash ^= zobrist.castling[color][rookCol]
+			}
+		}
+	}
+	if g.enPassantField() != "-" {
+		hash ^= zobrist.enPassant[g.EnPassant.Col]
+	}
+	return hash
+}
+
+// hashSquares XORs the pieces on squares in or out of the hash, each square
+// once however often it is listed
+func (g *ChessGame) hashSquares(squares []Position) {
+	for i, square := range squares {
+		if slices.Contains(squares[:i], square) {
+			continue
+		}
+		if piece := g.Board[square.Row][square.Col]; piece != nil {
+			g.hash ^= zobrist.piece(piece, square)
+		}
+	}
+}
+
+// resetPositions starts the repetition history over at the current
+// position, for a position that was set up rather than played to
+func (g *ChessGame) resetPositions() {
+	g.hash = g.positionHash()
+	g.positions = []uint64{g.hash}
+	g.repetitions = 1
+}
+
+// countRepetitions is how many times the current position has occurred.
+// Nothing before the last capture or pawn move can come back, so the
+// history is only searched back that far.
+func (g *ChessGame) countRepetitions() int {
+	count := 1
+	for i := len(g.MoveHistory) - 1; i >= 0; i-- {
+		move := g.MoveHistory[i]
+		if move.Piece.Type == Pawn || move.CapturedPiece != nil {
+			break
+		}
+		if g.positions[i] == g.hash {
+			count++
+		}
+	}
+	return count
+}
+
+// repetitionCount is how many times the current position has occurred,
+// kept up to date by MakeMove so the search can check it at every node
+func (g *ChessGame) repetitionCount() int {
+	return g.repetitions
+}
+
+// DrawAvailable reports whether the side to move may claim a draw by
+// threefold repetition or the fifty-move rule
+func (g *ChessGame) DrawAvailable() bool {
+	if g.GameOver {
+		return false
+	}
+	return g.repetitionCount() >= CLAIMABLE_REPETITIONS || g.halfMoveClock() >= CLAIMABLE_HALF_MOVES
+}
+
+// ClaimDraw ends the game as a draw if a claimable draw condition is met
+func (g *ChessGame) ClaimDraw() error {
+	if g.GameOver {
+		return fmt.Errorf("game is over")
+	}
+
+	switch {
+	case g.repetitionCount() >= CLAIMABLE_REPETITIONS:
+		g.endInDraw("threefold_repetition")
+	case g.halfMoveClock() >= CLAIMABLE_HALF_MOVES:
+		g.endInDraw("fifty_move_rule")
+	default:
+		return fmt.Errorf("no draw can be claimed in this position")
+	}
+	return nil
+}
+
+func (g *ChessGame) checkAutomaticDraw() {
+	switch {
+	case g.repetitionCount() >= AUTOMATIC_REPETITIONS:
+		g.endInDraw("fivefold_repetition")
+	case g.halfMoveClock() >= AUTOMATIC_HALF_MOVES:
+		g.endInDraw("seventy_five_move_rule")
+	case g.insufficientMaterial():
+		g.endInDraw("insufficient_material")
+	case g.blockedPosition():
+		g.endInDraw("dead_position")
+	case g.moveLimit > 0 && len(g.MoveHistory) >= g.moveLimit:
+		g.endInDraw("move_limit")
+	}
+}
+
+// insufficientMaterial reports positions where no sequence of moves can mate:
+// bare kings, a single knight, or only bishops that all stand on one colour
+func (g *ChessGame) insufficientMaterial() bool {
+	knights := 0
+	bishopSquares := map[int]bool{}
+	for i := 0; i < 8; i++ {
+		for j := 0; j < 8; j++ {
+			piece := g.Board[i][j]
+			if piece == nil {
+				continue
+			}
+			switch piece.Type {
+			case King:
+			case Knight:
+				knights++
+			case Bishop:
+				bishopSquares[(i+j)%2] = true
+			default:
+				return false
+			}
+		}
+	}
+
+	switch knights {
+	case 0:
+		return len(bishopSquares) <= 1
+	case 1:
+		return len(bishopSquares) == 0
+	}
+	return false
+}
+
+// blockedPosition is a conservative test for dead positions with only kings
+// and pawns: every pawn is rammed head-on by an enemy pawn and has nothing to
+// capture, and neither king can get at an enemy pawn. Then no pawn can ever
+// move or be taken, and bare kings can't mate. Positions it can't prove dead
+// are left to the other draw rules.
+func (g *ChessGame) blockedPosition() bool {
+	kings := map[Color]Position{}
+	pawns := 0
+	for i := 0; i < 8; i++ {
+		for j := 0; j < 8; j++ {
+			piece := g.Board[i][j]
+			if piece == nil {
+				continue
+			}
+			switch piece.Type {
+			case King:
+				kings[piece.Color] = Position{Row: i, Col: j}
+			case Pawn:
+				pawns++
+				direction := 1
+				if piece.Color == White {
+					direction = -1
+				}
+				// A pawn on the edge rank can't come from a legal game, but
+				// nothing here should index off the board over it
+				if i+direction < 0 || i+direction > 7 {
+					return false
+				}
+				ahead := g.Board[i+direction][j]
+				if ahead == nil || ahead.Type != Pawn || ahead.Color == piece.Color {
+					return false
+				}
+				for _, col := range []int{j - 1, j + 1} {
+					if col < 0 || col > 7 {
+						continue
+					}
+					if target := g.Board[i+direction][col]; target != nil && target.Color != piece.Color {
+						return false
+					}
+				}
+			default:
+				return false
+			}
+		}
+	}
+
+	return pawns > 0 && len(kings) == 2 &&
+		!g.kingCanReachEnemyPawn(kings[White], White) &&
+		!g.kingCanReachEnemyPawn(kings[Black], Black)
+}
+
+// kingCanReachEnemyPawn walks the king over every square it could ever step
+// to, avoiding enemy pawn attacks, and reports whether an enemy pawn is within
+// reach
+func (g *ChessGame) kingCanReachEnemyPawn(from Position, color Color) bool {
+	seen := map[Position]bool{from: true}
+	queue := []Position{from}
+	for len(queue) > 0 {
+		pos := queue[0]
+		queue = queue[1:]
+
+		for dr := -1; dr <= 1; dr++ {
+			for dc := -1; dc <= 1; dc++ {
+				next := Position{Row: pos.Row + dr, Col: pos.Col + dc}
+				if !inBounds(next) || seen[next] {
+					continue
+				}
+				seen[next] = true
+
+				if piece := g.Board[next.Row][next.Col]; piece != nil {
+					if piece.Type == Pawn && piece.Color != color {
+						return true
+					}
+					continue
+				}
+				if !g.attackedByPawn(next, opponentColor(color)) {
+					queue = append(queue, next)
+				}
+			}
+		}
+	}
+	return false
+}
+
+func (g *ChessGame) attackedByPawn(pos Position, byColor Color) bool {
+	// Pawns attack towards the side they move to, so look one row back
+	row := pos.Row - 1
+	if byColor == White {
+		row = pos.Row + 1
+	}
+	for _, col := range []int{pos.Col - 1, pos.Col + 1} {
+		from := Position{Row: row, Col: col}
+		if !inBounds(from) {
+			continue
+		}
+		if piece := g.Board[from.Row][from.Col]; piece != nil && piece.Type == Pawn && piece.Color == byColor {
+			return true
+		}
+	}
+	return false
+}
+
+// DrawOffer is a draw one player has proposed and the other hasn't answered.
+// It lives on the game, so a client that reconnects still sees it.
+type DrawOffer struct {
+	OfferingColor Color     `json:"offeringColor"`
+	OfferedAt     time.Time `json:"offeredAt"`
+}
+
+// OfferDraw records color's draw offer. Any move made or taken back
+// withdraws it, so the opponent playing on is a decline.
+func (g *ChessGame) OfferDraw(color Color, now time.Time) error {
+	if g.GameOver {
+		return fmt.Errorf("game is over")
+	}
+	if g.DrawOffer != nil {
+		return fmt.Errorf("%s has already offered a draw", g.DrawOffer.OfferingColor)
+	}
+	g.DrawOffer = &DrawOffer{OfferingColor: color, OfferedAt: now}
+	return nil
+}
+
+// AnswerDrawOffer lets color accept or decline the opponent's pending offer.
+// Accepting ends the game as a draw by agreement.
+func (g *ChessGame) AnswerDrawOffer(color Color, accept bool) error {
+	if g.GameOver {
+		return fmt.Errorf("game is over")
+	}
+	if g.DrawOffer == nil {
+		return fmt.Errorf("no draw has been offered")
+	}
+	if g.DrawOffer.OfferingColor == color {
+		return fmt.Errorf("%s can't answer its own draw offer", color)
+	}
+
+	g.DrawOffer = nil
+	if accept {
+		g.endInDraw("agreement")
+	}
+	return nil
+}
+
+func (g *ChessGame) endInDraw(reason string) {
+	g.GameOver = true
+	g.Winner = "draw"
+	g.EndReason = reason
+}
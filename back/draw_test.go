@@ -0,0 +1,371 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestDeadPositionBlockedPawns(t *testing.T) {
+	// Rammed pawns on a, c, e and g files: every square a king could cross
+	// the chain on is guarded by an enemy pawn
+	game, err := LoadFEN("4k3/8/8/p1p1p1p1/P1P1P1P1/8/8/4K3 w - - 0 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !game.GameOver || game.EndReason != "dead_position" {
+		t.Errorf("got game over %v with %q, want a dead position draw", game.GameOver, game.EndReason)
+	}
+}
+
+func TestBlockedPawnsNotDead(t *testing.T) {
+	fens := map[string]string{
+		"knight left":          "4k3/8/8/p1p1p1p1/P1P1P1P1/8/8/4K2N w - - 0 1",
+		"pawn can capture":     "4k3/8/8/p1pp2p1/P1PP2P1/8/8/4K3 w - - 0 1",
+		"king reaches a pawn":  "4k3/8/8/p1p1p3/P1P1P3/8/8/4K3 w - - 0 1",
+		"pawn free to advance": "4k3/8/8/p1p1p1p1/P1P1P1P1/8/7P/4K3 w - - 0 1",
+	}
+	for name, fen := range fens {
+		game, err := LoadFEN(fen)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if game.blockedPosition() {
+			t.Errorf("%s: %s is not dead", name, fen)
+		}
+	}
+}
+
+func TestBlockedPositionEdgePawn(t *testing.T) {
+	// LoadFEN refuses this, so build the board by hand to make sure the
+	// pawn lookahead doesn't run off the board
+	game := &ChessGame{}
+	game.Board[0][0] = &Piece{Type: Pawn, Color: White}
+	game.Board[7][7] = &Piece{Type: Pawn, Color: Black}
+	game.Board[0][4] = &Piece{Type: King, Color: Black}
+	game.Board[7][4] = &Piece{Type: King, Color: White}
+	if game.blockedPosition() {
+		t.Error("pawns on the edge ranks aren't blocked")
+	}
+}
+
+func TestBackRankPawnRejected(t *testing.T) {
+	for _, fen := range []string{
+		"P3k3/8/8/8/8/8/8/4K3 w - - 0 1",
+		"4k3/8/8/8/8/8/8/p3K3 w - - 0 1",
+	} {
+		if _, err := LoadFEN(fen); err == nil {
+			t.Errorf("%s loaded with a pawn on the back rank", fen)
+		}
+	}
+
+	service := NewChessService()
+	if _, err := service.NewGame(NewGameRequest{StartingFEN: "P3k3/8/8/8/8/8/8/4K3 w - - 0 1"}); err == nil {
+		t.Error("new game started with a pawn on the eighth rank")
+	}
+}
+
+func TestMoveLimitDrawsGame(t *testing.T) {
+	game := NewChessGame()
+	game.moveLimit = 4
+	playSAN(t, game, "e4 e5 Nf3")
+	if game.GameOver {
+		t.Fatal("game over before the move limit")
+	}
+	playSAN(t, game, "Nc6")
+	if !game.GameOver || game.EndReason != "move_limit" || game.Winner != "draw" {
+		t.Errorf("got game over %v with %q, want a move_limit draw", game.GameOver, game.EndReason)
+	}
+}
+
+func TestMoveLimitSetOnService(t *testing.T) {
+	service := NewChessService()
+	if got := service.GetGame().moveLimit; got != DEFAULT_MAX_HALF_MOVES {
+		t.Errorf("default move limit %d, want %d", got, DEFAULT_MAX_HALF_MOVES)
+	}
+	if err := service.SetMoveLimit(0); err == nil {
+		t.Error("move limit of 0 accepted")
+	}
+	if err := service.SetMoveLimit(300); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.NewGame(NewGameRequest{Mode: ModePvP}); err != nil {
+		t.Fatal(err)
+	}
+	if got := service.GetGame().moveLimit; got != 300 {
+		t.Errorf("new game has move limit %d, want 300", got)
+	}
+}
+
+func TestMoveLimitSparesImportedGames(t *testing.T) {
+	service := NewChessService()
+	if err := service.SetMoveLimit(4); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.NewGame(NewGameRequest{Mode: ModePvP}); err != nil {
+		t.Fatal(err)
+	}
+	response, err := service.LoadPGN("1. e4 e5 2. Nf3 Nc6 3. Bb5 a6 *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.IsGameOver {
+		t.Fatal("imported game longer than the move limit was cut short")
+	}
+
+	if _, err := service.MakePlayerMove(MoveRequest{From: Position{7, 3}, To: Position{6, 4}}); err != nil {
+		t.Fatal(err)
+	}
+	if game := service.GetGame(); !game.GameOver || game.EndReason != "move_limit" {
+		t.Errorf("got game over %v with %q after the import, want a move_limit draw", game.GameOver, game.EndReason)
+	}
+}
+
+// TestIncrementalHashMatchesPosition plays random games, including Chess960
+// ones, checking after every move and take-back that the hash MakeMove keeps
+// is the one the position hashes to and that repetitions are counted as a
+// position key count would
+func TestIncrementalHashMatchesPosition(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	for i := 0; i < 60; i++ {
+		game := NewChessGame()
+		if i%3 == 0 {
+			game = NewChess960Game(rng)
+		}
+		keys := []string{game.positionKey()}
+		for ply := 0; ply < 200 && !game.GameOver; ply++ {
+			moves := game.LegalMoves()
+			if err := game.MakeMove(moves[rng.Intn(len(moves))]); err != nil {
+				t.Fatal(err)
+			}
+			keys = append(keys, game.positionKey())
+			if game.hash != game.positionHash() {
+				t.Fatalf("game %d ply %d: hash drifted at %s", i, ply, game.ToFEN())
+			}
+
+			count := 0
+			for _, key := range keys {
+				if key == keys[len(keys)-1] {
+					count++
+				}
+			}
+			if game.repetitionCount() != count {
+				t.Fatalf("game %d ply %d: %d repetitions counted, the position occurred %d times", i, ply, game.repetitionCount(), count)
+			}
+		}
+
+		for len(game.MoveHistory) > 0 {
+			if err := game.UndoMove(); err != nil {
+				t.Fatal(err)
+			}
+			if game.hash != game.positionHash() {
+				t.Fatalf("game %d: hash wrong after undo at %s", i, game.ToFEN())
+			}
+		}
+	}
+}
+
+func TestLostCastlingRightsAreNotARepetition(t *testing.T) {
+	game := NewChessGame()
+	playSAN(t, game, "e4 e5")
+	// Same squares after the kings walk back, but neither side can castle
+	playSAN(t, game, "Ke2 Ke7 Ke1 Ke8")
+	if got := game.repetitionCount(); got != 1 {
+		t.Fatalf("position without castling rights counted %d times, want 1", got)
+	}
+	playSAN(t, game, "Ke2 Ke7 Ke1 Ke8")
+	if got := game.repetitionCount(); got != 2 {
+		t.Errorf("repeated position counted %d times, want 2", got)
+	}
+}
+
+func TestLostEnPassantIsNotARepetition(t *testing.T) {
+	game := mustLoadFEN(t, "4k1n1/3p4/8/4P3/8/8/8/4K1N1 b - - 0 1")
+	// After d5 White may take en passant; after the knights go out and
+	// back it no longer can
+	playSAN(t, game, "d5 Nf3 Nf6 Ng1 Ng8")
+	if got := game.repetitionCount(); got != 1 {
+		t.Fatalf("position without en passant counted %d times, want 1", got)
+	}
+	playSAN(t, game, "Nf3 Nf6 Ng1 Ng8")
+	if got := game.repetitionCount(); got != 2 {
+		t.Errorf("repeated position counted %d times, want 2", got)
+	}
+}
+
+func TestRepetitionThresholds(t *testing.T) {
+	game := NewChessGame()
+	shuffle := "Nf3 Nf6 Ng1 Ng8"
+	playSAN(t, game, shuffle+" "+shuffle)
+	if game.GameOver || !game.DrawAvailable() {
+		t.Fatalf("threefold repetition: game over %v, draw available %v, want a claimable draw", game.GameOver, game.DrawAvailable())
+	}
+
+	claimed := game.CopyState()
+	if err := claimed.ClaimDraw(); err != nil || claimed.EndReason != "threefold_repetition" {
+		t.Errorf("claim after threefold repetition: %v, ended by %q", err, claimed.EndReason)
+	}
+
+	playSAN(t, game, shuffle)
+	if game.GameOver {
+		t.Fatal("game ended after fourfold repetition")
+	}
+	playSAN(t, game, shuffle)
+	if !game.GameOver || game.Winner != "draw" || game.EndReason != "fivefold_repetition" {
+		t.Errorf("fivefold repetition: game over %v with %q, want an automatic draw", game.GameOver, game.EndReason)
+	}
+}
+
+func TestHalfMoveThresholds(t *testing.T) {
+	game := mustLoadFEN(t, "r3k3/8/8/8/8/8/P7/R3K3 w - - 98 80")
+	playSAN(t, game, "Rb1")
+	if game.DrawAvailable() {
+		t.Fatal("draw available after 99 half-moves")
+	}
+	if err := game.CopyState().ClaimDraw(); err == nil {
+		t.Error("draw claimed after 99 half-moves")
+	}
+	playSAN(t, game, "Rb8")
+	if game.GameOver || !game.DrawAvailable() {
+		t.Fatalf("fifty-move rule: game over %v, draw available %v, want a claimable draw", game.GameOver, game.DrawAvailable())
+	}
+	if err := game.CopyState().ClaimDraw(); err != nil {
+		t.Errorf("claim after 100 half-moves: %v", err)
+	}
+
+	game = mustLoadFEN(t, "r3k3/8/8/8/8/8/P7/R3K3 w - - 149 120")
+	pawnMove := game.CopyState()
+	playSAN(t, pawnMove, "a3")
+	if pawnMove.GameOver {
+		t.Error("pawn move on the 150th half-move ended the game")
+	}
+	playSAN(t, game, "Rb1")
+	if !game.GameOver || game.Winner != "draw" || game.EndReason != "seventy_five_move_rule" {
+		t.Errorf("seventy-five-move rule: game over %v with %q, want an automatic draw", game.GameOver, game.EndReason)
+	}
+}
+
+func TestRepetitionsFollowUndoAndGoto(t *testing.T) {
+	service := NewChessService()
+	if _, err := service.NewGame(NewGameRequest{Mode: ModePvP}); err != nil {
+		t.Fatal(err)
+	}
+	playServiceSAN(t, service, "Nf3 Nf6 Ng1 Ng8 Nf3 Nf6 Ng1 Ng8")
+	if game := service.GetGame(); game.repetitionCount() != 3 || !game.DrawAvailable() {
+		t.Fatalf("start position counted %d times, draw available %v", game.repetitionCount(), game.DrawAvailable())
+	}
+
+	if _, err := service.UndoMove(); err != nil {
+		t.Fatal(err)
+	}
+	if game := service.GetGame(); game.repetitionCount() != 2 || game.DrawAvailable() {
+		t.Errorf("after undo: counted %d times, draw available %v, want 2 and no draw", game.repetitionCount(), game.DrawAvailable())
+	}
+
+	// A different move from here starts the count over for what follows
+	playServiceSAN(t, service, "Nh5")
+	if got := service.GetGame().repetitionCount(); got != 1 {
+		t.Errorf("new position counted %d times, want 1", got)
+	}
+
+	if _, err := service.GotoMove(4); err != nil {
+		t.Fatal(err)
+	}
+	if got := service.GetGame().repetitionCount(); got != 2 {
+		t.Errorf("back at move 4: counted %d times, want 2", got)
+	}
+	if _, err := service.GotoMove(0); err != nil {
+		t.Fatal(err)
+	}
+	if got := service.GetGame().repetitionCount(); got != 1 {
+		t.Errorf("back at the start: counted %d times, want 1", got)
+	}
+}
+
+// newPvPGame starts a two-player game and plays moves into it
+func newPvPGame(t *testing.T, moves string) *ChessService {
+	t.Helper()
+	service := NewChessService()
+	if _, err := service.NewGame(NewGameRequest{Mode: ModePvP}); err != nil {
+		t.Fatal(err)
+	}
+	playServiceSAN(t, service, moves)
+	return service
+}
+
+func TestDrawOfferAccepted(t *testing.T) {
+	service := newPvPGame(t, "e4")
+	if _, err := service.OfferDraw(Black); err == nil {
+		t.Error("Black offered a draw before making a move")
+	}
+	if _, err := service.OfferDraw(White); err != nil {
+		t.Fatal(err)
+	}
+
+	// A client coming back sees the offer
+	if offer := service.GetGameState().DrawOffer; offer == nil || offer.OfferingColor != White || offer.OfferedAt.IsZero() {
+		t.Fatalf("pending offer reads %+v", offer)
+	}
+	if _, err := service.AnswerDrawOffer(White, true); err == nil {
+		t.Error("White accepted its own offer")
+	}
+
+	response, err := service.AnswerDrawOffer(Black, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !response.IsGameOver || response.Winner != "draw" || response.EndReason != "agreement" || response.DrawOffer != nil {
+		t.Errorf("after accepting: over %v, winner %q, reason %q, offer %+v", response.IsGameOver, response.Winner, response.EndReason, response.DrawOffer)
+	}
+}
+
+func TestDrawOfferDeclined(t *testing.T) {
+	service := newPvPGame(t, "e4")
+	if _, err := service.OfferDraw(White); err != nil {
+		t.Fatal(err)
+	}
+	response, err := service.AnswerDrawOffer(Black, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.IsGameOver || response.DrawOffer != nil {
+		t.Errorf("after declining: over %v, offer %+v", response.IsGameOver, response.DrawOffer)
+	}
+	if _, err := service.AnswerDrawOffer(Black, true); err == nil {
+		t.Error("declined offer accepted")
+	}
+}
+
+func TestDrawOfferWithdrawn(t *testing.T) {
+	service := newPvPGame(t, "e4")
+	if _, err := service.OfferDraw(White); err != nil {
+		t.Fatal(err)
+	}
+	playServiceSAN(t, service, "e5")
+	if offer := service.GetGameState().DrawOffer; offer != nil {
+		t.Errorf("offer %+v still pending after a move", offer)
+	}
+	if _, err := service.AnswerDrawOffer(Black, true); err == nil {
+		t.Error("offer accepted after a move")
+	}
+
+	if _, err := service.OfferDraw(Black); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.UndoMove(); err != nil {
+		t.Fatal(err)
+	}
+	if offer := service.GetGameState().DrawOffer; offer != nil {
+		t.Errorf("offer %+v still pending after undo", offer)
+	}
+
+	playServiceSAN(t, service, "e5")
+	if _, err := service.OfferDraw(Black); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.Resign(White); err != nil {
+		t.Fatal(err)
+	}
+	if offer := service.GetGameState().DrawOffer; offer != nil {
+		t.Errorf("offer %+v still pending after resigning", offer)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// ============================================================================
+// OPENING NAMES
+// ============================================================================
+
+// Each entry names the position after its SAN move sequence from the standard
+// start. A line only needs to be listed where the name changes: positions on
+// the way to a longer listed line keep the name of the longest listed line
+// they start with. Once a game leaves every listed line it's out of book and
+// has no name.
+//
+//go:embed eco.json
+var openingsJSON []byte
+
+var openings = mustLoadOpenings(openingsJSON)
+
+// openingPrefixes holds every move sequence that leads into a listed line,
+// the lines themselves included
+var openingPrefixes = linePrefixes(openings)
+
+type Opening struct {
+	ECO   string `json:"eco"`
+	Name  string `json:"name"`
+	Moves string `json:"moves"` // SAN, space separated
+}
+
+type OpeningResponse struct {
+	Known  bool   `json:"known"`
+	ECO    string `json:"eco,omitempty"`
+	Name   string `json:"name,omitempty"`
+	Moves  string `json:"moves,omitempty"` // The named line
+	Plies  int    `json:"plies"`           // How many of the game's moves the named line covers
+	InBook bool   `json:"in_book"`         // Whether the game is still on the way into a listed line
+}
+
+// mustLoadOpenings panics on a malformed file so a bad entry stops the server
+// at startup instead of naming positions wrongly
+func mustLoadOpenings(data []byte) map[string]Opening {
+	byLine, err := loadOpenings(data)
+	if err != nil {
+		panic(fmt.Sprintf("invalid opening table: %v", err))
+	}
+	return byLine
+}
+
+// loadOpenings replays every line to check it's legal and keys it by its
+// moves in coordinate notation, the way the opening book is keyed
+func loadOpenings(data []byte) (map[string]Opening, error) {
+	var entries []Opening
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+
+	byLine := map[string]Opening{}
+	for _, entry := range entries {
+		game := NewChessGame()
+		var played []string
+		for _, token := range strings.Fields(entry.Moves) {
+			move, err := game.parseSAN(token)
+			if err != nil {
+				return nil, fmt.Errorf("%s %s: %w", entry.ECO, entry.Name, err)
+			}
+			played = append(played, moveCoordinates(move))
+			game.MakeMove(move)
+		}
+
+		line := strings.Join(played, " ")
+		if existing, ok := byLine[line]; ok {
+			return nil, fmt.Errorf("%s %s: same line as %s %s", entry.ECO, entry.Name, existing.ECO, existing.Name)
+		}
+		byLine[line] = entry
+	}
+	return byLine, nil
+}
+
+func linePrefixes(byLine map[string]Opening) map[string]bool {
+	prefixes := map[string]bool{}
+	for line := range byLine {
+		moves := strings.Fields(line)
+		for plies := 1; plies <= len(moves); plies++ {
+			prefixes[strings.Join(moves[:plies], " ")] = true
+		}
+	}
+	return prefixes
+}
+
+// OpeningName names the game's opening from the longest listed line its moves
+// start with. Games that left the listed lines, or didn't start from the
+// standard position, have none.
+func (g *ChessGame) OpeningName() OpeningResponse {
+	if g.Chess960 || g.StartFEN != "" {
+		return OpeningResponse{}
+	}
+
+	played := make([]string, len(g.MoveHistory))
+	for i, move := range g.MoveHistory {
+		played[i] = moveCoordinates(move)
+	}
+	if len(played) == 0 {
+		return OpeningResponse{InBook: true}
+	}
+	if !openingPrefixes[strings.Join(played, " ")] {
+		return OpeningResponse{}
+	}
+
+	for plies := len(played); plies > 0; plies-- {
+		opening, ok := openings[strings.Join(played[:plies], " ")]
+		if !ok {
+			continue
+		}
+		return OpeningResponse{
+			Known:  true,
+			ECO:    opening.ECO,
+			Name:   opening.Name,
+			Moves:  opening.Moves,
+			Plies:  plies,
+			InBook: true,
+		}
+	}
+	// On the way into a listed line but short of any named one
+	return OpeningResponse{InBook: true}
+}
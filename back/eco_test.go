@@ -0,0 +1,55 @@
+package main
+
+import "testing"
+
+func TestOpeningName(t *testing.T) {
+	tests := []struct {
+		moves  string
+		eco    string
+		plies  int
+		inBook bool
+	}{
+		{"", "", 0, true},
+		{"e4 c5", "B20", 2, true},
+		{"e4 c5 Nf3 d6 d4", "B50", 4, true}, // On the way to the Open Sicilian
+		{"e4 c5 Nf3 d6 d4 cxd4 Nxd4 Nf6 Nc3 a6", "B90", 10, true},
+		{"e4 c5 Nf3 d6 d4 cxd4 Nxd4 Nf6 Nc3 a6 Be3", "", 0, false},
+		{"h3 h6", "", 0, false},
+	}
+	for _, tt := range tests {
+		game := NewChessGame()
+		playSAN(t, game, tt.moves)
+		got := game.OpeningName()
+		if got.ECO != tt.eco || got.Plies != tt.plies || got.InBook != tt.inBook || got.Known != (tt.eco != "") {
+			t.Errorf("%q: got %+v, want %s after %d plies, in book %v", tt.moves, got, tt.eco, tt.plies, tt.inBook)
+		}
+	}
+}
+
+func TestOpeningNameEmptyOutOfBook(t *testing.T) {
+	game := NewChessGame()
+	playSAN(t, game, "e4 c5 Nf3 d6 d4 cxd4 Nxd4 Nf6 Nc3 a6 Be3 e5 Nb3")
+	if got := game.OpeningName(); got != (OpeningResponse{}) {
+		t.Errorf("out of book game still named: %+v", got)
+	}
+}
+
+func TestOpeningNameNonStandardStart(t *testing.T) {
+	game := mustLoadFEN(t, "rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1")
+	playSAN(t, game, "e4 c5")
+	if got := game.OpeningName(); got.Known {
+		t.Errorf("game set up from a FEN named %s", got.Name)
+	}
+}
+
+func TestLoadOpeningsRejectsBadLines(t *testing.T) {
+	for name, data := range map[string]string{
+		"illegal move":   `[{"eco": "X00", "name": "Bad", "moves": "e5"}]`,
+		"duplicate line": `[{"eco": "X00", "name": "A", "moves": "e4"}, {"eco": "X01", "name": "B", "moves": "e4"}]`,
+		"not json":       `{`,
+	} {
+		if _, err := loadOpenings([]byte(data)); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+)
+
+// ============================================================================
+// EVALUATION CACHE
+// ============================================================================
+
+const EVAL_CACHE_SIZE = 4096
+
+// EvalCacheStats is reported under /api/ai/stats
+type EvalCacheStats struct {
+	Size     int   `json:"size"`
+	Capacity int   `json:"capacity"`
+	Hits     int64 `json:"hits"`
+	Misses   int64 `json:"misses"`
+}
+
+type evalCacheEntry struct {
+	key        string
+	evaluation int
+}
+
+// evalCache is a fixed-size LRU of position evaluations, safe for concurrent
+// use
+type evalCache struct {
+	lock     sync.Mutex
+	capacity int
+	entries  map[string]*list.Element
+	order    *list.List // Most recently used first
+	hits     int64
+	misses   int64
+}
+
+func newEvalCache(capacity int) *evalCache {
+	return &evalCache{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// evalCacheKey identifies what an evaluation depends on: the position (not
+// the move clocks), the search depth (0 for a static evaluation) and the
+// evaluation and search settings. Draws that depend on how the position was reached are
+// not part of it.
+func evalCacheKey(game *ChessGame, depth int, mode EvalMode, settings AISettings) string {
+	return fmt.Sprintf("%s|%d|%s|%t|%d|%d", game.positionKey(), depth, mode, settings.UseQuiescence, settings.CheckExtension, settings.RecaptureExtension)
+}
+
+func (c *evalCache) get(key string) (int, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		return 0, false
+	}
+	c.hits++
+	c.order.MoveToFront(element)
+	return element.Value.(*evalCacheEntry).evaluation, true
+}
+
+func (c *evalCache) put(key string, evaluation int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		element.Value.(*evalCacheEntry).evaluation = evaluation
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&evalCacheEntry{key: key, evaluation: evaluation})
+	if c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*evalCacheEntry).key)
+	}
+}
+
+func (c *evalCache) stats() EvalCacheStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return EvalCacheStats{
+		Size:     c.order.Len(),
+		Capacity: c.capacity,
+		Hits:     c.hits,
+		Misses:   c.misses,
+	}
+}
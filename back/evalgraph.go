@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// ============================================================================
+// EVALUATION GRAPH
+// ============================================================================
+
+const (
+	EVAL_GRAPH_DEPTH     = 2
+	EVAL_GRAPH_MAX_DEPTH = 3
+)
+
+// EvalGraphPoint is the evaluation after one half-move
+type EvalGraphPoint struct {
+	Ply        int    `json:"ply"`
+	Move       string `json:"move"` // SAN
+	Evaluation int    `json:"evaluation"`
+}
+
+type EvalGraphResponse struct {
+	Depth       int              `json:"depth"`
+	Evaluations []EvalGraphPoint `json:"evaluations"`
+	Computed    int              `json:"computed"` // Positions searched for this request; the rest came from the cache
+}
+
+// evalGraphCache remembers the last graph so that after a few more moves only
+// the new tail has to be searched
+type evalGraphCache struct {
+	lock      sync.Mutex
+	depth     int
+	positions []string // FEN after each half-move
+	points    []EvalGraphPoint
+}
+
+// evaluate replays the game on a scratch board and scores the position after
+// every half-move, reusing cached scores for the longest matching prefix
+func (c *evalGraphCache) evaluate(ctx context.Context, ai *AIService, game *ChessGame, depth int) (*EvalGraphResponse, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	replay, err := game.startingPosition()
+	if err != nil {
+		return nil, fmt.Errorf("failed to rebuild starting position: %w", err)
+	}
+
+	if depth != c.depth {
+		c.depth, c.positions, c.points = depth, nil, nil
+	}
+
+	response := &EvalGraphResponse{Depth: depth, Evaluations: []EvalGraphPoint{}}
+	for ply, played := range game.MoveHistory {
+		move := Move{From: played.From, To: played.To, Promotion: played.Promotion}
+		san := replay.MoveToSAN(move)
+		replay.MakeMove(move)
+		fen := replay.ToFEN()
+
+		if ply < len(c.positions) && c.positions[ply] == fen {
+			response.Evaluations = append(response.Evaluations, c.points[ply])
+			continue
+		}
+		// The game diverged from the cached one here, so nothing after counts
+		c.positions, c.points = c.positions[:ply], c.points[:ply]
+
+		evaluation, err := ai.SearchEvaluation(ctx, replay.CopyState(), depth)
+		if err != nil {
+			return nil, err
+		}
+		point := EvalGraphPoint{Ply: ply + 1, Move: san, Evaluation: evaluation}
+		c.positions = append(c.positions, fen)
+		c.points = append(c.points, point)
+		response.Evaluations = append(response.Evaluations, point)
+		response.Computed++
+	}
+
+	return response, nil
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var fenPieceTypes = map[byte]PieceType{
+	'p': Pawn, 'n': Knight, 'b': Bishop, 'r': Rook, 'q': Queen, 'k': King,
+}
+
+// LoadFEN builds a new game from a FEN string. Castling rights may be given as
+// KQkq or, for Chess960, as Shredder-FEN rook files. The half-move clock and
+// full-move number are optional.
+func LoadFEN(fen string) (*ChessGame, error) {
+	fields := strings.Fields(fen)
+	if len(fields) < 4 || len(fields) > 6 {
+		return nil, fmt.Errorf("FEN must have 4 to 6 fields, got %d", len(fields))
+	}
+
+	game := &ChessGame{
+		KingMoved: map[Color]bool{White: true, Black: true},
+		RookMoved: map[Color]map[int]bool{White: {}, Black: {}},
+		StartFEN:  fen,
+	}
+
+	if err := game.parsePlacement(fields[0]); err != nil {
+		return nil, err
+	}
+	if game.countPieces(White, King) != 1 || game.countPieces(Black, King) != 1 {
+		return nil, fmt.Errorf("each side must have exactly one king")
+	}
+	for row := 0; row < 8; row += 7 {
+		for col := 0; col < 8; col++ {
+			if piece := game.Board[row][col]; piece != nil && piece.Type == Pawn {
+				square := Position{Row: row, Col: col}
+				return nil, fmt.Errorf("%s pawn on %s, pawns can't stand on the first or last rank", piece.Color, square.ToAlgebraic())
+			}
+		}
+	}
+
+	switch fields[1] {
+	case "w":
+		game.CurrentTurn = White
+	case "b":
+		game.CurrentTurn = Black
+	default:
+		return nil, fmt.Errorf("invalid side to move %q", fields[1])
+	}
+
+	// The side that just moved can't have left its own king in check
+	if waiting := opponentColor(game.CurrentTurn); game.IsInCheck(waiting) {
+		return nil, fmt.Errorf("%s is in check but it's %s's turn", waiting, game.CurrentTurn)
+	}
+
+	if err := game.parseCastling(fields[2]); err != nil {
+		return nil, err
+	}
+
+	if fields[3] != "-" {
+		square, err := ParseAlgebraic(fields[3])
+		if err != nil {
+			return nil, fmt.Errorf("invalid en passant square: %w", err)
+		}
+		if !game.couldBeEnPassant(square) {
+			return nil, fmt.Errorf("en passant square %s doesn't follow a %s pawn's double step", fields[3], opponentColor(game.CurrentTurn))
+		}
+		game.EnPassant = &square
+	}
+
+	if len(fields) > 4 {
+		clock, err := strconv.Atoi(fields[4])
+		if err != nil || clock < 0 {
+			return nil, fmt.Errorf("invalid half-move clock %q", fields[4])
+		}
+		game.StartHalfMoveClock = clock
+	}
+
+	if len(fields) > 5 {
+		number, err := strconv.Atoi(fields[5])
+		if err != nil || number < 1 {
+			return nil, fmt.Errorf("invalid full-move number %q", fields[5])
+		}
+		game.MoveNumberOffset = number - 1
+	}
+
+	game.resetPositions()
+	game.checkGameOver()
+	return game, nil
+}
+
+// couldBeEnPassant reports whether square is where the opponent's pawn
+// passed over with a double step: an empty square on the third rank from the
+// opponent's side, with the pawn just past it and its starting square empty
+func (g *ChessGame) couldBeEnPassant(square Position) bool {
+	pushed := opponentColor(g.CurrentTurn)
+	direction := 1
+	if pushed == White {
+		direction = -1
+	}
+	if square.Row != homeRow(pushed)+2*direction {
+		return false
+	}
+
+	pawn := g.Board[square.Row+direction][square.Col]
+	return pawn != nil && pawn.Type == Pawn && pawn.Color == pushed &&
+		g.Board[square.Row][square.Col] == nil && g.Board[square.Row-direction][square.Col] == nil
+}
+
+func (g *ChessGame) parsePlacement(placement string) error {
+	ranks := strings.Split(placement, "/")
+	if len(ranks) != 8 {
+		return fmt.Errorf("FEN board must have 8 ranks, got %d", len(ranks))
+	}
+
+	for i, rank := range ranks {
+		col := 0
+		for k := 0; k < len(rank); k++ {
+			c := rank[k]
+			if c >= '1' && c <= '8' {
+				col += int(c - '0')
+				continue
+			}
+
+			color := Black
+			if c >= 'A' && c <= 'Z' {
+				color = White
+				c += 'a' - 'A'
+			}
+			pieceType, ok := fenPieceTypes[c]
+			if !ok {
+				return fmt.Errorf("invalid piece %q in rank %d", rank[k], 8-i)
+			}
+			if col >= 8 {
+				return fmt.Errorf("rank %d must describe 8 squares", 8-i)
+			}
+			g.Board[i][col] = &Piece{Type: pieceType, Color: color}
+			col++
+		}
+		if col != 8 {
+			return fmt.Errorf("rank %d must describe 8 squares", 8-i)
+		}
+	}
+	return nil
+}
+
+func (g *ChessGame) parseCastling(field string) error {
+	if field == "-" {
+		return nil
+	}
+
+	for _, right := range field {
+		color, rookCol, err := g.castlingRook(right)
+		if err != nil {
+			return err
+		}
+		g.KingMoved[color] = false
+		g.RookMoved[color][rookCol] = false
+	}
+	return nil
+}
+
+// castlingRook finds the rook a single castling right refers to
+func (g *ChessGame) castlingRook(right rune) (Color, int, error) {
+	c := right
+	color := Black
+	if c >= 'A' && c <= 'Z' {
+		color = White
+		c += 'a' - 'A'
+	}
+
+	row := homeRow(color)
+	king := g.findKing(color)
+	if king == nil || king.Row != row {
+		return color, -1, fmt.Errorf("castling right %q without a king on its home rank", right)
+	}
+
+	rookCol := -1
+	switch {
+	case c == 'k':
+		// Outermost rook on the king side (X-FEN)
+		for col := 7; col > king.Col && rookCol < 0; col-- {
+			if g.isRookOf(color, row, col) {
+				rookCol = col
+			}
+		}
+	case c == 'q':
+		for col := 0; col < king.Col && rookCol < 0; col++ {
+			if g.isRookOf(color, row, col) {
+				rookCol = col
+			}
+		}
+	case c >= 'a' && c <= 'h':
+		if g.isRookOf(color, row, int(c-'a')) {
+			rookCol = int(c - 'a')
+		}
+		g.Chess960 = true
+	}
+	if rookCol < 0 {
+		return color, -1, fmt.Errorf("castling right %q has no matching rook", right)
+	}
+	return color, rookCol, nil
+}
+
+func (g *ChessGame) isRookOf(color Color, row, col int) bool {
+	piece := g.Board[row][col]
+	return piece != nil && piece.Type == Rook && piece.Color == color
+}
+
+// ToFEN returns the Forsyth-Edwards Notation of the current position. Chess960
+// games use Shredder-FEN castling fields (rook files instead of KQkq).
+func (g *ChessGame) ToFEN() string {
+	var sb strings.Builder
+
+	for i := 0; i < 8; i++ {
+		empty := 0
+		for j := 0; j < 8; j++ {
+			piece := g.Board[i][j]
+			if piece == nil {
+				empty++
+				continue
+			}
+			if empty > 0 {
+				sb.WriteString(fmt.Sprint(empty))
+				empty = 0
+			}
+			sb.WriteString(pieceSymbol(piece))
+		}
+		if empty > 0 {
+			sb.WriteString(fmt.Sprint(empty))
+		}
+		if i < 7 {
+			sb.WriteByte('/')
+		}
+	}
+
+	turn := "w"
+	if g.CurrentTurn == Black {
+		turn = "b"
+	}
+
+	return fmt.Sprintf("%s %s %s %s %d %d", sb.String(), turn, g.castlingField(),
+		g.enPassantField(), g.halfMoveClock(), g.fullMoveNumber())
+}
+
+// enPassantField names the en passant target only when the side to move has a
+// legal en passant capture, as strict FEN readers expect. This also keeps a
+// double push nobody can take from making the position look new for
+// repetition purposes.
+func (g *ChessGame) enPassantField() string {
+	if g.EnPassant == nil {
+		return "-"
+	}
+
+	target := *g.EnPassant
+	pawnRow := target.Row - 1
+	if g.CurrentTurn == White {
+		pawnRow = target.Row + 1
+	}
+	for _, col := range []int{target.Col - 1, target.Col + 1} {
+		from := Position{Row: pawnRow, Col: col}
+		if !inBounds(from) {
+			continue
+		}
+		piece := g.Board[from.Row][from.Col]
+		if piece != nil && piece.Type == Pawn && piece.Color == g.CurrentTurn &&
+			!g.wouldLeaveKingInCheck(Move{From: from, To: target}) {
+			return target.ToAlgebraic()
+		}
+	}
+	return "-"
+}
+
+func (g *ChessGame) castlingField() string {
+	field := ""
+	for _, color := range []Color{White, Black} {
+		for _, rookCol := range g.castlingRookCols(color) {
+			var symbol string
+			switch {
+			case g.Chess960:
+				symbol = string(rune('a' + rookCol))
+			case rookCol == 7:
+				symbol = "k"
+			case rookCol == 0:
+				symbol = "q"
+			default:
+				continue
+			}
+			if color == White {
+				symbol = strings.ToUpper(symbol)
+			}
+			field += symbol
+		}
+	}
+
+	if field == "" {
+		return "-"
+	}
+	return field
+}
+
+// castlingRookCols lists, king side first, the columns of the rooks the given
+// color may still castle with
+func (g *ChessGame) castlingRookCols(color Color) []int {
+	if g.KingMoved[color] {
+		return nil
+	}
+
+	row := homeRow(color)
+	var cols []int
+	for col, moved := range g.RookMoved[color] {
+		rook := g.Board[row][col]
+		if !moved && rook != nil && rook.Type == Rook && rook.Color == color {
+			cols = append(cols, col)
+		}
+	}
+
+	sort.Sort(sort.Reverse(sort.IntSlice(cols)))
+	return cols
+}
+
+// halfMoveClock counts the half-moves since the last pawn move or capture
+func (g *ChessGame) halfMoveClock() int {
+	clock := 0
+	for i := len(g.MoveHistory) - 1; i >= 0; i-- {
+		move := g.MoveHistory[i]
+		if move.Piece.Type == Pawn || move.CapturedPiece != nil {
+			return clock
+		}
+		clock++
+	}
+	// No reset since the game started, so carry on from the loaded position's clock
+	return clock + g.StartHalfMoveClock
+}
+
+// fullMoveNumber is the number of the move being played, counting on from the
+// loaded position's own move number. It goes up after each of Black's moves.
+func (g *ChessGame) fullMoveNumber() int {
+	plies := len(g.MoveHistory)
+	// Count from White's move of the starting full move
+	startTurn := g.CurrentTurn
+	if plies%2 == 1 {
+		startTurn = opponentColor(startTurn)
+	}
+	if startTurn == Black {
+		plies++
+	}
+	return g.MoveNumberOffset + plies/2 + 1
+}
+
+// Built once: ToFEN runs for every position the search visits
+var pieceSymbols = map[PieceType]map[Color]string{
+	King:   {White: "K", Black: "k"},
+	Queen:  {White: "Q", Black: "q"},
+	Rook:   {White: "R", Black: "r"},
+	Bishop: {White: "B", Black: "b"},
+	Knight: {White: "N", Black: "n"},
+	Pawn:   {White: "P", Black: "p"},
+}
+
+func pieceSymbol(piece *Piece) string {
+	if typeSymbols, exists := pieceSymbols[piece.Type]; exists {
+		if symbol, exists := typeSymbols[piece.Color]; exists {
+			return symbol
+		}
+	}
+
+	return "?"
+}
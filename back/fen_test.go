@@ -0,0 +1,107 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestToFENEnPassant plays real openings and compares against the FENs strict
+// readers expect, which only name an en passant square that can be taken
+func TestToFENEnPassant(t *testing.T) {
+	tests := []struct {
+		name  string
+		start string
+		moves string
+		want  string
+	}{
+		{"1.e4", "", "e4", "rnbqkbnr/pppppppp/8/8/4P3/8/PPPP1PPP/RNBQKBNR b KQkq - 0 1"},
+		{"Sicilian", "", "e4 c5", "rnbqkbnr/pp1ppppp/8/2p5/4P3/8/PPPP1PPP/RNBQKBNR w KQkq - 0 2"},
+		{"French Advance", "", "e4 e6 d4 d5 e5 c5", "rnbqkbnr/pp3ppp/4p3/2ppP3/3P4/8/PPP2PPP/RNBQKBNR w KQkq - 0 4"},
+		{"capture on offer", "", "e4 e6 e5 d5", "rnbqkbnr/ppp2ppp/4p3/3pP3/8/8/PPPP1PPP/RNBQKBNR w KQkq d6 0 3"},
+		{"black to capture", "", "d4 Nf6 c4 c5 d5 b5 e4 b4 a4", "rnbqkb1r/p2ppppp/5n2/2pP4/PpP1P3/8/1P3PPP/RNBQKBNR b KQkq a3 0 5"},
+		// bxc6 would open the fifth rank to the rook
+		{"pinned capturer", "8/2p5/8/KP5r/8/8/8/6k1 b - - 0 1", "c5", "8/8/8/KPp4r/8/8/8/6k1 w - - 0 2"},
+	}
+	for _, tt := range tests {
+		game := NewChessGame()
+		if tt.start != "" {
+			game = mustLoadFEN(t, tt.start)
+		}
+		playSAN(t, game, tt.moves)
+		if got := game.ToFEN(); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+		if got := mustLoadFEN(t, tt.want).ToFEN(); got != tt.want {
+			t.Errorf("%s: %s reloads as %s", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestLoadFENKeepsMoveNumber(t *testing.T) {
+	game := mustLoadFEN(t, "rnbqkbnr/pppppppp/8/8/4P3/8/PPPP1PPP/RNBQKBNR b KQkq - 0 20")
+	if got := game.ToFEN(); got != "rnbqkbnr/pppppppp/8/8/4P3/8/PPPP1PPP/RNBQKBNR b KQkq - 0 20" {
+		t.Errorf("reloaded as %s", got)
+	}
+
+	playSAN(t, game, "Nf6")
+	if got, want := game.ToFEN(), "rnbqkb1r/pppppppp/5n2/8/4P3/8/PPPP1PPP/RNBQKBNR w KQkq - 1 21"; got != want {
+		t.Errorf("after Black's move: %s, want %s", got, want)
+	}
+	playSAN(t, game, "e5")
+	if got, want := game.ToFEN(), "rnbqkb1r/pppppppp/5n2/4P3/8/8/PPPP1PPP/RNBQKBNR b KQkq - 0 21"; got != want {
+		t.Errorf("after White's move: %s, want %s", got, want)
+	}
+
+	pgn, err := game.ToPGN(Black)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(pgn, "20... Nf6 21. e5") {
+		t.Errorf("moves not numbered from 20 in\n%s", pgn)
+	}
+	loaded, err := LoadPGN(pgn)
+	if err != nil {
+		t.Fatalf("%v in\n%s", err, pgn)
+	}
+	if loaded.ToFEN() != game.ToFEN() {
+		t.Errorf("re-imported to %s, want %s", loaded.ToFEN(), game.ToFEN())
+	}
+
+	for _, fen := range []string{
+		"4k3/8/8/8/8/8/8/4K3 w - - 0 0",
+		"4k3/8/8/8/8/8/8/4K3 w - - 0 -3",
+		"4k3/8/8/8/8/8/8/4K3 w - - 0 twenty",
+	} {
+		if _, err := LoadFEN(fen); err == nil {
+			t.Errorf("%s loaded", fen)
+		}
+	}
+}
+
+func TestLoadFENRejectsWaitingSideInCheck(t *testing.T) {
+	for _, tt := range []struct {
+		fen  string
+		want string
+	}{
+		{"4k3/8/8/8/8/8/4R3/4K3 w - - 0 1", "black is in check but it's white's turn"},
+		{"4k3/8/3N4/8/8/8/8/4K3 w - - 0 1", "black is in check but it's white's turn"},
+		{"4k3/8/8/8/8/8/3p4/4K3 b - - 0 1", "white is in check but it's black's turn"},
+		{"4k3/8/8/b7/8/8/8/4K3 b - - 0 1", "white is in check but it's black's turn"},
+	} {
+		_, err := LoadFEN(tt.fen)
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("%s: %v, want %q", tt.fen, err, tt.want)
+		}
+		if _, err := NewChessService().NewGame(NewGameRequest{StartingFEN: tt.fen}); err == nil {
+			t.Errorf("%s: new game started", tt.fen)
+		}
+	}
+
+	// The side to move being in check is an ordinary position
+	for _, fen := range []string{
+		"4k3/8/8/8/8/8/4R3/4K3 b - - 0 1",
+		"4k3/8/8/b7/8/8/8/4K3 w - - 0 1",
+	} {
+		mustLoadFEN(t, fen)
+	}
+}
@@ -1,6 +1,13 @@
 package main
 
-import "fmt"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
 
 type Color string
 type PieceType string
@@ -24,6 +31,29 @@ type Position struct {
 	Col int `json:"col"`
 }
 
+// Row 0 is Black's back rank (rank 8) and column 0 the a-file, whichever way
+// the board is drawn. Go through these helpers rather than redoing the
+// arithmetic by hand.
+
+// ToAlgebraic names the square, e.g. "e4"
+func (p Position) ToAlgebraic() string {
+	return string(rune('a'+p.Col)) + string(rune('8'-p.Row))
+}
+
+// ParseAlgebraic reads a square name such as "e4"
+func ParseAlgebraic(name string) (Position, error) {
+	if len(name) != 2 || name[0] < 'a' || name[0] > 'h' || name[1] < '1' || name[1] > '8' {
+		return Position{}, fmt.Errorf("invalid square %q", name)
+	}
+	return Position{Row: int('8' - name[1]), Col: int(name[0] - 'a')}, nil
+}
+
+// Flipped is the same square seen from Black's side of the board. Flipping
+// twice gives back the original square.
+func (p Position) Flipped() Position {
+	return Position{Row: 7 - p.Row, Col: 7 - p.Col}
+}
+
 type Piece struct {
 	Type  PieceType `json:"type"`
 	Color Color     `json:"color"`
@@ -43,12 +73,92 @@ type Move struct {
 	IsEnPassant   bool      `json:"isEnPassant,omitempty"`
 	IsCastle      bool      `json:"isCastle,omitempty"`
 	IsPromotion   bool      `json:"isPromotion,omitempty"`
+	Promotion     PieceType `json:"promotion,omitempty"`
 }
 
+var promotionPieces = []PieceType{Queen, Rook, Bishop, Knight}
+
 // API Types
 type MoveRequest struct {
-	From Position `json:"from"`
-	To   Position `json:"to"`
+	From      Position  `json:"from"`
+	To        Position  `json:"to"`
+	Promotion PieceType `json:"promotion,omitempty"` // Defaults to queen
+	ThinkMs   int       `json:"thinkMs,omitempty"`   // Time for the AI's reply to this move only; 0 keeps the configured limit
+}
+
+type NewGameRequest struct {
+	Mode         GameMode      `json:"mode,omitempty"` // "pvai" (default) or "pvp"
+	Chess960     bool          `json:"chess960"`
+	StartingFEN  string        `json:"startingFen,omitempty"`
+	Handicap     []PieceType   `json:"handicap,omitempty"`     // Pieces the AI starts without, e.g. ["queen"] for queen odds
+	HumanColor   Color         `json:"humanColor,omitempty"`   // "white" (default) or "black"
+	AIDifficulty string        `json:"aiDifficulty,omitempty"` // Preset name, see SetDifficulty
+	Depth        *int          `json:"depth,omitempty"`        // Overrides the preset's depth
+	TimeControl  *TimeControl  `json:"timeControl,omitempty"`
+	Coach        *CoachOptions `json:"coach,omitempty"` // Review each player move for blunders, pvai only
+}
+
+// CoachOptions turn on live blunder warnings for a game
+type CoachOptions struct {
+	BlunderThreshold int `json:"blunderThreshold,omitempty"` // Centipawns; defaults to the game review's blunder threshold
+}
+
+// GameMode says whether the AI plays one side or two people share the board
+type GameMode string
+
+const (
+	ModePvAI GameMode = "pvai"
+	ModePvP  GameMode = "pvp"
+)
+
+// TimeControl is the game's clock setting. The server doesn't run the
+// players' clocks; it records the setting and the AI budgets its moves by it.
+type TimeControl struct {
+	InitialMs   int64 `json:"initialMs"`
+	IncrementMs int64 `json:"incrementMs"`
+}
+
+const (
+	MAX_TIME_CONTROL_INITIAL   = 3 * time.Hour
+	MAX_TIME_CONTROL_INCREMENT = time.Minute
+)
+
+func (tc *TimeControl) validate() error {
+	if tc.InitialMs <= 0 || tc.InitialMs > MAX_TIME_CONTROL_INITIAL.Milliseconds() {
+		return fmt.Errorf("initialMs must be between 1 and %d, got %d", MAX_TIME_CONTROL_INITIAL.Milliseconds(), tc.InitialMs)
+	}
+	if tc.IncrementMs < 0 || tc.IncrementMs > MAX_TIME_CONTROL_INCREMENT.Milliseconds() {
+		return fmt.Errorf("incrementMs must be between 0 and %d, got %d", MAX_TIME_CONTROL_INCREMENT.Milliseconds(), tc.IncrementMs)
+	}
+	return nil
+}
+
+// moveBudget is how long the AI may think per move, budgeted the way a UCI
+// "go wtime/winc" is; 0 without a time control
+func (tc *TimeControl) moveBudget() time.Duration {
+	if tc == nil {
+		return 0
+	}
+	return time.Duration(tc.InitialMs/UCI_MOVES_TO_GO+tc.IncrementMs/2) * time.Millisecond
+}
+
+// pgnTag writes the time control as a PGN TimeControl tag, e.g. "300+5"
+func (tc *TimeControl) pgnTag() string {
+	return fmt.Sprintf("%d+%d", tc.InitialMs/1000, tc.IncrementMs/1000)
+}
+
+// DrawOfferRequest offers a draw, or answers the opponent's offer
+type DrawOfferRequest struct {
+	Action string `json:"action"`          // "offer", "accept" or "decline"
+	Color  Color  `json:"color,omitempty"` // The player acting; against the AI always the human, who may leave it out
+}
+
+type ResignRequest struct {
+	Color Color `json:"color,omitempty"` // The player resigning; against the AI always the human, who may leave it out
+}
+
+type GotoRequest struct {
+	MoveIndex int `json:"moveIndex"`
 }
 
 type ChangeDepthRequest struct {
@@ -56,14 +166,42 @@ type ChangeDepthRequest struct {
 }
 
 type GameResponse struct {
-	Board       [][]Square `json:"board"`
-	IsGameOver  bool       `json:"isGameOver"`
-	Winner      string     `json:"winner,omitempty"`
-	IsCheck     bool       `json:"isCheck"`
-	CurrentTurn string     `json:"currentTurn"`
-	LastMove    *Move      `json:"lastMove,omitempty"`
-	AIThinking  bool       `json:"aiThinking,omitempty"`
-	MoveCount   int        `json:"moveCount"`
+	Board          [][]Square      `json:"board"`
+	IsGameOver     bool            `json:"isGameOver"`
+	Winner         string          `json:"winner,omitempty"`
+	IsCheck        bool            `json:"isCheck"`
+	CurrentTurn    string          `json:"currentTurn"`
+	LastMove       *MoveSummary    `json:"lastMove,omitempty"`
+	AIThinking     bool            `json:"aiThinking,omitempty"`
+	MoveCount      int             `json:"moveCount"`      // Half-moves played
+	FullMoveNumber int             `json:"fullMoveNumber"` // The move number the FEN and PGN use for the side to move
+	FEN            string          `json:"fen"`
+	EndReason      string          `json:"endReason,omitempty"`
+	DrawAvailable  bool            `json:"drawAvailable"`
+	HumanColor     string          `json:"humanColor"`          // Which way the frontend should orient the board
+	AIThinkMs      int64           `json:"aiThinkMs,omitempty"` // Time the AI spent on its reply, if it made one
+	Perspective    string          `json:"perspective"`         // Side the board and lastMove are laid out from
+	Mode           GameMode        `json:"mode"`
+	TimeControl    *TimeControl    `json:"timeControl,omitempty"`
+	Alternatives   []CandidateMove `json:"alternatives,omitempty"` // The AI's ranked candidates, if asked for
+	Coach          *CoachReport    `json:"coach,omitempty"`        // Review of the player's move, if the game has a coach
+	DrawOffer      *DrawOffer      `json:"drawOffer,omitempty"`    // A draw offer still waiting for an answer
+
+	CapturedByWhite []PieceType `json:"capturedByWhite"`
+	CapturedByBlack []PieceType `json:"capturedByBlack"`
+}
+
+// ExportResponse is everything needed to save or share a game in one payload.
+// Fields may be added over time but existing ones keep their name and meaning.
+type ExportResponse struct {
+	FEN       string   `json:"fen"`                 // Current position
+	StartFEN  string   `json:"startFen,omitempty"`  // Only set for non-standard starting positions
+	PGN       string   `json:"pgn"`                 // Full game including headers
+	Moves     []string `json:"moves"`               // SAN, in order, from the starting position
+	Result    string   `json:"result"`              // "1-0", "0-1", "1/2-1/2" or "*" while in progress
+	EndReason string   `json:"endReason,omitempty"` // e.g. "checkmate", "stalemate"
+	MoveCount int      `json:"moveCount"`           // Half-moves played
+	Chess960  bool     `json:"chess960"`
 }
 
 type ChessGame struct {
@@ -71,23 +209,150 @@ type ChessGame struct {
 	CurrentTurn Color
 	GameOver    bool
 	Winner      string
+	EndReason   string
 	MoveHistory []Move
-	EnPassant   *Position // For en passant captures
+	undoStack   []UndoInfo // One per MoveHistory entry
+	EnPassant   *Position  // For en passant captures
 	KingMoved   map[Color]bool
 	RookMoved   map[Color]map[int]bool // [color][column] -> has moved
+	Chess960    bool
+	hash        uint64       // Zobrist hash of the current position, see positionHash
+	positions   []uint64     // Hash of every position since the start, the current one last
+	repetitions int          // Times the current position has occurred
+	TimeControl *TimeControl // nil for an untimed game
+	DrawOffer   *DrawOffer   // Pending draw offer, withdrawn by any move
+	moveLimit   int          // Half-moves after which the game is drawn, 0 for no limit
+
+	// Set when the game didn't start from the standard position
+	StartFEN           string
+	StartHalfMoveClock int
+	MoveNumberOffset   int // Full moves played before the start position
+
+	// The side to move's legal moves, kept from the game-over check that runs
+	// after every move so a search doesn't generate them a second time
+	legalMoves      []Move
+	legalMovesKnown bool
+}
+
+// UndoInfo is what a move overwrote that the Move itself doesn't record, so
+// UndoMove can put it back instead of working castling, en passant and
+// promotion out in reverse. The half-move clock needs nothing, it is counted
+// from MoveHistory.
+type UndoInfo struct {
+	CaptureSquare Position // Differs from the move's To for en passant
+	CastleRookCol int      // -1 unless the move castled
+	EnPassant     *Position
+	KingMoved     bool       // The mover's flag before the move
+	RookFlags     []RookFlag // RookMoved entries the move changed
+	Repetitions   int
+	GameOver      bool
+	Winner        string
+	EndReason     string
+}
+
+// RookFlag is one RookMoved entry as it was. Absent entries matter too: only
+// castling rooks have one.
+type RookFlag struct {
+	Color   Color
+	Col     int
+	Moved   bool
+	Present bool
 }
 
+// ChessService holds the one game the server plays. Every method holds mu
+// for its whole run, so a reset or a move lands wholly before or after any
+// other. The AI searches a snapshot without it and applies its move with
+// applyAIMove.
 type ChessService struct {
-	game *ChessGame
+	mu      sync.Mutex
+	game    *ChessGame
+	version int // Bumped by every change to the game or the sides, so a search can tell its snapshot went stale
+
+	// startPosition and line let GotoMove rebuild any earlier position while
+	// remembering the moves after it, so the user can step forward again
+	startPosition *ChessGame
+	line          []Move
+
+	rng *rand.Rand // Chess960 setups
+
+	mode          GameMode
+	aiColor       Color // The side the AI plays; the human has the other
+	hopelessMoves int   // The AI's searches in a row that found it lost, see ResignPolicy
+
+	coachThreshold int // Loss that makes a player move a blunder; 0 without a coach
+	moveLimit      int // Half-moves after which a game is drawn, see SetMoveLimit
+
+	aiSearch *liveSearch // The AI's search for its move, while one runs
+}
+
+// liveSearch is the AI's search for its move in this game. It is kept with
+// the game so stopping it can't reach any other search.
+type liveSearch struct {
+	service   *ChessService
+	cancel    context.CancelFunc
+	bestSoFar *Move // Best move of its deepest finished iteration
 }
 
 func NewChessService() *ChessService {
-	return &ChessService{
-		game: NewChessGame(),
+	s := &ChessService{
+		rng:       rand.New(rand.NewSource(time.Now().UnixNano())),
+		mode:      ModePvAI,
+		aiColor:   Black,
+		moveLimit: DEFAULT_MAX_HALF_MOVES,
 	}
+	s.setGame(NewChessGame())
+	return s
+}
+
+// SetMoveLimit caps how many half-moves a game may run before it is drawn
+// with "move_limit", for the current game and every later one. Moves read
+// from an imported PGN are never cut short, the cap only ends the game on
+// the next move played.
+func (s *ChessService) SetMoveLimit(halfMoves int) error {
+	if halfMoves < 1 || halfMoves > MAX_HALF_MOVES_LIMIT {
+		return fmt.Errorf("move limit must be between 1 and %d half-moves, got %d", MAX_HALF_MOVES_LIMIT, halfMoves)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.moveLimit = halfMoves
+	s.game.moveLimit = halfMoves
+	s.startPosition.moveLimit = halfMoves
+	return nil
+}
+
+// SetSeed makes Chess960 start positions reproducible
+func (s *ChessService) SetSeed(seed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rng = rand.New(rand.NewSource(seed))
+}
+
+func (s *ChessService) setGame(game *ChessGame) {
+	game.moveLimit = s.moveLimit
+	s.game = game
+	s.version++
+	s.startPosition = game.CopyState()
+	s.line = nil
+	s.hopelessMoves = 0
 }
 
+var standardBackRank = []PieceType{Rook, Knight, Bishop, Queen, King, Bishop, Knight, Rook}
+
 func NewChessGame() *ChessGame {
+	return newChessGameWithBackRank(standardBackRank)
+}
+
+// NewChess960Game starts a Fischer Random game from a random legal back rank
+func NewChess960Game(rng *rand.Rand) *ChessGame {
+	game := newChessGameWithBackRank(generateChess960BackRank(rng))
+	game.Chess960 = true
+	game.StartFEN = game.ToFEN()
+	// Castling keys depend on the variant, so hash again now it's known
+	game.resetPositions()
+	return game
+}
+
+func newChessGameWithBackRank(pieceOrder []PieceType) *ChessGame {
 	game := &ChessGame{
 		CurrentTurn: White,
 		GameOver:    false,
@@ -95,26 +360,28 @@ func NewChessGame() *ChessGame {
 		RookMoved:   make(map[Color]map[int]bool),
 	}
 	
+	// Castling rooks are keyed by their starting column
 	game.RookMoved[White] = make(map[int]bool)
 	game.RookMoved[Black] = make(map[int]bool)
-	game.RookMoved[White][0] = false  // Queen side
-	game.RookMoved[White][7] = false  // King side
-	game.RookMoved[Black][0] = false
-	game.RookMoved[Black][7] = false
+	for col, pieceType := range pieceOrder {
+		if pieceType == Rook {
+			game.RookMoved[White][col] = false
+			game.RookMoved[Black][col] = false
+		}
+	}
 	
-	game.initializeBoard()
+	game.initializeBoard(pieceOrder)
+	game.resetPositions()
 	return game
 }
 
-func (g *ChessGame) initializeBoard() {
+func (g *ChessGame) initializeBoard(pieceOrder []PieceType) {
 	for i := 0; i < 8; i++ {
 		for j := 0; j < 8; j++ {
 			g.Board[i][j] = nil
 		}
 	}
 	
-	pieceOrder := []PieceType{Rook, Knight, Bishop, Queen, King, Bishop, Knight, Rook}
-	
 	for j, pieceType := range pieceOrder {
 		g.Board[0][j] = &Piece{Type: pieceType, Color: Black}
 	}
@@ -130,42 +397,502 @@ func (g *ChessGame) initializeBoard() {
 	}
 }
 
+// removeHandicapPiece takes the queenside-most piece of the given type off
+// color's back rank, the traditional choice for rook and knight odds. Taking
+// a rook also drops castling with it.
+func (g *ChessGame) removeHandicapPiece(color Color, pieceType PieceType) error {
+	if !isPromotionPiece(pieceType) {
+		return fmt.Errorf("handicap must be a queen, rook, bishop or knight, got %q", pieceType)
+	}
+
+	row := homeRow(color)
+	for col := 0; col < 8; col++ {
+		piece := g.Board[row][col]
+		if piece != nil && piece.Type == pieceType && piece.Color == color {
+			g.Board[row][col] = nil
+			delete(g.RookMoved[color], col)
+			g.legalMovesKnown = false
+			return nil
+		}
+	}
+	return fmt.Errorf("no %s left to remove for the handicap", pieceType)
+}
+
 func (s *ChessService) GetGameState() *GameResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.gameState()
+}
+
+func (s *ChessService) gameState() *GameResponse {
+	capturedByWhite, capturedByBlack := s.game.CapturedPieces()
 	return &GameResponse{
-		Board:       s.game.GetBoardForFrontend(),
-		IsGameOver:  s.game.GameOver,
-		Winner:      s.game.Winner,
-		IsCheck:     s.game.IsInCheck(s.game.CurrentTurn),
-		CurrentTurn: string(s.game.CurrentTurn),
-		LastMove:    s.game.GetLastMove(),
-		MoveCount:   len(s.game.MoveHistory),
+		Board:          s.game.GetBoardForFrontend(),
+		IsGameOver:     s.game.GameOver,
+		Winner:         s.game.Winner,
+		EndReason:      s.game.EndReason,
+		IsCheck:        s.game.IsInCheck(s.game.CurrentTurn),
+		CurrentTurn:    string(s.game.CurrentTurn),
+		LastMove:       s.game.LastMoveSummary(),
+		MoveCount:      len(s.game.MoveHistory),
+		FullMoveNumber: s.game.fullMoveNumber(),
+		FEN:            s.game.ToFEN(),
+		DrawAvailable:  s.game.DrawAvailable(),
+		HumanColor:     string(opponentColor(s.aiColor)),
+		Mode:           s.mode,
+		TimeControl:    s.game.TimeControl,
+		DrawOffer:      s.game.DrawOffer,
+		Perspective:    string(White),
+
+		CapturedByWhite: capturedByWhite,
+		CapturedByBlack: capturedByBlack,
 	}
 }
 
 func (s *ChessService) MakePlayerMove(moveReq MoveRequest) (*GameResponse, error) {
-	move := Move{From: moveReq.From, To: moveReq.To}
+	response, _, err := s.makePlayerMove(moveReq, false)
+	return response, err
+}
+
+// makePlayerMove is MakePlayerMove that, if keepBefore is set, also returns
+// a copy of the position the move was played from
+func (s *ChessService) makePlayerMove(moveReq MoveRequest, keepBefore bool) (*GameResponse, *ChessGame, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	move := Move{From: moveReq.From, To: moveReq.To, Promotion: moveReq.Promotion}
 	
-	if !s.game.IsValidMove(move) {
-		return nil, fmt.Errorf("invalid move from %v to %v", moveReq.From, moveReq.To)
+	if s.game.GameOver {
+		return nil, nil, &MoveError{From: moveReq.From, To: moveReq.To, Reason: RejectGameOver}
+	}
+	if reason := s.game.ValidateMove(move); reason != "" {
+		return nil, nil, &MoveError{From: moveReq.From, To: moveReq.To, Reason: reason}
 	}
 	
+	var before *ChessGame
+	if keepBefore {
+		before = s.game.CopyState()
+	}
 	err := s.game.MakeMove(move)
+	if err != nil {
+		return nil, nil, err
+	}
+	s.version++
+	
+	return s.gameState(), before, nil
+}
+
+// NewGame checks every option before replacing the current game, so a bad
+// request leaves the game as it was
+func (s *ChessService) NewGame(req NewGameRequest) (*GameResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	mode := ModePvAI
+	switch req.Mode {
+	case "", ModePvAI:
+	case ModePvP:
+		mode = ModePvP
+	default:
+		return nil, fmt.Errorf("mode must be %q or %q, got %q", ModePvAI, ModePvP, req.Mode)
+	}
+
+	aiColor := Black
+	switch req.HumanColor {
+	case "", White:
+	case Black:
+		aiColor = White
+	default:
+		return nil, fmt.Errorf("human color must be %q or %q, got %q", White, Black, req.HumanColor)
+	}
+
+	if req.TimeControl != nil {
+		if err := req.TimeControl.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	coachThreshold := 0
+	if req.Coach != nil {
+		if mode == ModePvP {
+			return nil, fmt.Errorf("coach is only available against the AI")
+		}
+		coachThreshold = req.Coach.BlunderThreshold
+		if coachThreshold == 0 {
+			coachThreshold = DefaultAnnotationThresholds().Blunder
+		}
+		if coachThreshold < 0 || coachThreshold > MAX_EVAL {
+			return nil, fmt.Errorf("blunderThreshold must be between 1 and %d, got %d", MAX_EVAL, coachThreshold)
+		}
+	}
+
+	var game *ChessGame
+	switch {
+	case req.StartingFEN != "" && (req.Chess960 || len(req.Handicap) > 0):
+		return nil, fmt.Errorf("startingFen can't be combined with chess960 or handicap")
+	case req.StartingFEN != "":
+		var err error
+		if game, err = LoadFEN(req.StartingFEN); err != nil {
+			return nil, fmt.Errorf("invalid startingFen: %w", err)
+		}
+	case req.Chess960:
+		game = NewChess960Game(s.rng)
+	default:
+		game = NewChessGame()
+	}
+
+	// Material odds come off the AI's side
+	for _, pieceType := range req.Handicap {
+		if err := game.removeHandicapPiece(aiColor, pieceType); err != nil {
+			return nil, err
+		}
+	}
+	if len(req.Handicap) > 0 {
+		game.StartFEN = game.ToFEN()
+		game.resetPositions()
+	}
+
+	game.TimeControl = req.TimeControl
+	s.setGame(game)
+	s.mode = mode
+	s.aiColor = aiColor
+	s.coachThreshold = coachThreshold
+	return s.gameState(), nil
+}
+
+// AIColor is the side the AI plays in the current game
+func (s *ChessService) AIColor() Color {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.aiColor
+}
+
+// Mode says whether the current game is against the AI or two-player
+func (s *ChessService) Mode() GameMode {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.mode
+}
+
+// CoachThreshold is the loss that makes a player move a blunder, 0 if the
+// game has no coach
+func (s *ChessService) CoachThreshold() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.coachThreshold
+}
+
+// engineColor is the side the AI plays for the PGN player tags, "" in a
+// two-player game
+func (s *ChessService) engineColor() Color {
+	if s.mode == ModePvP {
+		return ""
+	}
+	return s.aiColor
+}
+
+// SwapSides hands the AI the side the human was playing and the human the
+// AI's. The board is left as it is.
+func (s *ChessService) SwapSides() *GameResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.aiColor = opponentColor(s.aiColor)
+	s.hopelessMoves = 0
+	s.version++
+	return s.gameState()
+}
+
+// IsAITurn reports whether the AI is to move in a game still in progress.
+// It never is in a two-player game.
+func (s *ChessService) IsAITurn() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.isAITurn()
+}
+
+func (s *ChessService) isAITurn() bool {
+	return s.mode == ModePvAI && !s.game.GameOver && s.game.CurrentTurn == s.aiColor
+}
+
+// GotoMove rewinds or fast-forwards the game to the position after moveIndex
+// half-moves by replaying the line from the starting position
+func (s *ChessService) GotoMove(moveIndex int) (*GameResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Moves played since the last jump replace whatever line was remembered
+	if !isPrefixOf(s.game.MoveHistory, s.line) {
+		s.line = append([]Move(nil), s.game.MoveHistory...)
+	}
+	
+	if moveIndex < 0 || moveIndex > len(s.line) {
+		return nil, fmt.Errorf("move index must be between 0 and %d, got %d", len(s.line), moveIndex)
+	}
+	
+	game, err := s.replay(s.line[:moveIndex])
 	if err != nil {
 		return nil, err
 	}
+	s.game = game
+	s.hopelessMoves = 0
+	s.version++
 	
-	response := s.GetGameState()
-	response.LastMove = &move
-	return response, nil
+	return s.gameState(), nil
+}
+
+// replay plays moves from the game's starting position
+func (s *ChessService) replay(moves []Move) (*ChessGame, error) {
+	game := s.startPosition.CopyState()
+	for i, move := range moves {
+		if err := game.MakeMove(Move{From: move.From, To: move.To, Promotion: move.Promotion}); err != nil {
+			return nil, fmt.Errorf("failed to replay move %d: %w", i+1, err)
+		}
+	}
+	return game, nil
+}
+
+func isPrefixOf(moves, line []Move) bool {
+	if len(moves) > len(line) {
+		return false
+	}
+	for i, move := range moves {
+		if move.From != line[i].From || move.To != line[i].To || move.Promotion != line[i].Promotion {
+			return false
+		}
+	}
+	return true
 }
 
-func (s *ChessService) NewGame() *GameResponse {
-	s.game = NewChessGame()
-	return s.GetGameState()
+// UndoMove takes moves back until it is the human's turn again: the AI's reply
+// and the move before it, or only the last move if the AI hasn't replied. In a
+// two-player game it takes back one move.
+func (s *ChessService) UndoMove() (*GameResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Keep the moves taken back so GotoMove can redo them
+	if !isPrefixOf(s.game.MoveHistory, s.line) {
+		s.line = append([]Move(nil), s.game.MoveHistory...)
+	}
+
+	if err := s.game.UndoMove(); err != nil {
+		return nil, err
+	}
+	s.version++
+	for s.mode == ModePvAI && s.game.CurrentTurn == s.aiColor && len(s.game.MoveHistory) > 0 {
+		if err := s.game.UndoMove(); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.recountPositions(); err != nil {
+		return nil, err
+	}
+	s.hopelessMoves = 0
+	return s.gameState(), nil
 }
 
+// recountPositions rebuilds the repetition counts from the moves still in the
+// history, so positions that were only reached on the line taken back no
+// longer count towards a draw
+func (s *ChessService) recountPositions() error {
+	replay, err := s.replay(s.game.MoveHistory)
+	if err != nil {
+		return err
+	}
+	s.game.hash, s.game.positions, s.game.repetitions = replay.hash, replay.positions, replay.repetitions
+	return nil
+}
+
+func (s *ChessService) ClaimDraw() (*GameResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.game.ClaimDraw(); err != nil {
+		return nil, err
+	}
+	s.version++
+	return s.gameState(), nil
+}
+
+// OfferDraw records color's draw offer. In a two-player game the offer comes
+// after the player's move, so the opponent, who is to move, answers it.
+func (s *ChessService) OfferDraw(color Color) (*GameResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.mode == ModePvP && color == s.game.CurrentTurn {
+		return nil, fmt.Errorf("offer a draw after making your move")
+	}
+	if err := s.game.OfferDraw(color, time.Now()); err != nil {
+		return nil, err
+	}
+	s.version++
+	return s.gameState(), nil
+}
+
+// AnswerDrawOffer lets color accept or decline the opponent's pending offer
+func (s *ChessService) AnswerDrawOffer(color Color, accept bool) (*GameResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.game.AnswerDrawOffer(color, accept); err != nil {
+		return nil, err
+	}
+	s.version++
+	return s.gameState(), nil
+}
+
+// Resign ends the game as a loss for color. No reply is coming now, so the
+// AI's search for one in this game is stopped, and the version bump makes
+// it drop its move.
+func (s *ChessService) Resign(color Color) (*GameResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.game.GameOver {
+		return nil, fmt.Errorf("game is already over")
+	}
+	s.game.Resign(color)
+	s.version++
+	if s.aiSearch != nil {
+		s.aiSearch.cancel()
+	}
+	return s.gameState(), nil
+}
+
+func (s *ChessService) ExportPGN() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.game.ToPGN(s.engineColor())
+}
+
+func (s *ChessService) Export() (*ExportResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pgn, err := s.game.ToPGN(s.engineColor())
+	if err != nil {
+		return nil, err
+	}
+	moves, err := s.game.SANMoves()
+	if err != nil {
+		return nil, err
+	}
+	
+	return &ExportResponse{
+		FEN:       s.game.ToFEN(),
+		StartFEN:  s.game.StartFEN,
+		PGN:       pgn,
+		Moves:     moves,
+		Result:    s.game.pgnResult(),
+		EndReason: s.game.EndReason,
+		MoveCount: len(s.game.MoveHistory),
+		Chess960:  s.game.Chess960,
+	}, nil
+}
+
+func (s *ChessService) LoadPGN(pgn string) (*GameResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	game, err := LoadPGN(pgn)
+	if err != nil {
+		return nil, err
+	}
+	
+	start, err := game.startingPosition()
+	if err != nil {
+		return nil, err
+	}
+	// Applied after the replay so a long game still loads whole
+	game.moveLimit = s.moveLimit
+	start.moveLimit = s.moveLimit
+	s.game = game
+	s.startPosition = start
+	s.line = nil
+	s.hopelessMoves = 0
+	s.coachThreshold = 0
+	s.version++
+	
+	return s.gameState(), nil
+}
+
+// GetGame returns a snapshot of the game, which stays consistent however
+// long the caller works on it
 func (s *ChessService) GetGame() *ChessGame {
-	return s.game
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.game.CopyState()
+}
+
+// errGameChanged means the game moved on (a new game, an undo, ...) while the
+// AI was searching, so its move was dropped
+var errGameChanged = errors.New("the game changed while the AI was thinking")
+
+// aiSnapshot returns a copy of the game for the AI to search, with the
+// version to hand back to applyAIMove
+func (s *ChessService) aiSnapshot() (*ChessGame, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.game.CopyState(), s.version
+}
+
+// startAISearch registers the AI's search for its move, which runs under the
+// returned context so StopAI can end it. Call finish once it is over.
+func (s *ChessService) startAISearch(ctx context.Context) (context.Context, *liveSearch) {
+	ctx, cancel := context.WithCancel(ctx)
+	search := &liveSearch{service: s, cancel: cancel}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.aiSearch = search
+	return ctx, search
+}
+
+// progress records the best move of the search's latest finished iteration
+func (l *liveSearch) progress(move *Move) {
+	l.service.mu.Lock()
+	defer l.service.mu.Unlock()
+	l.bestSoFar = move
+}
+
+func (l *liveSearch) finish() {
+	l.service.mu.Lock()
+	defer l.service.mu.Unlock()
+	if l.service.aiSearch == l {
+		l.service.aiSearch = nil
+	}
+	l.cancel()
+}
+
+// StopAI cuts the AI's search for its move short, which then plays the best
+// move of its deepest finished iteration. It reports whether a search was
+// running and the best move found so far.
+func (s *ChessService) StopAI() (bool, *Move) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.aiSearch == nil {
+		return false, nil
+	}
+	s.aiSearch.cancel()
+	return true, s.aiSearch.bestSoFar
+}
+
+// applyAIMove runs apply on the live game, under the lock, if nothing has
+// changed since the snapshot at version was taken. Otherwise it fails with
+// errGameChanged and the game is left alone.
+func (s *ChessService) applyAIMove(version int, apply func() error) (*GameResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if version != s.version {
+		return nil, errGameChanged
+	}
+	if err := apply(); err != nil {
+		return nil, err
+	}
+	s.version++
+	return s.gameState(), nil
 }
 
 func (g *ChessGame) GetBoardForFrontend() [][]Square {
@@ -190,6 +917,32 @@ func (g *ChessGame) GetBoardForFrontend() [][]Square {
 	return result
 }
 
+// ForPerspective lays the board and last move out from color's side, so row
+// 0 is the far rank for that player. Squares keep their own colouring and
+// only change places. Moves sent to the server always use White's layout.
+func (r *GameResponse) ForPerspective(color Color) {
+	r.Perspective = string(color)
+	if color != Black {
+		return
+	}
+
+	flipped := make([][]Square, 8)
+	for i := 0; i < 8; i++ {
+		flipped[i] = make([]Square, 8)
+		for j := 0; j < 8; j++ {
+			flipped[i][j] = r.Board[7-i][7-j]
+		}
+	}
+	r.Board = flipped
+
+	if r.LastMove != nil {
+		lastMove := *r.LastMove
+		lastMove.From = lastMove.From.Flipped()
+		lastMove.To = lastMove.To.Flipped()
+		r.LastMove = &lastMove
+	}
+}
+
 func getPieceIcon(pieceType PieceType) string {
 	icons := map[PieceType]string{
 		Pawn:   "faChessPawn",
@@ -202,36 +955,102 @@ func getPieceIcon(pieceType PieceType) string {
 	return icons[pieceType]
 }
 
+// MoveRejection says why a move is not legal
+type MoveRejection string
+
+const (
+	RejectOutOfBounds      MoveRejection = "out_of_bounds"
+	RejectNoPiece          MoveRejection = "no_piece"
+	RejectNotYourTurn      MoveRejection = "not_your_turn"
+	RejectSameSquare       MoveRejection = "same_square"
+	RejectInvalidPromotion MoveRejection = "invalid_promotion"
+	RejectNotPromotion     MoveRejection = "promotion_not_allowed" // A promotion piece on a move that isn't a pawn reaching the last rank
+	RejectIllegalCastle    MoveRejection = "illegal_castle"
+	RejectOwnPiece         MoveRejection = "own_piece"
+	RejectIllegalPieceMove MoveRejection = "illegal_piece_move"
+	RejectKingInCheck      MoveRejection = "leaves_king_in_check"
+	RejectKingCapture      MoveRejection = "king_capture" // Kept as a safeguard; LoadFEN refuses positions where the side not to move is in check
+	RejectGameOver         MoveRejection = "game_over"    // Only from MakePlayerMove; ValidateMove looks at the board alone
+)
+
+// MoveError is a player move that was turned down, and why
+type MoveError struct {
+	From   Position
+	To     Position
+	Reason MoveRejection
+}
+
+func (e *MoveError) Error() string {
+	return fmt.Sprintf("invalid move from %v to %v: %s", e.From, e.To, e.Reason)
+}
+
 func (g *ChessGame) IsValidMove(move Move) bool {
+	return g.ValidateMove(move) == ""
+}
+
+// ValidateMove returns why the move is illegal, or "" if it is legal
+func (g *ChessGame) ValidateMove(move Move) MoveRejection {
+	return g.validateMove(move, true)
+}
+
+// validateMove is ValidateMove that can skip playing the move out to see if
+// it exposes the king, for callers that already know it can't
+func (g *ChessGame) validateMove(move Move, checkKing bool) MoveRejection {
 	from, to := move.From, move.To
 	
 	if !inBounds(from) || !inBounds(to) {
-		return false
+		return RejectOutOfBounds
 	}
 	
 	piece := g.Board[from.Row][from.Col]
 	if piece == nil {
-		return false
+		return RejectNoPiece
 	}
 
 	if piece.Color != g.CurrentTurn {
-		return false
+		return RejectNotYourTurn
 	}
 	
 	if from.Row == to.Row && from.Col == to.Col {
-		return false
+		return RejectSameSquare
+	}
+	
+	if move.Promotion != "" && !isPromotionPiece(move.Promotion) {
+		return RejectInvalidPromotion
+	}
+	
+	// A pawn reaching the last rank without one promotes to a queen, see MakeMove
+	if move.Promotion != "" && (piece.Type != Pawn || to.Row != homeRow(opponentColor(piece.Color))) {
+		return RejectNotPromotion
+	}
+	
+	if piece.Type == King {
+		if rookCol := g.castlingRookCol(from, to, piece.Color); rookCol >= 0 {
+			if !g.isValidCastle(from, rookCol, piece.Color) {
+				return RejectIllegalCastle
+			}
+			return ""
+		}
 	}
 	
 	targetPiece := g.Board[to.Row][to.Col]
 	if targetPiece != nil && targetPiece.Color == piece.Color {
-		return false
+		return RejectOwnPiece
+	}
+	
+	// Kings are never captured, the game ends before that
+	if targetPiece != nil && targetPiece.Type == King {
+		return RejectKingCapture
 	}
 	
 	if !g.isValidPieceMove(from, to, piece) {
-		return false
+		return RejectIllegalPieceMove
 	}
 	
-	return !g.wouldLeaveKingInCheck(move)
+	if checkKing && g.wouldLeaveKingInCheck(move) {
+		return RejectKingInCheck
+	}
+	return ""
 }
 
 func (g *ChessGame) isValidPieceMove(from, to Position, piece *Piece) bool {
@@ -269,7 +1088,8 @@ func (g *ChessGame) isValidPawnMove(from, to Position, dx, dy int, color Color)
 		if color == White {
 			startingRow = 6
 		}
-		if from.Row == startingRow && dy == 2*direction && g.Board[to.Row][to.Col] == nil {
+		if from.Row == startingRow && dy == 2*direction && g.Board[to.Row][to.Col] == nil &&
+			g.Board[from.Row+direction][from.Col] == nil {
 			return true
 		}
 	}
@@ -316,6 +1136,83 @@ func (g *ChessGame) isValidKingMove(from, to Position, dx, dy int) bool {
 	return false
 }
 
+// castlingRookCol returns the column of the rook a king move castles with, or
+// -1 if the move is not a castling move. A castle is written as the king moving
+// to its final square when that is at least two files away, otherwise (as can
+// happen in Chess960) as the king moving onto its own rook.
+func (g *ChessGame) castlingRookCol(from, to Position, color Color) int {
+	row := homeRow(color)
+	if from.Row != row || to.Row != row || g.KingMoved[color] {
+		return -1
+	}
+	
+	for rookCol, moved := range g.RookMoved[color] {
+		rook := g.Board[row][rookCol]
+		if moved || rook == nil || rook.Type != Rook || rook.Color != color {
+			continue
+		}
+		
+		kingDest, _ := castleDestinations(rookCol > from.Col)
+		if abs(kingDest-from.Col) >= 2 {
+			if to.Col == kingDest {
+				return rookCol
+			}
+		} else if to.Col == rookCol {
+			return rookCol
+		}
+	}
+	
+	return -1
+}
+
+func (g *ChessGame) isValidCastle(from Position, rookCol int, color Color) bool {
+	row := from.Row
+	kingDest, rookDest := castleDestinations(rookCol > from.Col)
+	opponent := opponentColor(color)
+	
+	// Everything the king or rook crosses must be empty apart from the two pieces themselves
+	lo := min(min(from.Col, rookCol), min(kingDest, rookDest))
+	hi := max(max(from.Col, rookCol), max(kingDest, rookDest))
+	for col := lo; col <= hi; col++ {
+		if col != from.Col && col != rookCol && g.Board[row][col] != nil {
+			return false
+		}
+	}
+	
+	// The king may not castle out of, through or into check. Its own square
+	// is checked separately since in Chess960 it can already be the
+	// destination, which the walk below never visits.
+	if g.IsInCheck(color) {
+		return false
+	}
+	step := sign(kingDest - from.Col)
+	for col := from.Col; col != kingDest; col += step {
+		if g.isSquareAttacked(Position{row, col}, opponent) {
+			return false
+		}
+	}
+	
+	king, rook := g.Board[row][from.Col], g.Board[row][rookCol]
+	g.Board[row][from.Col], g.Board[row][rookCol] = nil, nil
+	g.Board[row][kingDest], g.Board[row][rookDest] = king, rook
+	
+	inCheck := g.IsInCheck(color)
+	
+	g.Board[row][kingDest], g.Board[row][rookDest] = nil, nil
+	g.Board[row][from.Col], g.Board[row][rookCol] = king, rook
+	
+	return !inCheck
+}
+
+// castleDestinations returns the final king and rook columns, which are the
+// same in standard chess and Chess960
+func castleDestinations(kingSide bool) (int, int) {
+	if kingSide {
+		return 6, 5
+	}
+	return 2, 3
+}
+
 func (g *ChessGame) isPathClear(from, to Position) bool {
 	dx := sign(to.Col - from.Col)
 	dy := sign(to.Row - from.Row)
@@ -334,13 +1231,58 @@ func (g *ChessGame) isPathClear(from, to Position) bool {
 
 func (g *ChessGame) MakeMove(move Move) error {
 	from, to := move.From, move.To
+	g.legalMovesKnown = false
+	g.DrawOffer = nil
 	
 	piece := g.Board[from.Row][from.Col]
 	capturedPiece := g.Board[to.Row][to.Col]
 	
+	castleRookCol := -1
+	if piece.Type == King {
+		castleRookCol = g.castlingRookCol(from, to, piece.Color)
+	}
+	if castleRookCol >= 0 {
+		// The king may land on its own rook's square in Chess960
+		capturedPiece = nil
+	}
+	
 	move.Piece = piece
 	move.CapturedPiece = capturedPiece
 	
+	undo := UndoInfo{
+		CaptureSquare: to,
+		CastleRookCol: castleRookCol,
+		EnPassant:     g.EnPassant,
+		KingMoved:     g.KingMoved[piece.Color],
+		Repetitions:   g.repetitions,
+		GameOver:      g.GameOver,
+		Winner:        g.Winner,
+		EndReason:     g.EndReason,
+	}
+	if castleRookCol >= 0 {
+		undo.RookFlags = append(undo.RookFlags, g.rookFlag(piece.Color, castleRookCol))
+	}
+	if piece.Type == Rook && from.Row == homeRow(piece.Color) {
+		undo.RookFlags = append(undo.RookFlags, g.rookFlag(piece.Color, from.Col))
+	}
+	if capturedPiece != nil && capturedPiece.Type == Rook {
+		undo.RookFlags = append(undo.RookFlags, g.rookFlag(capturedPiece.Color, to.Col))
+	}
+
+	// Only the squares the move touches and the side, castling and en passant
+	// state change, so the hash is updated for those rather than rebuilt
+	touched := []Position{from, to}
+	if piece.Type == Pawn && g.EnPassant != nil && to == *g.EnPassant {
+		touched = append(touched, Position{Row: from.Row, Col: to.Col})
+	}
+	if castleRookCol >= 0 {
+		kingDest, rookDest := castleDestinations(castleRookCol > from.Col)
+		touched = append(touched, Position{Row: from.Row, Col: castleRookCol},
+			Position{Row: from.Row, Col: kingDest}, Position{Row: from.Row, Col: rookDest})
+	}
+	g.hash ^= g.stateHash()
+	g.hashSquares(touched)
+	
 	if piece.Type == Pawn && g.EnPassant != nil && 
 		to.Row == g.EnPassant.Row && to.Col == g.EnPassant.Col {
 		captureRow := to.Row
@@ -349,31 +1291,132 @@ func (g *ChessGame) MakeMove(move Move) error {
 		} else {
 			captureRow = to.Row - 1
 		}
+		move.CapturedPiece = g.Board[captureRow][to.Col]
 		g.Board[captureRow][to.Col] = nil
 		move.IsEnPassant = true
+		undo.CaptureSquare = Position{captureRow, to.Col}
 	}
 	
-	g.Board[to.Row][to.Col] = piece
-	g.Board[from.Row][from.Col] = nil
+	if castleRookCol >= 0 {
+		g.castle(from, castleRookCol, piece.Color)
+		move.IsCastle = true
+	} else {
+		g.Board[to.Row][to.Col] = piece
+		g.Board[from.Row][from.Col] = nil
+	}
+	
+	if piece.Type == Pawn && to.Row == homeRow(opponentColor(piece.Color)) {
+		if move.Promotion == "" {
+			move.Promotion = Queen
+		}
+		g.Board[to.Row][to.Col] = &Piece{Type: move.Promotion, Color: piece.Color}
+		move.IsPromotion = true
+	}
 	
 	if piece.Type == King {
 		g.KingMoved[piece.Color] = true
 	}
-	if piece.Type == Rook {
+	if piece.Type == Rook && from.Row == homeRow(piece.Color) {
 		g.RookMoved[piece.Color][from.Col] = true
 	}
-	
+	// A rook captured on its home square can no longer castle either
+	if capturedPiece != nil && capturedPiece.Type == Rook {
+		g.invalidateRookOnCapture(capturedPiece.Color, to)
+	}
+
 	g.updateEnPassant(move)
 	
 	g.MoveHistory = append(g.MoveHistory, move)
+	g.undoStack = append(g.undoStack, undo)
 	
 	g.CurrentTurn = opponentColor(g.CurrentTurn)
 	
+	g.hashSquares(touched)
+	g.hash ^= g.stateHash()
+	g.positions = append(g.positions, g.hash)
+	g.repetitions = g.countRepetitions()
+	
 	g.checkGameOver()
 	
 	return nil
 }
 
+// UndoMove takes back the last move, restoring what MakeMove saved for it
+func (g *ChessGame) UndoMove() error {
+	if len(g.undoStack) == 0 {
+		return fmt.Errorf("no moves to undo")
+	}
+	last := len(g.MoveHistory) - 1
+	move, undo := g.MoveHistory[last], g.undoStack[last]
+	from, to := move.From, move.To
+	g.DrawOffer = nil
+	
+	g.positions = g.positions[:last+1]
+	g.hash = g.positions[last]
+	
+	if undo.CastleRookCol >= 0 {
+		// Clear both destinations before refilling, in Chess960 they can
+		// overlap the starting squares
+		kingDest, rookDest := castleDestinations(undo.CastleRookCol > from.Col)
+		rook := g.Board[from.Row][rookDest]
+		g.Board[from.Row][kingDest], g.Board[from.Row][rookDest] = nil, nil
+		g.Board[from.Row][from.Col], g.Board[from.Row][undo.CastleRookCol] = move.Piece, rook
+	} else {
+		// move.Piece is the pawn itself if it promoted
+		g.Board[to.Row][to.Col] = nil
+		g.Board[from.Row][from.Col] = move.Piece
+		if move.CapturedPiece != nil {
+			g.Board[undo.CaptureSquare.Row][undo.CaptureSquare.Col] = move.CapturedPiece
+		}
+	}
+	
+	g.EnPassant = undo.EnPassant
+	g.KingMoved[move.Piece.Color] = undo.KingMoved
+	// Backwards, in case one entry was saved twice
+	for i := len(undo.RookFlags) - 1; i >= 0; i-- {
+		flag := undo.RookFlags[i]
+		if flag.Present {
+			g.RookMoved[flag.Color][flag.Col] = flag.Moved
+		} else {
+			delete(g.RookMoved[flag.Color], flag.Col)
+		}
+	}
+	g.repetitions = undo.Repetitions
+	g.GameOver, g.Winner, g.EndReason = undo.GameOver, undo.Winner, undo.EndReason
+	
+	g.CurrentTurn = move.Piece.Color
+	g.MoveHistory = g.MoveHistory[:last]
+	g.undoStack = g.undoStack[:last]
+	g.legalMovesKnown = false
+	
+	return nil
+}
+
+func (g *ChessGame) rookFlag(color Color, col int) RookFlag {
+	moved, present := g.RookMoved[color][col]
+	return RookFlag{Color: color, Col: col, Moved: moved, Present: present}
+}
+
+func (g *ChessGame) castle(from Position, rookCol int, color Color) {
+	row := from.Row
+	kingDest, rookDest := castleDestinations(rookCol > from.Col)
+	
+	king, rook := g.Board[row][from.Col], g.Board[row][rookCol]
+	g.Board[row][from.Col], g.Board[row][rookCol] = nil, nil
+	g.Board[row][kingDest], g.Board[row][rookDest] = king, rook
+	
+	g.RookMoved[color][rookCol] = true
+}
+
+func (g *ChessGame) invalidateRookOnCapture(color Color, square Position) {
+	if square.Row != homeRow(color) {
+		return
+	}
+	if _, isHome := g.RookMoved[color][square.Col]; isHome {
+		g.RookMoved[color][square.Col] = true
+	}
+}
+
 func (g *ChessGame) updateEnPassant(move Move) {
 	g.EnPassant = nil
 	
@@ -408,9 +1451,113 @@ func (g *ChessGame) IsInCheck(color Color) bool {
 	return false
 }
 
+// isSquareAttacked reports whether any piece of the given color attacks pos,
+// regardless of what (if anything) stands on it
+func (g *ChessGame) isSquareAttacked(pos Position, byColor Color) bool {
+	for i := 0; i < 8; i++ {
+		for j := 0; j < 8; j++ {
+			piece := g.Board[i][j]
+			if piece == nil || piece.Color != byColor {
+				continue
+			}
+			
+			if g.attacksSquare(Position{i, j}, pos, piece) {
+				return true
+			}
+		}
+	}
+	
+	return false
+}
+
+func (g *ChessGame) attacksSquare(from, pos Position, piece *Piece) bool {
+	if from == pos {
+		return false
+	}
+	
+	if piece.Type == Pawn {
+		// Pawns attack diagonally whether or not the square is occupied
+		direction := 1
+		if piece.Color == White {
+			direction = -1
+		}
+		return pos.Row == from.Row+direction && abs(pos.Col-from.Col) == 1
+	}
+	
+	return g.isValidPieceMove(from, pos, piece)
+}
+
+// AttackMap counts, for every square, how many pieces of the given color attack it
+func (g *ChessGame) AttackMap(color Color) [8][8]int {
+	var attackMap [8][8]int
+	
+	for i := 0; i < 8; i++ {
+		for j := 0; j < 8; j++ {
+			piece := g.Board[i][j]
+			if piece == nil || piece.Color != color {
+				continue
+			}
+			
+			g.forEachAttackedSquare(Position{i, j}, piece, func(pos Position) {
+				attackMap[pos.Row][pos.Col]++
+			})
+		}
+	}
+	
+	return attackMap
+}
+
+// forEachAttackedSquare calls visit for every square the piece on from attacks,
+// the same squares attacksSquare accepts, by walking its rays instead of
+// testing the whole board
+func (g *ChessGame) forEachAttackedSquare(from Position, piece *Piece, visit func(Position)) {
+	step := func(offsets []Position, slide bool) {
+		for _, offset := range offsets {
+			pos := Position{from.Row + offset.Row, from.Col + offset.Col}
+			for ; inBounds(pos); pos = (Position{pos.Row + offset.Row, pos.Col + offset.Col}) {
+				visit(pos)
+				if !slide || g.Board[pos.Row][pos.Col] != nil {
+					break
+				}
+			}
+		}
+	}
+	
+	switch piece.Type {
+	case Pawn:
+		direction := 1
+		if piece.Color == White {
+			direction = -1
+		}
+		step([]Position{{direction, -1}, {direction, 1}}, false)
+	case Knight:
+		step(knightOffsets, false)
+	case Bishop:
+		step(diagonalDirections, true)
+	case Rook:
+		step(orthogonalDirections, true)
+	case Queen:
+		step(orthogonalDirections, true)
+		step(diagonalDirections, true)
+	case King:
+		step(orthogonalDirections, false)
+		step(diagonalDirections, false)
+	}
+}
+
 func (g *ChessGame) GetValidMoves(color Color) []Move {
 	var validMoves []Move
 	
+	// In check, a piece other than the king can only help by capturing the
+	// checker or blocking its line, and in double check not at all
+	evasions, inCheck := g.checkEvasionSquares(color)
+	
+	// A pinned piece can only slide along its pin. Out of check, that and the
+	// moves below that can still expose the king are all that needs playing
+	// out: king moves, and en passant, which empties two squares of a rank.
+	kingPos := g.findKing(color)
+	pins := g.pinRays(color)
+	
 	for i := 0; i < 8; i++ {
 		for j := 0; j < 8; j++ {
 			piece := g.Board[i][j]
@@ -419,13 +1566,37 @@ func (g *ChessGame) GetValidMoves(color Color) []Move {
 			}
 			
 			from := Position{i, j}
+			if inCheck && piece.Type != King && len(evasions) == 0 {
+				continue
+			}
+			pinDirection, pinned := pins[from]
 			
 			for x := 0; x < 8; x++ {
 				for y := 0; y < 8; y++ {
 					to := Position{x, y}
 					move := Move{From: from, To: to}
 					
-					if g.IsValidMove(move) {
+					if inCheck && piece.Type != King && !evasions[to] {
+						continue
+					}
+					
+					if pinned && !onRay(*kingPos, pinDirection, to) {
+						continue
+					}
+					
+					enPassant := piece.Type == Pawn && g.EnPassant != nil && to == *g.EnPassant
+					checkKing := inCheck || piece.Type == King || enPassant
+					if g.validateMove(move, checkKing) != "" {
+						continue
+					}
+					
+					// A pawn reaching the last rank is one move per promotion piece
+					if piece.Type == Pawn && to.Row == homeRow(opponentColor(color)) {
+						for _, promotion := range promotionPieces {
+							move.Promotion = promotion
+							validMoves = append(validMoves, move)
+						}
+					} else {
 						validMoves = append(validMoves, move)
 					}
 				}
@@ -436,6 +1607,103 @@ func (g *ChessGame) GetValidMoves(color Color) []Move {
 	return validMoves
 }
 
+// LegalMoves is GetValidMoves for the side to move, generated at most once per
+// position. The board must only be changed through MakeMove once it is used.
+// The returned slice is shared and must not be modified.
+func (g *ChessGame) LegalMoves() []Move {
+	if !g.legalMovesKnown {
+		g.legalMoves = g.GetValidMoves(g.CurrentTurn)
+		g.legalMovesKnown = true
+	}
+	return g.legalMoves
+}
+
+// checkEvasionSquares reports whether color is in check and, if so, the squares
+// a piece other than the king must move to in order to resolve it: the
+// checker's square (or the en passant square behind a checking pawn) and the
+// squares between a sliding checker and the king. It is empty in double check.
+func (g *ChessGame) checkEvasionSquares(color Color) (map[Position]bool, bool) {
+	kingPos := g.findKing(color)
+	if kingPos == nil {
+		return nil, false
+	}
+	
+	checkers := g.attackersOf(*kingPos, opponentColor(color))
+	if len(checkers) == 0 {
+		return nil, false
+	}
+	
+	squares := map[Position]bool{}
+	if len(checkers) > 1 {
+		return squares, true
+	}
+	
+	checker := checkers[0]
+	squares[checker] = true
+	
+	switch g.Board[checker.Row][checker.Col].Type {
+	case Rook, Bishop, Queen:
+		dRow, dCol := sign(checker.Row-kingPos.Row), sign(checker.Col-kingPos.Col)
+		for pos := (Position{kingPos.Row + dRow, kingPos.Col + dCol}); pos != checker; pos = (Position{pos.Row + dRow, pos.Col + dCol}) {
+			squares[pos] = true
+		}
+	case Pawn:
+		if g.EnPassant != nil && g.EnPassant.Col == checker.Col && abs(g.EnPassant.Row-checker.Row) == 1 {
+			squares[*g.EnPassant] = true
+		}
+	}
+	
+	return squares, true
+}
+
+// Perft counts the leaf nodes of the legal move tree to the given depth, the
+// standard way of checking move generation against known totals
+func (g *ChessGame) Perft(depth int) int64 {
+	if depth == 0 {
+		return 1
+	}
+	
+	moves := g.LegalMoves()
+	if depth == 1 {
+		return int64(len(moves))
+	}
+	
+	var nodes int64
+	for _, move := range moves {
+		gameCopy := g.CopyState()
+		gameCopy.MakeMove(move)
+		nodes += gameCopy.Perft(depth - 1)
+	}
+	return nodes
+}
+
+// capturedBy returns the piece a move would capture, including en passant
+func (g *ChessGame) capturedBy(move Move) *Piece {
+	piece := g.Board[move.From.Row][move.From.Col]
+	if piece == nil {
+		return nil
+	}
+	
+	target := g.Board[move.To.Row][move.To.Col]
+	if target != nil {
+		// A Chess960 castle can land the king on its own rook
+		if target.Color == piece.Color {
+			return nil
+		}
+		return target
+	}
+	
+	if piece.Type == Pawn && g.EnPassant != nil &&
+		move.To.Row == g.EnPassant.Row && move.To.Col == g.EnPassant.Col {
+		return g.Board[move.From.Row][move.To.Col]
+	}
+	return nil
+}
+
+func (g *ChessGame) isCapture(move Move) bool {
+	return g.capturedBy(move) != nil
+}
+
 func (g *ChessGame) findKing(color Color) *Position {
 	for i := 0; i < 8; i++ {
 		for j := 0; j < 8; j++ {
@@ -448,11 +1716,81 @@ func (g *ChessGame) findKing(color Color) *Position {
 	return nil
 }
 
+var (
+	orthogonalDirections = []Position{{-1, 0}, {1, 0}, {0, -1}, {0, 1}}
+	diagonalDirections   = []Position{{-1, -1}, {-1, 1}, {1, -1}, {1, 1}}
+	knightOffsets        = []Position{{-2, -1}, {-2, 1}, {-1, -2}, {-1, 2}, {1, -2}, {1, 2}, {2, -1}, {2, 1}}
+)
+
+// PinnedPieces returns the squares of the given color's pieces that are
+// absolutely pinned, i.e. stand between their own king and an enemy slider
+func (g *ChessGame) PinnedPieces(color Color) []Position {
+	pins := g.pinRays(color)
+	pinned := make([]Position, 0, len(pins))
+	for square := range pins {
+		pinned = append(pinned, square)
+	}
+	return pinned
+}
+
+// pinRays maps each of color's pinned pieces to the direction from its king
+// towards it, the only line the piece may still move along
+func (g *ChessGame) pinRays(color Color) map[Position]Position {
+	kingPos := g.findKing(color)
+	if kingPos == nil {
+		return nil
+	}
+	
+	pins := map[Position]Position{}
+	scan := func(directions []Position, sliders ...PieceType) {
+		for _, dir := range directions {
+			var blocker *Position
+			pos := Position{kingPos.Row + dir.Row, kingPos.Col + dir.Col}
+			for ; inBounds(pos); pos = (Position{pos.Row + dir.Row, pos.Col + dir.Col}) {
+				piece := g.Board[pos.Row][pos.Col]
+				if piece == nil {
+					continue
+				}
+				if piece.Color == color {
+					if blocker != nil {
+						break
+					}
+					square := pos
+					blocker = &square
+					continue
+				}
+				if blocker != nil && (piece.Type == sliders[0] || piece.Type == sliders[1]) {
+					pins[*blocker] = dir
+				}
+				break
+			}
+		}
+	}
+	scan(orthogonalDirections, Rook, Queen)
+	scan(diagonalDirections, Bishop, Queen)
+	
+	return pins
+}
+
+// onRay reports whether pos lies on the line through origin in direction dir,
+// on either side of it
+func onRay(origin, dir, pos Position) bool {
+	return (pos.Row-origin.Row)*dir.Col == (pos.Col-origin.Col)*dir.Row
+}
+
 func (g *ChessGame) wouldLeaveKingInCheck(move Move) bool {
 	from, to := move.From, move.To
 	originalPiece := g.Board[to.Row][to.Col]
 	movingPiece := g.Board[from.Row][from.Col]
 	
+	// En passant also clears the captured pawn's square, which can open a line
+	// onto the king along the rank
+	var enPassantPawn *Piece
+	if movingPiece.Type == Pawn && originalPiece == nil && from.Col != to.Col {
+		enPassantPawn = g.Board[from.Row][to.Col]
+		g.Board[from.Row][to.Col] = nil
+	}
+	
 	g.Board[to.Row][to.Col] = movingPiece
 	g.Board[from.Row][from.Col] = nil
 	
@@ -460,21 +1798,83 @@ func (g *ChessGame) wouldLeaveKingInCheck(move Move) bool {
 	
 	g.Board[from.Row][from.Col] = movingPiece
 	g.Board[to.Row][to.Col] = originalPiece
+	if enPassantPawn != nil {
+		g.Board[from.Row][to.Col] = enPassantPawn
+	}
 	
 	return inCheck
 }
 
+// Resign ends the game with color's opponent as the winner
+func (g *ChessGame) Resign(color Color) {
+	g.GameOver = true
+	g.Winner = string(opponentColor(color))
+	g.EndReason = "resignation"
+	g.DrawOffer = nil
+}
+
 func (g *ChessGame) checkGameOver() {
-	validMoves := g.GetValidMoves(g.CurrentTurn)
+	validMoves := g.LegalMoves()
 	
 	if len(validMoves) == 0 {
 		g.GameOver = true
 		if g.IsInCheck(g.CurrentTurn) {
 			g.Winner = string(opponentColor(g.CurrentTurn))
+			g.EndReason = "checkmate"
 		} else {
 			g.Winner = "draw"
+			g.EndReason = "stalemate"
+		}
+		return
+	}
+	
+	g.checkAutomaticDraw()
+}
+
+// CapturedPieces returns the pieces each side has taken, in capture order. It is
+// derived from MoveHistory so it always matches the moves actually on record.
+func (g *ChessGame) CapturedPieces() (byWhite, byBlack []PieceType) {
+	byWhite, byBlack = []PieceType{}, []PieceType{}
+	for _, move := range g.MoveHistory {
+		if move.CapturedPiece == nil {
+			continue
+		}
+		if move.Piece.Color == White {
+			byWhite = append(byWhite, move.CapturedPiece.Type)
+		} else {
+			byBlack = append(byBlack, move.CapturedPiece.Type)
 		}
 	}
+	return byWhite, byBlack
+}
+
+// PieceStats tallies one piece type's part in the game
+type PieceStats struct {
+	Moves    int `json:"moves"`
+	Captures int `json:"captures"` // Enemy pieces it took
+	Captured int `json:"captured"` // Times a piece of this type was taken
+}
+
+// PieceStatistics tallies moves and captures by colour and piece type from
+// MoveHistory. A promoting pawn's move counts for the pawn.
+func (g *ChessGame) PieceStatistics() map[Color]map[PieceType]*PieceStats {
+	stats := map[Color]map[PieceType]*PieceStats{}
+	for _, color := range []Color{White, Black} {
+		stats[color] = map[PieceType]*PieceStats{}
+		for _, pieceType := range []PieceType{Pawn, Knight, Bishop, Rook, Queen, King} {
+			stats[color][pieceType] = &PieceStats{}
+		}
+	}
+
+	for _, move := range g.MoveHistory {
+		mover := stats[move.Piece.Color][move.Piece.Type]
+		mover.Moves++
+		if move.CapturedPiece != nil {
+			mover.Captures++
+			stats[move.CapturedPiece.Color][move.CapturedPiece.Type].Captured++
+		}
+	}
+	return stats
 }
 
 func (g *ChessGame) GetLastMove() *Move {
@@ -489,10 +1889,26 @@ func (g *ChessGame) CopyState() *ChessGame {
 		CurrentTurn: g.CurrentTurn,
 		GameOver:    g.GameOver,
 		Winner:      g.Winner,
+		EndReason:   g.EndReason,
 		MoveHistory: make([]Move, len(g.MoveHistory)),
+		undoStack:   make([]UndoInfo, len(g.undoStack)),
 		EnPassant:   g.EnPassant,
 		KingMoved:   make(map[Color]bool),
 		RookMoved:   make(map[Color]map[int]bool),
+		Chess960:    g.Chess960,
+		hash:        g.hash,
+		positions:   make([]uint64, len(g.positions)),
+		repetitions: g.repetitions,
+
+		StartFEN:           g.StartFEN,
+		StartHalfMoveClock: g.StartHalfMoveClock,
+		MoveNumberOffset:   g.MoveNumberOffset,
+		TimeControl:        g.TimeControl,
+		DrawOffer:          g.DrawOffer,
+		moveLimit:          g.moveLimit,
+
+		legalMoves:      g.legalMoves,
+		legalMovesKnown: g.legalMovesKnown,
 	}
 	
 	for i := 0; i < 8; i++ {
@@ -507,6 +1923,9 @@ func (g *ChessGame) CopyState() *ChessGame {
 	}
 	
 	copy(newGame.MoveHistory, g.MoveHistory)
+	copy(newGame.undoStack, g.undoStack) // Entries are never changed once saved
+	
+	copy(newGame.positions, g.positions)
 	
 	newGame.KingMoved[White] = g.KingMoved[White]
 	newGame.KingMoved[Black] = g.KingMoved[Black]
@@ -530,6 +1949,22 @@ func opponentColor(color Color) Color {
 	return White
 }
 
+func isPromotionPiece(pieceType PieceType) bool {
+	for _, promotion := range promotionPieces {
+		if pieceType == promotion {
+			return true
+		}
+	}
+	return false
+}
+
+func homeRow(color Color) int {
+	if color == White {
+		return 7
+	}
+	return 0
+}
+
 func inBounds(pos Position) bool {
 	return pos.Row >= 0 && pos.Row < 8 && pos.Col >= 0 && pos.Col < 8
 }
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// playSAN plays space separated SAN moves on game, failing the test on the
+// first one that doesn't parse or isn't legal
+func playSAN(t testing.TB, game *ChessGame, moves string) {
+	t.Helper()
+	for _, san := range strings.Fields(moves) {
+		move, err := game.parseSAN(san)
+		if err != nil {
+			t.Fatalf("%s: %v", san, err)
+		}
+		if err := game.MakeMove(move); err != nil {
+			t.Fatalf("%s: %v", san, err)
+		}
+	}
+}
+
+// playServiceSAN plays space separated SAN moves through the service, as a
+// client would
+func playServiceSAN(t testing.TB, service *ChessService, moves string) {
+	t.Helper()
+	for _, san := range strings.Fields(moves) {
+		move, err := service.GetGame().parseSAN(san)
+		if err != nil {
+			t.Fatalf("%s: %v", san, err)
+		}
+		if _, err := service.MakePlayerMove(MoveRequest{From: move.From, To: move.To, Promotion: move.Promotion}); err != nil {
+			t.Fatalf("%s: %v", san, err)
+		}
+	}
+}
+
+// mustLoadFEN loads fen or fails the test
+func mustLoadFEN(t testing.TB, fen string) *ChessGame {
+	t.Helper()
+	game, err := LoadFEN(fen)
+	if err != nil {
+		t.Fatalf("%s: %v", fen, err)
+	}
+	return game
+}
+
+func TestScholarsMateEndsTheGame(t *testing.T) {
+	service := NewChessService()
+	if _, err := service.NewGame(NewGameRequest{Mode: ModePvP}); err != nil {
+		t.Fatal(err)
+	}
+
+	var response *GameResponse
+	for _, move := range strings.Fields("e2e4 e7e5 f1c4 b8c6 d1h5 g8f6 h5f7") {
+		from, _ := ParseAlgebraic(move[:2])
+		to, _ := ParseAlgebraic(move[2:])
+		var err error
+		if response, err = service.MakePlayerMove(MoveRequest{From: from, To: to}); err != nil {
+			t.Fatalf("%s: %v", move, err)
+		}
+		if response.IsGameOver != (move == "h5f7") {
+			t.Fatalf("%s: game over is %v", move, response.IsGameOver)
+		}
+	}
+
+	if response.Winner != string(White) || response.EndReason != "checkmate" || !response.IsCheck {
+		t.Errorf("got winner %q, end reason %q, check %v, want white to have mated", response.Winner, response.EndReason, response.IsCheck)
+	}
+	if _, err := service.MakePlayerMove(MoveRequest{From: Position{0, 4}, To: Position{1, 4}}); err == nil {
+		t.Error("move accepted after checkmate")
+	}
+}
+
+// TestNewGameDuringMoves starts new games while player and AI moves, undos
+// and reads are in flight. Run with -race; every call must see either the
+// old game or the new one whole.
+func TestNewGameDuringMoves(t *testing.T) {
+	service := NewChessService()
+	ai := NewAIService()
+	if err := ai.SetMaxThinkingTime(50 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	depth := 2
+	newGame := func() {
+		if _, err := service.NewGame(NewGameRequest{Depth: &depth}); err != nil {
+			t.Error(err)
+		}
+	}
+	newGame()
+
+	var wg sync.WaitGroup
+	run := func(rounds int, step func(rng *rand.Rand)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(int64(rounds)))
+			for i := 0; i < rounds; i++ {
+				step(rng)
+			}
+		}()
+	}
+
+	run(40, func(*rand.Rand) { newGame() })
+	run(150, func(rng *rand.Rand) {
+		moves := service.GetGame().LegalMoves()
+		if len(moves) == 0 {
+			return
+		}
+		move := moves[rng.Intn(len(moves))]
+		response, err := service.MakePlayerMove(MoveRequest{From: move.From, To: move.To, Promotion: move.Promotion})
+		if err == nil && response.MoveCount == 0 {
+			t.Errorf("move accepted but the game has no moves: %s", response.FEN)
+		}
+	})
+	run(20, func(*rand.Rand) {
+		if service.IsAITurn() {
+			ai.MakeAIMove(context.Background(), service)
+		}
+	})
+	run(80, func(*rand.Rand) {
+		service.UndoMove()
+		service.StopAI()
+	})
+	run(150, func(*rand.Rand) {
+		if _, err := LoadFEN(service.GetGameState().FEN); err != nil {
+			t.Error(err)
+		}
+		if _, err := service.ExportPGN(); err != nil {
+			t.Error(err)
+		}
+	})
+	wg.Wait()
+
+	game := service.GetGame()
+	if game.hash != game.positionHash() || len(game.positions) != len(game.MoveHistory)+1 {
+		t.Errorf("game left inconsistent: %d positions for %d moves", len(game.positions), len(game.MoveHistory))
+	}
+}
+
+func TestCapturedHomeRookLosesCastling(t *testing.T) {
+	game := mustLoadFEN(t, "r3k2r/8/8/8/8/8/6b1/R3K2R b KQkq - 0 1")
+	playSAN(t, game, "Bxh1")
+	if game.IsValidMove(Move{From: Position{7, 4}, To: Position{7, 6}}) {
+		t.Error("white castled kingside with its rook captured")
+	}
+	if !game.IsValidMove(Move{From: Position{7, 4}, To: Position{7, 2}}) {
+		t.Error("white lost queenside castling too")
+	}
+	if got := game.castlingField(); got != "Qkq" {
+		t.Errorf("castling rights %q, want Qkq", got)
+	}
+
+	// A rook that comes back to the empty corner doesn't bring the right back
+	game = mustLoadFEN(t, "r3k2r/8/8/8/8/8/6b1/R3K2R b KQkq - 0 1")
+	playSAN(t, game, "Bxh1 Rb1 Bd5 Rb2 Be6 Rh2 Bd5 Rh1 Be6")
+	if game.IsValidMove(Move{From: Position{7, 4}, To: Position{7, 6}}) {
+		t.Error("white castled with a rook that came back to h1")
+	}
+}
+
+func TestAlgebraicRoundTrip(t *testing.T) {
+	for row := 0; row < 8; row++ {
+		for col := 0; col < 8; col++ {
+			square := Position{row, col}
+			name := square.ToAlgebraic()
+			parsed, err := ParseAlgebraic(name)
+			if err != nil || parsed != square {
+				t.Errorf("%v is %q, which parses as %v, %v", square, name, parsed, err)
+			}
+		}
+	}
+
+	// Row 0 is Black's back rank
+	for name, want := range map[string]Position{"a8": {0, 0}, "h8": {0, 7}, "a1": {7, 0}, "h1": {7, 7}, "e4": {4, 4}} {
+		if got := want.ToAlgebraic(); got != name {
+			t.Errorf("%v is %q, want %q", want, got, name)
+		}
+	}
+
+	for _, name := range []string{"", "e", "e44", "i1", "a0", "a9", "E4", "4e", "`1"} {
+		if _, err := ParseAlgebraic(name); err == nil {
+			t.Errorf("%q parsed", name)
+		}
+	}
+}
+
+func TestValidateMovePromotion(t *testing.T) {
+	const fen = "4k3/P7/8/8/8/8/4P3/4K1N1 w - - 0 1"
+	tests := []struct {
+		name string
+		move Move
+		want MoveRejection
+	}{
+		{"pawn push with a piece", Move{From: Position{6, 4}, To: Position{4, 4}, Promotion: Queen}, RejectNotPromotion},
+		{"knight move with a piece", Move{From: Position{7, 6}, To: Position{5, 5}, Promotion: Knight}, RejectNotPromotion},
+		{"king move with a piece", Move{From: Position{7, 4}, To: Position{7, 3}, Promotion: Rook}, RejectNotPromotion},
+		{"promoting to a king", Move{From: Position{1, 0}, To: Position{0, 0}, Promotion: King}, RejectInvalidPromotion},
+		{"promoting to a pawn", Move{From: Position{1, 0}, To: Position{0, 0}, Promotion: Pawn}, RejectInvalidPromotion},
+		{"underpromotion", Move{From: Position{1, 0}, To: Position{0, 0}, Promotion: Knight}, ""},
+		{"promotion without a piece", Move{From: Position{1, 0}, To: Position{0, 0}}, ""},
+	}
+	game := mustLoadFEN(t, fen)
+	for _, tt := range tests {
+		if got := game.ValidateMove(tt.move); got != tt.want {
+			t.Errorf("%s: %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	// Without a piece the pawn becomes a queen rather than staying a pawn
+	if err := game.MakeMove(Move{From: Position{1, 0}, To: Position{0, 0}}); err != nil {
+		t.Fatal(err)
+	}
+	if piece := game.Board[0][0]; piece == nil || piece.Type != Queen {
+		t.Errorf("a8 holds %v after promoting without a piece", piece)
+	}
+}
+
+func TestMakePlayerMoveRejectsStrayPromotion(t *testing.T) {
+	service := NewChessService()
+	if _, err := service.NewGame(NewGameRequest{Mode: ModePvP}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := service.MakePlayerMove(MoveRequest{From: Position{6, 4}, To: Position{4, 4}, Promotion: Queen})
+	var moveErr *MoveError
+	if !errors.As(err, &moveErr) || moveErr.Reason != RejectNotPromotion {
+		t.Fatalf("e2-e4 with a promotion piece: %v", err)
+	}
+	if fen := service.GetGame().ToFEN(); fen != NewChessGame().ToFEN() {
+		t.Errorf("rejected move left the game at %s", fen)
+	}
+}
+
+func TestFlippedRoundTrip(t *testing.T) {
+	for row := 0; row < 8; row++ {
+		for col := 0; col < 8; col++ {
+			square := Position{row, col}
+			flipped := square.Flipped()
+			if flipped == square || !inBounds(flipped) {
+				t.Errorf("%s flips to %v", square.ToAlgebraic(), flipped)
+			}
+			if again := flipped.Flipped(); again != square {
+				t.Errorf("%s flips back to %s", square.ToAlgebraic(), again.ToAlgebraic())
+			}
+		}
+	}
+	if got := (Position{7, 0}).Flipped().ToAlgebraic(); got != "h8" {
+		t.Errorf("a1 flips to %s, want h8", got)
+	}
+}
+
+func TestForPerspective(t *testing.T) {
+	service := NewChessService()
+	if _, err := service.NewGame(NewGameRequest{Mode: ModePvP}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.MakePlayerMove(MoveRequest{From: Position{6, 4}, To: Position{4, 4}}); err != nil {
+		t.Fatal(err)
+	}
+
+	white := service.GetGameState()
+	white.ForPerspective(White)
+	black := service.GetGameState()
+	black.ForPerspective(Black)
+	if white.Perspective != string(White) || black.Perspective != string(Black) {
+		t.Errorf("perspectives %q and %q", white.Perspective, black.Perspective)
+	}
+
+	for row := 0; row < 8; row++ {
+		for col := 0; col < 8; col++ {
+			square := Position{row, col}
+			want, got := white.Board[row][col], black.Board[square.Flipped().Row][square.Flipped().Col]
+			if got.IsWhite != want.IsWhite || (got.Piece == nil) != (want.Piece == nil) || got.Piece != nil && *got.Piece != *want.Piece {
+				t.Errorf("%s from Black's side is %+v, want %+v", square.ToAlgebraic(), got, want)
+			}
+		}
+	}
+	// a1 is dark whichever side it's seen from, now in the top right
+	if black.Board[0][7].IsWhite || black.Board[0][7].Piece.Type != Rook {
+		t.Errorf("top right from Black's side is %+v, want a1's dark square and rook", black.Board[0][7])
+	}
+
+	if black.LastMove.From != white.LastMove.From.Flipped() || black.LastMove.To != white.LastMove.To.Flipped() {
+		t.Errorf("last move from Black's side %v-%v, want %v-%v flipped", black.LastMove.From, black.LastMove.To, white.LastMove.From, white.LastMove.To)
+	}
+	if piece := black.Board[black.LastMove.To.Row][black.LastMove.To.Col].Piece; piece == nil || piece.Type != Pawn {
+		t.Errorf("flipped last move points at %v, not the pawn that moved", piece)
+	}
+}
+
+func TestFullMoveNumber(t *testing.T) {
+	tests := []struct {
+		start string
+		moves []string
+		want  []int // after each move, starting before the first
+	}{
+		{"", []string{"e4", "e5", "Nf3"}, []int{1, 1, 2, 2}},
+		{"rnbqkbnr/pppppppp/8/8/4P3/8/PPPP1PPP/RNBQKBNR b KQkq - 0 20", []string{"Nf6", "e5"}, []int{20, 21, 21}},
+	}
+	for _, tt := range tests {
+		service := NewChessService()
+		response, err := service.NewGame(NewGameRequest{Mode: ModePvP, StartingFEN: tt.start})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, want := range tt.want {
+			if i > 0 {
+				playServiceSAN(t, service, tt.moves[i-1])
+				response = service.GetGameState()
+			}
+			fields := strings.Fields(response.FEN)
+			if response.FullMoveNumber != want || fields[len(fields)-1] != fmt.Sprint(want) {
+				t.Errorf("after %v: full move %d, FEN %s, want %d", tt.moves[:i], response.FullMoveNumber, response.FEN, want)
+			}
+		}
+	}
+}
+
+// TestJumpsStartAFreshResignStreak checks that loading a PGN or jumping to a
+// move forgets the AI's hopeless searches, and that a PGN drops the coach.
+func TestJumpsStartAFreshResignStreak(t *testing.T) {
+	service := NewChessService()
+	if _, err := service.NewGame(NewGameRequest{Coach: &CoachOptions{}}); err != nil {
+		t.Fatal(err)
+	}
+
+	service.hopelessMoves = 2
+	if _, err := service.LoadPGN("1. e4 e5 2. Nf3 Nc6 *"); err != nil {
+		t.Fatal(err)
+	}
+	if service.hopelessMoves != 0 || service.CoachThreshold() != 0 {
+		t.Errorf("after LoadPGN: %d hopeless moves, coach threshold %d, want 0 and 0", service.hopelessMoves, service.CoachThreshold())
+	}
+
+	service.hopelessMoves = 2
+	if _, err := service.GotoMove(2); err != nil {
+		t.Fatal(err)
+	}
+	if service.hopelessMoves != 0 {
+		t.Errorf("after GotoMove: %d hopeless moves, want 0", service.hopelessMoves)
+	}
+}
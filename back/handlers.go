@@ -3,9 +3,14 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"log"
+	"errors"
+	"io"
+	"log/slog"
 	"net/http"
+	"runtime"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 	"fmt"
 )
@@ -17,263 +22,1388 @@ import (
 type Handlers struct {
 	chessService *ChessService
 	aiService    *AIService
+	evalGraph    *evalGraphCache
+	searchPool   *searchPool // Shared by the endpoints that run analysis searches
+
+	// Deadline for an AI reply within a request. It stays above the engine's
+	// think time so the search ends on its own limit, with its best move,
+	// rather than being cut off by the request.
+	aiReplyTimeout time.Duration
+
+	analysisMaxThinkTime time.Duration // Most an analysis request's max_think_ms can ask for
 }
 
 type ErrorResponse struct {
-	Error   string `json:"error"`
-	Code    int    `json:"code,omitempty"`
-	Details string `json:"details,omitempty"`
+	Error   string    `json:"error"`
+	Code    ErrorCode `json:"code"`   // Stable, for clients to switch on
+	Status  int       `json:"status"` // Same as the HTTP status
+	Details string    `json:"details,omitempty"`
+}
+
+// ErrorCode identifies the kind of error independently of its message
+type ErrorCode string
+
+const (
+	ErrInvalidJSON      ErrorCode = "INVALID_JSON"
+	ErrBodyTooLarge     ErrorCode = "BODY_TOO_LARGE"
+	ErrInvalidParameter ErrorCode = "INVALID_PARAMETER"
+	ErrInvalidMove      ErrorCode = "INVALID_MOVE"
+	ErrOutOfBounds      ErrorCode = "OUT_OF_BOUNDS"
+	ErrNotYourTurn      ErrorCode = "NOT_YOUR_TURN"
+	ErrNotAITurn        ErrorCode = "NOT_AI_TURN"
+	ErrGameOver         ErrorCode = "GAME_OVER"
+	ErrGameChanged      ErrorCode = "GAME_CHANGED" // The game moved on while the AI was thinking
+	ErrDrawNotAvailable ErrorCode = "DRAW_NOT_AVAILABLE"
+	ErrNothingToUndo    ErrorCode = "NOTHING_TO_UNDO"
+	ErrInvalidFEN       ErrorCode = "INVALID_FEN"
+	ErrInvalidPGN       ErrorCode = "INVALID_PGN"
+	ErrAITimeout        ErrorCode = "AI_TIMEOUT"
+	ErrAIFailed         ErrorCode = "AI_FAILED"
+	ErrServerBusy       ErrorCode = "SERVER_BUSY"
+	ErrInternal         ErrorCode = "INTERNAL_ERROR"
+)
+
+// Request body limits. PGN and batch bodies carry whole games, everything
+// else is a handful of fields.
+const (
+	MAX_BODY_BYTES      = 64 << 10
+	MAX_GAME_BODY_BYTES = 1 << 20
+)
+
+// moveErrorCode maps why a player move was rejected onto an error code
+func moveErrorCode(err error) ErrorCode {
+	var moveErr *MoveError
+	if !errors.As(err, &moveErr) {
+		return ErrInvalidMove
+	}
+	switch moveErr.Reason {
+	case RejectOutOfBounds:
+		return ErrOutOfBounds
+	case RejectNotYourTurn:
+		return ErrNotYourTurn
+	case RejectGameOver:
+		return ErrGameOver
+	}
+	return ErrInvalidMove
+}
+
+// searchErrorCode tells a search that ran out of time from one that failed
+func searchErrorCode(ctx context.Context) ErrorCode {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return ErrAITimeout
+	}
+	return ErrAIFailed
 }
 
 func NewHandlers(chessService *ChessService, aiService *AIService) *Handlers {
 	return &Handlers{
 		chessService: chessService,
 		aiService:    aiService,
+		evalGraph:    &evalGraphCache{},
+		searchPool:   defaultSearchPool(),
+
+		aiReplyTimeout:       defaultAIReplyTimeout(aiService.GetMaxThinkingTime()),
+		analysisMaxThinkTime: MAX_ANALYSIS_THINKING_TIME,
 	}
 }
 
+func defaultAIReplyTimeout(thinkTime time.Duration) time.Duration {
+	if thinkTime <= 0 {
+		return AI_REPLY_TIMEOUT
+	}
+	return thinkTime + AI_REPLY_MARGIN
+}
+
+// SetAIReplyTimeout sets the request deadline for AI replies. It may not be
+// shorter than the engine's think time.
+func (h *Handlers) SetAIReplyTimeout(d time.Duration) error {
+	if thinkTime := h.aiService.GetMaxThinkingTime(); d < thinkTime {
+		return fmt.Errorf("AI reply timeout %v is shorter than the engine think time %v", d, thinkTime)
+	}
+	h.aiReplyTimeout = d
+	return nil
+}
+
+// SetAnalysisMaxThinkingTime sets the ceiling on the think time analysis
+// requests may ask for with max_think_ms
+func (h *Handlers) SetAnalysisMaxThinkingTime(d time.Duration) error {
+	if d <= 0 {
+		return fmt.Errorf("analysis think time ceiling must be positive, got %v", d)
+	}
+	h.analysisMaxThinkTime = d
+	return nil
+}
+
+// SetAnalysisConcurrency limits how many analysis searches run at once and
+// how long a request waits for one to finish before getting a 503
+func (h *Handlers) SetAnalysisConcurrency(maxSearches int, queueTimeout time.Duration) {
+	h.searchPool = newSearchPool(maxSearches, queueTimeout)
+}
+
+// ============================================================================
+// ANALYSIS RESPONSE TYPES
+// ============================================================================
+
+// Evaluations are in centipawns; positive favours Black, negative White
+
+type MaterialBalance struct {
+	White      int                         `json:"white"`
+	Black      int                         `json:"black"`
+	Difference int                         `json:"difference"` // Black minus White
+	Counts     map[Color]map[PieceType]int `json:"counts"`     // Pieces of each type, kings left out
+	Imbalances []Imbalance                 `json:"imbalances"` // The difference in words, see MaterialImbalances
+}
+
+type EvaluationResponse struct {
+	Evaluation   int             `json:"evaluation"`
+	CurrentTurn  string          `json:"current_turn"`
+	Description  string          `json:"description"`
+	MaterialOnly MaterialBalance `json:"material_only"`
+	GamePhase    string          `json:"game_phase"` // "opening", "middlegame" or "endgame"
+}
+
+type AnalysisResponse struct {
+	BestMove      *Move  `json:"best_move"`
+	AnalysisDepth int    `json:"analysis_depth"`
+	Evaluation    int    `json:"evaluation"`
+	CurrentTurn   string `json:"current_turn"`
+}
+
+// PositionAnalysis is one side of a ComparisonResponse
+type PositionAnalysis struct {
+	FEN         string `json:"fen"`
+	Evaluation  int    `json:"evaluation"`
+	Description string `json:"description"`
+	CurrentTurn string `json:"current_turn"`
+	BestMove    *Move  `json:"best_move,omitempty"` // Only when requested
+}
+
+type ComparisonResponse struct {
+	A     PositionAnalysis `json:"a"`
+	B     PositionAnalysis `json:"b"`
+	Delta int              `json:"delta"` // B's evaluation minus A's
+}
+
+type AttackMapResponse struct {
+	Color       string    `json:"color"`
+	AttackMap   [8][8]int `json:"attack_map"` // Attackers of each square, indexed [row][col]
+	CurrentTurn string    `json:"current_turn"`
+}
+
+type PieceStatusResponse struct {
+	Pieces      []PieceStatus `json:"pieces"`
+	CurrentTurn string        `json:"current_turn"`
+}
+
+type ThreatsResponse struct {
+	Side     string   `json:"side"` // The side to move
+	Hanging  []Threat `json:"hanging"`
+	Winnable []Threat `json:"winnable"`
+}
+
+type GameStats struct {
+	MovesPlayed int    `json:"moves_played"`
+	CurrentTurn string `json:"current_turn"`
+	GameOver    bool   `json:"game_over"`
+	IsCheck     bool   `json:"is_check"`
+	ValidMoves  int    `json:"valid_moves"`
+}
+
+type StatsResponse struct {
+	Engine        string         `json:"engine"`
+	Depth         int            `json:"depth"`
+	Difficulty    string         `json:"difficulty"`
+	Timeout       string         `json:"timeout"`
+	MinResponse   string         `json:"min_response_time"`
+	MaxDepth      int            `json:"max_depth"`
+	MaxNodes      int64          `json:"max_nodes"`
+	NodesSearched int64          `json:"nodes_searched"`
+	LastThinkTime string         `json:"last_think_time"`
+	LastForced    bool           `json:"last_move_forced"` // The last move was the only legal one
+	Settings      AISettings     `json:"settings"`
+	EvalMode      EvalMode       `json:"eval_mode"`
+	Style         string         `json:"style"`
+	Resign        ResignPolicy   `json:"resign"`
+	EvalCache     EvalCacheStats `json:"eval_cache"`
+	GameStats     *GameStats     `json:"game_stats,omitempty"` // Only from /api/ai/stats
+}
+
 // ============================================================================
 // HEALTH & STATUS ENDPOINTS
 // ============================================================================
 
-func (h *Handlers) Health(w http.ResponseWriter, r *http.Request) {
+func (h *Handlers) Health(w http.ResponseWriter, r *http.Request) {
+	response := map[string]interface{}{
+		"status":      "healthy",
+		"service":     "chess-ai-backend",
+		"version":     "3.0.0",
+		"timestamp":   time.Now(),
+		"uptime":      "running", // Could calculate actual uptime
+		"endpoints": map[string]string{
+			"game":       "GET /api/game",
+			"move":       "POST /api/move", 
+			"new_game":   "POST /api/new-game",
+			"ai_move":    "POST /api/ai/move",
+			"ai_stats":   "GET /api/ai/stats",
+		},
+		"analysis_searches": map[string]int{
+			"max":     h.searchPool.size(),
+			"running": h.searchPool.inUse(),
+		},
+	}
+	
+	h.writeJSON(w, response)
+}
+
+func (h *Handlers) ChangeDepth(w http.ResponseWriter, r *http.Request) {
+	var depthReq ChangeDepthRequest
+	if err := decodeJSON(w, r, &depthReq, MAX_BODY_BYTES); err != nil {
+		h.writeDecodeError(w, err)
+		return
+	}
+
+	h.aiService.SetDepth(depthReq.Depth)
+
+	slog.Info("AI depth changed", "depth", depthReq.Depth)
+}
+
+// ============================================================================
+// GAME STATE ENDPOINTS
+// ============================================================================
+
+func (h *Handlers) GetGameState(w http.ResponseWriter, r *http.Request) {
+	response := h.chessService.GetGameState()
+	
+	// ?perspective=black flips the board for a client drawing it from Black's side
+	if perspective := Color(strings.ToLower(r.URL.Query().Get("perspective"))); perspective != "" {
+		if perspective != White && perspective != Black {
+			h.writeError(w, ErrInvalidParameter, "Invalid perspective", http.StatusBadRequest, "perspective must be 'white' or 'black'")
+			return
+		}
+		response.ForPerspective(perspective)
+	}
+	
+	h.writeJSON(w, response)
+}
+
+func (h *Handlers) NewGame(w http.ResponseWriter, r *http.Request) {
+	// The options body is optional, an empty request starts a standard game
+	var req NewGameRequest
+	if err := decodeJSON(w, r, &req, MAX_BODY_BYTES); err != nil && err != io.EOF {
+		h.writeDecodeError(w, err)
+		return
+	}
+
+	// Every option is checked before any is applied, so a bad one changes
+	// neither the game nor the AI
+	settings, err := h.aiService.difficultySettings(req.AIDifficulty, req.Depth)
+	if err != nil {
+		h.writeError(w, ErrInvalidParameter, "Invalid new game options", http.StatusBadRequest, err.Error())
+		return
+	}
+	response, err := h.chessService.NewGame(req)
+	if err != nil {
+		h.writeError(w, ErrInvalidParameter, "Invalid new game options", http.StatusBadRequest, err.Error())
+		return
+	}
+	h.aiService.setSettings(settings)
+
+	switch {
+	case req.Chess960:
+		slog.Info("New game", "variant", "chess960")
+	case req.StartingFEN != "":
+		slog.Info("New game", "fen", req.StartingFEN)
+	default:
+		slog.Info("New game")
+	}
+	if req.Mode == ModePvP {
+		slog.Info("Two-player game, the AI sits out")
+	}
+	if len(req.Handicap) > 0 {
+		slog.Info("AI gives odds", "handicap", req.Handicap)
+	}
+	if req.AIDifficulty != "" || req.Depth != nil {
+		slog.Info("AI difficulty set", "difficulty", h.aiService.getDifficultyString(), "depth", h.aiService.GetDepth())
+	}
+	if req.TimeControl != nil {
+		slog.Info("Time control set", "time_control", req.TimeControl.pgnTag())
+	}
+
+	// With the human on Black the AI opens
+	if h.chessService.IsAITurn() {
+		slog.Debug("AI making the first move")
+
+		ctx, cancel := context.WithTimeout(r.Context(), h.aiReplyTimeout)
+		defer cancel()
+
+		aiResponse, err := h.aiService.MakeAIMove(ctx, h.chessService)
+		h.logSearchCutoff(ctx)
+		if err != nil {
+			slog.Warn("AI move failed", "err", err)
+		} else {
+			response = aiResponse
+		}
+	}
+	h.writeJSON(w, response)
+}
+
+func (h *Handlers) GetValidMoves(w http.ResponseWriter, r *http.Request) {
+	game := h.chessService.GetGame()
+	moves := game.GetValidMoves(game.CurrentTurn)
+	
+	response := map[string]interface{}{
+		"valid_moves":  moves,
+		"count":        len(moves),
+		"current_turn": string(game.CurrentTurn),
+		"is_check":     game.IsInCheck(game.CurrentTurn),
+	}
+	
+	h.writeJSON(w, response)
+}
+
+// IsMoveLegal checks a single move, e.g. for premove or hover feedback,
+// without fetching every valid move
+func (h *Handlers) IsMoveLegal(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	
+	var coords [4]int
+	for i, name := range []string{"fromRow", "fromCol", "toRow", "toCol"} {
+		value, err := strconv.Atoi(query.Get(name))
+		if err != nil {
+			h.writeError(w, ErrInvalidParameter, "Invalid "+name, http.StatusBadRequest, err.Error())
+			return
+		}
+		coords[i] = value
+	}
+	
+	move := Move{
+		From:      Position{Row: coords[0], Col: coords[1]},
+		To:        Position{Row: coords[2], Col: coords[3]},
+		Promotion: PieceType(query.Get("promotion")),
+	}
+	reason := h.chessService.GetGame().ValidateMove(move)
+	
+	response := map[string]interface{}{
+		"legal": reason == "",
+	}
+	if reason != "" {
+		response["reason"] = reason
+	}
+	
+	h.writeJSON(w, response)
+}
+
+func (h *Handlers) GetGameHistory(w http.ResponseWriter, r *http.Request) {
+	game := h.chessService.GetGame()
+	
+	response := map[string]interface{}{
+		"moves":         game.MoveHistory,
+		"move_count":    len(game.MoveHistory),
+		"current_turn":  string(game.CurrentTurn),
+		"game_over":     game.GameOver,
+		"winner":        game.Winner,
+		"last_move":     game.GetLastMove(),
+	}
+	
+	h.writeJSON(w, response)
+}
+
+func (h *Handlers) GotoMove(w http.ResponseWriter, r *http.Request) {
+	var req GotoRequest
+	if err := decodeJSON(w, r, &req, MAX_BODY_BYTES); err != nil {
+		h.writeDecodeError(w, err)
+		return
+	}
+
+	response, err := h.chessService.GotoMove(req.MoveIndex)
+	if err != nil {
+		h.writeError(w, ErrInvalidParameter, "Invalid move index", http.StatusBadRequest, err.Error())
+		return
+	}
+
+	slog.Debug("Jumped to move", "move_index", req.MoveIndex)
+	h.writeJSON(w, response)
+}
+
+func (h *Handlers) UndoMove(w http.ResponseWriter, r *http.Request) {
+	response, err := h.chessService.UndoMove()
+	if err != nil {
+		h.writeError(w, ErrNothingToUndo, "Cannot undo", http.StatusBadRequest, err.Error())
+		return
+	}
+
+	slog.Debug("Took back moves", "moves_left", response.MoveCount)
+	h.writeJSON(w, response)
+}
+
+// SwapSides switches which side the AI plays and, if that leaves the AI to
+// move, has it move straight away
+func (h *Handlers) SwapSides(w http.ResponseWriter, r *http.Request) {
+	response := h.chessService.SwapSides()
+	slog.Info("Sides swapped", "ai_color", h.chessService.AIColor())
+
+	if h.chessService.IsAITurn() {
+		ctx, cancel := context.WithTimeout(r.Context(), h.aiReplyTimeout)
+		defer cancel()
+
+		aiResponse, err := h.aiService.MakeAIMove(ctx, h.chessService)
+		h.logSearchCutoff(ctx)
+		if err != nil {
+			// The swap stands, the AI can still be asked to move later
+			slog.Warn("AI move failed", "err", err)
+			h.writeJSON(w, response)
+			return
+		}
+		response = aiResponse
+	}
+
+	h.writeJSON(w, response)
+}
+
+func (h *Handlers) ClaimDraw(w http.ResponseWriter, r *http.Request) {
+	response, err := h.chessService.ClaimDraw()
+	if err != nil {
+		h.writeError(w, ErrDrawNotAvailable, "Cannot claim draw", http.StatusBadRequest, err.Error())
+		return
+	}
+
+	slog.Info("Draw claimed", "reason", response.EndReason)
+	h.writeJSON(w, response)
+}
+
+// DrawOffer offers a draw or answers the opponent's offer. Against the AI the
+// offer is answered at once, so it never stays pending.
+func (h *Handlers) DrawOffer(w http.ResponseWriter, r *http.Request) {
+	var req DrawOfferRequest
+	if err := decodeJSON(w, r, &req, MAX_BODY_BYTES); err != nil {
+		h.writeDecodeError(w, err)
+		return
+	}
+
+	color, ok := h.playerColor(w, req.Color, "the AI answers draw offers itself")
+	if !ok {
+		return
+	}
+	req.Color = color
+	pvai := h.chessService.Mode() == ModePvAI
+
+	var response *GameResponse
+	var err error
+	switch req.Action {
+	case "offer":
+		response, err = h.chessService.OfferDraw(req.Color)
+	case "accept", "decline":
+		response, err = h.chessService.AnswerDrawOffer(req.Color, req.Action == "accept")
+	default:
+		h.writeError(w, ErrInvalidParameter, "Invalid action", http.StatusBadRequest, "action must be 'offer', 'accept' or 'decline'")
+		return
+	}
+	if err != nil {
+		h.writeError(w, ErrDrawNotAvailable, "Cannot "+req.Action+" draw", http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if pvai && req.Action == "offer" {
+		accept := h.aiService.AcceptsDraw(r.Context(), h.chessService.GetGame(), h.chessService.AIColor())
+		if answered, err := h.chessService.AnswerDrawOffer(h.chessService.AIColor(), accept); err == nil {
+			response = answered
+		}
+		slog.Info("AI answered draw offer", "accepted", accept)
+	} else {
+		slog.Info("Draw offer", "action", req.Action, "color", req.Color)
+	}
+	h.writeJSON(w, response)
+}
+
+// playerColor resolves the color a player acts for. Against the AI that is
+// the human's, which the request may leave out; a two-player game names it.
+// aiRefusal says why the AI's color is refused. On a bad color it answers
+// 400 itself and returns false.
+func (h *Handlers) playerColor(w http.ResponseWriter, color Color, aiRefusal string) (Color, bool) {
+	pvai := h.chessService.Mode() == ModePvAI
+	humanColor := opponentColor(h.chessService.AIColor())
+	if color == "" && pvai {
+		color = humanColor
+	}
+	if color != White && color != Black {
+		h.writeError(w, ErrInvalidParameter, "Invalid color", http.StatusBadRequest, "color must be 'white' or 'black'")
+		return "", false
+	}
+	if pvai && color != humanColor {
+		h.writeError(w, ErrInvalidParameter, "Invalid color", http.StatusBadRequest, aiRefusal)
+		return "", false
+	}
+	return color, true
+}
+
+// Resign gives the game up for the requesting player. Against the AI that is
+// the human, whichever color they play; a two-player game names the color.
+func (h *Handlers) Resign(w http.ResponseWriter, r *http.Request) {
+	var req ResignRequest
+	if err := decodeJSON(w, r, &req, MAX_BODY_BYTES); err != nil {
+		h.writeDecodeError(w, err)
+		return
+	}
+
+	color, ok := h.playerColor(w, req.Color, "only the AI can resign for the AI")
+	if !ok {
+		return
+	}
+	req.Color = color
+
+	response, err := h.chessService.Resign(req.Color)
+	if err != nil {
+		h.writeError(w, ErrGameOver, "Cannot resign", http.StatusBadRequest, err.Error())
+		return
+	}
+	slog.Info("Player resigned", "color", req.Color, "winner", response.Winner)
+	h.writeJSON(w, response)
+}
+
+func (h *Handlers) ExportPGN(w http.ResponseWriter, r *http.Request) {
+	pgn, err := h.chessService.ExportPGN()
+	if err != nil {
+		h.writeError(w, ErrInternal, "Failed to export PGN", http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	h.writeJSON(w, map[string]interface{}{"pgn": pgn})
+}
+
+// Export returns FEN, PGN and the SAN move list in one payload; see
+// ExportResponse for the format
+func (h *Handlers) Export(w http.ResponseWriter, r *http.Request) {
+	export, err := h.chessService.Export()
+	if err != nil {
+		h.writeError(w, ErrInternal, "Failed to export game", http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	h.writeJSON(w, export)
+}
+
+func (h *Handlers) LoadPGN(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		PGN string `json:"pgn"`
+	}
+	if err := decodeJSON(w, r, &req, MAX_GAME_BODY_BYTES); err != nil {
+		h.writeDecodeError(w, err)
+		return
+	}
+
+	response, err := h.chessService.LoadPGN(req.PGN)
+	if err != nil {
+		h.writeError(w, ErrInvalidPGN, "Invalid PGN", http.StatusBadRequest, err.Error())
+		return
+	}
+
+	slog.Info("Loaded PGN game", "moves", response.MoveCount)
+	h.writeJSON(w, response)
+}
+
+// AnnotatePGN reviews a game, the posted PGN or else the current one, and
+// returns it with every move evaluated and errors marked
+func (h *Handlers) AnnotatePGN(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		PGN        string                `json:"pgn,omitempty"`
+		Depth      int                   `json:"depth,omitempty"`
+		Thresholds *AnnotationThresholds `json:"thresholds,omitempty"`
+	}
+	if err := decodeJSON(w, r, &req, MAX_GAME_BODY_BYTES); err != nil && err != io.EOF {
+		h.writeDecodeError(w, err)
+		return
+	}
+
+	depth := ANNOTATE_DEPTH
+	if req.Depth != 0 {
+		if req.Depth < 1 || req.Depth > ANNOTATE_MAX_DEPTH {
+			h.writeError(w, ErrInvalidParameter, "Invalid depth", http.StatusBadRequest, fmt.Sprintf("depth must be between 1 and %d", ANNOTATE_MAX_DEPTH))
+			return
+		}
+		depth = req.Depth
+	}
+
+	thresholds := DefaultAnnotationThresholds()
+	if req.Thresholds != nil {
+		if err := req.Thresholds.validate(); err != nil {
+			h.writeError(w, ErrInvalidParameter, "Invalid thresholds", http.StatusBadRequest, err.Error())
+			return
+		}
+		thresholds = *req.Thresholds
+	}
+
+	game := h.chessService.GetGame()
+	if req.PGN != "" {
+		loaded, err := LoadPGN(req.PGN)
+		if err != nil {
+			h.writeError(w, ErrInvalidPGN, "Invalid PGN", http.StatusBadRequest, err.Error())
+			return
+		}
+		game = loaded
+	}
+
+	if !h.acquireSearch(w, r) {
+		return
+	}
+	defer h.searchPool.release()
+
+	ctx, cancel := context.WithTimeout(r.Context(), ANALYSIS_THINKING_TIME)
+	defer cancel()
+
+	response, err := h.aiService.AnnotateGame(ctx, game, h.chessService.AIColor(), depth, thresholds)
+	if err != nil {
+		h.writeError(w, searchErrorCode(ctx), "Failed to annotate game", http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	slog.Info("Annotated game", "moves", len(response.Moves), "depth", depth)
+	h.writeJSON(w, response)
+}
+
+// ============================================================================
+// MOVE ENDPOINTS
+// ============================================================================
+
+func (h *Handlers) MakeMove(w http.ResponseWriter, r *http.Request) {
+	var moveReq MoveRequest
+	if err := decodeJSON(w, r, &moveReq, MAX_BODY_BYTES); err != nil {
+		h.writeDecodeError(w, err)
+		return
+	}
+
+	h.playMove(w, r, moveReq)
+}
+
+// MakeUCIMove plays a move given in coordinate form, e.g. {"uci": "e7e8q"}
+func (h *Handlers) MakeUCIMove(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		UCI     string `json:"uci"`
+		ThinkMs int    `json:"thinkMs,omitempty"`
+	}
+	if err := decodeJSON(w, r, &req, MAX_BODY_BYTES); err != nil {
+		h.writeDecodeError(w, err)
+		return
+	}
+
+	moveReq, err := ParseUCIMove(req.UCI)
+	if err != nil {
+		h.writeError(w, ErrInvalidMove, "Invalid UCI move", http.StatusBadRequest, err.Error())
+		return
+	}
+	moveReq.ThinkMs = req.ThinkMs
+
+	h.playMove(w, r, moveReq)
+}
+
+// playMove makes the player's move and, if it is then the AI's turn, the AI's reply
+func (h *Handlers) playMove(w http.ResponseWriter, r *http.Request, moveReq MoveRequest) {
+	slog.Debug("Player move", "from", moveReq.From.ToAlgebraic(), "to", moveReq.To.ToAlgebraic(), "promotion", moveReq.Promotion)
+
+	// Validate the move request
+	if !inBounds(moveReq.From) || !inBounds(moveReq.To) {
+		h.writeError(w, ErrOutOfBounds, "Move coordinates out of bounds", http.StatusBadRequest, "")
+		return
+	}
+
+	// The AI's reply may not think longer than the engine's own limit, or
+	// past the request's deadline
+	thinkTime := time.Duration(moveReq.ThinkMs) * time.Millisecond
+	maxThinkTime := h.aiService.GetMaxThinkingTime()
+	if maxThinkTime <= 0 {
+		maxThinkTime = h.aiReplyTimeout - AI_REPLY_MARGIN
+	}
+	if deadline, ok := r.Context().Deadline(); ok && deadline.Sub(h.aiService.Now()) < maxThinkTime {
+		maxThinkTime = deadline.Sub(h.aiService.Now())
+	}
+	if thinkTime < 0 || thinkTime > maxThinkTime {
+		h.writeError(w, ErrInvalidParameter, "Invalid thinkMs", http.StatusBadRequest, fmt.Sprintf("thinkMs must be between 0 and %d", maxThinkTime.Milliseconds()))
+		return
+	}
+
+	// Make player move, keeping the position it was played from for the coach
+	coachThreshold := h.chessService.CoachThreshold()
+	response, before, err := h.chessService.makePlayerMove(moveReq, coachThreshold > 0)
+	if err != nil {
+		h.writeError(w, moveErrorCode(err), "Invalid move", http.StatusBadRequest, err.Error())
+		return
+	}
+
+	slog.Debug("Player move played")
+
+	var coach *CoachReport
+	if before != nil {
+		coach = h.reviewPlayerMove(r.Context(), before, moveReq, coachThreshold)
+		response.Coach = coach
+	}
+
+	// If game is over, return immediately
+	if response.IsGameOver {
+		slog.Info("Game over", "winner", response.Winner, "reason", response.EndReason)
+		h.writeJSON(w, response)
+		return
+	}
+
+	// Make AI move if it's AI's turn
+	if h.chessService.IsAITurn() {
+		slog.Debug("AI thinking")
+		
+		ctx, cancel := context.WithTimeout(r.Context(), h.aiReplyTimeout)
+		defer cancel()
+		
+		start := h.aiService.Now()
+		aiResponse, err := h.aiService.MakeAIMoveWithOptions(ctx, h.chessService, AIMoveOptions{ThinkTime: thinkTime})
+		h.logSearchCutoff(ctx)
+		if err != nil {
+			slog.Warn("AI move failed", "err", err)
+			// Return current state even if AI fails
+			response.AIThinking = false
+			h.writeJSON(w, response)
+			return
+		}
+		
+		slog.Debug("AI move played", "think_ms", aiResponse.AIThinkMs)
+		response = aiResponse
+		response.AIThinking = false
+		response.Coach = coach
+		
+		h.aiService.PadResponse(ctx, start)
+	}
+
+	h.writeJSON(w, response)
+}
+
+// reviewPlayerMove has the coach look at the move just played from before.
+// A review that fails is logged and left out rather than failing the move.
+func (h *Handlers) reviewPlayerMove(ctx context.Context, before *ChessGame, moveReq MoveRequest, threshold int) *CoachReport {
+	move := Move{From: moveReq.From, To: moveReq.To, Promotion: moveReq.Promotion}
+	report, err := h.aiService.ReviewMove(ctx, before, move, threshold)
+	if err != nil {
+		slog.Warn("Coach review skipped", "err", err)
+		return nil
+	}
+	if report.Blunder {
+		slog.Debug("Blunder", "move", report.Move, "loss", report.Loss, "better_move", report.BetterMove)
+	}
+	return report
+}
+
+// checkAITurn writes the error and reports false unless the AI can move now.
+// The game can still change before the AI's move is applied, which
+// applyAIMove catches.
+func (h *Handlers) checkAITurn(w http.ResponseWriter) bool {
+	game := h.chessService.GetGame()
+	if game.GameOver {
+		h.writeError(w, ErrGameOver, "Cannot make AI move: game is over", http.StatusBadRequest, "")
+		return false
+	}
+
+	if h.chessService.Mode() == ModePvP {
+		h.writeError(w, ErrNotAITurn, "No AI in a two-player game", http.StatusBadRequest, "")
+		return false
+	}
+
+	if game.CurrentTurn != h.chessService.AIColor() {
+		h.writeError(w, ErrNotAITurn, "Not AI's turn", http.StatusBadRequest, "Current turn: "+string(game.CurrentTurn))
+		return false
+	}
+	return true
+}
+
+func (h *Handlers) ForceAIMove(w http.ResponseWriter, r *http.Request) {
+	if !h.checkAITurn(w) {
+		return
+	}
+
+	// ?analyze=true also reports the moves the AI ranked behind its choice
+	analyze := false
+	if raw := r.URL.Query().Get("analyze"); raw != "" {
+		value, err := strconv.ParseBool(raw)
+		if err != nil {
+			h.writeError(w, ErrInvalidParameter, "Invalid analyze", http.StatusBadRequest, "analyze must be true or false")
+			return
+		}
+		analyze = value
+	}
+	top := AI_ALTERNATIVES
+	if topStr := r.URL.Query().Get("top"); topStr != "" {
+		n, err := strconv.Atoi(topStr)
+		if err != nil || n < 1 || n > MAX_AI_ALTERNATIVES {
+			h.writeError(w, ErrInvalidParameter, "Invalid top", http.StatusBadRequest, fmt.Sprintf("top must be between 1 and %d", MAX_AI_ALTERNATIVES))
+			return
+		}
+		top = n
+	}
+
+	slog.Debug("Forced AI move requested")
+
+	ctx, cancel := context.WithTimeout(r.Context(), h.aiReplyTimeout)
+	defer cancel()
+	
+	options := AIMoveOptions{}
+	if analyze {
+		options.Alternatives = top
+	}
+	response, err := h.aiService.MakeAIMoveWithOptions(ctx, h.chessService, options)
+	h.logSearchCutoff(ctx)
+	if errors.Is(err, errGameChanged) {
+		h.writeError(w, ErrGameChanged, "AI move dropped", http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		h.writeError(w, searchErrorCode(ctx), "AI move failed", http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	slog.Debug("Forced AI move played")
+	h.writeJSON(w, response)
+}
+
+// StreamAIMove plays the AI move like ForceAIMove but reports the search as
+// Server-Sent Events: a "progress" event per completed depth, then a final
+// "move" event with the game state (or an "error" event)
+func (h *Handlers) StreamAIMove(w http.ResponseWriter, r *http.Request) {
+	if !h.checkAITurn(w) {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		h.writeError(w, ErrInternal, "Streaming not supported", http.StatusInternalServerError, "")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	// The search reports from its own goroutine and may outlive a timeout, so
+	// stop it from writing once this handler is done with the response
+	var mu sync.Mutex
+	finished := false
+	send := func(event string, data interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		if finished {
+			return
+		}
+		h.writeEvent(w, event, data)
+		flusher.Flush()
+	}
+	defer func() {
+		mu.Lock()
+		finished = true
+		mu.Unlock()
+	}()
+
+	slog.Debug("Streaming AI move requested")
+
+	ctx, cancel := context.WithTimeout(r.Context(), h.aiReplyTimeout)
+	defer cancel()
+
+	response, err := h.aiService.MakeAIMoveWithOptions(ctx, h.chessService, AIMoveOptions{Progress: func(p SearchProgress) {
+		send("progress", p)
+	}})
+	h.logSearchCutoff(ctx)
+	if err != nil {
+		slog.Warn("Streaming AI move failed", "err", err)
+		if errors.Is(err, errGameChanged) {
+			send("error", ErrorResponse{Error: "AI move dropped", Code: ErrGameChanged, Status: http.StatusConflict, Details: err.Error()})
+			return
+		}
+		send("error", ErrorResponse{Error: "AI move failed", Code: searchErrorCode(ctx), Status: http.StatusInternalServerError, Details: err.Error()})
+		return
+	}
+
+	slog.Debug("Streaming AI move played")
+	send("move", response)
+}
+
+// ============================================================================
+// AI CONFIGURATION ENDPOINTS
+// ============================================================================
+
+// StopAI makes a running AI search return its best move so far right away
+func (h *Handlers) StopAI(w http.ResponseWriter, r *http.Request) {
+	stopped, bestMove := h.chessService.StopAI()
+	if stopped {
+		slog.Debug("AI search stopped on request")
+	}
+	
+	response := map[string]interface{}{
+		"stopped":   stopped,
+		"best_move": bestMove,
+	}
+	
+	h.writeJSON(w, response)
+}
+
+func (h *Handlers) GetAIStats(w http.ResponseWriter, r *http.Request) {
+	stats := h.aiService.GetStats()
+	
+	// Add game-specific stats
+	game := h.chessService.GetGame()
+	stats.GameStats = &GameStats{
+		MovesPlayed: len(game.MoveHistory),
+		CurrentTurn: string(game.CurrentTurn),
+		GameOver:    game.GameOver,
+		IsCheck:     game.IsInCheck(game.CurrentTurn),
+		ValidMoves:  len(game.GetValidMoves(game.CurrentTurn)),
+	}
+	
+	h.writeJSON(w, stats)
+}
+
+func (h *Handlers) SetDifficulty(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Difficulty         string        `json:"difficulty"`
+		Depth              *int          `json:"depth,omitempty"`
+		MinResponseMs      *int64        `json:"minResponseMs,omitempty"`
+		Style              string        `json:"style,omitempty"`
+		CheckExtension     *int          `json:"checkExtension,omitempty"`
+		RecaptureExtension *int          `json:"recaptureExtension,omitempty"` // Quarter plies
+		Resign             *ResignPolicy `json:"resign,omitempty"`             // Replaces the whole policy
+	}
+	
+	if err := decodeJSON(w, r, &req, MAX_BODY_BYTES); err != nil {
+		h.writeDecodeError(w, err)
+		return
+	}
+
+	// Set difficulty by name or custom depth
+	if req.Depth != nil {
+		if err := h.aiService.SetDepth(*req.Depth); err != nil {
+			h.writeError(w, ErrInvalidParameter, "Invalid depth", http.StatusBadRequest, err.Error())
+			return
+		}
+		slog.Info("AI depth set", "depth", *req.Depth)
+	} else if req.Difficulty != "" {
+		if err := h.aiService.SetDifficulty(req.Difficulty); err != nil {
+			h.writeError(w, ErrInvalidParameter, "Invalid difficulty", http.StatusBadRequest, err.Error())
+			return
+		}
+		slog.Info("AI difficulty set", "difficulty", req.Difficulty)
+	} else if req.MinResponseMs == nil && req.Style == "" && req.CheckExtension == nil && req.RecaptureExtension == nil && req.Resign == nil {
+		h.writeError(w, ErrInvalidParameter, "Must provide 'difficulty', 'depth', 'minResponseMs', 'style', 'checkExtension', 'recaptureExtension' or 'resign'", http.StatusBadRequest, "")
+		return
+	}
+
+	if req.Resign != nil {
+		if err := h.aiService.SetResignPolicy(*req.Resign); err != nil {
+			h.writeError(w, ErrInvalidParameter, "Invalid resign policy", http.StatusBadRequest, err.Error())
+			return
+		}
+		slog.Info("AI resign policy set", "policy", h.aiService.GetResignPolicy())
+	}
+
+	if req.CheckExtension != nil {
+		if err := h.aiService.SetCheckExtension(*req.CheckExtension); err != nil {
+			h.writeError(w, ErrInvalidParameter, "Invalid checkExtension", http.StatusBadRequest, err.Error())
+			return
+		}
+		slog.Info("AI check extension set", "plies", *req.CheckExtension)
+	}
+
+	if req.RecaptureExtension != nil {
+		if err := h.aiService.SetRecaptureExtension(*req.RecaptureExtension); err != nil {
+			h.writeError(w, ErrInvalidParameter, "Invalid recaptureExtension", http.StatusBadRequest, err.Error())
+			return
+		}
+		slog.Info("AI recapture extension set", "quarter_plies", *req.RecaptureExtension)
+	}
+
+	if req.Style != "" {
+		if err := h.aiService.SetStyle(req.Style); err != nil {
+			h.writeError(w, ErrInvalidParameter, "Invalid style", http.StatusBadRequest, err.Error())
+			return
+		}
+		slog.Info("AI style set", "style", h.aiService.GetStyle())
+	}
+
+	if req.MinResponseMs != nil {
+		minResponse := time.Duration(*req.MinResponseMs) * time.Millisecond
+		if err := h.aiService.SetMinResponseTime(minResponse); err != nil {
+			h.writeError(w, ErrInvalidParameter, "Invalid minResponseMs", http.StatusBadRequest, err.Error())
+			return
+		}
+		slog.Info("AI min response time set", "min_response", minResponse)
+	}
+
 	response := map[string]interface{}{
-		"status":      "healthy",
-		"service":     "chess-ai-backend",
-		"version":     "3.0.0",
-		"timestamp":   time.Now(),
-		"uptime":      "running", // Could calculate actual uptime
-		"endpoints": map[string]string{
-			"game":       "GET /api/game",
-			"move":       "POST /api/move", 
-			"new_game":   "POST /api/new-game",
-			"ai_move":    "POST /api/ai/move",
-			"ai_stats":   "GET /api/ai/stats",
-		},
+		"message":     "AI configuration updated successfully",
+		"difficulty":  h.aiService.getDifficultyString(),
+		"depth":       h.aiService.GetDepth(),
+		"style":       h.aiService.GetStyle(),
+		"settings":    h.aiService.GetSettings(),
+		"stats":       h.aiService.GetStats(),
 	}
 	
 	h.writeJSON(w, response)
 }
 
-func (h *Handlers) ChangeDepth(w http.ResponseWriter, r *http.Request) {
-	var depthReq ChangeDepthRequest
-	if err := json.NewDecoder(r.Body).Decode(&depthReq); err != nil {
-		h.writeError(w, "Invalid JSON format", http.StatusBadRequest, err.Error())
-		return
+func (h *Handlers) SetEvalMode(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Mode string `json:"mode"`
 	}
 
-	h.aiService.SetDepth(depthReq.Depth)
+	if err := decodeJSON(w, r, &req, MAX_BODY_BYTES); err != nil {
+		h.writeDecodeError(w, err)
+		return
+	}
 
-	log.Printf("Depth change: %+v", depthReq)
-}
+	if err := h.aiService.SetEvalMode(req.Mode); err != nil {
+		h.writeError(w, ErrInvalidParameter, "Invalid eval mode", http.StatusBadRequest, err.Error())
+		return
+	}
+	slog.Info("AI eval mode set", "mode", req.Mode)
 
-// ============================================================================
-// GAME STATE ENDPOINTS
-// ============================================================================
+	response := map[string]interface{}{
+		"message":   "AI evaluation mode updated successfully",
+		"eval_mode": req.Mode,
+		"stats":     h.aiService.GetStats(),
+	}
 
-func (h *Handlers) GetGameState(w http.ResponseWriter, r *http.Request) {
-	response := h.chessService.GetGameState()
 	h.writeJSON(w, response)
 }
 
-func (h *Handlers) NewGame(w http.ResponseWriter, r *http.Request) {
-	log.Println("🎮 Starting new game")
-	response := h.chessService.NewGame()
-	h.writeJSON(w, response)
-}
+// ============================================================================
+// ANALYSIS ENDPOINTS
+// ============================================================================
 
-func (h *Handlers) GetValidMoves(w http.ResponseWriter, r *http.Request) {
+func (h *Handlers) EvaluatePosition(w http.ResponseWriter, r *http.Request) {
 	game := h.chessService.GetGame()
-	moves := game.GetValidMoves(game.CurrentTurn)
+	evaluation := h.aiService.Evaluate(game)
 	
-	response := map[string]interface{}{
-		"valid_moves":  moves,
-		"count":        len(moves),
-		"current_turn": string(game.CurrentTurn),
-		"is_check":     game.IsInCheck(game.CurrentTurn),
+	response := EvaluationResponse{
+		Evaluation:   evaluation,
+		CurrentTurn:  string(game.CurrentTurn),
+		Description:  getEvaluationDescription(evaluation),
+		MaterialOnly: h.getMaterialBalance(game),
+		GamePhase:    h.getGamePhase(game),
 	}
 	
 	h.writeJSON(w, response)
 }
 
-func (h *Handlers) GetGameHistory(w http.ResponseWriter, r *http.Request) {
-	game := h.chessService.GetGame()
-	
-	response := map[string]interface{}{
-		"moves":         game.MoveHistory,
-		"move_count":    len(game.MoveHistory),
-		"current_turn":  string(game.CurrentTurn),
-		"game_over":     game.GameOver,
-		"winner":        game.Winner,
-		"last_move":     game.GetLastMove(),
+// ComparePositions evaluates two FENs side by side on scratch games, e.g. the
+// position before and after a blunder. The live game is left untouched.
+func (h *Handlers) ComparePositions(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		FenA     string `json:"fenA"`
+		FenB     string `json:"fenB"`
+		BestMove bool   `json:"bestMove,omitempty"`
 	}
-	
-	h.writeJSON(w, response)
-}
 
-// ============================================================================
-// MOVE ENDPOINTS
-// ============================================================================
+	if err := decodeJSON(w, r, &req, MAX_BODY_BYTES); err != nil {
+		h.writeDecodeError(w, err)
+		return
+	}
 
-func (h *Handlers) MakeMove(w http.ResponseWriter, r *http.Request) {
-	var moveReq MoveRequest
-	if err := json.NewDecoder(r.Body).Decode(&moveReq); err != nil {
-		h.writeError(w, "Invalid JSON format", http.StatusBadRequest, err.Error())
+	thinkTime, err := h.analysisThinkingTime(r)
+	if err != nil {
+		h.writeError(w, ErrInvalidParameter, "Invalid max_think_ms", http.StatusBadRequest, err.Error())
 		return
 	}
+	if req.BestMove {
+		if !h.acquireSearch(w, r) {
+			return
+		}
+		defer h.searchPool.release()
+	}
+	worker := h.aiService.analysisWorker(thinkTime)
 
-	log.Printf("🎯 Player move: %+v", moveReq)
+	var results []PositionAnalysis
+	for _, fen := range []string{req.FenA, req.FenB} {
+		game, err := LoadFEN(fen)
+		if err != nil {
+			h.writeError(w, ErrInvalidFEN, "Invalid FEN", http.StatusBadRequest, err.Error())
+			return
+		}
 
-	// Validate the move request
-	if !inBounds(moveReq.From) || !inBounds(moveReq.To) {
-		h.writeError(w, "Move coordinates out of bounds", http.StatusBadRequest, "")
-		return
+		evaluation := h.aiService.Evaluate(game)
+		result := PositionAnalysis{
+			FEN:         fen,
+			Evaluation:  evaluation,
+			Description: getEvaluationDescription(evaluation),
+			CurrentTurn: string(game.CurrentTurn),
+		}
+
+		if req.BestMove && !game.GameOver {
+			bestMove, err := worker.GetBestMove(r.Context(), game)
+			if err != nil {
+				h.writeError(w, searchErrorCode(r.Context()), "Failed to analyze position", http.StatusInternalServerError, err.Error())
+				return
+			}
+			result.BestMove = bestMove
+		}
+
+		results = append(results, result)
 	}
 
-	// Make player move
-	response, err := h.chessService.MakePlayerMove(moveReq)
-	if err != nil {
-		h.writeError(w, "Invalid move", http.StatusBadRequest, err.Error())
-		return
+	response := ComparisonResponse{
+		A:     results[0],
+		B:     results[1],
+		Delta: results[1].Evaluation - results[0].Evaluation,
 	}
 
-	log.Printf("✅ Player move successful")
+	h.writeJSON(w, response)
+}
 
-	// If game is over, return immediately
-	if response.IsGameOver {
-		log.Printf("🏁 Game over: %s", response.Winner)
-		h.writeJSON(w, response)
+// ValidatePosition checks whether a setup, given as a FEN or a list of
+// pieces, could occur in a game before it's used to start one
+func (h *Handlers) ValidatePosition(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		FEN      string        `json:"fen,omitempty"`
+		Pieces   []PlacedPiece `json:"pieces,omitempty"`
+		Turn     Color         `json:"turn,omitempty"`
+		Castling string        `json:"castling,omitempty"`
+	}
+
+	if err := decodeJSON(w, r, &req, MAX_BODY_BYTES); err != nil {
+		h.writeDecodeError(w, err)
 		return
 	}
 
-	// Make AI move if it's AI's turn (Black)
-	if h.chessService.game.CurrentTurn == Black {
-		log.Println("🤖 AI thinking...")
-		
-		ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
-		defer cancel()
-		
-		aiResponse, err := h.aiService.MakeAIMove(ctx, h.chessService)
+	var game *ChessGame
+	castling := req.Castling
+	switch {
+	case req.FEN != "" && req.Pieces != nil:
+		h.writeError(w, ErrInvalidParameter, "Provide either 'fen' or 'pieces', not both", http.StatusBadRequest, "")
+		return
+	case req.FEN != "":
+		var err error
+		game, castling, err = setupFromFEN(req.FEN)
 		if err != nil {
-			log.Printf("⚠️ AI move failed: %v", err)
-			// Return current state even if AI fails
-			response.AIThinking = false
-			h.writeJSON(w, response)
+			h.writeError(w, ErrInvalidFEN, "Invalid FEN", http.StatusBadRequest, err.Error())
 			return
 		}
-		
-		log.Printf("🤖 AI move completed")
-		response = aiResponse
-		response.AIThinking = false
+	case req.Pieces != nil:
+		var err error
+		game, err = setupFromPieces(req.Pieces, req.Turn)
+		if err != nil {
+			h.writeError(w, ErrInvalidParameter, "Invalid piece placement", http.StatusBadRequest, err.Error())
+			return
+		}
+	default:
+		h.writeError(w, ErrInvalidParameter, "Provide 'fen' or 'pieces'", http.StatusBadRequest, "")
+		return
 	}
 
+	response := PositionValidation{Problems: game.ValidateSetup(castling)}
+	response.Legal = len(response.Problems) == 0
+	if response.Legal {
+		response.FEN = game.ToFEN()
+	}
 	h.writeJSON(w, response)
 }
 
-func (h *Handlers) ForceAIMove(w http.ResponseWriter, r *http.Request) {
-	if h.chessService.game.GameOver {
-		h.writeError(w, "Cannot make AI move: game is over", http.StatusBadRequest, "")
+// AnalyzeBatch finds the best move and evaluation of many positions in one
+// call, given as a list of FENs or as every position of a PGN's main line
+func (h *Handlers) AnalyzeBatch(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		FENs   []string `json:"fens,omitempty"`
+		PGN    string   `json:"pgn,omitempty"`
+		ItemMs int      `json:"itemMs,omitempty"`
+	}
+	if err := decodeJSON(w, r, &req, MAX_GAME_BODY_BYTES); err != nil {
+		h.writeDecodeError(w, err)
 		return
 	}
 
-	if h.chessService.game.CurrentTurn != Black {
-		h.writeError(w, "Not AI's turn", http.StatusBadRequest, "Current turn: "+string(h.chessService.game.CurrentTurn))
-		return
+	itemTime := BATCH_ITEM_TIME
+	if req.ItemMs != 0 {
+		itemTime = time.Duration(req.ItemMs) * time.Millisecond
+		if itemTime <= 0 || itemTime > h.analysisMaxThinkTime {
+			h.writeError(w, ErrInvalidParameter, "Invalid itemMs", http.StatusBadRequest, fmt.Sprintf("itemMs must be between 1 and %d", h.analysisMaxThinkTime.Milliseconds()))
+			return
+		}
+	}
+	if itemTime > h.analysisMaxThinkTime {
+		itemTime = h.analysisMaxThinkTime
 	}
 
-	log.Println("🤖 Forced AI move requested")
+	var games []*ChessGame
+	switch {
+	case len(req.FENs) > 0 && req.PGN != "":
+		h.writeError(w, ErrInvalidParameter, "Provide either 'fens' or 'pgn', not both", http.StatusBadRequest, "")
+		return
+	case req.PGN != "":
+		game, err := LoadPGN(req.PGN)
+		if err != nil {
+			h.writeError(w, ErrInvalidPGN, "Invalid PGN", http.StatusBadRequest, err.Error())
+			return
+		}
+		if games, err = batchPositions(game); err != nil {
+			h.writeError(w, ErrInvalidPGN, "Invalid PGN", http.StatusBadRequest, err.Error())
+			return
+		}
+	default:
+		for i, fen := range req.FENs {
+			game, err := LoadFEN(fen)
+			if err != nil {
+				h.writeError(w, ErrInvalidFEN, "Invalid FEN", http.StatusBadRequest, fmt.Sprintf("position %d: %v", i, err))
+				return
+			}
+			games = append(games, game)
+		}
+	}
+	if len(games) == 0 || len(games) > MAX_BATCH_POSITIONS {
+		h.writeError(w, ErrInvalidParameter, "Invalid batch size", http.StatusBadRequest, fmt.Sprintf("batch must have between 1 and %d positions, got %d", MAX_BATCH_POSITIONS, len(games)))
+		return
+	}
 
-	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
-	defer cancel()
-	
-	response, err := h.aiService.MakeAIMove(ctx, h.chessService)
-	if err != nil {
-		h.writeError(w, "AI move failed", http.StatusInternalServerError, err.Error())
+	if !h.acquireSearch(w, r) {
 		return
 	}
+	// Every worker holds a slot: the batch spreads over the ones free now
+	// rather than starting NumCPU searches on a single slot
+	workers := 1 + h.searchPool.tryAcquire(min(runtime.NumCPU(), len(games))-1)
+	defer func() {
+		for i := 0; i < workers; i++ {
+			h.searchPool.release()
+		}
+	}()
+
+	start := time.Now()
+	response := BatchResponse{
+		Results:    h.aiService.AnalyzeBatch(r.Context(), games, itemTime, workers),
+		ItemTimeMs: itemTime.Milliseconds(),
+	}
 
-	log.Printf("🤖 Forced AI move completed")
+	slog.Info("Batch analysed", "positions", len(games), "elapsed", time.Since(start).Round(time.Millisecond))
 	h.writeJSON(w, response)
 }
 
-// ============================================================================
-// AI CONFIGURATION ENDPOINTS
-// ============================================================================
-
-func (h *Handlers) GetAIStats(w http.ResponseWriter, r *http.Request) {
-	stats := h.aiService.GetStats()
-	
-	// Add game-specific stats
-	game := h.chessService.GetGame()
-	stats["game_stats"] = map[string]interface{}{
-		"moves_played":   len(game.MoveHistory),
-		"current_turn":   string(game.CurrentTurn),
-		"game_over":      game.GameOver,
-		"is_check":       game.IsInCheck(game.CurrentTurn),
-		"valid_moves":    len(game.GetValidMoves(game.CurrentTurn)),
+// AnalyzeLine plays a "what if" line on a scratch game, from a FEN or the
+// current position, and returns the evaluation and best reply where it ends
+func (h *Handlers) AnalyzeLine(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		FEN   string   `json:"fen,omitempty"` // Defaults to the current position
+		Moves []string `json:"moves"`         // UCI or SAN
+	}
+	if err := decodeJSON(w, r, &req, MAX_BODY_BYTES); err != nil {
+		h.writeDecodeError(w, err)
+		return
 	}
-	
-	h.writeJSON(w, stats)
-}
 
-func (h *Handlers) SetDifficulty(w http.ResponseWriter, r *http.Request) {
-	var req struct {
-		Difficulty string `json:"difficulty"`
-		Depth      *int   `json:"depth,omitempty"`
+	if len(req.Moves) > MAX_LINE_MOVES {
+		h.writeError(w, ErrInvalidParameter, "Line too long", http.StatusBadRequest, fmt.Sprintf("at most %d moves, got %d", MAX_LINE_MOVES, len(req.Moves)))
+		return
 	}
-	
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		h.writeError(w, "Invalid JSON format", http.StatusBadRequest, err.Error())
+
+	thinkTime, err := h.analysisThinkingTime(r)
+	if err != nil {
+		h.writeError(w, ErrInvalidParameter, "Invalid max_think_ms", http.StatusBadRequest, err.Error())
 		return
 	}
 
-	// Set difficulty by name or custom depth
-	if req.Depth != nil {
-		if err := h.aiService.SetDepth(*req.Depth); err != nil {
-			h.writeError(w, "Invalid depth", http.StatusBadRequest, err.Error())
+	start := h.chessService.GetGame()
+	if req.FEN != "" {
+		if start, err = LoadFEN(req.FEN); err != nil {
+			h.writeError(w, ErrInvalidFEN, "Invalid FEN", http.StatusBadRequest, err.Error())
 			return
 		}
-		log.Printf("🎯 AI depth set to %d", *req.Depth)
-	} else if req.Difficulty != "" {
-		if err := h.aiService.SetDifficulty(req.Difficulty); err != nil {
-			h.writeError(w, "Invalid difficulty", http.StatusBadRequest, err.Error())
+	}
+
+	if !h.acquireSearch(w, r) {
+		return
+	}
+	defer h.searchPool.release()
+
+	h.writeJSON(w, h.aiService.AnalyzeLine(r.Context(), start, req.Moves, thinkTime))
+}
+
+// GetEvalGraph scores the position after every half-move so far, for drawing
+// the game's evaluation curve
+func (h *Handlers) GetEvalGraph(w http.ResponseWriter, r *http.Request) {
+	depth := EVAL_GRAPH_DEPTH
+	if depthStr := r.URL.Query().Get("depth"); depthStr != "" {
+		d, err := strconv.Atoi(depthStr)
+		if err != nil || d < 1 || d > EVAL_GRAPH_MAX_DEPTH {
+			h.writeError(w, ErrInvalidParameter, "Invalid depth", http.StatusBadRequest, fmt.Sprintf("depth must be between 1 and %d", EVAL_GRAPH_MAX_DEPTH))
 			return
 		}
-		log.Printf("🎯 AI difficulty set to %s", req.Difficulty)
-	} else {
-		h.writeError(w, "Must provide either 'difficulty' or 'depth'", http.StatusBadRequest, "")
+		depth = d
+	}
+	
+	if !h.acquireSearch(w, r) {
+		return
+	}
+	defer h.searchPool.release()
+	
+	response, err := h.evalGraph.evaluate(r.Context(), h.aiService, h.chessService.GetGame(), depth)
+	if err != nil {
+		h.writeError(w, searchErrorCode(r.Context()), "Failed to build evaluation graph", http.StatusInternalServerError, err.Error())
 		return
 	}
+	
+	h.writeJSON(w, response)
+}
 
-	response := map[string]interface{}{
-		"message":     "AI configuration updated successfully",
-		"difficulty":  h.aiService.getDifficultyString(),
-		"depth":       h.aiService.GetDepth(),
-		"stats":       h.aiService.GetStats(),
+func (h *Handlers) GetAttackMap(w http.ResponseWriter, r *http.Request) {
+	game := h.chessService.GetGame()
+	
+	color := game.CurrentTurn
+	switch r.URL.Query().Get("color") {
+	case "":
+	case string(White):
+		color = White
+	case string(Black):
+		color = Black
+	default:
+		h.writeError(w, ErrInvalidParameter, "Invalid color", http.StatusBadRequest, "color must be 'white' or 'black'")
+		return
+	}
+	
+	response := AttackMapResponse{
+		Color:       string(color),
+		AttackMap:   game.AttackMap(color),
+		CurrentTurn: string(game.CurrentTurn),
 	}
 	
 	h.writeJSON(w, response)
 }
 
-// ============================================================================
-// ANALYSIS ENDPOINTS
-// ============================================================================
+// GetPieceStatus reports which pieces are attacked and defended, so a UI can
+// mark the hanging ones
+func (h *Handlers) GetPieceStatus(w http.ResponseWriter, r *http.Request) {
+	game := h.chessService.GetGame()
 
-func (h *Handlers) EvaluatePosition(w http.ResponseWriter, r *http.Request) {
+	response := PieceStatusResponse{
+		Pieces:      game.PieceStatuses(),
+		CurrentTurn: string(game.CurrentTurn),
+	}
+
+	h.writeJSON(w, response)
+}
+
+func (h *Handlers) GetThreats(w http.ResponseWriter, r *http.Request) {
 	game := h.chessService.GetGame()
-	evaluation := h.aiService.evaluatePosition(game)
+	hanging, winnable := game.Threats()
 	
-	response := map[string]interface{}{
-		"evaluation":    evaluation,
-		"current_turn":  string(game.CurrentTurn),
-		"description":   getEvaluationDescription(evaluation),
-		"material_only": h.getMaterialBalance(game),
-		"game_phase":    h.getGamePhase(game),
+	response := ThreatsResponse{
+		Side:     string(game.CurrentTurn),
+		Hanging:  hanging,
+		Winnable: winnable,
 	}
 	
 	h.writeJSON(w, response)
 }
 
+// GetTablebaseLite reports the theoretical result of the current position when
+// it is one of the basic endgames the built-in rules cover
+func (h *Handlers) GetTablebaseLite(w http.ResponseWriter, r *http.Request) {
+	h.writeJSON(w, h.chessService.GetGame().TheoreticalResult())
+}
+
+func (h *Handlers) GetPieceStats(w http.ResponseWriter, r *http.Request) {
+	h.writeJSON(w, h.chessService.GetGame().PieceStatistics())
+}
+
+func (h *Handlers) GetOpening(w http.ResponseWriter, r *http.Request) {
+	h.writeJSON(w, h.chessService.GetGame().OpeningName())
+}
+
 func (h *Handlers) GetBestMoves(w http.ResponseWriter, r *http.Request) {
 	// Get depth from query parameter (default to AI's current depth)
 	depthStr := r.URL.Query().Get("depth")
@@ -287,27 +1417,29 @@ func (h *Handlers) GetBestMoves(w http.ResponseWriter, r *http.Request) {
 	
 	game := h.chessService.GetGame()
 	
-	// Get top 3 moves (simplified analysis)
-	ctx, cancel := context.WithTimeout(r.Context(), 15*time.Second)
-	defer cancel()
-	
-	originalDepth := h.aiService.GetDepth()
-	h.aiService.SetDepth(depth)
-	
-	bestMove, err := h.aiService.GetBestMove(ctx, game)
+	thinkTime, err := h.analysisThinkingTime(r)
+	if err != nil {
+		h.writeError(w, ErrInvalidParameter, "Invalid max_think_ms", http.StatusBadRequest, err.Error())
+		return
+	}
 	
-	h.aiService.SetDepth(originalDepth) // Restore original depth
+	if !h.acquireSearch(w, r) {
+		return
+	}
+	defer h.searchPool.release()
 	
+	// The depth and think time are this request's own, the AI's settings stay as they are
+	result, err := h.aiService.analysisWorker(thinkTime).Search(r.Context(), game, SearchOptions{Depth: depth})
 	if err != nil {
-		h.writeError(w, "Failed to analyze position", http.StatusInternalServerError, err.Error())
+		h.writeError(w, searchErrorCode(r.Context()), "Failed to analyze position", http.StatusInternalServerError, err.Error())
 		return
 	}
 	
-	response := map[string]interface{}{
-		"best_move":     bestMove,
-		"analysis_depth": depth,
-		"evaluation":    h.aiService.evaluatePosition(game),
-		"current_turn":  string(game.CurrentTurn),
+	response := AnalysisResponse{
+		BestMove:      result.Move,
+		AnalysisDepth: depth,
+		Evaluation:    h.aiService.Evaluate(game),
+		CurrentTurn:   string(game.CurrentTurn),
 	}
 	
 	h.writeJSON(w, response)
@@ -317,7 +1449,7 @@ func (h *Handlers) GetBestMoves(w http.ResponseWriter, r *http.Request) {
 // HELPER METHODS
 // ============================================================================
 
-func (h *Handlers) getMaterialBalance(game *ChessGame) map[string]int {
+func (h *Handlers) getMaterialBalance(game *ChessGame) MaterialBalance {
 	whiteMaterial := 0
 	blackMaterial := 0
 	
@@ -337,11 +1469,57 @@ func (h *Handlers) getMaterialBalance(game *ChessGame) map[string]int {
 		}
 	}
 	
-	return map[string]int{
-		"white": whiteMaterial,
-		"black": blackMaterial,
-		"difference": blackMaterial - whiteMaterial,
+	return MaterialBalance{
+		White:      whiteMaterial,
+		Black:      blackMaterial,
+		Difference: blackMaterial - whiteMaterial,
+		Counts:     game.PieceCounts(),
+		Imbalances: game.MaterialImbalances(),
+	}
+}
+
+// logSearchCutoff reports which limit, if any, ended the AI's last search:
+// the request's AI reply timeout or the engine's own think time
+func (h *Handlers) logSearchCutoff(ctx context.Context) {
+	last := h.aiService.LastMove()
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		slog.Debug("AI search cut off by the request timeout", "timeout", h.aiReplyTimeout)
+	case last.ThinkLimit > 0 && last.ThinkTime >= last.ThinkLimit:
+		slog.Debug("AI search stopped at the engine think time", "think_time", last.ThinkLimit)
+	}
+}
+
+// acquireSearch takes an analysis search slot. When none frees up in time it
+// answers 503 with a Retry-After hint itself and returns false.
+func (h *Handlers) acquireSearch(w http.ResponseWriter, r *http.Request) bool {
+	if err := h.searchPool.acquire(r.Context()); err != nil {
+		w.Header().Set("Retry-After", strconv.Itoa(int(ANALYSIS_RETRY_AFTER.Seconds())))
+		h.writeError(w, ErrServerBusy, "Too many analysis requests", http.StatusServiceUnavailable, err.Error())
+		return false
+	}
+	return true
+}
+
+// analysisThinkingTime reads the optional max_think_ms query parameter that
+// lets analysis requests search longer than normal play, up to the
+// configured ceiling. Longer requests are clamped to it.
+func (h *Handlers) analysisThinkingTime(r *http.Request) (time.Duration, error) {
+	thinkTime := ANALYSIS_THINKING_TIME
+	if raw := r.URL.Query().Get("max_think_ms"); raw != "" {
+		ms, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || ms <= 0 {
+			return 0, fmt.Errorf("max_think_ms must be a positive integer, got %q", raw)
+		}
+		if ms > h.analysisMaxThinkTime.Milliseconds() {
+			return h.analysisMaxThinkTime, nil
+		}
+		thinkTime = time.Duration(ms) * time.Millisecond
+	}
+	if thinkTime > h.analysisMaxThinkTime {
+		thinkTime = h.analysisMaxThinkTime
 	}
+	return thinkTime, nil
 }
 
 func (h *Handlers) getGamePhase(game *ChessGame) string {
@@ -374,6 +1552,8 @@ func getEvaluationDescription(eval int) string {
 	}
 	
 	switch {
+	case isMateScore(eval):
+		magnitude = "has won"
 	case absEval > 1000:
 		magnitude = "winning"
 	case absEval > 500:
@@ -399,29 +1579,66 @@ func (h *Handlers) writeJSON(w http.ResponseWriter, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	
 	if err := json.NewEncoder(w).Encode(data); err != nil {
-		log.Printf("❌ Error encoding JSON: %v", err)
+		slog.Error("Encoding JSON response failed", "err", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 	}
 }
 
-func (h *Handlers) writeError(w http.ResponseWriter, message string, statusCode int, details string) {
+func (h *Handlers) writeEvent(w http.ResponseWriter, event string, data interface{}) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		slog.Error("Encoding event failed", "err", err)
+		return
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload)
+}
+
+func (h *Handlers) writeError(w http.ResponseWriter, code ErrorCode, message string, statusCode int, details string) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(statusCode)
 	
 	errorResponse := ErrorResponse{
 		Error:   message,
-		Code:    statusCode,
+		Code:    code,
+		Status:  statusCode,
 		Details: details,
 	}
 	
-	log.Printf("⚠️ HTTP Error %d: %s", statusCode, message)
-	if details != "" {
-		log.Printf("   Details: %s", details)
+	// A bad request is the client's problem; a failure on our side is ours
+	level := slog.LevelWarn
+	if statusCode >= http.StatusInternalServerError {
+		level = slog.LevelError
 	}
+	slog.Log(context.Background(), level, "HTTP error", "status", statusCode, "code", code, "message", message, "details", details)
 	
 	if err := json.NewEncoder(w).Encode(errorResponse); err != nil {
-		log.Printf("❌ Error encoding error response: %v", err)
+		slog.Error("Encoding error response failed", "err", err)
+	}
+}
+
+// decodeJSON reads a request body of at most limit bytes into v. Unknown
+// fields and anything after the JSON value are rejected. An empty body gives
+// io.EOF so optional bodies can tell it apart from a malformed one.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}, limit int64) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, limit))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return err
+	}
+	if decoder.More() {
+		return errors.New("unexpected data after the JSON body")
+	}
+	return nil
+}
+
+func (h *Handlers) writeDecodeError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		h.writeError(w, ErrBodyTooLarge, "Request body too large", http.StatusBadRequest,
+			fmt.Sprintf("the limit is %d bytes", tooLarge.Limit))
+		return
 	}
+	h.writeError(w, ErrInvalidJSON, "Invalid JSON format", http.StatusBadRequest, err.Error())
 }
 
 // ============================================================================
@@ -440,7 +1657,7 @@ func (h *Handlers) DebugBoard(w http.ResponseWriter, r *http.Request) {
 			if piece == nil {
 				boardStr += ". "
 			} else {
-				symbol := h.getPieceSymbol(piece)
+				symbol := pieceSymbol(piece)
 				boardStr += symbol + " "
 			}
 		}
@@ -460,21 +1677,13 @@ func (h *Handlers) DebugBoard(w http.ResponseWriter, r *http.Request) {
 	h.writeJSON(w, response)
 }
 
-func (h *Handlers) getPieceSymbol(piece *Piece) string {
-	symbols := map[PieceType]map[Color]string{
-		King:   {White: "K", Black: "k"},
-		Queen:  {White: "Q", Black: "q"},
-		Rook:   {White: "R", Black: "r"},
-		Bishop: {White: "B", Black: "b"},
-		Knight: {White: "N", Black: "n"},
-		Pawn:   {White: "P", Black: "p"},
-	}
-	
-	if typeSymbols, exists := symbols[piece.Type]; exists {
-		if symbol, exists := typeSymbols[piece.Color]; exists {
-			return symbol
-		}
+// Profile times the engine's hot paths on the current position. It's only
+// routed when DEBUG_ENDPOINTS=1.
+func (h *Handlers) Profile(w http.ResponseWriter, r *http.Request) {
+	if !h.acquireSearch(w, r) {
+		return
 	}
-	
-	return "?"
-}
\ No newline at end of file
+	defer h.searchPool.release()
+
+	h.writeJSON(w, h.aiService.Profile(r.Context(), h.chessService.GetGame()))
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAnalysisThinkingTime(t *testing.T) {
+	h := NewHandlers(NewChessService(), NewAIService())
+	if err := h.SetAnalysisMaxThinkingTime(time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query string
+		want  time.Duration
+	}{
+		{"", ANALYSIS_THINKING_TIME},
+		{"?max_think_ms=500", 500 * time.Millisecond},
+		{"?max_think_ms=600000", time.Minute},
+		{"?max_think_ms=99999999999999999", time.Minute},
+	}
+	for _, tt := range tests {
+		got, err := h.analysisThinkingTime(httptest.NewRequest("GET", "/api/best-moves"+tt.query, nil))
+		if err != nil || got != tt.want {
+			t.Errorf("%q: got %v, %v, want %v", tt.query, got, err, tt.want)
+		}
+	}
+
+	for _, query := range []string{"?max_think_ms=0", "?max_think_ms=-5", "?max_think_ms=soon"} {
+		if _, err := h.analysisThinkingTime(httptest.NewRequest("GET", "/api/best-moves"+query, nil)); err == nil {
+			t.Errorf("%q should be rejected", query)
+		}
+	}
+}
+
+// TestAnalysisLeavesAISettingsAlone runs the analysis endpoints with their
+// own depth and think time while the AI's settings are read alongside
+// TestBatchItemTimeIsCapped checks that itemMs is held to the analysis
+// ceiling, like max_think_ms on the other analysis endpoints.
+func TestBatchItemTimeIsCapped(t *testing.T) {
+	h := NewHandlers(NewChessService(), NewAIService())
+	if err := h.SetAnalysisMaxThinkingTime(100 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	body := `{"fens": ["4k3/8/8/8/8/8/4P3/4K3 w - - 0 1"], "itemMs": 101}`
+	rec := httptest.NewRecorder()
+	h.AnalyzeBatch(rec, httptest.NewRequest("POST", "/api/analyze/batch", strings.NewReader(body)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("itemMs over the analysis ceiling: got status %d, want 400", rec.Code)
+	}
+}
+
+func TestAnalysisLeavesAISettingsAlone(t *testing.T) {
+	ai := NewAIService()
+	if err := ai.SetDepth(3); err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandlers(NewChessService(), ai)
+
+	requests := []func() *http.Request{
+		func() *http.Request { return httptest.NewRequest("GET", "/api/best-moves?depth=2&max_think_ms=500", nil) },
+		func() *http.Request {
+			body := `{"fenA": "4k3/8/8/8/8/8/4P3/4K3 w - - 0 1", "fenB": "4k3/8/8/8/8/8/8/4K3 w - - 0 1", "bestMove": true}`
+			return httptest.NewRequest("POST", "/api/compare?max_think_ms=500", strings.NewReader(body))
+		},
+	}
+	handlers := []http.HandlerFunc{h.GetBestMoves, h.ComparePositions}
+
+	var wg sync.WaitGroup
+	for i := range handlers {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			handlers[i](rec, requests[i]())
+			if rec.Code != http.StatusOK {
+				t.Errorf("request %d: status %d: %s", i, rec.Code, rec.Body)
+			}
+		}(i)
+	}
+	for i := 0; i < 100; i++ {
+		if ai.GetDepth() != 3 || ai.GetMaxThinkingTime() != MAX_THINKING_TIME {
+			t.Errorf("analysis changed the AI: depth %d, think time %v", ai.GetDepth(), ai.GetMaxThinkingTime())
+			break
+		}
+	}
+	wg.Wait()
+}
+
+func TestMoveThinkTimeIsPerMove(t *testing.T) {
+	ai := NewAIService()
+	if err := ai.SetDepth(1); err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandlers(NewChessService(), ai)
+
+	body := `{"from": {"row": 6, "col": 4}, "to": {"row": 4, "col": 4}, "thinkMs": 750}`
+	rec := httptest.NewRecorder()
+	h.MakeMove(rec, httptest.NewRequest("POST", "/api/move", strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if got := ai.LastMove().ThinkLimit; got != 750*time.Millisecond {
+		t.Errorf("reply searched under a %v cap, want 750ms", got)
+	}
+	if got := ai.GetMaxThinkingTime(); got != MAX_THINKING_TIME {
+		t.Errorf("thinkMs leaked into the AI's think time: %v", got)
+	}
+}
+
+// TestMoveThinkTimeIsCapped checks that thinkMs can't lift the AI past its
+// configured think time.
+func TestMoveThinkTimeIsCapped(t *testing.T) {
+	ai := NewAIService()
+	if err := ai.SetMaxThinkingTime(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandlers(NewChessService(), ai)
+
+	body := `{"from": {"row": 6, "col": 4}, "to": {"row": 4, "col": 4}, "thinkMs": 1001}`
+	rec := httptest.NewRecorder()
+	h.MakeMove(rec, httptest.NewRequest("POST", "/api/move", strings.NewReader(body)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("thinkMs over the engine's limit: got status %d, want 400", rec.Code)
+	}
+	if moves := len(h.chessService.GetGame().MoveHistory); moves != 0 {
+		t.Errorf("rejected move was played: %d moves in the game", moves)
+	}
+}
+
+// TestAnalysisResponseFields checks the JSON field names of the analysis
+// endpoints' response types.
+func TestAnalysisResponseFields(t *testing.T) {
+	h := NewHandlers(NewChessService(), NewAIService())
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		fields  []string
+	}{
+		{"attack map", h.GetAttackMap, []string{"color", "attack_map", "current_turn"}},
+		{"threats", h.GetThreats, []string{"side", "hanging", "winnable"}},
+		{"piece status", h.GetPieceStatus, []string{"pieces", "current_turn"}},
+	}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		tt.handler(rec, httptest.NewRequest("GET", "/api/analysis", nil))
+		var response map[string]json.RawMessage
+		if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if len(response) != len(tt.fields) {
+			t.Errorf("%s: got %d fields, want %v", tt.name, len(response), tt.fields)
+		}
+		for _, field := range tt.fields {
+			if _, ok := response[field]; !ok {
+				t.Errorf("%s: missing %q", tt.name, field)
+			}
+		}
+	}
+}
+
+func TestForcedMoveAlternativesComeFromItsOwnSearch(t *testing.T) {
+	cs := NewChessService()
+	if _, err := cs.NewGame(NewGameRequest{HumanColor: Black}); err != nil {
+		t.Fatal(err)
+	}
+	ai := NewAIService()
+	if err := ai.SetDepth(2); err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandlers(cs, ai)
+
+	// An analysis of another position searches alongside the AI's move
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		other := mustLoadFEN(t, "r3k2r/p1ppqpb1/bn2pnp1/3PN3/1p2P3/2N2Q1p/PPPBBPPP/R3K2R w KQkq - 0 1")
+		ai.analysisWorker(0).Search(context.Background(), other, SearchOptions{Depth: 3})
+	}()
+
+	rec := httptest.NewRecorder()
+	h.ForceAIMove(rec, httptest.NewRequest("POST", "/api/ai/move?analyze=true&top=5", nil))
+	<-done
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var response GameResponse
+	if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Alternatives) != 5 {
+		t.Fatalf("got %d alternatives, want 5", len(response.Alternatives))
+	}
+	start := NewChessGame()
+	for _, alternative := range response.Alternatives {
+		if !start.IsValidMove(alternative.Move) {
+			t.Errorf("alternative %s isn't a move in the game", alternative.UCI)
+		}
+	}
+}
+
+func TestGameStatePerspective(t *testing.T) {
+	h := NewHandlers(NewChessService(), NewAIService())
+	tests := []struct {
+		query  string
+		status int
+		want   string
+	}{
+		{"", http.StatusOK, "white"},
+		{"?perspective=white", http.StatusOK, "white"},
+		{"?perspective=Black", http.StatusOK, "black"},
+		{"?perspective=red", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		h.GetGameState(rec, httptest.NewRequest("GET", "/api/game"+tt.query, nil))
+		if rec.Code != tt.status {
+			t.Errorf("%q: status %d: %s", tt.query, rec.Code, rec.Body)
+			continue
+		}
+		if tt.status != http.StatusOK {
+			continue
+		}
+		var response GameResponse
+		if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		if response.Perspective != tt.want {
+			t.Errorf("%q: perspective %q, want %q", tt.query, response.Perspective, tt.want)
+		}
+		// From Black's side e8 is the fourth square of the near rank
+		if king := response.Board[7][3].Piece; tt.want == "black" && (king == nil || king.Type != King || king.Color != Black) {
+			t.Errorf("%q: e8 laid out as %v", tt.query, king)
+		}
+	}
+}
+
+func TestEvaluationDescriptionMateBand(t *testing.T) {
+	tests := []struct {
+		eval int
+		want string
+	}{
+		{MAX_EVAL, "Black winning"},
+		{-MAX_EVAL, "White winning"},
+		{WIN_SCORE, "Black has won"},
+		{-WIN_SCORE - 3, "White has won"},
+	}
+	for _, tt := range tests {
+		if got := getEvaluationDescription(tt.eval); !strings.Contains(got, tt.want) {
+			t.Errorf("%d: %q, want %q", tt.eval, got, tt.want)
+		}
+	}
+}
+
+func TestCoachFlagsBlunders(t *testing.T) {
+	// Few pieces, so the review finishes well inside COACH_TIMEOUT even
+	// under the race detector
+	const fen = "4k3/pp6/8/8/8/8/PP6/3QK3 w - - 0 1"
+	ai := NewAIService()
+	if err := ai.SetDepth(1); err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandlers(NewChessService(), ai)
+
+	tests := []struct {
+		name    string
+		coach   string
+		move    string
+		blunder bool
+	}{
+		// Qd7+ gives the queen away to Kxd7
+		{"blunder", `, "coach": {}`, `{"from": {"row": 7, "col": 3}, "to": {"row": 1, "col": 3}}`, true},
+		{"good move", `, "coach": {}`, `{"from": {"row": 7, "col": 3}, "to": {"row": 4, "col": 3}}`, false},
+		{"no coach", ``, `{"from": {"row": 7, "col": 3}, "to": {"row": 1, "col": 3}}`, false},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		h.NewGame(rec, httptest.NewRequest("POST", "/api/new-game", strings.NewReader(`{"startingFen": "`+fen+`"`+tt.coach+`}`)))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: new game status %d: %s", tt.name, rec.Code, rec.Body)
+		}
+
+		rec = httptest.NewRecorder()
+		h.MakeMove(rec, httptest.NewRequest("POST", "/api/move", strings.NewReader(tt.move)))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: move status %d: %s", tt.name, rec.Code, rec.Body)
+		}
+		var response GameResponse
+		if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+
+		switch {
+		case tt.coach == "":
+			if response.Coach != nil {
+				t.Errorf("%s: reviewed without a coach: %+v", tt.name, response.Coach)
+			}
+		case response.Coach == nil:
+			t.Errorf("%s: no review", tt.name)
+		case response.Coach.Blunder != tt.blunder:
+			t.Errorf("%s: %+v, want blunder %v", tt.name, response.Coach, tt.blunder)
+		case tt.blunder && response.Coach.BetterMove == "":
+			t.Errorf("%s: blunder without a better move: %+v", tt.name, response.Coach)
+		}
+	}
+}
+
+func TestCoachOptionsValidated(t *testing.T) {
+	service := NewChessService()
+	for _, req := range []NewGameRequest{
+		{Mode: ModePvP, Coach: &CoachOptions{}},
+		{Coach: &CoachOptions{BlunderThreshold: -1}},
+		{Coach: &CoachOptions{BlunderThreshold: MAX_EVAL + 1}},
+	} {
+		if _, err := service.NewGame(req); err == nil {
+			t.Errorf("%+v accepted", req)
+		}
+	}
+	if _, err := service.NewGame(NewGameRequest{Coach: &CoachOptions{}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := service.CoachThreshold(); got != DefaultAnnotationThresholds().Blunder {
+		t.Errorf("default coach threshold %d, want the review's %d", got, DefaultAnnotationThresholds().Blunder)
+	}
+}
+
+func TestAIAnswersDrawOffers(t *testing.T) {
+	tests := []struct {
+		name   string
+		fen    string
+		accept bool
+	}{
+		{"even start", "", false},
+		{"AI a queen down", "4k3/8/8/8/8/8/8/3QK3 w - - 0 1", true},
+	}
+	for _, tt := range tests {
+		ai := NewAIService()
+		if err := ai.SetDepth(1); err != nil {
+			t.Fatal(err)
+		}
+		cs := NewChessService()
+		if _, err := cs.NewGame(NewGameRequest{StartingFEN: tt.fen}); err != nil {
+			t.Fatal(err)
+		}
+		h := NewHandlers(cs, ai)
+
+		rec := httptest.NewRecorder()
+		h.DrawOffer(rec, httptest.NewRequest("POST", "/api/draw-offer", strings.NewReader(`{"action": "offer"}`)))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", tt.name, rec.Code, rec.Body)
+		}
+		var response GameResponse
+		if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		if response.IsGameOver != tt.accept || response.DrawOffer != nil {
+			t.Errorf("%s: game over %v, offer %+v, want accepted %v", tt.name, response.IsGameOver, response.DrawOffer, tt.accept)
+		}
+	}
+}
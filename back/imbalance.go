@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ============================================================================
+// MATERIAL IMBALANCE
+// ============================================================================
+
+// Imbalance is one way the two sides' material differs, told from the side
+// it names
+type Imbalance struct {
+	Side        Color  `json:"side"`
+	Kind        string `json:"kind"` // e.g. "exchange", "piece_for_pawns", "extra_pawns"
+	Description string `json:"description"`
+}
+
+// minorPiece stands for knights and bishops together when matching trades
+const minorPiece PieceType = "minor"
+
+var materialTypes = []PieceType{Queen, Rook, Bishop, Knight, Pawn}
+
+// materialTrades are the usual ways material gets swapped unevenly, each from
+// the point of view of the side that has the first set of pieces for the
+// second. Bigger trades come first so a queen for two rooks isn't read as two
+// separate rook deficits.
+var materialTrades = []struct {
+	kind        string
+	description string
+	has, gave   map[PieceType]int
+}{
+	{"queen_for_rooks", "has a queen for two rooks", map[PieceType]int{Queen: 1}, map[PieceType]int{Rook: 2}},
+	{"queen_for_rook_and_piece", "has a queen for a rook and a minor piece", map[PieceType]int{Queen: 1}, map[PieceType]int{Rook: 1, minorPiece: 1}},
+	{"queen_for_pieces", "has a queen for three minor pieces", map[PieceType]int{Queen: 1}, map[PieceType]int{minorPiece: 3}},
+	{"pieces_for_rook", "has two minor pieces for a rook", map[PieceType]int{minorPiece: 2}, map[PieceType]int{Rook: 1}},
+	{"exchange", "is up the exchange", map[PieceType]int{Rook: 1}, map[PieceType]int{minorPiece: 1}},
+	{"piece_for_pawns", "has a minor piece for three pawns", map[PieceType]int{minorPiece: 1}, map[PieceType]int{Pawn: 3}},
+	{"piece_for_pawns", "has a minor piece for two pawns", map[PieceType]int{minorPiece: 1}, map[PieceType]int{Pawn: 2}},
+}
+
+var countWords = []string{"no", "a", "two", "three", "four", "five", "six", "seven", "eight", "nine"}
+
+// PieceCounts counts each side's pieces by type, kings left out
+func (g *ChessGame) PieceCounts() map[Color]map[PieceType]int {
+	counts := map[Color]map[PieceType]int{White: {}, Black: {}}
+	for _, pieceType := range materialTypes {
+		counts[White][pieceType] = 0
+		counts[Black][pieceType] = 0
+	}
+	for i := 0; i < 8; i++ {
+		for j := 0; j < 8; j++ {
+			piece := g.Board[i][j]
+			if piece != nil && piece.Type != King {
+				counts[piece.Color][piece.Type]++
+			}
+		}
+	}
+	return counts
+}
+
+// MaterialImbalances describes the material difference in chess terms, such
+// as "White is up the exchange", rather than as one number. Known trades are
+// matched first and whatever is left is listed as extra material. Equal
+// material gives no entries, except that a bishop pair is always noted.
+func (g *ChessGame) MaterialImbalances() []Imbalance {
+	counts := g.PieceCounts()
+	diff := map[PieceType]int{} // White minus Black
+	for _, pieceType := range materialTypes {
+		diff[pieceType] = counts[White][pieceType] - counts[Black][pieceType]
+	}
+	knights, bishops := diff[Knight], diff[Bishop]
+	diff[minorPiece] = knights + bishops
+
+	imbalances := []Imbalance{}
+	add := func(side Color, kind, description string) {
+		imbalances = append(imbalances, Imbalance{Side: side, Kind: kind, Description: colorName(side) + " " + description})
+	}
+	sides := []Color{White, Black}
+	sign := map[Color]int{White: 1, Black: -1}
+
+	// Each trade is tried for both sides before the next, so the side that
+	// really made the trade is the one it's credited to
+	for _, trade := range materialTrades {
+		for _, side := range sides {
+			for tradeApplies(diff, sign[side], trade.has, trade.gave) {
+				add(side, trade.kind, trade.description)
+				for pieceType, n := range trade.has {
+					diff[pieceType] -= sign[side] * n
+				}
+				for pieceType, n := range trade.gave {
+					diff[pieceType] += sign[side] * n
+				}
+			}
+		}
+	}
+
+	for _, side := range sides {
+		s := sign[side]
+		for _, pieceType := range []PieceType{Queen, Rook, minorPiece} {
+			n := s * diff[pieceType]
+			if n <= 0 {
+				continue
+			}
+			name := string(pieceType)
+			switch {
+			case pieceType != minorPiece:
+			case s*knights > 0 && s*bishops <= 0:
+				name = string(Knight)
+			case s*bishops > 0 && s*knights <= 0:
+				name = string(Bishop)
+			default:
+				name = "minor piece"
+			}
+			add(side, "extra_"+strings.ReplaceAll(name, " ", "_"), "is up "+countOf(n, name))
+		}
+		if n := s * diff[Pawn]; n > 0 {
+			add(side, "extra_pawns", "has "+countOf(n, "extra pawn"))
+		}
+	}
+
+	// Level on minor pieces, but not the same ones
+	if knights+bishops == 0 && knights != 0 {
+		side := White
+		if knights < 0 {
+			side = Black
+		}
+		n := sign[side] * knights
+		add(side, "knight_for_bishop", fmt.Sprintf("has %s for %s", countOf(n, "knight"), countOf(n, "bishop")))
+	}
+
+	for _, side := range sides {
+		if counts[side][Bishop] >= 2 && counts[opponentColor(side)][Bishop] < 2 {
+			add(side, "bishop_pair", "has the bishop pair")
+		}
+	}
+	return imbalances
+}
+
+func tradeApplies(diff map[PieceType]int, sign int, has, gave map[PieceType]int) bool {
+	for pieceType, n := range has {
+		if sign*diff[pieceType] < n {
+			return false
+		}
+	}
+	for pieceType, n := range gave {
+		if sign*diff[pieceType] > -n {
+			return false
+		}
+	}
+	return true
+}
+
+// countOf spells out a small count, e.g. "a rook" or "two extra pawns"
+func countOf(n int, noun string) string {
+	if n >= len(countWords) {
+		return fmt.Sprintf("%d %ss", n, noun)
+	}
+	if n == 1 {
+		if strings.IndexByte("aeiou", noun[0]) >= 0 {
+			return "an " + noun
+		}
+		return "a " + noun
+	}
+	return countWords[n] + " " + noun + "s"
+}
+
+func colorName(color Color) string {
+	name := string(color)
+	return strings.ToUpper(name[:1]) + name[1:]
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestMaterialImbalances checks that common trades and extra material are
+// named, in order, for the side that has them.
+func TestMaterialImbalances(t *testing.T) {
+	tests := []struct {
+		name string
+		fen  string
+		want []string
+	}{
+		{"equal", "rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1", nil},
+		{"exchange", "1nbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/R1BQKBNR w - - 0 1", []string{"White is up the exchange"}},
+		{"extra pawns", "4k3/8/8/8/8/8/PP6/4K3 w - - 0 1", []string{"White has two extra pawns"}},
+		{"piece for pawns", "4k3/ppp5/8/8/8/8/8/4KB2 w - - 0 1", []string{"White has a minor piece for three pawns"}},
+		{"queen for rooks", "r3k2r/8/8/8/8/8/8/3QK3 w - - 0 1", []string{"White has a queen for two rooks"}},
+		{"pieces for rook", "r3k3/8/8/8/8/8/8/2B1KN2 w - - 0 1", []string{"White has two minor pieces for a rook"}},
+		{"extra knight", "4k3/8/8/8/8/8/8/4KN2 w - - 0 1", []string{"White is up a knight"}},
+		{"extra queen", "3qk3/8/8/8/8/8/8/4K3 w - - 0 1", []string{"Black is up a queen"}},
+		{"knight for bishop", "4kb2/8/8/8/8/8/8/4KN2 w - - 0 1", []string{"White has a knight for a bishop"}},
+		{"bishop pair", "2b1kb2/8/8/8/8/8/8/2B1KN2 w - - 0 1", []string{"White has a knight for a bishop", "Black has the bishop pair"}},
+	}
+
+	for _, tt := range tests {
+		imbalances := mustLoadFEN(t, tt.fen).MaterialImbalances()
+		if imbalances == nil {
+			t.Errorf("%s: got nil, want a non-nil list", tt.name)
+		}
+		var got []string
+		for _, imbalance := range imbalances {
+			got = append(got, imbalance.Description)
+		}
+		if strings.Join(got, "; ") != strings.Join(tt.want, "; ") {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestPieceCounts checks the counts for the starting position, kings left out.
+func TestPieceCounts(t *testing.T) {
+	counts := NewChessGame().PieceCounts()
+	want := map[PieceType]int{Pawn: 8, Knight: 2, Bishop: 2, Rook: 2, Queen: 1}
+	for _, color := range []Color{White, Black} {
+		for pieceType, n := range want {
+			if counts[color][pieceType] != n {
+				t.Errorf("%s %s: got %d, want %d", color, pieceType, counts[color][pieceType], n)
+			}
+		}
+		if _, ok := counts[color][King]; ok {
+			t.Errorf("%s: kings should be left out", color)
+		}
+	}
+}
+
+// TestEvaluateReportsImbalances checks that the evaluate endpoint returns the
+// piece counts and imbalances alongside the material totals.
+func TestEvaluateReportsImbalances(t *testing.T) {
+	cs := NewChessService()
+	if _, err := cs.NewGame(NewGameRequest{Mode: ModePvP, StartingFEN: "1nbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/R1BQKBNR w - - 0 1"}); err != nil {
+		t.Fatalf("new game: %v", err)
+	}
+	h := NewHandlers(cs, NewAIService())
+	rec := httptest.NewRecorder()
+	h.EvaluatePosition(rec, httptest.NewRequest("GET", "/api/evaluate", nil))
+
+	var resp struct {
+		Material MaterialBalance `json:"material_only"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode: %v (status %d)", err, rec.Code)
+	}
+	if resp.Material.Counts[Black][Rook] != 1 {
+		t.Errorf("black rooks: got %d, want 1", resp.Material.Counts[Black][Rook])
+	}
+	if len(resp.Material.Imbalances) != 1 || resp.Material.Imbalances[0].Kind != "exchange" {
+		t.Errorf("imbalances: got %+v, want the exchange", resp.Material.Imbalances)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// ============================================================================
+// LINE ANALYSIS
+// ============================================================================
+
+// A "what if" line is played out on a scratch game, so trying variations
+// never touches the real one
+const MAX_LINE_MOVES = 300
+
+// LineBreak is the first move of a line that couldn't be played
+type LineBreak struct {
+	Index  int    `json:"index"` // Position of the move in the request, from 0
+	Move   string `json:"move"`
+	Reason string `json:"reason"`
+}
+
+type LineAnalysis struct {
+	StartFEN string        `json:"start_fen"`
+	Moves    []string      `json:"moves"`       // SAN of the moves that were played
+	Attacks  [][]NewAttack `json:"new_attacks"` // For each played move, the opponent pieces it newly attacks
+	Legal    bool          `json:"legal"`
+	Break    *LineBreak    `json:"break,omitempty"`
+	Result   BatchResult   `json:"result"` // Evaluation and best reply where the line ends, or where it broke
+}
+
+// parseLineMove reads a move of a line as UCI ("g1f3") or SAN ("Nf3") and
+// checks that it's legal
+func (g *ChessGame) parseLineMove(token string) (Move, error) {
+	moveReq, err := ParseUCIMove(token)
+	if err != nil {
+		return g.parseSAN(token)
+	}
+	move := Move{From: moveReq.From, To: moveReq.To, Promotion: moveReq.Promotion}
+	if reason := g.ValidateMove(move); reason != "" {
+		return Move{}, fmt.Errorf("illegal move %q: %s", token, reason)
+	}
+	return move, nil
+}
+
+// AnalyzeLine plays moves from start on a copy and searches the position it
+// ends in, for at most thinkTime. An illegal move ends the line early; the
+// position before it is analysed and the break reported.
+func (ai *AIService) AnalyzeLine(ctx context.Context, start *ChessGame, moves []string, thinkTime time.Duration) LineAnalysis {
+	game := start.CopyState()
+	analysis := LineAnalysis{StartFEN: game.ToFEN(), Moves: []string{}, Attacks: [][]NewAttack{}, Legal: true}
+
+	for i, token := range moves {
+		if game.GameOver {
+			analysis.Legal = false
+			analysis.Break = &LineBreak{Index: i, Move: token, Reason: "the game is already over"}
+			break
+		}
+		move, err := game.parseLineMove(token)
+		if err != nil {
+			analysis.Legal = false
+			analysis.Break = &LineBreak{Index: i, Move: token, Reason: err.Error()}
+			break
+		}
+
+		analysis.Moves = append(analysis.Moves, game.MoveToSAN(move))
+		analysis.Attacks = append(analysis.Attacks, game.NewAttacks(move))
+		game.MakeMove(move)
+	}
+
+	analysis.Result = ai.analysisWorker(thinkTime).analyzeBatchItem(ctx, game)
+	analysis.Result.Index = len(analysis.Moves)
+	return analysis
+}
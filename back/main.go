@@ -1,86 +1,172 @@
 package main
 
 import (
-	"log"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"os"
+	"runtime/debug"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/mux"
 )
 
 func main() {
+	uciMode := flag.Bool("uci", false, "speak the UCI protocol on stdin/stdout instead of serving HTTP")
+	flag.Parse()
+
+	config, err := loadConfig()
+	if err != nil {
+		for _, problem := range strings.Split(err.Error(), "\n") {
+			slog.Error("Invalid configuration", "problem", problem)
+		}
+		os.Exit(1)
+	}
+	setupLogging(config.LogLevel)
+
 	chessService := NewChessService()
+	if err := chessService.SetMoveLimit(config.MaxHalfMoves); err != nil {
+		fatal("Invalid MAX_HALF_MOVES", "err", err)
+	}
 	aiService := NewAIService()
+	aiService.SetLimits(config.AILimits)
+	if err := aiService.SetDepth(config.AIDefaultDepth); err != nil {
+		fatal("Invalid AI_DEFAULT_DEPTH", "err", err)
+	}
+
+	// A fixed seed makes AI choices and Chess960 setups reproducible
+	if config.Seed != nil {
+		chessService.SetSeed(*config.Seed)
+		aiService.SetSeed(*config.Seed)
+		slog.Info("Using random seed", "seed", *config.Seed)
+	}
+
+	if *uciMode {
+		runUCI(os.Stdin, os.Stdout, aiService)
+		return
+	}
 	handlers := NewHandlers(chessService, aiService)
-	log.Println("Hello2");
+	if err := handlers.SetAnalysisMaxThinkingTime(config.AnalysisMaxThinkTime); err != nil {
+		fatal("Invalid ANALYSIS_MAX_THINK_MS", "err", err)
+	}
+	handlers.SetAnalysisConcurrency(config.AnalysisMaxSearches, config.AnalysisQueueTimeout)
+	if err := handlers.SetAIReplyTimeout(config.AIReplyTimeout); err != nil {
+		fatal("Invalid AI_REPLY_TIMEOUT_MS", "err", err)
+	}
 
 	r := mux.NewRouter()
 
-	r.Use(corsMiddleware)
+	r.Use(corsMiddleware(config))
 	r.Use(loggingMiddleware)
+	r.Use(recoveryMiddleware)
 
 	r.HandleFunc("/health", handlers.Health).Methods("GET")
 
 	api := r.PathPrefix("/api").Subrouter()
-	
-	api.Use(corsMiddleware)
 
 	api.HandleFunc("/game", handlers.GetGameState).Methods("GET")
 	api.HandleFunc("/move", handlers.MakeMove).Methods("POST", "OPTIONS")
+	api.HandleFunc("/move/legal", handlers.IsMoveLegal).Methods("GET")
+	api.HandleFunc("/move/uci", handlers.MakeUCIMove).Methods("POST", "OPTIONS")
 	api.HandleFunc("/new-game", handlers.NewGame).Methods("POST")
 	api.HandleFunc("/valid-moves", handlers.GetValidMoves).Methods("GET")
 	api.HandleFunc("/change-depth", handlers.ChangeDepth).Methods("POST", "OPTIONS")
 
 	api.HandleFunc("/ai/move", handlers.ForceAIMove).Methods("POST")
+	api.HandleFunc("/ai/move/stream", handlers.StreamAIMove).Methods("GET")
+	api.HandleFunc("/ai/stop", handlers.StopAI).Methods("POST")
 	api.HandleFunc("/ai/stats", handlers.GetAIStats).Methods("GET")
 	api.HandleFunc("/ai/difficulty", handlers.SetDifficulty).Methods("POST")
+	api.HandleFunc("/ai/eval-mode", handlers.SetEvalMode).Methods("POST")
 	
 	api.HandleFunc("/evaluate", handlers.EvaluatePosition).Methods("GET")
+	api.HandleFunc("/eval-graph", handlers.GetEvalGraph).Methods("GET")
+	api.HandleFunc("/attack-map", handlers.GetAttackMap).Methods("GET")
+	api.HandleFunc("/threats", handlers.GetThreats).Methods("GET")
+	api.HandleFunc("/piece-status", handlers.GetPieceStatus).Methods("GET")
+	api.HandleFunc("/tablebase-lite", handlers.GetTablebaseLite).Methods("GET")
+	api.HandleFunc("/opening", handlers.GetOpening).Methods("GET")
+	api.HandleFunc("/compare", handlers.ComparePositions).Methods("POST")
+	api.HandleFunc("/position/validate", handlers.ValidatePosition).Methods("POST")
+	api.HandleFunc("/analyze/batch", handlers.AnalyzeBatch).Methods("POST")
+	api.HandleFunc("/analyze/line", handlers.AnalyzeLine).Methods("POST")
 	api.HandleFunc("/history", handlers.GetGameHistory).Methods("GET")
+	api.HandleFunc("/stats/pieces", handlers.GetPieceStats).Methods("GET")
+	api.HandleFunc("/goto", handlers.GotoMove).Methods("POST")
+	api.HandleFunc("/pgn", handlers.ExportPGN).Methods("GET")
+	api.HandleFunc("/export", handlers.Export).Methods("GET")
+	api.HandleFunc("/load-pgn", handlers.LoadPGN).Methods("POST")
+	api.HandleFunc("/pgn/annotate", handlers.AnnotatePGN).Methods("POST")
+	api.HandleFunc("/claim-draw", handlers.ClaimDraw).Methods("POST")
+	api.HandleFunc("/draw-offer", handlers.DrawOffer).Methods("POST")
+	api.HandleFunc("/resign", handlers.Resign).Methods("POST")
+	api.HandleFunc("/undo", handlers.UndoMove).Methods("POST")
+	api.HandleFunc("/swap-sides", handlers.SwapSides).Methods("POST")
+
+	// Profiling ties up the CPU for seconds at a time, so it's opt-in
+	if config.DebugEndpoints {
+		api.HandleFunc("/debug/profile", handlers.Profile).Methods("GET")
+		slog.Info("Debug endpoints enabled")
+	}
 
-	port := getEnv("PORT", "8080")
+	port := config.Port
 	
-	log.Printf("Chess AI server starting on port %s", port)
-	log.Printf("Available endpoints:")
-	log.Printf("   GET  /health")
-	log.Printf("   GET  /api/game")
-	log.Printf("   POST /api/move")
-	log.Printf("   POST /api/new-game")
-	log.Printf("   POST /api/ai/move")
-	log.Printf("   POST /api/change-depth");
+	slog.Info("Chess AI server starting", "port", port, "log_level", config.LogLevel)
+	slog.Debug("Available endpoints", "endpoints", []string{
+		"GET /health",
+		"GET /api/game",
+		"POST /api/move",
+		"POST /api/new-game",
+		"POST /api/ai/move",
+		"POST /api/change-depth",
+	})
 	
 	if err := http.ListenAndServe(":"+port, r); err != nil {
-		log.Fatal("Server failed to start:", err)
+		fatal("Server failed to start", "err", err)
 	}
 }
 
-func corsMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == "OPTIONS" {
-			w.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
-			w.Header().Set("Access-Control-Allow-Credentials", "true")
+// corsMiddleware lets browsers at the configured origins call the API
+func corsMiddleware(config Config) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			if r.Method == "OPTIONS" {
+				setAllowedOrigin(w, config, origin)
+				w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+				w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+
+			//fix that later
+
+			slog.Debug("Request", "path", r.URL.Path)
+
+			setAllowedOrigin(w, config, origin)
+
 			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
 			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-			w.WriteHeader(http.StatusOK)
-			return
-		}
-
-		//fix that later
 
-		log.Printf("request %s", r.URL.Path);
+			next.ServeHTTP(w, r)
+		})
+	}
+}
 
-		origin := r.Header.Get("Origin")
-		if origin == "http://localhost:3000" {
-			w.Header().Set("Access-Control-Allow-Origin", origin)
-            w.Header().Set("Access-Control-Allow-Credentials", "true")
-		}
-		
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-		
-		next.ServeHTTP(w, r)
-	})
+func setAllowedOrigin(w http.ResponseWriter, config Config, origin string) {
+	allowed, credentials := config.allowedOrigin(origin)
+	if allowed == "" {
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", allowed)
+	if credentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+		w.Header().Set("Vary", "Origin")
+	}
 }
 
 func loggingMiddleware(next http.Handler) http.Handler {
@@ -92,7 +178,45 @@ func loggingMiddleware(next http.Handler) http.Handler {
 		next.ServeHTTP(wrapped, r)
 		
 		duration := time.Since(start)
-		log.Printf("%s %s %d %v", r.Method, r.RequestURI, wrapped.statusCode, duration)
+		slog.Info("Request served", "method", r.Method, "uri", r.RequestURI, "status", wrapped.statusCode, "duration", duration)
+	})
+}
+
+var requestCounter atomic.Uint64
+
+// recoveryMiddleware turns a panic in a handler into a 500 instead of taking
+// the whole server down. Each request gets an ID (the caller's X-Request-ID if
+// it sent one) so the logged stack can be matched to the failed request.
+func recoveryMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get("X-Request-ID")
+		if requestID == "" {
+			requestID = fmt.Sprintf("%x-%d", time.Now().Unix(), requestCounter.Add(1))
+		}
+		w.Header().Set("X-Request-ID", requestID)
+
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+
+			slog.Error("Panic in handler", "method", r.Method, "path", r.URL.Path, "request_id", requestID, "err", err, "stack", string(debug.Stack()))
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(ErrorResponse{
+				Error:   "Internal server error",
+				Code:    ErrInternal,
+				Status:  http.StatusInternalServerError,
+				Details: "request " + requestID,
+			})
+		}()
+
+		next.ServeHTTP(w, r)
 	})
 }
 
@@ -106,9 +230,21 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.ResponseWriter.WriteHeader(code)
 }
 
-func getEnv(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
-		return value
+// Flush lets streaming handlers (SSE) push data through the logging wrapper
+func (rw *responseWriter) Flush() {
+	if flusher, ok := rw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
 	}
-	return defaultValue
-}
\ No newline at end of file
+}
+
+// fatal logs why the server can't run and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// setupLogging sends every log line, including the standard log package's,
+// through a key=value logger that drops lines below level
+func setupLogging(level slog.Level) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// moveGenSeeds are positions where the rules code has special cases to get
+// wrong: castling on both wings and in Chess960, en passant that would expose
+// the king, pins, promotions and checks
+var moveGenSeeds = []string{
+	"rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1",
+	"r3k2r/p1ppqpb1/bn2pnp1/3PN3/1p2P3/2N2Q1p/PPPBBPPP/R3K2R w KQkq - 0 1",
+	"8/2p5/3p4/KP5r/1R3p1k/8/4P1P1/8 w - - 0 1",
+	"r3k2r/Pppp1ppp/1b3nbN/nP6/BBP1P3/q4N2/Pp1P2PP/R2Q1RK1 w kq - 0 1",
+	"rnbq1k1r/pp1Pbppp/2p5/8/2B5/8/PPP1NnPP/RNBQK2R w KQ - 1 8",
+	"r4rk1/1pp1qppp/p1np1n2/2b1p1B1/2B1P1b1/P1NP1N2/1PP1QPPP/R4RK1 w - - 0 10",
+	"8/8/8/KPp4r/8/8/8/6k1 w - c6 0 2",
+	"4k3/8/8/8/8/8/8/R3K2R w KQ - 0 1",
+	"4k3/8/8/8/8/5q2/8/R3K2R w KQ - 0 1",
+	"4k3/8/8/8/8/8/4r3/4K3 w - - 0 1",
+	"bqnbrnkr/pppppppp/8/8/8/8/PPPPPPPP/BQNBRNKR w HEhe - 0 1",
+	"1r4k1/8/8/8/8/8/8/1RK5 w Bb - 0 1",
+	"8/8/8/8/8/8/8/8 w - - 0 1",
+	"rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBN w KQkq - 0 1",
+}
+
+// FuzzMoveGeneration loads arbitrary FENs and checks that every position the
+// loader accepts can have its moves generated, validated and played out
+// without panicking, and that what is generated is legal and all of what
+// bruteForceMoves finds.
+// Run with: go test -run '^$' -fuzz FuzzMoveGeneration
+func FuzzMoveGeneration(f *testing.F) {
+	for _, fen := range moveGenSeeds {
+		f.Add(fen)
+	}
+	f.Fuzz(func(t *testing.T, fen string) {
+		game, err := LoadFEN(fen)
+		if err != nil {
+			return
+		}
+
+		moves := game.GetValidMoves(game.CurrentTurn)
+		if want := bruteForceMoves(game); !sameMoves(moves, want) {
+			t.Fatalf("%s: generated %v, brute force finds %v", fen, moves, want)
+		}
+		for _, move := range moves {
+			if !game.IsValidMove(move) {
+				t.Fatalf("%s: generated %v fails validation", fen, move)
+			}
+
+			next := game.CopyState()
+			if err := next.MakeMove(move); err != nil {
+				t.Fatalf("%s: generated %v can't be played: %v", fen, move, err)
+			}
+			if next.IsInCheck(game.CurrentTurn) {
+				t.Fatalf("%s: %v leaves the king in check", fen, move)
+			}
+			if _, err := LoadFEN(next.ToFEN()); err != nil {
+				t.Fatalf("%s: %v leads to %s, which doesn't load: %v", fen, move, next.ToFEN(), err)
+			}
+			next.GetValidMoves(next.CurrentTurn)
+		}
+		game.Perft(2)
+	})
+}
+
+func TestLoadFENRejectsImpossibleEnPassant(t *testing.T) {
+	for _, fen := range []string{
+		"8/8/8/KPp4b/8/8/8/6k1 w - a6 0 1",    // the king, not a pawn, stands past a6
+		"4k3/8/8/2pP4/8/8/8/4K3 w - c5 0 1",   // wrong rank
+		"4k3/2p5/8/2pP4/8/8/8/4K3 w - c6 0 1", // the pawn couldn't have come from c7
+		"4k3/8/8/8/3pP3/8/8/4K3 w - e3 0 1",   // white's own pawn, with white to move
+	} {
+		if _, err := LoadFEN(fen); err == nil {
+			t.Errorf("%s loaded", fen)
+		}
+	}
+	mustLoadFEN(t, "4k3/8/8/8/3pP3/8/8/4K3 b - e3 0 1")
+}
+
+// bruteForceMoves generates moves the slow way, trying every from and to
+// square with the full legality check, to hold GetValidMoves' shortcuts to
+func bruteForceMoves(game *ChessGame) []Move {
+	var moves []Move
+	for from := 0; from < 64; from++ {
+		for to := 0; to < 64; to++ {
+			move := Move{From: Position{from / 8, from % 8}, To: Position{to / 8, to % 8}}
+			piece := game.Board[move.From.Row][move.From.Col]
+			if piece == nil || piece.Color != game.CurrentTurn || !game.IsValidMove(move) {
+				continue
+			}
+			if piece.Type == Pawn && move.To.Row == homeRow(opponentColor(piece.Color)) {
+				for _, promotion := range promotionPieces {
+					move.Promotion = promotion
+					moves = append(moves, move)
+				}
+				continue
+			}
+			moves = append(moves, move)
+		}
+	}
+	return moves
+}
+
+// sameMoves compares two move lists regardless of order
+func sameMoves(a, b []Move) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	counts := map[string]int{}
+	for _, move := range a {
+		counts[fmt.Sprint(move.From, move.To, move.Promotion)]++
+	}
+	for _, move := range b {
+		key := fmt.Sprint(move.From, move.To, move.Promotion)
+		if counts[key] == 0 {
+			return false
+		}
+		counts[key]--
+	}
+	return true
+}
+
+func TestGetValidMovesMatchesBruteForce(t *testing.T) {
+	rng := rand.New(rand.NewSource(5))
+	for _, fen := range moveGenSeeds {
+		game, err := LoadFEN(fen)
+		if err != nil {
+			continue
+		}
+		for ply := 0; ply < 80 && !game.GameOver; ply++ {
+			moves := game.GetValidMoves(game.CurrentTurn)
+			if want := bruteForceMoves(game); !sameMoves(moves, want) {
+				t.Fatalf("%s: generated %v, brute force finds %v", game.ToFEN(), moves, want)
+			}
+			if err := game.MakeMove(moves[rng.Intn(len(moves))]); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestPinRaysMatchBruteForce(t *testing.T) {
+	rng := rand.New(rand.NewSource(6))
+	for _, fen := range moveGenSeeds {
+		game, err := LoadFEN(fen)
+		if err != nil {
+			continue
+		}
+		for ply := 0; ply < 80 && !game.GameOver; ply++ {
+			color := game.CurrentTurn
+			king := *game.findKing(color)
+			attackers := len(game.attackersOf(king, opponentColor(color)))
+			pins := game.pinRays(color)
+			// A piece is pinned if taking it off the board lets another
+			// enemy piece attack its king
+			for i := 0; i < 8; i++ {
+				for j := 0; j < 8; j++ {
+					piece := game.Board[i][j]
+					if piece == nil || piece.Color != color || piece.Type == King {
+						continue
+					}
+					game.Board[i][j] = nil
+					exposes := len(game.attackersOf(king, opponentColor(color))) > attackers
+					game.Board[i][j] = piece
+					if _, pinned := pins[Position{i, j}]; pinned != exposes {
+						t.Fatalf("%s: %v pinned %v, shields the king %v", game.ToFEN(), Position{i, j}, pinned, exposes)
+					}
+				}
+			}
+			moves := game.LegalMoves()
+			if err := game.MakeMove(moves[rng.Intn(len(moves))]); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// TestPerft counts move trees from the six standard perft positions against
+// their published totals
+func TestPerft(t *testing.T) {
+	tests := []struct {
+		fen   string
+		nodes []int64 // by depth, from 1
+	}{
+		{"rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1", []int64{20, 400, 8902, 197281}},
+		{"r3k2r/p1ppqpb1/bn2pnp1/3PN3/1p2P3/2N2Q1p/PPPBBPPP/R3K2R w KQkq - 0 1", []int64{48, 2039, 97862}},
+		{"8/2p5/3p4/KP5r/1R3p1k/8/4P1P1/8 w - - 0 1", []int64{14, 191, 2812, 43238}},
+		{"r3k2r/Pppp1ppp/1b3nbN/nP6/BBP1P3/q4N2/Pp1P2PP/R2Q1RK1 w kq - 0 1", []int64{6, 264, 9467}},
+		{"rnbq1k1r/pp1Pbppp/2p5/8/2B5/8/PPP1NnPP/RNBQK2R w KQ - 1 8", []int64{44, 1486, 62379}},
+		{"r4rk1/1pp1qppp/p1np1n2/2b1p1B1/2B1P1b1/P1NP1N2/1PP1QPPP/R4RK1 w - - 0 10", []int64{46, 2079, 89890}},
+	}
+	for _, tt := range tests {
+		for depth, want := range tt.nodes {
+			if depth == 3 && testing.Short() {
+				break
+			}
+			if got := mustLoadFEN(t, tt.fen).Perft(depth + 1); got != want {
+				t.Errorf("%s: perft(%d) = %d, want %d", tt.fen, depth+1, got, want)
+			}
+		}
+	}
+}
+
+// TestMovesInCheck checks move generation in check: published perft counts
+// for positions in check, every reply two plies on against brute force, and
+// only the king moving out of double check
+func TestMovesInCheck(t *testing.T) {
+	tests := []struct {
+		fen   string
+		moves int64
+	}{
+		{"r6r/1b2k1bq/8/8/7B/8/8/R3K2R b KQ - 3 2", 8},
+		{"r3k2r/p1pp1pb1/bn2Qnp1/2qPN3/1p2P3/2N5/PPPBBPPP/R3K2R b KQkq - 3 2", 5},
+		{"8/8/8/2k5/2pP4/8/B7/4K3 b - d3 0 3", 8},
+		{"4k3/8/8/8/1b6/8/4r3/2N1K3 w - - 0 1", 3},
+	}
+	for _, tt := range tests {
+		game := mustLoadFEN(t, tt.fen)
+		if !game.IsInCheck(game.CurrentTurn) {
+			t.Fatalf("%s isn't check", tt.fen)
+		}
+		if got := game.Perft(1); got != tt.moves {
+			t.Errorf("%s: perft(1) = %d, want %d", tt.fen, got, tt.moves)
+		}
+		for _, move := range game.LegalMoves() {
+			next := game.CopyState()
+			if err := next.MakeMove(move); err != nil {
+				t.Fatal(err)
+			}
+			if want := bruteForceMoves(next); !sameMoves(next.GetValidMoves(next.CurrentTurn), want) {
+				t.Errorf("%s: after %v, generated moves differ from brute force %v", tt.fen, move, want)
+			}
+		}
+	}
+
+	// Double check: the knight could take the rook, but that leaves the bishop's check
+	game := mustLoadFEN(t, "4k3/8/8/8/1b6/8/4r3/2N1K3 w - - 0 1")
+	for _, move := range game.LegalMoves() {
+		if game.Board[move.From.Row][move.From.Col].Type != King {
+			t.Errorf("%v played out of double check", move)
+		}
+	}
+}
+
+// TestAttackMapMatchesAttacksSquare holds the ray walk AttackMap and the
+// evaluation use to attacksSquare, tested square by square
+func TestAttackMapMatchesAttacksSquare(t *testing.T) {
+	rng := rand.New(rand.NewSource(7))
+	for _, fen := range moveGenSeeds {
+		game, err := LoadFEN(fen)
+		if err != nil {
+			continue
+		}
+		for ply := 0; ply < 60 && !game.GameOver; ply++ {
+			for _, color := range []Color{White, Black} {
+				var want [8][8]int
+				for from := 0; from < 64; from++ {
+					piece := game.Board[from/8][from%8]
+					if piece == nil || piece.Color != color {
+						continue
+					}
+					for to := 0; to < 64; to++ {
+						if game.attacksSquare(Position{from / 8, from % 8}, Position{to / 8, to % 8}, piece) {
+							want[to/8][to%8]++
+						}
+					}
+				}
+				if got := game.AttackMap(color); got != want {
+					t.Fatalf("%s: %s attack map %v, want %v", game.ToFEN(), color, got, want)
+				}
+			}
+			moves := game.LegalMoves()
+			if err := game.MakeMove(moves[rng.Intn(len(moves))]); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// TestKingCaptureRefused forces the turn over to the side giving check, a
+// position LoadFEN wouldn't accept, and checks the king can't be taken
+func TestKingCaptureRefused(t *testing.T) {
+	game := mustLoadFEN(t, "4k3/8/8/8/8/8/8/r3K3 w - - 0 1")
+	game.CurrentTurn = Black
+
+	capture := Move{From: Position{7, 0}, To: Position{7, 4}}
+	if got := game.ValidateMove(capture); got != RejectKingCapture {
+		t.Errorf("Rxe1 rejected as %q, want %q", got, RejectKingCapture)
+	}
+	for _, move := range game.GetValidMoves(Black) {
+		if move.To == capture.To {
+			t.Errorf("%v generated", move)
+		}
+	}
+}
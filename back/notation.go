@@ -0,0 +1,450 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ============================================================================
+// STANDARD ALGEBRAIC NOTATION
+// ============================================================================
+
+// MoveToSAN renders a legal move of the side to move in Standard Algebraic
+// Notation, e.g. "Nbd7", "exd8=N+", "O-O" or "Qh7#"
+func (g *ChessGame) MoveToSAN(move Move) string {
+	san := g.sanWithoutSuffix(move)
+	if san == "" {
+		return ""
+	}
+
+	after := g.CopyState()
+	after.MakeMove(move)
+	if after.EndReason == "checkmate" {
+		return san + "#"
+	}
+	if after.IsInCheck(after.CurrentTurn) {
+		return san + "+"
+	}
+	return san
+}
+
+func (g *ChessGame) sanWithoutSuffix(move Move) string {
+	from, to := move.From, move.To
+	piece := g.Board[from.Row][from.Col]
+	if piece == nil {
+		return ""
+	}
+
+	if piece.Type == King {
+		if rookCol := g.castlingRookCol(from, to, piece.Color); rookCol >= 0 {
+			if rookCol > from.Col {
+				return "O-O"
+			}
+			return "O-O-O"
+		}
+	}
+
+	capture := g.isCapture(move)
+	if piece.Type == Pawn {
+		san := ""
+		if capture {
+			san = from.ToAlgebraic()[:1] + "x"
+		}
+		san += to.ToAlgebraic()
+		if to.Row == homeRow(opponentColor(piece.Color)) {
+			promotion := move.Promotion
+			if promotion == "" {
+				promotion = Queen
+			}
+			san += "=" + pieceLetter(promotion)
+		}
+		return san
+	}
+
+	san := pieceLetter(piece.Type) + g.sanDisambiguation(move, piece)
+	if capture {
+		san += "x"
+	}
+	return san + to.ToAlgebraic()
+}
+
+// sanDisambiguation returns the file, rank or full square needed to tell the
+// moving piece apart from identical pieces that could reach the same square
+func (g *ChessGame) sanDisambiguation(move Move, piece *Piece) string {
+	var rivals []Position
+	for i := 0; i < 8; i++ {
+		for j := 0; j < 8; j++ {
+			other := g.Board[i][j]
+			from := Position{i, j}
+			if other == nil || from == move.From || other.Type != piece.Type || other.Color != piece.Color {
+				continue
+			}
+			if g.IsValidMove(Move{From: from, To: move.To}) {
+				rivals = append(rivals, from)
+			}
+		}
+	}
+	if len(rivals) == 0 {
+		return ""
+	}
+
+	sameFile, sameRank := false, false
+	for _, rival := range rivals {
+		sameFile = sameFile || rival.Col == move.From.Col
+		sameRank = sameRank || rival.Row == move.From.Row
+	}
+
+	square := move.From.ToAlgebraic()
+	switch {
+	case !sameFile:
+		return square[:1]
+	case !sameRank:
+		return square[1:]
+	default:
+		return square
+	}
+}
+
+func pieceLetter(pieceType PieceType) string {
+	return pieceSymbol(&Piece{Type: pieceType, Color: White})
+}
+
+// parseSAN finds the legal move a SAN token describes. Check and annotation
+// suffixes are ignored, as are "0-0" style castles and a missing "=" before
+// the promotion piece.
+func (g *ChessGame) parseSAN(token string) (Move, error) {
+	san := strings.TrimRight(token, "+#!?")
+	san = strings.ReplaceAll(san, "0", "O")
+	if n := len(san); n >= 3 && strings.ContainsRune("QRBN", rune(san[n-1])) && san[n-2] >= '1' && san[n-2] <= '8' {
+		san = san[:n-1] + "=" + san[n-1:]
+	}
+
+	for _, move := range g.GetValidMoves(g.CurrentTurn) {
+		if g.sanWithoutSuffix(move) == san {
+			return move, nil
+		}
+	}
+	return Move{}, fmt.Errorf("illegal move %q", token)
+}
+
+// MoveSummary is the last move with what the frontend needs to announce it
+type MoveSummary struct {
+	Move
+	SAN           string    `json:"san"`
+	IsCheck       bool      `json:"isCheck"`
+	IsCheckmate   bool      `json:"isCheckmate"`
+	CapturedValue int       `json:"capturedValue"` // Centipawns, 0 if nothing was taken
+	Summary       string    `json:"summary"`       // e.g. "Queen takes Rook, check"
+	Event         MoveEvent `json:"event"`         // Which sound or animation the frontend plays
+}
+
+// MoveEvent is the single most notable thing about a move, for the frontend's
+// sounds and animations
+type MoveEvent string
+
+// From most to least notable: a move that both captures and checks is a check
+const (
+	EventCheckmate MoveEvent = "checkmate"
+	EventStalemate MoveEvent = "stalemate"
+	EventCheck     MoveEvent = "check"
+	EventPromotion MoveEvent = "promotion"
+	EventCastle    MoveEvent = "castle"
+	EventCapture   MoveEvent = "capture"
+	EventMove      MoveEvent = "move"
+)
+
+// LastMoveSummary describes the last move played, or returns nil before the
+// first one
+func (g *ChessGame) LastMoveSummary() *MoveSummary {
+	last := g.GetLastMove()
+	if last == nil {
+		return nil
+	}
+
+	summary := &MoveSummary{
+		Move:        *last,
+		IsCheck:     g.IsInCheck(g.CurrentTurn),
+		IsCheckmate: g.EndReason == "checkmate",
+	}
+	if last.CapturedPiece != nil {
+		summary.CapturedValue = pieceValues[last.CapturedPiece.Type]
+	}
+
+	// SAN needs the position the move was played from
+	before := g.CopyState()
+	if err := before.UndoMove(); err == nil {
+		summary.SAN = before.MoveToSAN(Move{From: last.From, To: last.To, Promotion: last.Promotion})
+	}
+	summary.Summary = summary.describe()
+	summary.Event = summary.event(g.EndReason)
+	return summary
+}
+
+// event picks the move's MoveEvent; endReason is the game's after the move
+func (m *MoveSummary) event(endReason string) MoveEvent {
+	switch {
+	case m.IsCheckmate:
+		return EventCheckmate
+	case endReason == "stalemate":
+		return EventStalemate
+	case m.IsCheck:
+		return EventCheck
+	case m.IsPromotion:
+		return EventPromotion
+	case m.IsCastle:
+		return EventCastle
+	case m.CapturedPiece != nil:
+		return EventCapture
+	}
+	return EventMove
+}
+
+func (m *MoveSummary) describe() string {
+	var text string
+	switch {
+	case strings.HasPrefix(m.SAN, "O-O-O"):
+		text = "Castles queenside"
+	case strings.HasPrefix(m.SAN, "O-O"):
+		text = "Castles kingside"
+	case m.CapturedPiece != nil:
+		text = pieceName(m.Piece.Type) + " takes " + pieceName(m.CapturedPiece.Type)
+		if m.IsEnPassant {
+			text += " en passant"
+		}
+	default:
+		text = pieceName(m.Piece.Type) + " to " + m.To.ToAlgebraic()
+	}
+
+	if m.IsPromotion {
+		text += " and promotes to " + pieceName(m.Promotion)
+	}
+	if m.IsCheckmate {
+		text += ", checkmate"
+	} else if m.IsCheck {
+		text += ", check"
+	}
+	return text
+}
+
+func pieceName(pieceType PieceType) string {
+	name := string(pieceType)
+	return strings.ToUpper(name[:1]) + name[1:]
+}
+
+// ============================================================================
+// PORTABLE GAME NOTATION
+// ============================================================================
+
+// startingPosition rebuilds the position the game started from
+func (g *ChessGame) startingPosition() (*ChessGame, error) {
+	if g.StartFEN != "" {
+		return LoadFEN(g.StartFEN)
+	}
+	return NewChessGame(), nil
+}
+
+// SANMoves returns the moves played so far in SAN
+func (g *ChessGame) SANMoves() ([]string, error) {
+	replay, err := g.startingPosition()
+	if err != nil {
+		return nil, fmt.Errorf("failed to rebuild starting position: %w", err)
+	}
+
+	moves := make([]string, 0, len(g.MoveHistory))
+	for _, move := range g.MoveHistory {
+		replayMove := Move{From: move.From, To: move.To, Promotion: move.Promotion}
+		moves = append(moves, replay.MoveToSAN(replayMove))
+		replay.MakeMove(replayMove)
+	}
+	return moves, nil
+}
+
+// ToPGN exports the game, including a SetUp/FEN header pair when it didn't
+// start from the standard position. aiColor names the engine's side in the
+// player tags, "" if people played both sides.
+func (g *ChessGame) ToPGN(aiColor Color) (string, error) {
+	return g.toPGN(aiColor, nil)
+}
+
+// toPGN writes annotations[i], when given, straight after the i-th move
+func (g *ChessGame) toPGN(aiColor Color, annotations []string) (string, error) {
+	start, err := g.startingPosition()
+	if err != nil {
+		return "", fmt.Errorf("failed to rebuild starting position: %w", err)
+	}
+	moves, err := g.SANMoves()
+	if err != nil {
+		return "", err
+	}
+
+	result := g.pgnResult()
+
+	var sb strings.Builder
+	writeTag := func(name, value string) {
+		fmt.Fprintf(&sb, "[%s \"%s\"]\n", name, value)
+	}
+	writeTag("Event", "Chess AI Game")
+	writeTag("Site", "Chess AI")
+	writeTag("Date", time.Now().Format("2006.01.02"))
+	writeTag("Round", "-")
+	players := map[Color]string{White: "Player", Black: "Player"}
+	if aiColor != "" {
+		players[aiColor] = "Chess AI"
+	}
+	writeTag("White", players[White])
+	writeTag("Black", players[Black])
+	writeTag("Result", result)
+	if g.TimeControl != nil {
+		writeTag("TimeControl", g.TimeControl.pgnTag())
+	}
+	if g.Chess960 {
+		writeTag("Variant", "Chess960")
+	}
+	if g.StartFEN != "" {
+		writeTag("SetUp", "1")
+		writeTag("FEN", g.StartFEN)
+	}
+	sb.WriteString("\n")
+
+	moveNumber := start.MoveNumberOffset + 1
+	turn := start.CurrentTurn
+	for i, san := range moves {
+		if turn == White {
+			fmt.Fprintf(&sb, "%d. ", moveNumber)
+		} else if i == 0 {
+			fmt.Fprintf(&sb, "%d... ", moveNumber)
+		}
+
+		sb.WriteString(san)
+		if i < len(annotations) {
+			sb.WriteString(annotations[i])
+		}
+		sb.WriteString(" ")
+		if turn == Black {
+			moveNumber++
+		}
+		turn = opponentColor(turn)
+	}
+	sb.WriteString(result + "\n")
+
+	return sb.String(), nil
+}
+
+func (g *ChessGame) pgnResult() string {
+	if !g.GameOver {
+		return "*"
+	}
+	switch g.Winner {
+	case string(White):
+		return "1-0"
+	case string(Black):
+		return "0-1"
+	default:
+		return "1/2-1/2"
+	}
+}
+
+var (
+	pgnTagPattern        = regexp.MustCompile(`^\[(\w+)\s+"(.*)"\]$`)
+	pgnCommentPattern    = regexp.MustCompile(`\{[^}]*\}|;[^\n]*`)
+	pgnNAGPattern        = regexp.MustCompile(`\$\d+`)
+	pgnMoveNumberPattern = regexp.MustCompile(`^\d+\.+`)
+)
+
+// LoadPGN replays the main line of a PGN game. Comments, NAGs and variations
+// are skipped; a FEN tag sets up the starting position.
+func LoadPGN(pgn string) (*ChessGame, error) {
+	tags := map[string]string{}
+	var movetext []string
+	for _, line := range strings.Split(pgn, "\n") {
+		line = strings.TrimSpace(line)
+		if match := pgnTagPattern.FindStringSubmatch(line); match != nil {
+			tags[match[1]] = match[2]
+			continue
+		}
+		movetext = append(movetext, line)
+	}
+
+	game := NewChessGame()
+	if fen, ok := tags["FEN"]; ok {
+		var err error
+		if game, err = LoadFEN(fen); err != nil {
+			return nil, fmt.Errorf("invalid FEN tag: %w", err)
+		}
+	}
+
+	text := pgnCommentPattern.ReplaceAllString(strings.Join(movetext, "\n"), " ")
+	text = pgnNAGPattern.ReplaceAllString(stripVariations(text), " ")
+
+	for _, token := range strings.Fields(text) {
+		token = pgnMoveNumberPattern.ReplaceAllString(token, "")
+		switch token {
+		case "", "1-0", "0-1", "1/2-1/2", "*":
+			continue
+		}
+
+		if game.GameOver {
+			return nil, fmt.Errorf("move %q played after the game ended", token)
+		}
+		move, err := game.parseSAN(token)
+		if err != nil {
+			return nil, fmt.Errorf("ply %d: %w", len(game.MoveHistory)+1, err)
+		}
+		game.MakeMove(move)
+	}
+
+	return game, nil
+}
+
+// stripVariations removes (possibly nested) parenthesised side lines
+func stripVariations(text string) string {
+	var sb strings.Builder
+	depth := 0
+	for _, r := range text {
+		switch {
+		case r == '(':
+			depth++
+		case r == ')' && depth > 0:
+			depth--
+		case depth == 0:
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
+
+// ============================================================================
+// UCI (LONG ALGEBRAIC) NOTATION
+// ============================================================================
+
+var uciPromotions = map[byte]PieceType{'q': Queen, 'r': Rook, 'b': Bishop, 'n': Knight}
+
+// ParseUCIMove reads a coordinate move such as "e2e4" or "e7e8q". Legality is
+// left to the caller.
+func ParseUCIMove(uci string) (MoveRequest, error) {
+	if len(uci) != 4 && len(uci) != 5 {
+		return MoveRequest{}, fmt.Errorf("UCI move must look like e2e4 or e7e8q, got %q", uci)
+	}
+
+	from, err := ParseAlgebraic(uci[0:2])
+	if err != nil {
+		return MoveRequest{}, fmt.Errorf("invalid from square in %q: %w", uci, err)
+	}
+	to, err := ParseAlgebraic(uci[2:4])
+	if err != nil {
+		return MoveRequest{}, fmt.Errorf("invalid to square in %q: %w", uci, err)
+	}
+
+	moveReq := MoveRequest{From: from, To: to}
+	if len(uci) == 5 {
+		promotion, ok := uciPromotions[uci[4]]
+		if !ok {
+			return MoveRequest{}, fmt.Errorf("invalid promotion piece %q in %q (use q, r, b or n)", uci[4], uci)
+		}
+		moveReq.Promotion = promotion
+	}
+
+	return moveReq, nil
+}
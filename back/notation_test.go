@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestPromotionSAN(t *testing.T) {
+	tests := []struct {
+		fen  string
+		move Move
+		want string
+	}{
+		{"8/1P5k/8/8/8/8/8/4K3 w - - 0 1", Move{From: Position{1, 1}, To: Position{0, 1}, Promotion: Queen}, "b8=Q"},
+		{"8/1P5k/8/8/8/8/8/4K3 w - - 0 1", Move{From: Position{1, 1}, To: Position{0, 1}, Promotion: Knight}, "b8=N"},
+		{"3r4/4Pk2/8/8/8/8/8/K7 w - - 0 1", Move{From: Position{1, 4}, To: Position{0, 3}, Promotion: Knight}, "exd8=N+"},
+		{"4k3/8/8/8/8/7K/1p6/8 b - - 0 1", Move{From: Position{6, 1}, To: Position{7, 1}, Promotion: Rook}, "b1=R"},
+	}
+	for _, tt := range tests {
+		game := mustLoadFEN(t, tt.fen)
+		if got := game.MoveToSAN(tt.move); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.fen, got, tt.want)
+		}
+		parsed, err := game.parseSAN(tt.want)
+		if err != nil || parsed.Promotion != tt.move.Promotion {
+			t.Errorf("%s: %s parsed as %v, %v", tt.fen, tt.want, parsed, err)
+		}
+	}
+}
+
+func TestPromotionSANRejectsBadPieces(t *testing.T) {
+	game := mustLoadFEN(t, "4k3/1P6/8/8/8/8/8/4K3 w - - 0 1")
+	for _, san := range []string{"b8=K", "b8=P", "b8=X"} {
+		if _, err := game.parseSAN(san); err == nil {
+			t.Errorf("%s accepted", san)
+		}
+	}
+}
+
+func TestUnderpromotionPGNRoundTrip(t *testing.T) {
+	game := mustLoadFEN(t, "3r4/1P2Pk2/8/8/8/8/6p1/K7 w - - 0 1")
+	playSAN(t, game, "exd8=N+ Ke7 b8=R g1=B")
+
+	pgn, err := game.ToPGN(Black)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadPGN(pgn)
+	if err != nil {
+		t.Fatalf("%v in\n%s", err, pgn)
+	}
+	if loaded.ToFEN() != game.ToFEN() {
+		t.Errorf("re-imported to %s, want %s from\n%s", loaded.ToFEN(), game.ToFEN(), pgn)
+	}
+}
+
+func TestMoveEvent(t *testing.T) {
+	const start = "rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1"
+	tests := []struct {
+		fen   string
+		moves string
+		want  MoveEvent
+	}{
+		{start, "e4", EventMove},
+		{start, "e4 d5 exd5", EventCapture},
+		{start, "e4 e5 Nf3 Nc6 Bc4 Nf6 O-O", EventCastle},
+		{start, "e4 e5 Nf3 d6 Bb5+", EventCheck},
+		{start, "f3 e5 g4 Qh4#", EventCheckmate},
+		{"8/1P5k/8/8/8/8/8/K7 w - - 0 1", "b8=Q", EventPromotion},
+		// A capture that checks sounds like a check
+		{"4k3/4p3/8/8/8/8/8/4R1K1 w - - 0 1", "Rxe7+", EventCheck},
+		{"k7/8/1K6/8/8/8/8/2Q5 w - - 0 1", "Qc7", EventStalemate},
+	}
+	for _, tt := range tests {
+		game := mustLoadFEN(t, tt.fen)
+		playSAN(t, game, tt.moves)
+		if got := game.LastMoveSummary().Event; got != tt.want {
+			t.Errorf("%s: %q, want %q", tt.moves, got, tt.want)
+		}
+	}
+}
+
+func TestMoveEventOnBothSidesMoves(t *testing.T) {
+	service := NewChessService()
+	if _, err := service.NewGame(NewGameRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	response, err := service.MakePlayerMove(MoveRequest{From: Position{6, 4}, To: Position{4, 4}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.LastMove == nil || response.LastMove.Event != EventMove {
+		t.Errorf("player's e4 reported as %+v", response.LastMove)
+	}
+
+	ai := NewAIService()
+	if err := ai.SetDepth(1); err != nil {
+		t.Fatal(err)
+	}
+	response, err = ai.MakeAIMove(context.Background(), service)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := service.GetGame().LastMoveSummary().Event; response.LastMove == nil || response.LastMove.Event != want {
+		t.Errorf("AI's reply reported as %+v, want a %q", response.LastMove, want)
+	}
+}
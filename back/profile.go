@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// ============================================================================
+// PERFORMANCE PROFILE
+// ============================================================================
+
+// Timings of the engine's hot paths on one position, so the effect of a
+// performance change can be measured the same way each time. Each operation
+// repeats, doubling its iteration count like a Go benchmark, until it has run
+// for at least PROFILE_MIN_TIME.
+const (
+	PROFILE_MIN_TIME         = 200 * time.Millisecond
+	PROFILE_MIN_SEARCH_DEPTH = 3
+	PROFILE_MAX_SEARCH_DEPTH = 5
+)
+
+type OperationTiming struct {
+	Name       string `json:"name"`
+	Iterations int    `json:"iterations"`
+	NsPerOp    int64  `json:"ns_per_op"`
+}
+
+type SearchTiming struct {
+	Depth          int   `json:"depth"`
+	Nodes          int64 `json:"nodes"`
+	ElapsedMs      int64 `json:"elapsed_ms"`
+	NodesPerSecond int64 `json:"nodes_per_second"`
+	Complete       bool  `json:"complete"` // False if the node budget or the request ran out first
+}
+
+type ProfileResponse struct {
+	FEN        string            `json:"fen"`
+	Operations []OperationTiming `json:"operations"`
+	Searches   []SearchTiming    `json:"searches"`
+}
+
+// Profile times move generation, check detection, static evaluation and
+// fixed-depth searches from PROFILE_MIN_SEARCH_DEPTH to PROFILE_MAX_SEARCH_DEPTH
+// on a copy of the game. Searches skip the evaluation cache so earlier
+// analysis can't flatter them, and stop once ctx ends.
+func (ai *AIService) Profile(ctx context.Context, game *ChessGame) ProfileResponse {
+	position := game.CopyState()
+	config := ai.snapshot()
+	worker := NewAIService()
+	worker.evalMode = config.evalMode
+	worker.limits = config.limits
+	config.shareEvaluator(worker)
+
+	response := ProfileResponse{FEN: position.ToFEN()}
+	response.Operations = []OperationTiming{
+		timeOperation("GetValidMoves", func() { position.GetValidMoves(position.CurrentTurn) }),
+		timeOperation("IsInCheck", func() { position.IsInCheck(position.CurrentTurn) }),
+		timeOperation("evaluatePosition", func() { worker.evaluatePosition(position) }),
+	}
+
+	for depth := PROFILE_MIN_SEARCH_DEPTH; depth <= PROFILE_MAX_SEARCH_DEPTH; depth++ {
+		if ctx.Err() != nil {
+			break
+		}
+
+		search := worker.newSearch(ctx, 0)
+		start := time.Now()
+		_, err := search.fixedDepth(position.CopyState(), depth)
+		elapsed := time.Since(start)
+
+		timing := SearchTiming{
+			Depth:     depth,
+			Nodes:     search.nodes,
+			ElapsedMs: elapsed.Milliseconds(),
+			Complete:  err == nil,
+		}
+		if elapsed > 0 {
+			timing.NodesPerSecond = int64(float64(search.nodes) / elapsed.Seconds())
+		}
+		response.Searches = append(response.Searches, timing)
+	}
+	return response
+}
+
+func timeOperation(name string, op func()) OperationTiming {
+	iterations := 1
+	for {
+		start := time.Now()
+		for i := 0; i < iterations; i++ {
+			op()
+		}
+		elapsed := time.Since(start)
+		if elapsed >= PROFILE_MIN_TIME {
+			return OperationTiming{
+				Name:       name,
+				Iterations: iterations,
+				NsPerOp:    elapsed.Nanoseconds() / int64(iterations),
+			}
+		}
+		iterations *= 2
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+)
+
+// ============================================================================
+// PIECE-SQUARE TABLE LOADING
+// ============================================================================
+
+// Each table is laid out from White's side of the board: row 0 is rank 8, the
+// rank White's pawns promote on. Every piece needs a middlegame table; pieces
+// whose best squares change once the board empties (pawns should run, the king
+// should come out) also get an endgame one to taper towards.
+//
+//go:embed pst.json
+var pieceSquareTablesJSON []byte
+
+var pieceSquareTables = mustLoadPieceSquareTables(pieceSquareTablesJSON)
+
+type pieceSquareTable [8][8]int
+
+type pieceSquareTableSet struct {
+	middlegame map[PieceType]*pieceSquareTable
+	endgame    map[PieceType]*pieceSquareTable
+}
+
+// mustLoadPieceSquareTables panics on a malformed file so a bad table stops the
+// server at startup instead of skewing every evaluation
+func mustLoadPieceSquareTables(data []byte) *pieceSquareTableSet {
+	tables, err := loadPieceSquareTables(data)
+	if err != nil {
+		panic(fmt.Sprintf("invalid piece-square tables: %v", err))
+	}
+	return tables
+}
+
+func loadPieceSquareTables(data []byte) (*pieceSquareTableSet, error) {
+	// Decoded as slices first: JSON arrays of the wrong length would otherwise
+	// be silently padded or truncated to fit [8][8]int
+	var raw struct {
+		Middlegame map[PieceType][][]int `json:"middlegame"`
+		Endgame    map[PieceType][][]int `json:"endgame"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	tables := &pieceSquareTableSet{
+		middlegame: map[PieceType]*pieceSquareTable{},
+		endgame:    map[PieceType]*pieceSquareTable{},
+	}
+	for _, pieceType := range []PieceType{Pawn, Knight, Bishop, Rook, Queen, King} {
+		rows, ok := raw.Middlegame[pieceType]
+		if !ok {
+			return nil, fmt.Errorf("missing middlegame table for %s", pieceType)
+		}
+		table, err := toPieceSquareTable(rows)
+		if err != nil {
+			return nil, fmt.Errorf("middlegame %s table: %w", pieceType, err)
+		}
+		tables.middlegame[pieceType] = table
+	}
+	for pieceType, rows := range raw.Endgame {
+		if _, ok := tables.middlegame[pieceType]; !ok {
+			return nil, fmt.Errorf("endgame table for unknown piece %q", pieceType)
+		}
+		table, err := toPieceSquareTable(rows)
+		if err != nil {
+			return nil, fmt.Errorf("endgame %s table: %w", pieceType, err)
+		}
+		tables.endgame[pieceType] = table
+	}
+	return tables, nil
+}
+
+func toPieceSquareTable(rows [][]int) (*pieceSquareTable, error) {
+	if len(rows) != 8 {
+		return nil, fmt.Errorf("must have 8 rows, got %d", len(rows))
+	}
+	var table pieceSquareTable
+	for i, row := range rows {
+		if len(row) != 8 {
+			return nil, fmt.Errorf("row %d must have 8 columns, got %d", i, len(row))
+		}
+		copy(table[i][:], row)
+	}
+	return &table, nil
+}
+
+// value looks up a square already oriented to White's side, blending in the
+// endgame table by phase where the piece has one
+func (t *pieceSquareTableSet) value(pieceType PieceType, row, col, phase int) int {
+	middlegame, ok := t.middlegame[pieceType]
+	if !ok {
+		return 0
+	}
+	if endgame, ok := t.endgame[pieceType]; ok {
+		return taper(middlegame[row][col], endgame[row][col], phase)
+	}
+	return middlegame[row][col]
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestGamePhase(t *testing.T) {
+	tests := []struct {
+		fen  string
+		want int
+	}{
+		{"rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1", MIDGAME_PHASE},
+		{"4k3/pppppppp/8/8/8/8/PPPPPPPP/4K3 w - - 0 1", 0},
+		{"4k3/8/8/8/8/8/8/4K3 w - - 0 1", 0},
+		// Promotions can't push it past a full midgame
+		{"qqqqkqqq/pppppppp/8/8/8/8/PPPPPPPP/QQQQKQQQ w - - 0 1", MIDGAME_PHASE},
+	}
+	for _, tt := range tests {
+		if got := gamePhase(mustLoadFEN(t, tt.fen)); got != tt.want {
+			t.Errorf("%s: phase %d, want %d", tt.fen, got, tt.want)
+		}
+	}
+}
+
+func TestPieceSquareTablesTaperByPhase(t *testing.T) {
+	ai := NewAIService().snapshot()
+	whiteKing, blackKing := &Piece{Type: King, Color: White}, &Piece{Type: King, Color: Black}
+	middlegame, endgame := pieceSquareTables.middlegame[King], pieceSquareTables.endgame[King]
+
+	// e1 and, seen from Black's side, e8
+	if got := ai.pieceSquareValue(whiteKing, 7, 4, MIDGAME_PHASE); got != middlegame[7][4] {
+		t.Errorf("white king at full material scores %d, want the middlegame %d", got, middlegame[7][4])
+	}
+	if got := ai.pieceSquareValue(blackKing, 0, 4, MIDGAME_PHASE); got != middlegame[7][4] {
+		t.Errorf("black king at full material scores %d, want the middlegame %d", got, middlegame[7][4])
+	}
+	if got := ai.pieceSquareValue(whiteKing, 7, 4, 0); got != endgame[7][4] {
+		t.Errorf("white king with bare kings scores %d, want the endgame %d", got, endgame[7][4])
+	}
+	if got, want := ai.pieceSquareValue(whiteKing, 7, 4, MIDGAME_PHASE/2), (middlegame[7][4]+endgame[7][4])/2; got != want {
+		t.Errorf("white king at half phase scores %d, want %d", got, want)
+	}
+
+	// The king belongs at home with the board full and in the centre once
+	// it empties
+	home, centre := Position{7, 6}, Position{4, 4}
+	if ai.pieceSquareValue(whiteKing, home.Row, home.Col, MIDGAME_PHASE) <= ai.pieceSquareValue(whiteKing, centre.Row, centre.Col, MIDGAME_PHASE) {
+		t.Error("middlegame king prefers the centre to g1")
+	}
+	if ai.pieceSquareValue(whiteKing, home.Row, home.Col, 0) >= ai.pieceSquareValue(whiteKing, centre.Row, centre.Col, 0) {
+		t.Error("endgame king prefers g1 to the centre")
+	}
+}
+
+// TestEmbeddedPieceSquareTablesAre8x8 checks the shipped JSON itself, before
+// the loader copies it into fixed-size arrays
+func TestEmbeddedPieceSquareTablesAre8x8(t *testing.T) {
+	var raw map[string]map[PieceType][][]int
+	if err := json.Unmarshal(pieceSquareTablesJSON, &raw); err != nil {
+		t.Fatal(err)
+	}
+	for phase, tables := range raw {
+		for pieceType, rows := range tables {
+			if len(rows) != 8 {
+				t.Errorf("%s %s table has %d rows", phase, pieceType, len(rows))
+			}
+			for i, row := range rows {
+				if len(row) != 8 {
+					t.Errorf("%s %s table row %d has %d columns", phase, pieceType, i, len(row))
+				}
+			}
+		}
+	}
+	for _, pieceType := range []PieceType{Pawn, Knight, Bishop, Rook, Queen, King} {
+		if pieceSquareTables.middlegame[pieceType] == nil {
+			t.Errorf("no middlegame %s table", pieceType)
+		}
+	}
+}
+
+func TestLoadPieceSquareTablesRejectsBadTables(t *testing.T) {
+	row := "[0,0,0,0,0,0,0,0]"
+	table := "[" + row + "," + row + "," + row + "," + row + "," + row + "," + row + "," + row + "," + row + "]"
+	full := `"pawn":` + table + `,"knight":` + table + `,"bishop":` + table + `,"rook":` + table + `,"queen":` + table + `,"king":` + table
+	if _, err := loadPieceSquareTables([]byte(`{"middlegame":{` + full + `}}`)); err != nil {
+		t.Fatalf("valid tables rejected: %v", err)
+	}
+	for name, data := range map[string]string{
+		"missing piece":   `{"middlegame":{"pawn":` + table + `}}`,
+		"short row":       `{"middlegame":{` + full + `,"pawn":[[0]]}}`,
+		"ninth row":       `{"middlegame":{` + full + `,"rook":[` + row + `,` + row + `,` + row + `,` + row + `,` + row + `,` + row + `,` + row + `,` + row + `,` + row + `]}}`,
+		"long row":        `{"middlegame":{` + full + `,"king":[[0,0,0,0,0,0,0,0,0],` + row + `,` + row + `,` + row + `,` + row + `,` + row + `,` + row + `,` + row + `]}}`,
+		"unknown endgame": `{"middlegame":{` + full + `},"endgame":{"wizard":` + table + `}}`,
+		"not JSON":        `{`,
+	} {
+		if _, err := loadPieceSquareTables([]byte(data)); err == nil {
+			t.Errorf("%s accepted", name)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"time"
+)
+
+// ============================================================================
+// ANALYSIS SEARCH POOL
+// ============================================================================
+
+// Analysis endpoints share a fixed number of search slots so a burst of
+// requests can't oversubscribe the CPU. Moves in the live game don't take a
+// slot, they stay responsive however busy analysis gets.
+const (
+	ANALYSIS_QUEUE_TIMEOUT = 2 * time.Second // Longest a request waits for a free slot
+	ANALYSIS_RETRY_AFTER   = 1 * time.Second // Suggested back-off once it gives up
+)
+
+var errSearchPoolBusy = errors.New("all analysis search slots are busy")
+
+type searchPool struct {
+	slots        chan struct{}
+	queueTimeout time.Duration
+}
+
+func newSearchPool(size int, queueTimeout time.Duration) *searchPool {
+	return &searchPool{
+		slots:        make(chan struct{}, max(size, 1)),
+		queueTimeout: queueTimeout,
+	}
+}
+
+func defaultSearchPool() *searchPool {
+	return newSearchPool(runtime.NumCPU(), ANALYSIS_QUEUE_TIMEOUT)
+}
+
+// acquire waits up to the queue timeout for a slot. The caller must release
+// it once its search is done.
+func (p *searchPool) acquire(ctx context.Context) error {
+	select {
+	case p.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	timer := time.NewTimer(p.queueTimeout)
+	defer timer.Stop()
+	select {
+	case p.slots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return errSearchPoolBusy
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// tryAcquire takes up to n more slots that are free right now, without
+// waiting, and returns how many it got. Each one must be released.
+func (p *searchPool) tryAcquire(n int) int {
+	for got := 0; got < n; got++ {
+		select {
+		case p.slots <- struct{}{}:
+		default:
+			return got
+		}
+	}
+	return max(n, 0)
+}
+
+func (p *searchPool) release() {
+	<-p.slots
+}
+
+// size and inUse are reported by the health check
+func (p *searchPool) size() int {
+	return cap(p.slots)
+}
+
+func (p *searchPool) inUse() int {
+	return len(p.slots)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSearchPoolTryAcquire(t *testing.T) {
+	pool := newSearchPool(4, time.Millisecond)
+	if err := pool.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := pool.tryAcquire(8); got != 3 {
+		t.Errorf("took %d extra slots, want the 3 free ones", got)
+	}
+	if got := pool.tryAcquire(1); got != 0 {
+		t.Errorf("took %d slots from a full pool", got)
+	}
+	if err := pool.acquire(context.Background()); !errors.Is(err, errSearchPoolBusy) {
+		t.Errorf("acquire on a full pool: got %v, want %v", err, errSearchPoolBusy)
+	}
+
+	for i := 0; i < 4; i++ {
+		pool.release()
+	}
+	if pool.inUse() != 0 {
+		t.Errorf("%d slots still in use", pool.inUse())
+	}
+}
+
+func TestAnalyzeBatchUsesGivenWorkers(t *testing.T) {
+	ai := NewAIService()
+	ai.SetDepth(1)
+	games := []*ChessGame{NewChessGame(), mustLoadFEN(t, "4k3/8/8/8/8/8/8/4K2R w K - 0 1")}
+	results := ai.AnalyzeBatch(context.Background(), games, time.Second, 1)
+	for i, result := range results {
+		if result.Index != i || result.BestMove == nil || result.Error != "" {
+			t.Errorf("position %d: %+v", i, result)
+		}
+	}
+}
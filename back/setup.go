@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ============================================================================
+// POSITION SETUP VALIDATION
+// ============================================================================
+
+// A side starts with 8 pawns and 16 pieces in all. Every piece beyond the
+// starting set must have come from a promotion, which costs a pawn.
+const (
+	MAX_PAWNS  = 8
+	MAX_PIECES = 16
+)
+
+var startingPieceCounts = map[PieceType]int{
+	Queen: 1, Rook: 2, Bishop: 2, Knight: 2,
+}
+
+// PlacedPiece is one piece of a structured setup
+type PlacedPiece struct {
+	Square string    `json:"square"`
+	Type   PieceType `json:"type"`
+	Color  Color     `json:"color"`
+}
+
+type PositionValidation struct {
+	Legal    bool     `json:"legal"`
+	Problems []string `json:"problems"`
+	FEN      string   `json:"fen,omitempty"` // The setup as a FEN, once it's legal
+}
+
+// setupFromFEN reads a FEN's board, side to move and en passant square
+// without judging whether the position could occur. Castling rights are left
+// to the caller, which checks them against the placement.
+func setupFromFEN(fen string) (*ChessGame, string, error) {
+	fields := strings.Fields(fen)
+	if len(fields) < 4 || len(fields) > 6 {
+		return nil, "", fmt.Errorf("FEN must have 4 to 6 fields, got %d", len(fields))
+	}
+
+	game := newSetupGame()
+	if err := game.parsePlacement(fields[0]); err != nil {
+		return nil, "", err
+	}
+
+	switch fields[1] {
+	case "w":
+		game.CurrentTurn = White
+	case "b":
+		game.CurrentTurn = Black
+	default:
+		return nil, "", fmt.Errorf("invalid side to move %q", fields[1])
+	}
+
+	if fields[3] != "-" {
+		square, err := ParseAlgebraic(fields[3])
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid en passant square: %w", err)
+		}
+		game.EnPassant = &square
+	}
+	return game, fields[2], nil
+}
+
+// setupFromPieces places a structured list of pieces on an empty board
+func setupFromPieces(pieces []PlacedPiece, turn Color) (*ChessGame, error) {
+	game := newSetupGame()
+	switch turn {
+	case "", White:
+		game.CurrentTurn = White
+	case Black:
+		game.CurrentTurn = Black
+	default:
+		return nil, fmt.Errorf("invalid side to move %q", turn)
+	}
+
+	for _, placed := range pieces {
+		square, err := ParseAlgebraic(placed.Square)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := pieceValues[placed.Type]; !ok {
+			return nil, fmt.Errorf("invalid piece type %q on %s", placed.Type, placed.Square)
+		}
+		if placed.Color != White && placed.Color != Black {
+			return nil, fmt.Errorf("invalid color %q on %s", placed.Color, placed.Square)
+		}
+		if game.Board[square.Row][square.Col] != nil {
+			return nil, fmt.Errorf("more than one piece on %s", placed.Square)
+		}
+		game.Board[square.Row][square.Col] = &Piece{Type: placed.Type, Color: placed.Color}
+	}
+	return game, nil
+}
+
+func newSetupGame() *ChessGame {
+	return &ChessGame{
+		KingMoved: map[Color]bool{White: true, Black: true},
+		RookMoved: map[Color]map[int]bool{White: {}, Black: {}},
+	}
+}
+
+// ValidateSetup lists every reason the position couldn't arise in a game,
+// rather than stopping at the first
+func (g *ChessGame) ValidateSetup(castling string) []string {
+	problems := []string{}
+
+	for _, color := range []Color{White, Black} {
+		if kings := g.countPieces(color, King); kings != 1 {
+			problems = append(problems, fmt.Sprintf("%s has %d kings, needs exactly one", color, kings))
+		}
+
+		pawns := g.countPieces(color, Pawn)
+		if pawns > MAX_PAWNS {
+			problems = append(problems, fmt.Sprintf("%s has %d pawns, at most %d allowed", color, pawns, MAX_PAWNS))
+		}
+
+		total := pawns + g.countPieces(color, King)
+		promoted := 0
+		for pieceType, starting := range startingPieceCounts {
+			count := g.countPieces(color, pieceType)
+			total += count
+			promoted += max(count-starting, 0)
+		}
+		if total > MAX_PIECES {
+			problems = append(problems, fmt.Sprintf("%s has %d pieces, at most %d allowed", color, total, MAX_PIECES))
+		}
+		if missing := max(MAX_PAWNS-pawns, 0); promoted > missing {
+			problems = append(problems, fmt.Sprintf("%s has %d promoted pieces but only %d missing pawns", color, promoted, missing))
+		}
+	}
+
+	for row := 0; row < 8; row += 7 {
+		for col := 0; col < 8; col++ {
+			piece := g.Board[row][col]
+			if piece != nil && piece.Type == Pawn {
+				square := Position{Row: row, Col: col}
+				problems = append(problems, fmt.Sprintf("%s pawn on %s, pawns can't stand on the first or last rank", piece.Color, square.ToAlgebraic()))
+			}
+		}
+	}
+
+	// Only meaningful once there's a single king to be in check
+	waiting := opponentColor(g.CurrentTurn)
+	if g.countPieces(waiting, King) == 1 && g.IsInCheck(waiting) {
+		problems = append(problems, fmt.Sprintf("%s is in check but it's %s's turn", waiting, g.CurrentTurn))
+	}
+
+	if castling != "-" {
+		for _, right := range castling {
+			color, rookCol, err := g.castlingRook(right)
+			if err != nil {
+				problems = append(problems, err.Error())
+				continue
+			}
+			g.KingMoved[color] = false
+			g.RookMoved[color][rookCol] = false
+		}
+	}
+	return problems
+}
+
+func (g *ChessGame) countPieces(color Color, pieceType PieceType) int {
+	count := 0
+	for i := 0; i < 8; i++ {
+		for j := 0; j < 8; j++ {
+			piece := g.Board[i][j]
+			if piece != nil && piece.Color == color && piece.Type == pieceType {
+				count++
+			}
+		}
+	}
+	return count
+}
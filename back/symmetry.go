@@ -0,0 +1,70 @@
+package main
+
+import "fmt"
+
+// ============================================================================
+// EVALUATION SYMMETRY
+// ============================================================================
+
+// ColorMirrored flips the board top to bottom and swaps the colours of every
+// piece, the side to move and the castling rights. The result is the same
+// position seen from the other side.
+func (g *ChessGame) ColorMirrored() *ChessGame {
+	mirrored := &ChessGame{
+		CurrentTurn: opponentColor(g.CurrentTurn),
+		GameOver:    g.GameOver,
+		EndReason:   g.EndReason,
+		KingMoved:   map[Color]bool{White: g.KingMoved[Black], Black: g.KingMoved[White]},
+		RookMoved:   map[Color]map[int]bool{White: {}, Black: {}},
+		Chess960:    g.Chess960,
+	}
+
+	switch g.Winner {
+	case string(White):
+		mirrored.Winner = string(Black)
+	case string(Black):
+		mirrored.Winner = string(White)
+	default:
+		mirrored.Winner = g.Winner
+	}
+
+	for i := 0; i < 8; i++ {
+		for j := 0; j < 8; j++ {
+			if piece := g.Board[i][j]; piece != nil {
+				mirrored.Board[7-i][j] = &Piece{Type: piece.Type, Color: opponentColor(piece.Color)}
+			}
+		}
+	}
+
+	for color, rooks := range g.RookMoved {
+		for col, moved := range rooks {
+			mirrored.RookMoved[opponentColor(color)][col] = moved
+		}
+	}
+
+	if g.EnPassant != nil {
+		mirrored.EnPassant = &Position{Row: 7 - g.EnPassant.Row, Col: g.EnPassant.Col}
+	}
+
+	mirrored.resetPositions()
+	return mirrored
+}
+
+// CheckSymmetry evaluates the position and its mirror with the service's
+// evaluation mode and style. The style plays White in the position and Black
+// in the mirror, so its own-king and enemy-king weights stay with the same
+// king.
+func (ai *AIService) CheckSymmetry(game *ChessGame) error {
+	checker := ai.snapshot()
+	checker.weights = stylePresets[checker.style]
+
+	checker.weightsSide = White
+	original := checker.evaluatePosition(game)
+	checker.weightsSide = Black
+	mirrored := checker.evaluatePosition(game.ColorMirrored())
+
+	if original != -mirrored {
+		return fmt.Errorf("%s evaluates to %d but its mirror to %d", game.ToFEN(), original, mirrored)
+	}
+	return nil
+}
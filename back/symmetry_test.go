@@ -0,0 +1,53 @@
+package main
+
+import "testing"
+
+// A position and its colour-mirrored twin must evaluate to exact negatives of
+// each other. A term that gets the sign or the board orientation wrong for one
+// side shows up here long before it shows up as odd play.
+var symmetryCheckFENs = []string{
+	"rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1",
+	"r1bqkbnr/pppp1ppp/2n5/4p3/2B1P3/5N2/PPPP1PPP/RNBQK2R b KQkq - 3 3",
+	"r3k2r/p1ppqpb1/bn2pnp1/3PN3/1p2P3/2N2Q1p/PPPBBPPP/R3K2R w KQkq - 0 1",
+	"r1bq1rk1/pp2bppp/2n1pn2/3p4/2PP4/2N1PN2/PP3PPP/R2QKB1R w KQ - 0 8",
+	"2r3k1/5ppp/p3p3/1p1pP3/3P4/P1R2N2/1P3PPP/6K1 b - - 0 25",
+	"8/5k2/8/3P4/8/8/6K1/8 w - - 0 1",
+	"8/8/8/4k3/8/8/8/4K2R w K - 0 1",
+	"6k1/5p2/6p1/8/3b4/8/5PPP/3R2K1 w - - 0 30",
+}
+
+func TestEvaluationSymmetry(t *testing.T) {
+	for _, style := range []string{"aggressive", "balanced", "defensive"} {
+		for _, mode := range []EvalMode{EvalFull, EvalMaterial, EvalPositional} {
+			ai := NewAIService()
+			if err := ai.SetStyle(style); err != nil {
+				t.Fatal(err)
+			}
+			if err := ai.SetEvalMode(string(mode)); err != nil {
+				t.Fatal(err)
+			}
+			for _, fen := range symmetryCheckFENs {
+				if err := ai.CheckSymmetry(mustLoadFEN(t, fen)); err != nil {
+					t.Errorf("%s style, %s evaluation: %v", style, mode, err)
+				}
+			}
+		}
+	}
+}
+
+func TestColorMirroredTwiceIsTheSamePosition(t *testing.T) {
+	for _, fen := range symmetryCheckFENs {
+		game := mustLoadFEN(t, fen)
+		if got := game.ColorMirrored().ColorMirrored().positionKey(); got != game.positionKey() {
+			t.Errorf("%s mirrored twice is %s", game.positionKey(), got)
+		}
+	}
+}
+
+func TestColorMirroredSwapsSides(t *testing.T) {
+	game := mustLoadFEN(t, "8/8/8/4k3/8/8/8/4K2R w K - 0 1")
+	want := "4k2r/8/8/8/4K3/8/8/8 b k - 0 1"
+	if got := game.ColorMirrored().ToFEN(); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
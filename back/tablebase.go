@@ -0,0 +1,157 @@
+package main
+
+// ============================================================================
+// RULE-BASED ENDGAME CLASSIFICATION
+// ============================================================================
+
+// EndgameVerdict is the theoretical result of a position, from rules that hold
+// for the simplest endgames rather than a real tablebase
+type EndgameVerdict struct {
+	Known          bool   `json:"known"`
+	Material       string `json:"material"`         // Stronger side first, e.g. "KRvK"
+	Result         string `json:"result,omitempty"` // "win" or "draw"
+	Winner         Color  `json:"winner,omitempty"`
+	SideToMoveWins bool   `json:"side_to_move_wins"`
+	Rule           string `json:"rule,omitempty"` // Which rule decided it
+}
+
+// TheoreticalResult classifies positions with the two kings and at most one
+// other piece. Anything it can't decide with certainty is reported unknown.
+func (g *ChessGame) TheoreticalResult() EndgameVerdict {
+	kings := map[Color]Position{}
+	var extra *Piece
+	var extraPos Position
+	count := 0
+	for i := 0; i < 8; i++ {
+		for j := 0; j < 8; j++ {
+			piece := g.Board[i][j]
+			if piece == nil {
+				continue
+			}
+			if piece.Type == King {
+				kings[piece.Color] = Position{i, j}
+				continue
+			}
+			count++
+			extra, extraPos = piece, Position{i, j}
+		}
+	}
+	if len(kings) != 2 || count > 1 {
+		return EndgameVerdict{Material: g.materialSignature()}
+	}
+
+	verdict := EndgameVerdict{Material: "KvK"}
+	if extra != nil {
+		verdict.Material = "K" + pieceLetter(extra.Type) + "vK"
+	}
+
+	if g.GameOver {
+		verdict.Known = true
+		verdict.Rule = g.EndReason
+		if g.Winner == string(White) || g.Winner == string(Black) {
+			verdict.Result, verdict.Winner = "win", Color(g.Winner)
+		} else {
+			verdict.Result = "draw"
+		}
+		return verdict
+	}
+
+	if extra == nil || extra.Type == Bishop || extra.Type == Knight {
+		return verdict.draw("insufficient_material")
+	}
+
+	strong, weak := extra.Color, opponentColor(extra.Color)
+	// The lone defender takes an unprotected piece next to it and it's KvK
+	if g.CurrentTurn == weak && kingDistance(kings[weak], extraPos) == 1 && kingDistance(kings[strong], extraPos) > 1 {
+		return verdict.draw("piece_capturable")
+	}
+
+	switch extra.Type {
+	case Queen, Rook:
+		return verdict.win(strong, g.CurrentTurn, "basic_mate")
+	case Pawn:
+		return g.classifyPawnEnding(verdict, extraPos, kings[strong], kings[weak])
+	}
+	return verdict
+}
+
+// classifyPawnEnding applies the rule of the square, the rook-pawn corner draw
+// and the key squares of king and pawn against king
+func (g *ChessGame) classifyPawnEnding(verdict EndgameVerdict, pawn, strongKing, weakKing Position) EndgameVerdict {
+	strong := g.Board[pawn.Row][pawn.Col].Color
+	direction := -1
+	if strong == Black {
+		direction = 1
+	}
+	relativeRank := abs(homeRow(strong)-pawn.Row) + 1
+
+	// A defending king in front of a rook pawn can never be driven out of the corner
+	if pawn.Col == 0 || pawn.Col == 7 {
+		if weakKing.Col == pawn.Col && (weakKing.Row-pawn.Row)*direction > 0 {
+			return verdict.draw("rook_pawn_corner")
+		}
+	}
+
+	if g.pawnOutrunsKing(pawn, strong, weakKing) {
+		return verdict.win(strong, g.CurrentTurn, "rule_of_the_square")
+	}
+
+	if pawn.Col == 0 || pawn.Col == 7 {
+		return verdict
+	}
+
+	// Key squares: with the king on one of them the pawn promotes whoever is
+	// to move
+	var keyRows []int
+	switch {
+	case relativeRank <= 4:
+		keyRows = []int{pawn.Row + 2*direction}
+	case relativeRank <= 6:
+		keyRows = []int{pawn.Row + direction, pawn.Row + 2*direction}
+	default:
+		keyRows = []int{pawn.Row, pawn.Row + direction}
+	}
+	for _, row := range keyRows {
+		for col := pawn.Col - 1; col <= pawn.Col+1; col++ {
+			if strongKing == (Position{row, col}) {
+				return verdict.win(strong, g.CurrentTurn, "key_square")
+			}
+		}
+	}
+	return verdict
+}
+
+func (v EndgameVerdict) draw(rule string) EndgameVerdict {
+	v.Known, v.Result, v.Rule = true, "draw", rule
+	return v
+}
+
+func (v EndgameVerdict) win(winner, toMove Color, rule string) EndgameVerdict {
+	v.Known, v.Result, v.Winner, v.Rule = true, "win", winner, rule
+	v.SideToMoveWins = winner == toMove
+	return v
+}
+
+// materialSignature names the material on the board, stronger side first
+func (g *ChessGame) materialSignature() string {
+	pieces := map[Color]string{White: "", Black: ""}
+	material := map[Color]int{}
+	for _, pieceType := range []PieceType{King, Queen, Rook, Bishop, Knight, Pawn} {
+		for i := 0; i < 8; i++ {
+			for j := 0; j < 8; j++ {
+				if piece := g.Board[i][j]; piece != nil && piece.Type == pieceType {
+					pieces[piece.Color] += pieceLetter(pieceType)
+					material[piece.Color] += pieceValues[pieceType]
+				}
+			}
+		}
+	}
+	if material[Black] > material[White] {
+		return pieces[Black] + "v" + pieces[White]
+	}
+	return pieces[White] + "v" + pieces[Black]
+}
+
+func kingDistance(a, b Position) int {
+	return max(abs(a.Row-b.Row), abs(a.Col-b.Col))
+}
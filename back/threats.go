@@ -0,0 +1,279 @@
+package main
+
+import "sort"
+
+// ============================================================================
+// THREAT DETECTION
+// ============================================================================
+
+// Threat is a piece that can be won on its square
+type Threat struct {
+	Square    string    `json:"square"`
+	Piece     PieceType `json:"piece"`
+	Color     Color     `json:"color"`
+	Attackers []string  `json:"attackers"`
+	Gain      int       `json:"gain"` // Static exchange estimate for the attacking side
+}
+
+// Threats lists the side to move's pieces that are attacked and undefended,
+// and the opponent pieces the side to move can win with a legal capture
+func (g *ChessGame) Threats() (hanging, winnable []Threat) {
+	color := g.CurrentTurn
+	opponent := opponentColor(color)
+	hanging, winnable = []Threat{}, []Threat{}
+
+	captures := map[Position][]Position{}
+	for _, move := range g.GetValidMoves(color) {
+		if g.Board[move.To.Row][move.To.Col] == nil {
+			continue
+		}
+		froms := captures[move.To]
+		if len(froms) == 0 || froms[len(froms)-1] != move.From {
+			captures[move.To] = append(froms, move.From)
+		}
+	}
+
+	for i := 0; i < 8; i++ {
+		for j := 0; j < 8; j++ {
+			piece := g.Board[i][j]
+			pos := Position{i, j}
+			if piece == nil || piece.Type == King {
+				continue
+			}
+
+			if piece.Color == color {
+				attackers := g.attackersOf(pos, opponent)
+				if len(attackers) == 0 || g.isSquareAttacked(pos, color) {
+					continue
+				}
+				hanging = append(hanging, g.newThreat(pos, piece, attackers))
+				continue
+			}
+
+			if attackers := captures[pos]; len(attackers) > 0 {
+				if threat := g.newThreat(pos, piece, attackers); threat.Gain > 0 {
+					winnable = append(winnable, threat)
+				}
+			}
+		}
+	}
+
+	sort.SliceStable(hanging, func(a, b int) bool { return hanging[a].Gain > hanging[b].Gain })
+	sort.SliceStable(winnable, func(a, b int) bool { return winnable[a].Gain > winnable[b].Gain })
+	return hanging, winnable
+}
+
+func (g *ChessGame) newThreat(pos Position, piece *Piece, attackers []Position) Threat {
+	threat := Threat{
+		Square: pos.ToAlgebraic(),
+		Piece:  piece.Type,
+		Color:  piece.Color,
+		Gain:   -INFINITY,
+	}
+	for _, from := range attackers {
+		threat.Attackers = append(threat.Attackers, from.ToAlgebraic())
+		threat.Gain = max(threat.Gain, g.StaticExchangeEval(Move{From: from, To: pos}))
+	}
+	return threat
+}
+
+// PieceStatus says how contested one piece is, counting the pieces of each
+// side that attack its square
+type PieceStatus struct {
+	Square    string    `json:"square"`
+	Piece     PieceType `json:"piece"`
+	Color     Color     `json:"color"`
+	Attackers int       `json:"attackers"` // Opponent pieces attacking it
+	Defenders int       `json:"defenders"` // Own pieces covering its square
+	Attacked  bool      `json:"attacked"`
+	Defended  bool      `json:"defended"`
+	Hanging   bool      `json:"hanging"` // Attacked and not defended
+}
+
+// PieceStatuses reports every piece on the board, from a8 to h1. Both sides'
+// attack maps are built once, so each piece is a lookup rather than a scan
+// of the board.
+func (g *ChessGame) PieceStatuses() []PieceStatus {
+	attackMaps := map[Color][8][8]int{White: g.AttackMap(White), Black: g.AttackMap(Black)}
+
+	statuses := []PieceStatus{}
+	for i := 0; i < 8; i++ {
+		for j := 0; j < 8; j++ {
+			piece := g.Board[i][j]
+			if piece == nil {
+				continue
+			}
+			status := PieceStatus{
+				Square:    Position{i, j}.ToAlgebraic(),
+				Piece:     piece.Type,
+				Color:     piece.Color,
+				Attackers: attackMaps[opponentColor(piece.Color)][i][j],
+				Defenders: attackMaps[piece.Color][i][j],
+			}
+			status.Attacked = status.Attackers > 0
+			status.Defended = status.Defenders > 0
+			status.Hanging = status.Attacked && !status.Defended
+			statuses = append(statuses, status)
+		}
+	}
+	return statuses
+}
+
+// attackersOf returns the squares of all pieces of the given color attacking pos
+func (g *ChessGame) attackersOf(pos Position, color Color) []Position {
+	var attackers []Position
+	for i := 0; i < 8; i++ {
+		for j := 0; j < 8; j++ {
+			piece := g.Board[i][j]
+			if piece != nil && piece.Color == color && g.attacksSquare(Position{i, j}, pos, piece) {
+				attackers = append(attackers, Position{i, j})
+			}
+		}
+	}
+	return attackers
+}
+
+// ============================================================================
+// NEW AND DISCOVERED ATTACKS
+// ============================================================================
+
+// NewAttack is an opponent piece that a move leaves attacked by a piece that
+// didn't attack it before
+type NewAttack struct {
+	Attacker    string    `json:"attacker"` // Square of the attacking piece after the move
+	Piece       PieceType `json:"piece"`
+	Target      string    `json:"target"`
+	TargetPiece PieceType `json:"target_piece"`
+	Discovered  bool      `json:"discovered"` // The attacker stood still and the move opened its line
+	Gain        int       `json:"gain"`       // Static exchange estimate for taking it next move; 0 for the king
+}
+
+// NewAttacks compares what each of the mover's pieces attacks before and
+// after move, and lists the opponent pieces newly under attack, the moved
+// piece's first. A piece that didn't move but gains a target had its line
+// opened by the move: a discovered attack, or discovered check on the king.
+func (g *ChessGame) NewAttacks(move Move) []NewAttack {
+	color := g.CurrentTurn
+	after := g.CopyState()
+	attacks := []NewAttack{}
+	if err := after.MakeMove(move); err != nil {
+		return attacks
+	}
+
+	for i := 0; i < 8; i++ {
+		for j := 0; j < 8; j++ {
+			piece := after.Board[i][j]
+			pos := Position{i, j}
+			if piece == nil || piece.Color != color {
+				continue
+			}
+
+			// The same piece's attacks before the move: from where it started if
+			// it moved, from its own square if it didn't. A castling rook has
+			// nothing to compare with, so all it attacks is new.
+			origin := &pos
+			stood := g.Board[i][j]
+			if pos == move.To {
+				origin = &move.From
+			} else if stood == nil || stood.Type != piece.Type || stood.Color != color {
+				origin = nil
+			}
+			attackedBefore := map[Position]bool{}
+			if origin != nil {
+				g.forEachAttackedSquare(*origin, g.Board[origin.Row][origin.Col], func(target Position) {
+					attackedBefore[target] = true
+				})
+			}
+
+			after.forEachAttackedSquare(pos, piece, func(target Position) {
+				victim := after.Board[target.Row][target.Col]
+				if victim == nil || victim.Color == color || attackedBefore[target] {
+					return
+				}
+				attack := NewAttack{
+					Attacker:    pos.ToAlgebraic(),
+					Piece:       piece.Type,
+					Target:      target.ToAlgebraic(),
+					TargetPiece: victim.Type,
+					Discovered:  pos != move.To && origin != nil,
+				}
+				if victim.Type != King {
+					attack.Gain = after.StaticExchangeEval(Move{From: pos, To: target})
+				}
+				attacks = append(attacks, attack)
+			})
+		}
+	}
+
+	sort.SliceStable(attacks, func(a, b int) bool { return !attacks[a].Discovered && attacks[b].Discovered })
+	return attacks
+}
+
+// ============================================================================
+// STATIC EXCHANGE EVALUATION
+// ============================================================================
+
+// StaticExchangeEval plays out the capture sequence on the move's target square,
+// each side recapturing with its least valuable attacker and free to stop once
+// capturing no longer pays, and returns the net material won by the side making
+// the move. Pins are ignored.
+func (g *ChessGame) StaticExchangeEval(move Move) int {
+	from, to := move.From, move.To
+
+	// Only the board is needed; attack tests never look at the rest of the state
+	scratch := &ChessGame{Board: g.Board}
+
+	attacker := scratch.Board[from.Row][from.Col]
+	if attacker == nil {
+		return 0
+	}
+	captured := 0
+	if target := scratch.Board[to.Row][to.Col]; target != nil {
+		captured = pieceValues[target.Type]
+	} else if attacker.Type == Pawn && from.Col != to.Col {
+		// En passant: the captured pawn sits beside the capturing one
+		captured = pieceValues[Pawn]
+		scratch.Board[from.Row][to.Col] = nil
+	}
+
+	occupant := attacker
+	if attacker.Type == Pawn && to.Row == homeRow(opponentColor(attacker.Color)) {
+		promotion := move.Promotion
+		if promotion == "" {
+			promotion = Queen
+		}
+		captured += pieceValues[promotion] - pieceValues[Pawn]
+		occupant = &Piece{Type: promotion, Color: attacker.Color}
+	}
+
+	gains := []int{captured}
+	scratch.Board[from.Row][from.Col] = nil
+	scratch.Board[to.Row][to.Col] = occupant
+
+	for side := opponentColor(attacker.Color); ; side = opponentColor(side) {
+		next := scratch.leastValuableAttacker(to, side)
+		if next == nil {
+			break
+		}
+		gains = append(gains, pieceValues[occupant.Type]-gains[len(gains)-1])
+		occupant = scratch.Board[next.Row][next.Col]
+		scratch.Board[next.Row][next.Col] = nil
+		scratch.Board[to.Row][to.Col] = occupant
+	}
+
+	for i := len(gains) - 1; i > 0; i-- {
+		gains[i-1] = -max(-gains[i-1], gains[i])
+	}
+	return gains[0]
+}
+
+func (g *ChessGame) leastValuableAttacker(pos Position, color Color) *Position {
+	var best *Position
+	for _, from := range g.attackersOf(pos, color) {
+		if best == nil || pieceValues[g.Board[from.Row][from.Col].Type] < pieceValues[g.Board[best.Row][best.Col].Type] {
+			from := from
+			best = &from
+		}
+	}
+	return best
+}
@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestStaticExchangeEval(t *testing.T) {
+	tests := []struct {
+		name string
+		fen  string
+		san  string
+		want int
+	}{
+		{"queen takes a defended pawn", "4k3/8/2p5/3p4/8/8/3Q4/4K3 w - - 0 1", "Qxd5", pieceValues[Pawn] - pieceValues[Queen]},
+		{"undefended knight", "4k3/8/8/3n4/8/8/3R4/4K3 w - - 0 1", "Rxd5", pieceValues[Knight]},
+		{"pawn takes a defended knight", "4k3/8/2p5/3n4/4P3/8/8/4K3 w - - 0 1", "exd5", pieceValues[Knight] - pieceValues[Pawn]},
+		{"rook takes a pawn-defended knight", "4k3/8/2p5/3n4/8/8/3R4/4K3 w - - 0 1", "Rxd5", pieceValues[Knight] - pieceValues[Rook]},
+		// The second rook behind the first backs up the capture
+		{"doubled rooks win a defended pawn", "3rk3/8/8/3p4/8/8/3R4/3RK3 w - - 0 1", "Rxd5", pieceValues[Pawn]},
+		{"queen takes a pawn-defended rook", "4k3/8/2p5/3r4/8/8/3Q4/4K3 w - - 0 1", "Qxd5", pieceValues[Rook] - pieceValues[Queen]},
+	}
+	for _, tt := range tests {
+		game := mustLoadFEN(t, tt.fen)
+		move, err := game.parseSAN(tt.san)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		before := game.ToFEN()
+		if got := game.StaticExchangeEval(move); got != tt.want {
+			t.Errorf("%s: SEE %d, want %d", tt.name, got, tt.want)
+		}
+		if game.ToFEN() != before {
+			t.Errorf("%s: SEE left the board at %s", tt.name, game.ToFEN())
+		}
+	}
+}
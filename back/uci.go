@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// UCI PROTOCOL ADAPTER
+// ============================================================================
+
+// Share of the remaining clock spent on one move when the GUI only sends
+// wtime/btime
+const UCI_MOVES_TO_GO = 30
+
+// uciEngine speaks the UCI protocol over stdin/stdout so GUIs such as Arena or
+// CuteChess can run the engine
+type uciEngine struct {
+	ai   *AIService
+	game *ChessGame
+
+	out     io.Writer
+	outLock sync.Mutex
+
+	cancelSearch context.CancelFunc
+	searchDone   chan struct{}
+}
+
+func runUCI(in io.Reader, out io.Writer, ai *AIService) {
+	engine := &uciEngine{ai: ai, game: NewChessGame(), out: out}
+
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch fields[0] {
+		case "uci":
+			engine.send("id name Chess AI")
+			engine.send("id author Chess AI contributors")
+			engine.send("uciok")
+		case "isready":
+			engine.send("readyok")
+		case "ucinewgame":
+			engine.stop()
+			engine.game = NewChessGame()
+		case "position":
+			engine.stop()
+			if err := engine.setPosition(fields[1:]); err != nil {
+				engine.send("info string " + err.Error())
+			}
+		case "go":
+			engine.stop()
+			engine.search(fields[1:])
+		case "stop":
+			engine.stop()
+		case "quit":
+			engine.stop()
+			return
+		}
+	}
+	engine.stop()
+}
+
+func (e *uciEngine) send(line string) {
+	e.outLock.Lock()
+	defer e.outLock.Unlock()
+	fmt.Fprintln(e.out, line)
+}
+
+// setPosition handles "startpos [moves ...]" and "fen <fen> [moves ...]"
+func (e *uciEngine) setPosition(args []string) error {
+	movesAt := len(args)
+	for i, arg := range args {
+		if arg == "moves" {
+			movesAt = i
+			break
+		}
+	}
+
+	var game *ChessGame
+	switch {
+	case len(args) > 0 && args[0] == "startpos":
+		game = NewChessGame()
+	case len(args) > 0 && args[0] == "fen":
+		var err error
+		if game, err = LoadFEN(strings.Join(args[1:movesAt], " ")); err != nil {
+			return fmt.Errorf("invalid fen: %w", err)
+		}
+	default:
+		return fmt.Errorf("position must be followed by startpos or fen")
+	}
+
+	for i := movesAt + 1; i < len(args); i++ {
+		moveReq, err := ParseUCIMove(args[i])
+		if err != nil {
+			return err
+		}
+		move := Move{From: moveReq.From, To: moveReq.To, Promotion: moveReq.Promotion}
+		if !game.IsValidMove(move) {
+			return fmt.Errorf("illegal move %s", args[i])
+		}
+		game.MakeMove(move)
+	}
+
+	e.game = game
+	return nil
+}
+
+// search handles "go" with depth, movetime, wtime/btime/winc/binc or infinite.
+// It runs in the background so "stop" can end it early.
+func (e *uciEngine) search(args []string) {
+	depth := MAX_DEPTH // Searches are held to the configured depth limit
+	var thinkTime time.Duration
+	infinite := false
+
+	value := func(i int) int {
+		if i+1 >= len(args) {
+			return 0
+		}
+		n, _ := strconv.Atoi(args[i+1])
+		return n
+	}
+
+	clock, increment := "wtime", "winc"
+	if e.game.CurrentTurn == Black {
+		clock, increment = "btime", "binc"
+	}
+	for i, arg := range args {
+		switch arg {
+		case "depth":
+			depth = max(1, value(i))
+		case "movetime":
+			thinkTime = time.Duration(value(i)) * time.Millisecond
+		case clock:
+			if thinkTime == 0 {
+				thinkTime += time.Duration(value(i)/UCI_MOVES_TO_GO) * time.Millisecond
+			}
+		case increment:
+			thinkTime += time.Duration(value(i)/2) * time.Millisecond
+		case "infinite":
+			infinite = true
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	e.cancelSearch = cancel
+	e.searchDone = make(chan struct{})
+
+	game := e.game.CopyState()
+	go func() {
+		defer close(e.searchDone)
+		start := time.Now()
+
+		progress := func(p SearchProgress) {
+			score := p.Evaluation
+			if game.CurrentTurn == White {
+				score = -score
+			}
+			e.send(fmt.Sprintf("info depth %d score %s nodes %d time %d pv %s",
+				p.Depth, uciScore(score, p.Depth), p.NodesSearched, time.Since(start).Milliseconds(), uciMove(*p.BestMove)))
+		}
+
+		// Without movetime or a clock the search runs until its depth is done
+		var move *Move
+		result, err := e.ai.Search(ctx, game, SearchOptions{Depth: depth, ThinkTime: thinkTime, NoTimeLimit: thinkTime == 0, Progress: progress})
+		if err == nil {
+			move = result.Move
+		}
+
+		// In infinite mode the best move may only be reported once told to stop
+		if infinite {
+			<-ctx.Done()
+		}
+
+		if move == nil {
+			e.send("bestmove 0000")
+			return
+		}
+		e.send("bestmove " + uciMove(*move))
+	}()
+}
+
+// stop ends a running search, waiting for its bestmove to be sent
+func (e *uciEngine) stop() {
+	if e.cancelSearch == nil {
+		return
+	}
+	e.cancelSearch()
+	<-e.searchDone
+	e.cancelSearch = nil
+}
+
+// uciScore formats a side-to-move score, turning mate scores (WIN_SCORE plus
+// the depth left when mate was found) into a "mate <moves>" count
+func uciScore(score, depth int) string {
+	if !isMateScore(score) {
+		return fmt.Sprintf("cp %d", score)
+	}
+	plies := max(1, depth-(abs(score)-WIN_SCORE))
+	moves := (plies + 1) / 2
+	if score < 0 {
+		moves = -moves
+	}
+	return fmt.Sprintf("mate %d", moves)
+}
+
+func uciMove(move Move) string {
+	uci := moveCoordinates(move)
+	if move.Promotion != "" {
+		uci += strings.ToLower(pieceLetter(move.Promotion))
+	}
+	return uci
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// gameState is everything about a game that UndoMove has to put back
+func gameState(game *ChessGame) string {
+	enPassant := "-"
+	if game.EnPassant != nil {
+		enPassant = game.EnPassant.ToAlgebraic()
+	}
+	return fmt.Sprintf("%s ep=%s kings=%v,%v rooks=%v reps=%d hash=%x over=%v %s %s moves=%d",
+		game.ToFEN(), enPassant, game.KingMoved[White], game.KingMoved[Black], game.RookMoved, game.repetitionCount(), game.hash,
+		game.GameOver, game.Winner, game.EndReason, len(game.LegalMoves()))
+}
+
+// undoAll takes back every move of game, checking each position against the
+// state recorded before the move was made
+func undoAll(t *testing.T, game *ChessGame, states []string) {
+	t.Helper()
+	for i := len(states) - 1; i >= 0; i-- {
+		move := game.MoveHistory[len(game.MoveHistory)-1]
+		if err := game.UndoMove(); err != nil {
+			t.Fatal(err)
+		}
+		if got := gameState(game); got != states[i] {
+			t.Fatalf("undoing %v:\n got %s\nwant %s", move, got, states[i])
+		}
+	}
+}
+
+// TestUndoRandomGames plays random games, standard and Chess960, to the end
+// or a move cap, then takes every move back
+func TestUndoRandomGames(t *testing.T) {
+	games := 600
+	if testing.Short() {
+		games = 60
+	}
+	rng := rand.New(rand.NewSource(11))
+	for i := 0; i < games; i++ {
+		game := NewChessGame()
+		if i%4 == 0 {
+			game = NewChess960Game(rng)
+		}
+		var states []string
+		for ply := 0; ply < 120 && !game.GameOver; ply++ {
+			states = append(states, gameState(game))
+			moves := game.LegalMoves()
+			if err := game.MakeMove(moves[rng.Intn(len(moves))]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		undoAll(t, game, states)
+	}
+}
+
+func TestUndoSpecialMoves(t *testing.T) {
+	tests := []struct {
+		name  string
+		fen   string
+		moves string
+	}{
+		{"kingside castle", "r3k2r/8/8/8/8/8/8/R3K2R w KQkq - 0 1", "O-O O-O-O"},
+		{"queenside castle", "r3k2r/8/8/8/8/8/8/R3K2R w KQkq - 0 1", "O-O-O O-O"},
+		{"castle then rook capture", "r3k2r/8/8/8/8/8/8/R3K2R w KQkq - 0 1", "Rxa8+ Ke7 Raxh8"},
+		{"Chess960 castle onto the rook's square", "1r4k1/8/8/8/8/8/8/1RK5 w Bb - 0 1", "O-O-O"},
+		{"en passant", "4k3/3p4/8/4P3/8/8/8/4K3 b - - 0 1", "d5 exd6"},
+		{"promotion", "4k3/1P6/8/8/8/8/8/4K3 w - - 0 1", "b8=N"},
+		{"capturing promotion", "r3k3/1P6/8/8/8/8/8/4K3 w - - 0 1", "bxa8=Q+"},
+	}
+	for _, tt := range tests {
+		game := mustLoadFEN(t, tt.fen)
+		var states []string
+		for _, san := range strings.Fields(tt.moves) {
+			states = append(states, gameState(game))
+			playSAN(t, game, san)
+		}
+		t.Run(tt.name, func(t *testing.T) {
+			undoAll(t, game, states)
+			if got := game.ToFEN(); got != mustLoadFEN(t, tt.fen).ToFEN() {
+				t.Errorf("undone to %s, want %s", got, tt.fen)
+			}
+		})
+	}
+}